@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aideAttrs are the attribute bits of AIDE's database format for the fields
+// gohash reads and writes.
+var aideAttrs = map[string]int64{
+	"name":   1 << 0,
+	"size":   1 << 5,
+	"mtime":  1 << 8,
+	"md5":    1 << 12,
+	"sha1":   1 << 13,
+	"sha256": 1 << 30,
+	"sha512": 1 << 31,
+}
+
+// aideRecord is a file entry of an AIDE database with a hash gohash knows.
+type aideRecord struct {
+	Name    string
+	Hash    string
+	Size    int64
+	ModTime int64
+}
+
+func runAIDE(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s aide import [options] database_path root_directory aide_database\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s aide export [options] database_path root_directory\n", programName)
+	}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "import":
+		runAIDEImport(arguments[1:])
+	case "export":
+		runAIDEExport(arguments[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// runAIDEImport adopts the entries of an AIDE database under a root as the
+// root's baseline, so a scan compares against what AIDE last recorded
+// instead of trusting whatever is on disk now.
+func runAIDEImport(arguments []string) {
+	flags := flag.NewFlagSet("aide import", flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	prefix := flags.String("prefix", "", "path of the root in the AIDE database (default: the root's absolute path)")
+	algo := flags.String("algo", "", "which of the AIDE database's hashes to import: md5, sha1, sha256 or sha512 (default: the strongest present)")
+	reason := flags.String("reason", "imported from AIDE", "reason recorded in the audit log")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s aide import [options] database_path root_directory aide_database\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath, rootDirectory, aidePath := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+
+	rootID, rootPrefix := aideRoot(rootDirectory, *rootIDFlag, *prefix)
+	file, err := os.Open(aidePath)
+	if err != nil {
+		log.Fatalf("Error reading the AIDE database: %v", err)
+	}
+	defer file.Close()
+	records, hashAlgo, err := readAIDEDatabase(file, rootPrefix, *algo)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", aidePath, err)
+	}
+
+	lock, err := acquireRunLock(databasePath, *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db, err := openDatabase(databasePath)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	defer closeDatabase(db)
+
+	existing, err := rootRecordCount(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the baseline: %v", err)
+	}
+	if existing > 0 {
+		log.Fatalf("Error: root %s already has %d records; prune them or import under another -root-id", displayPath(rootID), existing)
+	}
+	required, err := rootRequiresApproval(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+	if required {
+		log.Fatalf("Error: root %s requires approval; accept the files with gohash accept instead", displayPath(rootID))
+	}
+	err = setRootHashAlgo(db, rootID, hashAlgo)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	pathPolicy, err := rootPathPolicy(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Error updating the baseline: %v", err)
+	}
+	defer tx.Rollback()
+	actor, now := auditActor(), time.Now().Unix()
+	for _, record := range records {
+		rel := normalizePath(pathPolicy, record.Name)
+		_, err = tx.Exec("INSERT INTO file_hashes (root_id, filename, hash, size, mtime, last_verified) VALUES (?, ?, ?, ?, ?, ?)",
+			rootID, dbPath(rel), record.Hash, record.Size, record.ModTime, now)
+		if err == nil {
+			err = recordAudit(tx, auditEntry{Actor: actor, Action: AuditImport, RootID: rootID, RelPath: rel, NewHash: record.Hash, Reason: *reason})
+		}
+		if err != nil {
+			log.Fatalf("Error updating the baseline: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalf("Error updating the baseline: %v", err)
+	}
+	fmt.Printf("Imported %d %s hashes under root ID %s\n", len(records), hashLabel(hashAlgo), displayPath(rootID))
+}
+
+// runAIDEExport writes a root's baseline as an AIDE database, with the
+// names, sizes, modification times and hashes gohash records.
+func runAIDEExport(arguments []string) {
+	flags := flag.NewFlagSet("aide export", flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	prefix := flags.String("prefix", "", "path of the root in the AIDE database (default: the root's absolute path)")
+	outputPath := flags.String("output", "", "write the AIDE database to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s aide export [options] database_path root_directory\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rootID, rootPrefix := aideRoot(flags.Arg(1), *rootIDFlag, *prefix)
+
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	hashAlgo, err := rootHashAlgo(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+	rows, err := db.Query("SELECT filename, hash, COALESCE(size, 0), COALESCE(mtime, 0) FROM file_hashes WHERE root_id = ? ORDER BY filename", rootID)
+	if err != nil {
+		log.Fatalf("Error reading the baseline: %v", err)
+	}
+	defer rows.Close()
+
+	output := os.Stdout
+	if *outputPath != "" {
+		output, err = os.Create(*outputPath)
+		if err != nil {
+			log.Fatalf("Error creating the AIDE database: %v", err)
+		}
+	}
+	w := bufio.NewWriter(output)
+	fmt.Fprintf(w, "@@begin_db\n# This file was generated by gohash, version %s\n", version)
+	fmt.Fprintf(w, "# Time of generation was %s\n", time.Now().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "@@db_spec name attr size mtime %s\n", hashAlgo)
+	attr := aideAttrs["name"] | aideAttrs["size"] | aideAttrs["mtime"] | aideAttrs[hashAlgo]
+	exported := 0
+	for rows.Next() {
+		var record aideRecord
+		err = rows.Scan(&record.Name, &record.Hash, &record.Size, &record.ModTime)
+		if err != nil {
+			log.Fatalf("Error reading the baseline: %v", err)
+		}
+		digest, err := hex.DecodeString(record.Hash)
+		if err != nil {
+			log.Fatalf("Error reading the baseline: bad hash for %s", displayPath(record.Name))
+		}
+		mtime := strconv.FormatInt(time.Unix(0, record.ModTime).Unix(), 10)
+		fmt.Fprintf(w, "%s %d %d %s %s\n", aideEncodeName(path.Join(rootPrefix, record.Name)), attr, record.Size,
+			base64.StdEncoding.EncodeToString([]byte(mtime)), base64.StdEncoding.EncodeToString(digest))
+		exported++
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalf("Error reading the baseline: %v", err)
+	}
+	fmt.Fprintf(w, "@@end_db\n")
+	err = w.Flush()
+	if err == nil && output != os.Stdout {
+		err = output.Close()
+	}
+	if err != nil {
+		log.Fatalf("Error writing the AIDE database: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d records\n", exported)
+}
+
+// aideRoot works out the root ID and the slash-separated path the root has
+// in AIDE databases.
+func aideRoot(rootDirectory, rootID, prefix string) (string, string) {
+	absRoot, err := defaultRootID(rootDirectory)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	if rootID == "" {
+		rootID = absRoot
+	}
+	if prefix == "" {
+		prefix = absRoot
+	}
+	return rootID, path.Clean(filepath.ToSlash(prefix))
+}
+
+// readAIDEDatabase returns the entries of a plain or gzipped AIDE database
+// below prefix, with names relative to it, and the algorithm of their
+// hashes. Entries without that hash, such as directories, are skipped.
+func readAIDEDatabase(r io.Reader, prefix, algo string) ([]aideRecord, string, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, "", err
+		}
+		defer gz.Close()
+		buffered = bufio.NewReader(gz)
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var spec map[string]int
+	var records []aideRecord
+	inDB := false
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case text == "@@begin_db":
+			inDB = true
+			continue
+		case text == "@@end_db":
+			inDB = false
+			continue
+		case strings.HasPrefix(text, "@@db_spec "):
+			spec = make(map[string]int)
+			for i, field := range strings.Fields(text)[1:] {
+				spec[field] = i
+			}
+			if algo == "" {
+				for _, candidate := range []string{"sha512", "sha256", "sha1", "md5"} {
+					if _, ok := spec[candidate]; ok {
+						algo = candidate
+						break
+					}
+				}
+			}
+			if _, ok := hashAlgorithms[algo]; !ok {
+				return nil, "", fmt.Errorf("no usable hash (md5, sha1, sha256 or sha512) in @@db_spec")
+			}
+			if _, ok := spec[algo]; !ok {
+				return nil, "", fmt.Errorf("the database has no %s hashes", algo)
+			}
+			if _, ok := spec["name"]; !ok {
+				return nil, "", fmt.Errorf("@@db_spec has no name field")
+			}
+			continue
+		case strings.HasPrefix(text, "@@"):
+			continue
+		}
+		if !inDB {
+			continue
+		}
+		if spec == nil {
+			return nil, "", fmt.Errorf("line %d: entry before @@db_spec", line)
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != len(spec) {
+			return nil, "", fmt.Errorf("line %d: %d fields, @@db_spec has %d", line, len(fields), len(spec))
+		}
+		name, err := aideDecodeName(fields[spec["name"]])
+		if err != nil {
+			return nil, "", fmt.Errorf("line %d: %v", line, err)
+		}
+		if !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		encoded := fields[spec[algo]]
+		if encoded == "0" {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(digest) != hashAlgorithms[algo]().Size() {
+			return nil, "", fmt.Errorf("line %d: bad %s hash %q", line, algo, encoded)
+		}
+
+		record := aideRecord{Name: strings.TrimPrefix(name, prefix+"/"), Hash: hex.EncodeToString(digest)}
+		if i, ok := spec["size"]; ok {
+			record.Size, _ = strconv.ParseInt(fields[i], 10, 64)
+		}
+		if i, ok := spec["mtime"]; ok {
+			record.ModTime = aideTime(fields[i]) * int64(time.Second)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if spec == nil {
+		return nil, "", fmt.Errorf("not an AIDE database: no @@db_spec line")
+	}
+	return records, algo, nil
+}
+
+// aideTime parses a time field, written by AIDE as a base64-encoded decimal
+// number of seconds or, by older versions, as the number itself.
+func aideTime(field string) int64 {
+	if seconds, err := strconv.ParseInt(field, 10, 64); err == nil {
+		return seconds
+	}
+	decoded, err := base64.StdEncoding.DecodeString(field)
+	if err != nil {
+		return 0
+	}
+	seconds, _ := strconv.ParseInt(string(decoded), 10, 64)
+	return seconds
+}
+
+// aideDecodeName undoes AIDE's escaping of names, which writes spaces,
+// control characters, '%' and bytes outside ASCII as %XX.
+func aideDecodeName(field string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '%' {
+			b.WriteByte(field[i])
+			continue
+		}
+		if i+2 >= len(field) {
+			return "", fmt.Errorf("bad escape in %q", field)
+		}
+		value, err := strconv.ParseUint(field[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("bad escape in %q", field)
+		}
+		b.WriteByte(byte(value))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func aideEncodeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c == '%' || c >= 0x7f {
+			fmt.Fprintf(&b, "%%%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// changeEntry is one record an accept sets to the file's current state.
+// A file that no longer exists has no hash and its record is removed.
+type changeEntry struct {
+	RelPath string
+	Hash    sql.NullString
+	Size    int64
+	ModTime int64
+}
+
+// runAccept re-baselines the named files at their current content. If the
+// root requires approval the changes are held as a pending changeset until
+// a second, different approver signs off on them with gohash approve.
+func runAccept(arguments []string) {
+	flags := flag.NewFlagSet("accept", flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	keyPath := flags.String("key", "", "approver's ed25519 private key, required for roots that require approval")
+	reason := flags.String("reason", "", "why the changes are being accepted")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s accept [options] database_path root_directory path...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() < 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath, rootDirectory := flags.Arg(0), flags.Arg(1)
+
+	rootID := *rootIDFlag
+	if rootID == "" {
+		var err error
+		rootID, err = defaultRootID(rootDirectory)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+	}
+
+	lock, err := acquireRunLock(databasePath, *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+
+	pathPolicy, err := rootPathPolicy(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+	hashAlgo, err := rootHashAlgo(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+
+	var entries []changeEntry
+	for _, name := range flags.Args()[2:] {
+		filePath, rel, err := resolveRootPath(rootDirectory, name)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		entry := changeEntry{RelPath: normalizePath(pathPolicy, rel)}
+		info, err := os.Stat(longPath(filePath))
+		if errors.Is(err, os.ErrNotExist) {
+			entries = append(entries, entry)
+			continue
+		} else if err != nil {
+			log.Fatalf("Error reading %s: %v", displayPath(filePath), err)
+		}
+		hash, err := computeFileHash(filePath, hashAlgo)
+		if err != nil {
+			log.Fatalf("Error computing %s hash for %s: %v", hashLabel(hashAlgo), displayPath(filePath), err)
+		}
+		entry.Hash = sql.NullString{String: hash, Valid: true}
+		entry.Size = info.Size()
+		entry.ModTime = info.ModTime().UnixNano()
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RelPath < entries[j].RelPath })
+
+	required, err := rootRequiresApproval(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+	if !required {
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			return applyChanges(tx, rootID, entries, auditActor(), *reason)
+		})
+		if err != nil {
+			log.Fatalf("Error updating the baseline: %v", err)
+		}
+		fmt.Printf("Accepted %d changes under %s\n", len(entries), displayPath(rootID))
+		return
+	}
+
+	if *keyPath == "" {
+		log.Fatalf("Error: root %s requires approval; give -key to request it", displayPath(rootID))
+	}
+	id, err := requestChangeset(db, *keyPath, rootID, *reason, changesetAction{}, entries)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	fmt.Printf("Changeset %d with %d changes is pending approval by another approver\n", id, len(entries))
+}
+
+// Changesets can also hold a change to who approves or to what needs
+// approval, so that one approver can't weaken the two-person rule alone.
+const (
+	ActionAddApprover    = "add-approver"
+	ActionRemoveApprover = "remove-approver"
+	ActionRelease        = "release"
+)
+
+// changesetAction is the change to the approvers or to the root's approval
+// requirement a changeset holds instead of baseline entries; its Kind is ""
+// for a change to the baseline.
+type changesetAction struct {
+	Kind     string
+	Approver string
+	// PublicKey is the encoded key of an approver being added.
+	PublicKey string
+}
+
+func (a changesetAction) String() string {
+	switch a.Kind {
+	case ActionAddApprover:
+		return "add approver " + a.Approver
+	case ActionRemoveApprover:
+		return "remove approver " + a.Approver
+	case ActionRelease:
+		return "stop requiring approval"
+	}
+	return ""
+}
+
+// requestChangeset stores a pending changeset signed by the approver whose
+// private key is at keyPath, returning its ID.
+func requestChangeset(db *sql.DB, keyPath, rootID, reason string, action changesetAction, entries []changeEntry) (int64, error) {
+	private, err := readPrivateKey(keyPath)
+	if err != nil {
+		return 0, err
+	}
+	requester, err := approverName(db, private.Public().(ed25519.PublicKey))
+	if err != nil {
+		return 0, err
+	}
+
+	created := time.Now().Unix()
+	payload := changesetPayload(rootID, requester, reason, created, action, entries)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, payload))
+	id, err := storeChangeset(db, rootID, requester, reason, created, signature, action, entries)
+	if err != nil {
+		return 0, fmt.Errorf("storing the changeset: %v", err)
+	}
+	return id, nil
+}
+
+// changesetPayload is what the requester and approver of a changeset sign.
+func changesetPayload(rootID, requester, reason string, created int64, action changesetAction, entries []changeEntry) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gohash changeset\nroot %q\nrequester %q\nreason %q\ncreated %d\n", rootID, requester, reason, created)
+	if action.Kind != "" {
+		fmt.Fprintf(&b, "action %s %q %q\n", action.Kind, action.Approver, action.PublicKey)
+	}
+	for _, entry := range entries {
+		if entry.Hash.Valid {
+			fmt.Fprintf(&b, "set %q %s %d %d\n", entry.RelPath, entry.Hash.String, entry.Size, entry.ModTime)
+		} else {
+			fmt.Fprintf(&b, "remove %q\n", entry.RelPath)
+		}
+	}
+	return []byte(b.String())
+}
+
+func storeChangeset(db *sql.DB, rootID, requester, reason string, created int64, signature string, action changesetAction, entries []changeEntry) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO changesets (root_id, requested_by, reason, created_at, requester_signature, status, action, action_approver, action_key)
+		VALUES (?, ?, ?, ?, ?, 'pending', ?, ?, ?)`, rootID, requester, reason, created, signature,
+		nullString(action.Kind), nullString(action.Approver), nullString(action.PublicKey))
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		_, err = tx.Exec("INSERT INTO changeset_entries (changeset_id, filename, hash, size, mtime) VALUES (?, ?, ?, ?, ?)",
+			id, dbPath(entry.RelPath), entry.Hash, entry.Size, entry.ModTime)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// inTransaction runs fn in a transaction, committing it if fn succeeds.
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyChanges writes entries to the baseline in tx, along with their
+// audit log entries.
+func applyChanges(tx *sql.Tx, rootID string, entries []changeEntry, actor, reason string) error {
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		var oldHash string
+		err := tx.QueryRow("SELECT hash FROM file_hashes WHERE root_id = ? AND filename = ?", rootID, dbPath(entry.RelPath)).Scan(&oldHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			if !entry.Hash.Valid {
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+
+		audit := auditEntry{Actor: actor, Action: AuditAccept, RootID: rootID, RelPath: entry.RelPath,
+			OldHash: oldHash, NewHash: entry.Hash.String, Reason: reason}
+		if !entry.Hash.Valid {
+			audit.Action = AuditRemove
+		}
+		err = recordAudit(tx, audit)
+		if err != nil {
+			return err
+		}
+
+		if entry.Hash.Valid {
+			_, err = tx.Exec(`INSERT INTO file_hashes (root_id, filename, hash, size, mtime, last_verified) VALUES (?, ?, ?, ?, ?, ?)
+				ON CONFLICT (root_id, filename) DO UPDATE SET hash = excluded.hash, size = excluded.size, mtime = excluded.mtime, last_verified = excluded.last_verified`,
+				rootID, dbPath(entry.RelPath), entry.Hash.String, entry.Size, entry.ModTime, now)
+		} else {
+			_, err = tx.Exec("DELETE FROM file_hashes WHERE root_id = ? AND filename = ?", rootID, dbPath(entry.RelPath))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAction makes the change to the approvers or to rootID's approval
+// requirement in tx.
+func applyAction(tx *sql.Tx, rootID string, action changesetAction) error {
+	switch action.Kind {
+	case ActionAddApprover:
+		_, err := tx.Exec("INSERT INTO approvers (name, public_key) VALUES (?, ?)", action.Approver, action.PublicKey)
+		return err
+	case ActionRemoveApprover:
+		result, err := tx.Exec("DELETE FROM approvers WHERE name = ?", action.Approver)
+		if err != nil {
+			return err
+		}
+		if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+			return fmt.Errorf("%s is not a registered approver", action.Approver)
+		}
+		// Roots that require approval would be locked for good.
+		var approvers int
+		err = tx.QueryRow("SELECT COUNT(*) FROM approvers").Scan(&approvers)
+		if err == nil && approvers < 2 && approvalInForce(tx) {
+			err = fmt.Errorf("removing %s would leave fewer than two approvers for the roots that require approval", action.Approver)
+		}
+		return err
+	case ActionRelease:
+		_, err := tx.Exec("UPDATE roots SET require_approval = 0 WHERE root_id = ?", rootID)
+		return err
+	}
+	return fmt.Errorf("unknown changeset action %q", action.Kind)
+}
+
+// approvalInForce reports whether any root requires approval, in which
+// case so do changes to the approvers.
+func approvalInForce(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}) bool {
+	var required bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM roots WHERE require_approval)").Scan(&required)
+	// An unreadable setting is taken as the stricter one.
+	return required || err != nil
+}
+
+// runApprove lists pending changesets, or approves or rejects one. The
+// approver must be registered and must not be the one who requested it.
+func runApprove(arguments []string) {
+	flags := flag.NewFlagSet("approve", flag.ExitOnError)
+	keyPath := flags.String("key", "", "approver's ed25519 private key")
+	reject := flags.Bool("reject", false, "reject the changeset instead of applying it")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s approve database_path\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s approve -key key_path [-reject] database_path changeset_id\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath := flags.Arg(0)
+	lock, err := acquireRunLock(databasePath, *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+
+	if flags.NArg() == 1 {
+		err = listChangesets(db)
+		if err != nil {
+			log.Fatalf("Error reading changesets: %v", err)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+	if err != nil {
+		log.Fatalf("Error: %s is not a changeset ID", flags.Arg(1))
+	}
+	if *keyPath == "" {
+		log.Fatalf("Error: -key is required to approve or reject a changeset")
+	}
+	private, err := readPrivateKey(*keyPath)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	approver, err := approverName(db, private.Public().(ed25519.PublicKey))
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+
+	var rootID, requester, reason, status, requesterSignature string
+	var created int64
+	var action changesetAction
+	err = db.QueryRow(`SELECT root_id, requested_by, reason, created_at, requester_signature, status,
+		COALESCE(action, ''), COALESCE(action_approver, ''), COALESCE(action_key, '') FROM changesets WHERE id = ?`, id).
+		Scan(&rootID, &requester, &reason, &created, &requesterSignature, &status, &action.Kind, &action.Approver, &action.PublicKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Fatalf("Error: no changeset %d", id)
+	} else if err != nil {
+		log.Fatalf("Error reading the changeset: %v", err)
+	}
+	if status != "pending" {
+		log.Fatalf("Error: changeset %d is already %s", id, status)
+	}
+	if approver == requester {
+		log.Fatalf("Error: changeset %d was requested by %s and needs approval by someone else", id, approver)
+	}
+
+	entries, err := changesetEntries(db, id)
+	if err != nil {
+		log.Fatalf("Error reading the changeset: %v", err)
+	}
+
+	// The requester's signature is checked against their current key, so a
+	// changeset altered in the database after it was requested is refused.
+	payload := changesetPayload(rootID, requester, reason, created, action, entries)
+	requesterKey, err := approverKey(db, requester)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(requesterSignature)
+	if err != nil || !ed25519.Verify(requesterKey, payload, signature) {
+		log.Fatalf("Error: the requester's signature on changeset %d is invalid", id)
+	}
+
+	status = "approved"
+	if *reject {
+		status = "rejected"
+	}
+	approval := base64.StdEncoding.EncodeToString(ed25519.Sign(private, append([]byte(status+"\n"), payload...)))
+	// The changes and the changeset's new status are committed together,
+	// so an applied changeset can't stay pending and be approved again.
+	err = inTransaction(db, func(tx *sql.Tx) error {
+		if !*reject {
+			auditReason := fmt.Sprintf("changeset %d requested by %s", id, requester)
+			if reason != "" {
+				auditReason += ": " + reason
+			}
+			var err error
+			if action.Kind != "" {
+				err = applyAction(tx, rootID, action)
+			} else {
+				err = applyChanges(tx, rootID, entries, approver, auditReason)
+			}
+			if err != nil {
+				return fmt.Errorf("applying the changeset: %v", err)
+			}
+		}
+		result, err := tx.Exec("UPDATE changesets SET status = ?, approved_by = ?, approved_at = ?, approver_signature = ? WHERE id = ? AND status = 'pending'",
+			status, approver, time.Now().Unix(), approval, id)
+		if err != nil {
+			return fmt.Errorf("updating the changeset: %v", err)
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated != 1 {
+			return fmt.Errorf("changeset %d is no longer pending", id)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	fmt.Printf("Changeset %d %s by %s\n", id, status, approver)
+}
+
+func changesetEntries(db *sql.DB, id int64) ([]changeEntry, error) {
+	rows, err := db.Query("SELECT filename, hash, size, mtime FROM changeset_entries WHERE changeset_id = ? ORDER BY filename", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []changeEntry
+	for rows.Next() {
+		var entry changeEntry
+		err = rows.Scan(&entry.RelPath, &entry.Hash, &entry.Size, &entry.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func listChangesets(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, root_id, requested_by, reason, created_at,
+		(SELECT COUNT(*) FROM changeset_entries WHERE changeset_id = id),
+		COALESCE(action, ''), COALESCE(action_approver, '')
+		FROM changesets WHERE status = 'pending' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tROOT\tREQUESTED BY\tCREATED\tCHANGES\tREASON")
+	for rows.Next() {
+		var id, created int64
+		var changes int
+		var rootID, requester, reason string
+		var action changesetAction
+		err = rows.Scan(&id, &rootID, &requester, &reason, &created, &changes, &action.Kind, &action.Approver)
+		if err != nil {
+			return err
+		}
+		described := strconv.Itoa(changes)
+		if action.Kind != "" {
+			described = action.String()
+		}
+		if rootID == "" {
+			rootID = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", id, displayPath(rootID), requester,
+			time.Unix(created, 0).Format(time.RFC3339), described, reason)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// runApprovers manages the keys allowed to request and approve changesets,
+// and which roots require approval. Once a root requires approval, adding
+// or removing an approver and releasing a root are themselves changesets
+// another approver has to approve.
+func runApprovers(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s approvers add [options] database_path name public_key_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s approvers remove [options] database_path name\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s approvers list database_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s approvers require|release [options] database_path root_id\n", programName)
+	}
+	counts := map[string]int{"add": 3, "remove": 2, "list": 1, "require": 2, "release": 2}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+	command := arguments[0]
+	count, ok := counts[command]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("approvers "+command, flag.ExitOnError)
+	keyPath := flags.String("key", "", "approver's ed25519 private key, required to request the change once a root requires approval")
+	reason := flags.String("reason", "", "why the change is being requested")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments[1:])
+	if flags.NArg() != count {
+		flags.Usage()
+		os.Exit(2)
+	}
+	args := flags.Args()
+
+	lock, err := acquireRunLock(args[0], *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+
+	var rootID string
+	var action changesetAction
+	switch command {
+	case "add":
+		var public ed25519.PublicKey
+		public, err = readPublicKey(args[2])
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		action = changesetAction{Kind: ActionAddApprover, Approver: args[1], PublicKey: encodePublicKey(public)}
+	case "remove":
+		action = changesetAction{Kind: ActionRemoveApprover, Approver: args[1]}
+	case "list":
+		err = listApprovers(db)
+		if err != nil {
+			log.Fatalf("Error listing approvers: %v", err)
+		}
+		return
+	case "require":
+		// Requiring approval only tightens what a single approver can do.
+		var approvers int
+		err = db.QueryRow("SELECT COUNT(*) FROM approvers").Scan(&approvers)
+		if err == nil && approvers < 2 {
+			err = errors.New("register at least two approvers first")
+		}
+		if err == nil {
+			_, err = db.Exec("INSERT INTO roots (root_id, require_approval) VALUES (?, 1) ON CONFLICT (root_id) DO UPDATE SET require_approval = 1", args[1])
+		}
+		if err != nil {
+			log.Fatalf("Error updating approvers: %v", err)
+		}
+		return
+	case "release":
+		rootID = args[1]
+		action = changesetAction{Kind: ActionRelease}
+	}
+
+	guarded := approvalInForce(db)
+	if command == "release" {
+		guarded, err = rootRequiresApproval(db, rootID)
+		if err != nil {
+			log.Fatalf("Error reading the root's settings: %v", err)
+		}
+		if !guarded {
+			fmt.Printf("Root %s doesn't require approval\n", rootID)
+			return
+		}
+	}
+	if !guarded {
+		// Until a root requires approval, approvers are set up directly.
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			return applyAction(tx, rootID, action)
+		})
+		if err != nil {
+			log.Fatalf("Error updating approvers: %v", err)
+		}
+		return
+	}
+
+	if *keyPath == "" {
+		log.Fatalf("Error: approval is required to %s; give -key to request it", action)
+	}
+	id, err := requestChangeset(db, *keyPath, rootID, *reason, action, nil)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	fmt.Printf("Changeset %d to %s is pending approval by another approver\n", id, action)
+}
+
+func listApprovers(db *sql.DB) error {
+	rows, err := db.Query("SELECT name, public_key FROM approvers ORDER BY name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, key string
+		err = rows.Scan(&name, &key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", name, key)
+	}
+	return rows.Err()
+}
+
+// encodePublicKey is how approver keys are stored: base64 PKIX DER.
+func encodePublicKey(public ed25519.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(public)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// approverName returns the registered approver holding public.
+func approverName(db *sql.DB, public ed25519.PublicKey) (string, error) {
+	var name string
+	err := db.QueryRow("SELECT name FROM approvers WHERE public_key = ?", encodePublicKey(public)).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.New("the key is not a registered approver")
+	}
+	return name, err
+}
+
+// approverKey returns the public key registered for name.
+func approverKey(db *sql.DB, name string) (ed25519.PublicKey, error) {
+	var encoded string
+	err := db.QueryRow("SELECT public_key FROM approvers WHERE name = ?", name).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("approver %s is no longer registered", name)
+	} else if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("approver %s has no ed25519 key", name)
+	}
+	return public, nil
+}
+
+// rootRequiresApproval reports whether baseline changes to rootID need a
+// second approver.
+func rootRequiresApproval(db *sql.DB, rootID string) (bool, error) {
+	var required bool
+	err := db.QueryRow("SELECT require_approval FROM roots WHERE root_id = ?", rootID).Scan(&required)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return required, err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Actions recorded in the baseline audit log.
+const (
+	AuditInsert   = "insert"
+	AuditExpected = "expected"
+	AuditAccept   = "accept"
+	AuditRemove   = "remove"
+	AuditPrune    = "prune"
+	AuditImport   = "import"
+	AuditDynamic  = "dynamic"
+)
+
+// auditEntry is one change to a stored hash. OldHash is empty for an
+// insert and NewHash for a removal.
+type auditEntry struct {
+	Actor   string
+	Action  string
+	RootID  string
+	RelPath string
+	OldHash string
+	NewHash string
+	Reason  string
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx, so audit entries can be
+// written in the same transaction as the change they describe.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+const auditInsert = `INSERT INTO baseline_audit (at, actor, action, root_id, filename, old_hash, new_hash, reason)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+func recordAudit(db execer, entry auditEntry) error {
+	_, err := db.Exec(auditInsert, time.Now().Unix(), entry.Actor, entry.Action, entry.RootID, dbPath(entry.RelPath),
+		nullString(entry.OldHash), nullString(entry.NewHash), entry.Reason)
+	return err
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// auditActor identifies who is making a change: the local user and host.
+func auditActor() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return name + "@" + hostname
+}
+
+func runReport(arguments []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s report audit [options] database_path\n", os.Args[0])
+	}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "audit":
+		runReportAudit(arguments[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// runReportAudit prints the baseline audit log, oldest first.
+func runReportAudit(arguments []string) {
+	flags := flag.NewFlagSet("report audit", flag.ExitOnError)
+	rootID := flags.String("root-id", "", "only show changes under this root ID")
+	since := flags.Duration("since", 0, "only show changes made within this long, e.g. 168h")
+	path := flags.String("path", "", "only show changes to this stored path")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s report audit [options] database_path\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+
+	var conditions []string
+	var args []any
+	if *rootID != "" {
+		conditions = append(conditions, "root_id = ?")
+		args = append(args, *rootID)
+	}
+	if *since > 0 {
+		conditions = append(conditions, "at >= ?")
+		args = append(args, time.Now().Add(-*since).Unix())
+	}
+	if *path != "" {
+		conditions = append(conditions, "filename = ?")
+		args = append(args, dbPath(*path))
+	}
+	query := "SELECT at, actor, action, root_id, filename, COALESCE(old_hash, ''), COALESCE(new_hash, ''), reason FROM baseline_audit"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		log.Fatalf("Error reading the audit log: %v", err)
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTOR\tACTION\tROOT\tPATH\tOLD HASH\tNEW HASH\tREASON")
+	for rows.Next() {
+		var at int64
+		var entry auditEntry
+		err = rows.Scan(&at, &entry.Actor, &entry.Action, &entry.RootID, &entry.RelPath, &entry.OldHash, &entry.NewHash, &entry.Reason)
+		if err != nil {
+			log.Fatalf("Error reading the audit log: %v", err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", time.Unix(at, 0).Format(time.RFC3339), entry.Actor, entry.Action,
+			displayPath(entry.RootID), displayPath(entry.RelPath), entry.OldHash, entry.NewHash, entry.Reason)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalf("Error reading the audit log: %v", err)
+	}
+	w.Flush()
+}
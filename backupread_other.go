@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openBackup(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+func enableBackupPrivilege() error {
+	return errors.New("they are only available on Windows")
+}
+
+func isSharingViolation(err error) bool {
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runBaseline keeps named copies of a root's baseline, such as the state of
+// a golden image or of a tree right after a deployment, which scans can
+// then verify against with -against. Exported to a file, a saved baseline
+// can be imported on other hosts, or verified against with -golden.
+func runBaseline(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s baseline save [options] database_path root_directory name\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s baseline delete [options] database_path root_directory name\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s baseline list [options] database_path [root_directory]\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s baseline export [options] database_path root_directory name golden_file\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s baseline import [options] database_path root_directory golden_file\n", programName)
+	}
+	counts := map[string]int{"save": 3, "delete": 3, "list": 2, "export": 4, "import": 3}
+	if len(arguments) < 1 || counts[arguments[0]] == 0 {
+		usage()
+		os.Exit(2)
+	}
+	command := arguments[0]
+
+	flags := flag.NewFlagSet("baseline "+command, flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	note := flags.String("note", "", "what the saved baseline is, e.g. the image or release it was taken from")
+	replace := flags.Bool("replace", false, "replace a saved baseline of the same name")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	keyPath := flags.String("key", "", "ed25519 key from gohash manifest keygen: the private key to sign an export with, or the public key an import must be signed with")
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments[1:])
+	nargs := counts[command]
+	if command == "list" {
+		nargs = min(max(flags.NArg(), 1), 2)
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	rootID := *rootIDFlag
+	if rootID == "" && flags.NArg() > 1 {
+		var err error
+		rootID, err = defaultRootID(flags.Arg(1))
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+	}
+
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	lock, err := acquireRunLock(flags.Arg(0), *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+
+	if command == "list" {
+		err = listBaselines(db, rootID)
+		if err != nil {
+			log.Fatalf("Error listing baselines: %v", err)
+		}
+		return
+	}
+
+	name := flags.Arg(2)
+	switch command {
+	case "export":
+		var key ed25519.PrivateKey
+		if *keyPath != "" {
+			key, err = readPrivateKey(*keyPath)
+		}
+		var files int
+		if err == nil {
+			files, err = exportGoldenImage(db, rootID, name, flags.Arg(3), key)
+		}
+		if err == nil {
+			fmt.Printf("Exported %d records of baseline %q to %s\n", files, name, flags.Arg(3))
+		}
+	case "import":
+		var key ed25519.PublicKey
+		if *keyPath != "" {
+			key, err = readPublicKey(*keyPath)
+		}
+		var image *goldenImage
+		if err == nil {
+			image, err = readGoldenImage(flags.Arg(2), key)
+		}
+		if err == nil {
+			name = goldenBaseline(image.Name)
+			err = importGoldenImage(db, rootID, image)
+		}
+		if err == nil {
+			fmt.Printf("Imported %d records as baseline %q of %s\n", len(image.Files), name, rootID)
+		}
+	case "save":
+		var files int64
+		files, err = saveBaseline(db, rootID, name, *note, *replace)
+		if err == nil {
+			fmt.Printf("Saved %d records of %s as baseline %q\n", files, rootID, name)
+		}
+	case "delete":
+		var result sql.Result
+		result, err = db.Exec("DELETE FROM baselines WHERE root_id = ? AND name = ?", rootID, name)
+		if err == nil {
+			if deleted, _ := result.RowsAffected(); deleted == 0 {
+				err = fmt.Errorf("no baseline %q for %s", name, rootID)
+			}
+		}
+		if err == nil {
+			_, err = db.Exec("DELETE FROM baseline_files WHERE root_id = ? AND baseline = ?", rootID, name)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Error updating baseline %q: %v", name, err)
+	}
+}
+
+// saveBaseline copies the current records of rootID into the baseline
+// called name, returning how many there were.
+func saveBaseline(db *sql.DB, rootID, name, note string, replace bool) (int64, error) {
+	if strings.HasPrefix(name, goldenPrefix) {
+		return 0, fmt.Errorf("names starting with %s are kept for imported golden images", goldenPrefix)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM baselines WHERE root_id = ? AND name = ?)", rootID, name).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists && !replace {
+		return 0, errors.New("it already exists; use -replace to save over it")
+	}
+	_, err = tx.Exec("DELETE FROM baseline_files WHERE root_id = ? AND baseline = ?", rootID, name)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("INSERT INTO baseline_files (root_id, baseline, filename, hash, size, mtime) SELECT root_id, ?, filename, hash, size, mtime FROM file_hashes WHERE root_id = ?",
+		name, rootID)
+	if err != nil {
+		return 0, err
+	}
+	files, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if files == 0 {
+		return 0, fmt.Errorf("%s has no records; scan it first", rootID)
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO baselines (root_id, name, created_at, created_by, note, files) VALUES (?, ?, ?, ?, ?, ?)",
+		rootID, name, time.Now().Unix(), auditActor(), nullString(note), files)
+	if err != nil {
+		return 0, err
+	}
+	return files, tx.Commit()
+}
+
+func listBaselines(db *sql.DB, rootID string) error {
+	rows, err := db.Query("SELECT root_id, name, created_at, created_by, note, files FROM baselines WHERE ? = '' OR root_id = ? ORDER BY root_id, created_at",
+		rootID, rootID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ROOT\tNAME\tSAVED\tBY\tFILES\tNOTE")
+	for rows.Next() {
+		var root, name, by string
+		var created, files int64
+		var note sql.NullString
+		err = rows.Scan(&root, &name, &created, &by, &note, &files)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%d\t%s\n", root, name, time.Unix(created, 0).Format(time.RFC3339), by, files, note.String)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// savedBaseline describes the named baseline a scan verifies against.
+func savedBaseline(db *sql.DB, rootID, name string) (string, error) {
+	var created int64
+	var by string
+	var note sql.NullString
+	err := db.QueryRow("SELECT created_at, created_by, note FROM baselines WHERE root_id = ? AND name = ?", rootID, name).Scan(&created, &by, &note)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("no baseline %q for %s; see %s baseline list", name, rootID, os.Args[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	description := fmt.Sprintf("%s, saved %s by %s", name, time.Unix(created, 0).Format(time.RFC3339), by)
+	if note.Valid {
+		description += ": " + note.String
+	}
+	return description, nil
+}
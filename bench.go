@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+func runBench(arguments []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	sampleSize := flags.String("sample", "256M", "amount of data to sample from the directory")
+	maxWorkers := flags.Int("max-workers", 2*runtime.NumCPU(), "largest worker count to try")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s bench [options] directory\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return
+	}
+	limit, err := parseByteSize(*sampleSize)
+	if err != nil {
+		log.Fatalf("Error parsing -sample: %v", err)
+	}
+
+	sample, total, err := sampleFiles(flags.Arg(0), limit)
+	if err != nil {
+		log.Fatalf("Error reading the specified directory: %v", err)
+	}
+	if len(sample) == 0 || total == 0 {
+		log.Fatalf("Error: no readable files under %s", flags.Arg(0))
+	}
+	fmt.Printf("Sample: %d files, %d bytes\n", len(sample), total)
+
+	// The first pass reads from the storage itself; later passes are likely
+	// served from the page cache and so measure hashing rather than I/O.
+	elapsed, err := benchPass(sample, "", "", runtime.NumCPU())
+	if err != nil {
+		log.Fatalf("Error reading the sample: %v", err)
+	}
+	fmt.Printf("Cold read: %s\n\n", throughput(total, elapsed))
+
+	var workerCounts []int
+	for n := 1; n <= *maxWorkers; n *= 2 {
+		workerCounts = append(workerCounts, n)
+	}
+
+	fmt.Printf("%-14s", "workers")
+	for _, n := range workerCounts {
+		fmt.Printf("%12d", n)
+	}
+	fmt.Println()
+
+	best := make(map[string]float64)
+	bestWorkers := make(map[string]int)
+	// Rows hashed with the kernel crypto API are labelled e.g.
+	// sha256/kernel.
+	var rows []string
+	for _, algo := range hashAlgorithmNames() {
+		rows = append(rows, algo)
+		if _, ok := kernelHashDriver(algo); ok {
+			rows = append(rows, algo+"/"+BackendKernel)
+		}
+	}
+	for _, row := range rows {
+		algo, backend, _ := strings.Cut(row, "/")
+		if backend == "" {
+			backend = BackendGo
+		}
+		fmt.Printf("%-14s", row)
+		var rates []float64
+		for _, n := range workerCounts {
+			elapsed, err := benchPass(sample, algo, backend, n)
+			if err != nil {
+				log.Fatalf("Error hashing the sample: %v", err)
+			}
+			rate := float64(total) / elapsed.Seconds()
+			rates = append(rates, rate)
+			fmt.Printf("%12s", throughput(total, elapsed))
+		}
+		fmt.Println()
+
+		// Prefer the fewest workers that get within 5% of the best rate.
+		for _, rate := range rates {
+			best[row] = max(best[row], rate)
+		}
+		for i, rate := range rates {
+			if rate >= 0.95*best[row] {
+				bestWorkers[row] = workerCounts[i]
+				break
+			}
+		}
+	}
+
+	// MD5 and SHA-1 are fast but not collision resistant, so suggest the
+	// faster of the SHA-2 family and mention the others only if they win.
+	suggested := "sha256"
+	if best["sha512"] > best["sha256"] {
+		suggested = "sha512"
+	}
+	if kernel := suggested + "/" + BackendKernel; best[kernel] > 1.05*best[suggested] {
+		fmt.Printf("\nSuggested: -algo=%s -hash-backend=kernel -workers=%d\n", suggested, bestWorkers[kernel])
+	} else {
+		fmt.Printf("\nSuggested: -algo=%s -workers=%d\n", suggested, bestWorkers[suggested])
+	}
+	if best["md5"] > best[suggested] {
+		fmt.Printf("md5 is %.1fx faster (-workers=%d) where tamper resistance is not a concern\n",
+			best["md5"]/best[suggested], bestWorkers["md5"])
+	}
+}
+
+// sampleFiles picks files under root until their combined size reaches limit.
+func sampleFiles(root string, limit int64) ([]string, int64, error) {
+	var sample []string
+	var total int64
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if total >= limit {
+			return filepath.SkipAll
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		sample = append(sample, path)
+		total += info.Size()
+		return nil
+	})
+	return sample, total, err
+}
+
+// benchPass hashes every file in sample with algo and backend using the
+// given number of workers, or just reads them when algo is empty.
+func benchPass(sample []string, algo, backend string, workers int) (time.Duration, error) {
+	files := make(chan string)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				var err error
+				if algo == "" {
+					err = readFile(path)
+				} else {
+					_, err = computeFileHashWith(path, algo, backend)
+				}
+				// Keep taking files after an error so the sender isn't
+				// left blocked.
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	for _, path := range sample {
+		files <- path
+	}
+	close(files)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	select {
+	case err := <-errs:
+		return 0, err
+	default:
+		return elapsed, nil
+	}
+}
+
+func readFile(path string) error {
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(io.Discard, file)
+	return err
+}
+
+func throughput(bytes int64, elapsed time.Duration) string {
+	return fmt.Sprintf("%.1f MB/s", float64(bytes)/elapsed.Seconds()/1e6)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// daemonConfig is the JSON file read by gohash daemon -config. Each profile
+// is scanned on its own schedule with its own baseline and notifications;
+// hashing is shared, at most Workers files at a time across all profiles.
+type daemonConfig struct {
+	Workers int `json:"workers"`
+	// Translations is a file translating reports and emails, as with
+	// -translations.
+	Translations string          `json:"translations"`
+	Profiles     []profileConfig `json:"profiles"`
+}
+
+// profileConfig is one scan profile. Fields left out take the same
+// defaults as the corresponding command-line flags.
+type profileConfig struct {
+	Name         string   `json:"name"`
+	Database     string   `json:"database"`
+	Root         string   `json:"root"`
+	Email        string   `json:"email"`
+	Interval     duration `json:"interval"`
+	DigestWindow duration `json:"digestWindow"`
+	Suppress     duration `json:"suppress"`
+	FullInterval duration `json:"fullInterval"`
+
+	RootID      string   `json:"rootId"`
+	PathPolicy  string   `json:"pathPolicy"`
+	Recursive   bool     `json:"recursive"`
+	Walkers     int      `json:"walkers"`
+	SortBySize  bool     `json:"sortSize"`
+	Algo        string   `json:"algo"`
+	Timeout     duration `json:"timeout"`
+	Retries     int      `json:"retries"`
+	RetryDelay  duration `json:"retryDelay"`
+	HashBackend string   `json:"hashBackend"`
+	BackupRead  bool     `json:"backupRead"`
+	Wait        duration `json:"wait"`
+	ReadOnly    bool     `json:"readOnly"`
+	EvidenceLog string   `json:"evidenceLog"`
+	ParityDir   string   `json:"parityDir"`
+	Parity      int      `json:"parity"`
+	FSErrors    bool     `json:"fsErrors"`
+	Streams     bool     `json:"streams"`
+	Gatekeeper  bool     `json:"gatekeeper"`
+	Privileges  bool     `json:"privileges"`
+	MaxFindings int      `json:"maxFindings"`
+	MapPrefix   []string `json:"mapPrefix"`
+	Snapshot    string   `json:"snapshot"`
+	SnapSize    string   `json:"snapshotSize"`
+	Budget      int      `json:"budget"`
+	Sample      string   `json:"sample"`
+	SampleSeed  int64    `json:"sampleSeed"`
+	Incremental bool     `json:"incremental"`
+	Dynamic     []string `json:"dynamic"`
+	Entropy     int      `json:"entropy"`
+	ContentType bool     `json:"contentType"`
+	QuickSize   string   `json:"quickSize"`
+	QuickEdge   string   `json:"quickEdge"`
+	FullEvery   duration `json:"fullEvery"`
+	Fast        bool     `json:"fast"`
+	Grace       duration `json:"grace"`
+	Special     string   `json:"special"`
+	Empty       string   `json:"empty"`
+	Against     string   `json:"against"`
+	Golden      string   `json:"golden"`
+	GoldenKey   string   `json:"goldenKey"`
+
+	Manifests   string `json:"manifests"`
+	ManifestKey string `json:"manifestKey"`
+
+	SubjectTemplate string   `json:"subjectTemplate"`
+	BodyTemplate    string   `json:"bodyTemplate"`
+	Desktop         bool     `json:"desktop"`
+	Mailer          string   `json:"mailer"`
+	SMTPServer      string   `json:"smtpServer"`
+	Sendmail        string   `json:"sendmail"`
+	PGPSign         string   `json:"pgpSign"`
+	PGPEncrypt      []string `json:"pgpEncrypt"`
+	GPG             string   `json:"gpg"`
+	MailAttempts    int      `json:"mailAttempts"`
+	MailBackoff     duration `json:"mailBackoff"`
+	TicketSystem    string   `json:"ticketSystem"`
+	TicketURL       string   `json:"ticketUrl"`
+	TicketProject   string   `json:"ticketProject"`
+	TicketType      string   `json:"ticketType"`
+	TicketSeverity  int      `json:"ticketSeverity"`
+	PageService     string   `json:"page"`
+	PageSeverity    int      `json:"pageSeverity"`
+	MQTTBroker      string   `json:"mqttBroker"`
+	MQTTTopic       string   `json:"mqttTopic"`
+	MQTTQoS         int      `json:"mqttQos"`
+	MQTTCA          string   `json:"mqttCa"`
+	EventSink       string   `json:"eventSink"`
+	EventURL        string   `json:"eventUrl"`
+	EventSubject    string   `json:"eventSubject"`
+	SummaryURL      string   `json:"summaryUrl"`
+	SummaryKey      string   `json:"summaryKey"`
+	SummaryRetain   duration `json:"summaryRetain"`
+}
+
+// duration is a time.Duration written as a string such as "90s" or "24h".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("durations are strings such as \"10m\": %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	*d = duration(parsed)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaultProfile returns a profile holding the command-line defaults.
+func defaultProfile() profileConfig {
+	var profile daemonProfile
+	profile.register(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	return profile.config()
+}
+
+// loadConfig reads and validates a daemon configuration file.
+func loadConfig(path string) (*daemonConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the configuration: %v", err)
+	}
+	defer file.Close()
+
+	// Profiles are decoded one at a time over a copy of the defaults, so
+	// anything a profile leaves out keeps its default value.
+	var raw struct {
+		Workers      *int              `json:"workers"`
+		Translations string            `json:"translations"`
+		Profiles     []json.RawMessage `json:"profiles"`
+	}
+	err = decodeStrict(file, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	config := &daemonConfig{Workers: 8, Translations: raw.Translations}
+	if raw.Workers != nil {
+		config.Workers = *raw.Workers
+	}
+	if text, ok := os.LookupEnv(envName("workers")); ok {
+		config.Workers, err = strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", envName("workers"), err)
+		}
+	}
+	if config.Workers < 1 {
+		return nil, fmt.Errorf("%s: workers must be at least 1", path)
+	}
+	if len(raw.Profiles) == 0 {
+		return nil, fmt.Errorf("%s defines no profiles", path)
+	}
+
+	names := make(map[string]bool)
+	for i, data := range raw.Profiles {
+		profile := defaultProfile()
+		err = decodeStrict(bytes.NewReader(data), &profile)
+		if err != nil {
+			return nil, fmt.Errorf("parsing profile %d of %s: %v", i+1, path, err)
+		}
+		if profile.Name == "" {
+			profile.Name = profile.Root
+		}
+		err = applyProfileEnvironment(&profile)
+		if err != nil {
+			return nil, fmt.Errorf("setting profile %s from the environment: %v", profile.Name, err)
+		}
+		if profile.Database == "" || profile.Root == "" || (profile.Email == "" && !profile.Desktop) {
+			return nil, fmt.Errorf("profile %s in %s needs a database, root and email, or desktop notifications", profile.Name, path)
+		}
+		if profile.Sample != "" {
+			if _, err := parsePercent(profile.Sample); err != nil {
+				return nil, fmt.Errorf("profile %s in %s: %v", profile.Name, path, err)
+			}
+		}
+		if time.Duration(profile.Interval) <= 0 {
+			return nil, fmt.Errorf("profile %s in %s has no interval", profile.Name, path)
+		}
+		if names[profile.Name] {
+			return nil, fmt.Errorf("%s defines profile %s more than once", path, profile.Name)
+		}
+		names[profile.Name] = true
+		config.Profiles = append(config.Profiles, profile)
+	}
+	return config, nil
+}
+
+// decodeStrict decodes a single JSON value, rejecting unknown fields so a
+// misspelled setting isn't silently ignored.
+func decodeStrict(r io.Reader, v any) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// mailSecrets lists the credentials each mail transport reads from the
+// environment.
+var mailSecrets = map[string][]string{
+	MailGraph:    {"AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET"},
+	MailSendGrid: {"SENDGRID_API_KEY"},
+	MailSES:      {"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"},
+}
+
+func runConfig(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s config check config_file\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s config print config_file\n", programName)
+	}
+	if len(arguments) != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	config, err := loadConfig(arguments[1])
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	switch arguments[0] {
+	case "check":
+		problems := checkConfig(config)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d profiles, no problems found\n", arguments[1], len(config.Profiles))
+	case "print":
+		printConfig(config)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// checkConfig looks for settings that parse but wouldn't work, such as
+// paths that don't exist or a mail server that can't be reached.
+func checkConfig(config *daemonConfig) []string {
+	var problems []string
+	if config.Translations != "" {
+		if _, err := readTranslations(config.Translations); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, c := range config.Profiles {
+		report := func(format string, args ...any) {
+			problems = append(problems, fmt.Sprintf("profile %s: ", c.Name)+fmt.Sprintf(format, args...))
+		}
+		profile := newDaemonProfile(c, config.Workers)
+
+		if policy := profile.Scan.PathPolicy; policy != "" && !validPathPolicy(policy) {
+			report("unknown path policy %q", policy)
+		}
+		if algo := profile.Scan.HashAlgo; algo != "" {
+			if _, ok := hashAlgorithms[algo]; !ok {
+				report("unknown hash algorithm %q", algo)
+			}
+		}
+		if profile.Scan.ManifestDir != "" {
+			if _, err := os.Stat(profile.Scan.ManifestDir); err != nil {
+				report("can't read the manifest directory: %v", err)
+			}
+			if _, err := readPublicKey(profile.Scan.ManifestKey); err != nil {
+				report("can't read the manifest key: %v", err)
+			}
+		}
+		if profile.Scan.EvidenceLog != "" {
+			if info, err := os.Stat(filepath.Dir(profile.Scan.EvidenceLog)); err != nil || !info.IsDir() {
+				report("the evidence log directory %s doesn't exist", filepath.Dir(profile.Scan.EvidenceLog))
+			}
+		}
+		if profile.Scan.ParityDir != "" {
+			if err := validParity(profile.Scan.Parity); err != nil {
+				report("%v", err)
+			}
+		}
+		if kind := profile.Scan.Snapshot; kind != "" && !validSnapshotKind(kind) {
+			report("unknown snapshot kind %q", kind)
+		}
+		if err := checkPathRules(profile.Scan.Dynamic); err != nil {
+			report("%v", err)
+		}
+		if _, err := parseQuickOptions(profile.Scan.QuickSize, profile.Scan.QuickEdge, profile.Scan.FullEvery); err != nil {
+			report("%v", err)
+		}
+		if policy := profile.Scan.Special; policy != "" && !validSpecialPolicy(policy) {
+			report("unknown special file policy %q", policy)
+		}
+		if policy := profile.Scan.Empty; policy != "" && !validEmptyPolicy(policy) {
+			report("unknown empty file policy %q", policy)
+		}
+		if backend := profile.Scan.File.Backend; !validHashBackend(backend) {
+			report("unknown hash backend %q", backend)
+		}
+		if profile.Scan.File.BackupRead && runtime.GOOS != "windows" {
+			report("backupRead is only available on Windows")
+		}
+		if profile.FullInterval < 0 {
+			report("fullInterval can't be negative")
+		}
+		if profile.Scan.Grace < 0 {
+			report("grace can't be negative")
+		}
+		if profile.Scan.MaxFindings < 0 {
+			report("maxFindings can't be negative")
+		}
+		for _, m := range profile.Scan.MapPrefix {
+			if _, _, err := parsePrefixMap(m); err != nil {
+				report("%v", err)
+			}
+		}
+		if _, err := loadEmailTemplates(profile.SubjectTemplate, profile.BodyTemplate); err != nil {
+			report("%v", err)
+		}
+
+		if err := checkTicketOptions(profile.Tickets); err != nil {
+			report("%v", err)
+		}
+		if err := checkPageOptions(profile.Pages); err != nil {
+			report("%v", err)
+		}
+		if err := checkMQTTOptions(profile.MQTT); err != nil {
+			report("%v", err)
+		}
+		if err := checkSinkOptions(profile.Events); err != nil {
+			report("%v", err)
+		}
+		if err := checkSummaryOptions(profile.Summary); err != nil {
+			report("%v", err)
+		}
+		if profile.Desktop {
+			if err := checkDesktop(); err != nil {
+				report("%v", err)
+			}
+		}
+		preflight := profile.preflight()
+		if profile.Email != "" {
+			if err := checkMailOptions(&profile.Mail); err != nil {
+				report("%v", err)
+				preflight.Mail = nil
+			}
+		}
+		// The database, root and endpoints are checked as the daemon
+		// would check them on starting.
+		for _, problem := range preflight.problems() {
+			report("%s", problem)
+		}
+	}
+	return problems
+}
+
+// printConfig writes the configuration as it takes effect, with defaults
+// and environment overrides applied. Credentials are only said to be set
+// or not.
+func printConfig(config *daemonConfig) {
+	secrets := make(map[string]string)
+	for _, profile := range config.Profiles {
+		names := append(mailSecrets[profile.Mailer], ticketSecrets[profile.TicketSystem]...)
+		names = append(names, pageSecrets[profile.PageService]...)
+		if profile.MQTTBroker != "" {
+			names = append(names, mqttSecrets...)
+		}
+		names = append(names, sinkSecrets[profile.EventSink]...)
+		names = append(names, summarySecrets(profile.SummaryURL)...)
+		for _, name := range names {
+			secrets[name] = "(not set)"
+			if os.Getenv(name) != "" {
+				secrets[name] = "(redacted)"
+			}
+		}
+	}
+	encoded, err := json.MarshalIndent(struct {
+		*daemonConfig
+		Secrets map[string]string `json:"secrets,omitempty"`
+	}{config, secrets}, "", "  ")
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	fmt.Printf("%s\n", encoded)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// executableMagic are the formats net/http doesn't recognise but that
+// matter most when a file's type changes.
+var executableMagic = []struct {
+	prefix      []byte
+	contentType string
+}{
+	{[]byte("MZ"), "application/vnd.microsoft.portable-executable"},
+	{[]byte("\x7fELF"), "application/x-elf"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-script"},
+}
+
+// fileContentType detects the content type of filePath from its first
+// bytes, e.g. "image/jpeg", without parameters such as the charset.
+func fileContentType(filePath string) (string, error) {
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(head, magic.prefix) {
+			return magic.contentType, nil
+		}
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+	return contentType, nil
+}
+
+// typeChanged reports whether a file's content type differs from the one
+// recorded, when both are known.
+func typeChanged(stored, now string) bool {
+	return stored != "" && now != "" && stored != now
+}
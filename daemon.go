@@ -0,0 +1,705 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// daemonProfile is one root scanned on a schedule, with its own baseline
+// and notifications.
+type daemonProfile struct {
+	Name            string
+	Database        string
+	Root            string
+	Email           string
+	Interval        time.Duration
+	DigestWindow    time.Duration
+	Suppress        time.Duration
+	FullInterval    time.Duration
+	SubjectTemplate string
+	BodyTemplate    string
+	Scan            scanOptions
+	Mail            mailOptions
+	Tickets         ticketOptions
+	Pages           pageOptions
+	MQTT            mqttOptions
+	Events          sinkOptions
+	Summary         summaryOptions
+	// Desktop pops up a desktop notification for the scans that would be
+	// emailed, with or without an email.
+	Desktop bool
+}
+
+func (p *daemonProfile) register(flags *flag.FlagSet) {
+	flags.DurationVar(&p.Interval, "interval", time.Hour, "time between the starts of consecutive scans")
+	flags.DurationVar(&p.DigestWindow, "digest-window", 0, "collect the findings of every scan within this window into one email (default: one email per scan with findings)")
+	flags.DurationVar(&p.Suppress, "suppress", 0, "don't report an identical finding again within this long, e.g. 24h")
+	flags.DurationVar(&p.FullInterval, "full-interval", 0, "hash every file at least this often, e.g. 168h, with -fast, -quick-size, -sample, -budget and -incremental off, making the scans in between the quick tier (default: off)")
+	p.Scan.register(flags)
+	flags.StringVar(&p.SubjectTemplate, "subject-template", "", "Go template for the email subject")
+	flags.StringVar(&p.BodyTemplate, "body-template", "", "file with a Go template for the email body (default: the text report)")
+	p.Mail.register(flags)
+	p.Tickets.register(flags)
+	p.Pages.register(flags)
+	p.MQTT.register(flags)
+	p.Events.register(flags)
+	p.Summary.register(flags)
+	flags.BoolVar(&p.Desktop, "desktop", false, "also pop up a desktop notification for scans with findings, making the email optional; the daemon must run in the desktop session")
+}
+
+// config returns the profile in its configuration file form.
+func (p *daemonProfile) config() profileConfig {
+	sample := ""
+	if p.Scan.Sample > 0 {
+		sample = formatPercent(p.Scan.Sample)
+	}
+	return profileConfig{
+		Name:            p.Name,
+		Database:        p.Database,
+		Root:            p.Root,
+		Email:           p.Email,
+		Interval:        duration(p.Interval),
+		DigestWindow:    duration(p.DigestWindow),
+		Suppress:        duration(p.Suppress),
+		FullInterval:    duration(p.FullInterval),
+		RootID:          p.Scan.RootID,
+		PathPolicy:      p.Scan.PathPolicy,
+		Recursive:       p.Scan.Recursive,
+		Walkers:         p.Scan.Walkers,
+		SortBySize:      p.Scan.SortBySize,
+		Algo:            p.Scan.HashAlgo,
+		Timeout:         duration(p.Scan.File.Timeout),
+		Retries:         p.Scan.File.Retries,
+		RetryDelay:      duration(p.Scan.File.RetryDelay),
+		HashBackend:     p.Scan.File.Backend,
+		BackupRead:      p.Scan.File.BackupRead,
+		Wait:            duration(p.Scan.LockWait),
+		ReadOnly:        p.Scan.ReadOnly,
+		EvidenceLog:     p.Scan.EvidenceLog,
+		ParityDir:       p.Scan.ParityDir,
+		Parity:          p.Scan.Parity,
+		FSErrors:        p.Scan.FSErrors,
+		Streams:         p.Scan.Streams,
+		Gatekeeper:      p.Scan.Gatekeeper,
+		Privileges:      p.Scan.Privileges,
+		MaxFindings:     p.Scan.MaxFindings,
+		Snapshot:        p.Scan.Snapshot,
+		SnapSize:        p.Scan.SnapSize,
+		Budget:          p.Scan.Budget,
+		Sample:          sample,
+		SampleSeed:      p.Scan.SampleSeed,
+		Incremental:     p.Scan.Incremental,
+		Dynamic:         p.Scan.Dynamic,
+		MapPrefix:       p.Scan.MapPrefix,
+		Entropy:         p.Scan.Entropy,
+		ContentType:     p.Scan.ContentType,
+		QuickSize:       p.Scan.QuickSize,
+		QuickEdge:       p.Scan.QuickEdge,
+		FullEvery:       duration(p.Scan.FullEvery),
+		Fast:            p.Scan.Fast,
+		Grace:           duration(p.Scan.Grace),
+		Special:         p.Scan.Special,
+		Empty:           p.Scan.Empty,
+		Against:         p.Scan.Against,
+		Golden:          p.Scan.Golden,
+		GoldenKey:       p.Scan.GoldenKey,
+		Manifests:       p.Scan.ManifestDir,
+		ManifestKey:     p.Scan.ManifestKey,
+		SubjectTemplate: p.SubjectTemplate,
+		BodyTemplate:    p.BodyTemplate,
+		Mailer:          p.Mail.Transport,
+		SMTPServer:      p.Mail.Server,
+		Sendmail:        p.Mail.Sendmail,
+		PGPSign:         p.Mail.PGP.SignKey,
+		PGPEncrypt:      p.Mail.PGP.Recipients,
+		GPG:             p.Mail.PGP.Program,
+		MailAttempts:    p.Mail.Attempts,
+		MailBackoff:     duration(p.Mail.Backoff),
+		TicketSystem:    p.Tickets.System,
+		TicketURL:       p.Tickets.URL,
+		TicketProject:   p.Tickets.Project,
+		TicketType:      p.Tickets.IssueType,
+		TicketSeverity:  p.Tickets.Severity,
+		PageService:     p.Pages.Service,
+		PageSeverity:    p.Pages.Severity,
+		MQTTBroker:      p.MQTT.Broker,
+		MQTTTopic:       p.MQTT.Topic,
+		MQTTQoS:         p.MQTT.QoS,
+		MQTTCA:          p.MQTT.CA,
+		EventSink:       p.Events.Sink,
+		EventURL:        p.Events.URL,
+		EventSubject:    p.Events.Subject,
+		SummaryURL:      p.Summary.URL,
+		SummaryKey:      p.Summary.Key,
+		SummaryRetain:   duration(p.Summary.Retain),
+		Desktop:         p.Desktop,
+	}
+}
+
+// newDaemonProfile builds a profile from its configuration file form.
+func newDaemonProfile(c profileConfig, workers int) *daemonProfile {
+	// loadConfig has checked the sample.
+	sample := 0.0
+	if c.Sample != "" {
+		sample, _ = parsePercent(c.Sample)
+	}
+	return &daemonProfile{
+		Name:            c.Name,
+		Database:        c.Database,
+		Root:            c.Root,
+		Email:           c.Email,
+		Interval:        time.Duration(c.Interval),
+		DigestWindow:    time.Duration(c.DigestWindow),
+		Suppress:        time.Duration(c.Suppress),
+		FullInterval:    time.Duration(c.FullInterval),
+		SubjectTemplate: c.SubjectTemplate,
+		BodyTemplate:    c.BodyTemplate,
+		Desktop:         c.Desktop,
+		Scan: scanOptions{
+			LockWait:    time.Duration(c.Wait),
+			RootID:      c.RootID,
+			PathPolicy:  c.PathPolicy,
+			Recursive:   c.Recursive,
+			Walkers:     c.Walkers,
+			Workers:     workers,
+			SortBySize:  c.SortBySize,
+			HashAlgo:    c.Algo,
+			ReadOnly:    c.ReadOnly,
+			EvidenceLog: c.EvidenceLog,
+			ParityDir:   c.ParityDir,
+			Parity:      c.Parity,
+			FSErrors:    c.FSErrors,
+			Streams:     c.Streams,
+			Gatekeeper:  c.Gatekeeper,
+			Privileges:  c.Privileges,
+			MaxFindings: c.MaxFindings,
+			Snapshot:    c.Snapshot,
+			SnapSize:    c.SnapSize,
+			Budget:      c.Budget,
+			Sample:      sample,
+			SampleSeed:  c.SampleSeed,
+			Incremental: c.Incremental,
+			Dynamic:     c.Dynamic,
+			MapPrefix:   c.MapPrefix,
+			Entropy:     c.Entropy,
+			ContentType: c.ContentType,
+			QuickSize:   c.QuickSize,
+			QuickEdge:   c.QuickEdge,
+			FullEvery:   time.Duration(c.FullEvery),
+			Fast:        c.Fast,
+			Grace:       time.Duration(c.Grace),
+			Special:     c.Special,
+			Empty:       c.Empty,
+			Against:     c.Against,
+			Golden:      c.Golden,
+			GoldenKey:   c.GoldenKey,
+			ManifestDir: c.Manifests,
+			ManifestKey: c.ManifestKey,
+			File: fileOptions{
+				Timeout:    time.Duration(c.Timeout),
+				Retries:    c.Retries,
+				RetryDelay: time.Duration(c.RetryDelay),
+				Backend:    c.HashBackend,
+				BackupRead: c.BackupRead,
+			},
+		},
+		Mail: mailOptions{
+			Transport: c.Mailer,
+			Server:    c.SMTPServer,
+			Sendmail:  c.Sendmail,
+			PGP:       pgpOptions{Program: c.GPG, SignKey: c.PGPSign, Recipients: c.PGPEncrypt},
+			Attempts:  c.MailAttempts,
+			Backoff:   time.Duration(c.MailBackoff),
+		},
+		Tickets: ticketOptions{
+			System:    c.TicketSystem,
+			URL:       c.TicketURL,
+			Project:   c.TicketProject,
+			IssueType: c.TicketType,
+			Severity:  c.TicketSeverity,
+		},
+		Pages:   pageOptions{Service: c.PageService, Severity: c.PageSeverity},
+		MQTT:    mqttOptions{Broker: c.MQTTBroker, Topic: c.MQTTTopic, QoS: c.MQTTQoS, CA: c.MQTTCA},
+		Events:  sinkOptions{Sink: c.EventSink, URL: c.EventURL, Subject: c.EventSubject},
+		Summary: summaryOptions{URL: c.SummaryURL, Key: c.SummaryKey, Retain: time.Duration(c.SummaryRetain)},
+	}
+}
+
+func runDaemon(arguments []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := flags.String("config", "", "run the profiles defined in this JSON file instead of the root on the command line")
+	var single daemonProfile
+	single.register(flags)
+	pprofAddr := flags.String("pprof", "", "serve net/http/pprof on this loopback address, e.g. localhost:6060")
+	maxMemory := flags.String("max-memory", "", "abort if the heap grows beyond this size, e.g. 512M")
+	translations := flags.String("translations", "", translationsUsage)
+	var self selfCheckOptions
+	self.register(flags)
+	var resources resourceOptions
+	resources.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s daemon [options] database_path root_directory email\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s daemon -desktop [options] database_path root_directory [email]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s daemon -config file\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Scans each root every interval and emails scans that have findings.\n")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	self.check()
+
+	args := flags.Args()
+	var profiles []*daemonProfile
+	var workers int
+	if *configPath != "" {
+		if len(args) != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		workers = config.Workers
+		if *translations == "" {
+			*translations = config.Translations
+		}
+		for _, profile := range config.Profiles {
+			profiles = append(profiles, newDaemonProfile(profile, workers))
+		}
+	} else {
+		if (len(args) != 3 && (len(args) != 2 || !single.Desktop)) || single.Interval <= 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		single.Database, single.Root = args[0], args[1]
+		if len(args) == 3 {
+			single.Email = args[2]
+		}
+		single.Name = single.Root
+		workers = single.Scan.Workers
+		profiles = append(profiles, &single)
+	}
+
+	if *maxMemory != "" {
+		limit, err := parseByteSize(*maxMemory)
+		if err != nil {
+			log.Fatalf("Error parsing -max-memory: %v", err)
+		}
+		limitMemory(limit)
+	}
+	resources.apply()
+	if *translations != "" {
+		if err := loadTranslations(*translations); err != nil {
+			log.Fatalf("Error %v", err)
+		}
+	}
+
+	// Every profile's scans draw on the same hashing slots, so running
+	// several at once doesn't multiply the load on the machine.
+	slots := make(chan struct{}, workers)
+	var runners []*profileRunner
+	for _, profile := range profiles {
+		runner, err := newProfileRunner(profile, slots)
+		if err != nil {
+			log.Fatalf("Error in profile %s: %v", profile.Name, err)
+		}
+		runners = append(runners, runner)
+	}
+	var problems []string
+	for _, profile := range profiles {
+		for _, problem := range profile.preflight().problems() {
+			problems = append(problems, fmt.Sprintf("profile %s: %s", profile.Name, problem))
+		}
+	}
+	requirePreflight(problems)
+
+	if *pprofAddr != "" {
+		err := servePprof(*pprofAddr)
+		if err != nil {
+			log.Fatalf("Error starting the pprof server: %v", err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopReasons := make(chan string, 1)
+	go func() {
+		stopReasons <- fmt.Sprintf("Received %s", <-signals)
+	}()
+	serviceStopped := runAsService(stopReasons)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, runner := range runners {
+		wg.Add(1)
+		go func(runner *profileRunner) {
+			defer wg.Done()
+			runner.run(stop)
+		}(runner)
+	}
+
+	sdNotify("READY=1")
+	sdWatchdog(stop)
+
+	log.Printf("%s, sending pending notifications and exiting", <-stopReasons)
+	sdNotify("STOPPING=1")
+	close(stop)
+	done := make(chan struct{})
+	go sdExtendStop(done)
+	wg.Wait()
+	close(done)
+	serviceStopped()
+}
+
+// preflight returns what the profile's scans are checked for before the
+// daemon starts. The mail settings must have been checked.
+func (p *daemonProfile) preflight() preflightCheck {
+	check := preflightCheck{
+		Database: p.Database,
+		Root:     p.Root,
+		ReadOnly: p.Scan.ReadOnly || p.Scan.Against != "",
+		Tickets:  p.Tickets,
+		Pages:    p.Pages,
+		MQTT:     p.MQTT,
+		Events:   p.Events,
+		Summary:  p.Summary,
+	}
+	if p.Email != "" {
+		check.Mail = &p.Mail
+	}
+	return check
+}
+
+// profileRunner schedules one profile's scans and notifications.
+type profileRunner struct {
+	profile *daemonProfile
+	pending *digest
+	// failure is the error of the last scan if it failed, so the same
+	// failure is only notified once.
+	failure string
+}
+
+func newProfileRunner(profile *daemonProfile, slots chan struct{}) (*profileRunner, error) {
+	templates, err := loadEmailTemplates(profile.SubjectTemplate, profile.BodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if profile.Email != "" {
+		err = checkMailOptions(&profile.Mail)
+		if err != nil {
+			return nil, fmt.Errorf("checking the mail settings: %v", err)
+		}
+	}
+	if profile.Desktop {
+		err = checkDesktop()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkTicketOptions(profile.Tickets)
+	if err != nil {
+		return nil, fmt.Errorf("checking the ticket settings: %v", err)
+	}
+	err = checkPageOptions(profile.Pages)
+	if err != nil {
+		return nil, fmt.Errorf("checking the paging settings: %v", err)
+	}
+	err = checkMQTTOptions(profile.MQTT)
+	if err != nil {
+		return nil, fmt.Errorf("checking the MQTT settings: %v", err)
+	}
+	err = checkSinkOptions(profile.Events)
+	if err != nil {
+		return nil, fmt.Errorf("checking the event sink settings: %v", err)
+	}
+	err = checkSummaryOptions(profile.Summary)
+	if err != nil {
+		return nil, fmt.Errorf("checking the run summary settings: %v", err)
+	}
+
+	profile.Scan.Slots = slots
+	if profile.Scan.Incremental {
+		profile.Scan.Watcher, err = newChangeWatcher(profile.Root)
+		if err != nil {
+			return nil, fmt.Errorf("watching for changes: %v", err)
+		}
+	}
+	if profile.Suppress > 0 {
+		history := &alertHistory{window: profile.Suppress, sent: make(map[string]time.Time)}
+		profile.Scan.Suppress = history.suppress
+	}
+	pending := &digest{window: profile.DigestWindow, send: func(reports []*scanReport) {
+		var err error
+		if profile.Desktop {
+			database := profile.Database
+			if profile.Scan.ReadOnly {
+				// Read-only scans don't record their findings.
+				database = ""
+			}
+			err = notifyDesktop(database, reports)
+			if err != nil {
+				log.Printf("[%s] Error showing the desktop notification: %v", profile.Name, err)
+			}
+		}
+		// With an email, its delivery is what is recorded.
+		if profile.Email != "" {
+			err = notify(profile.Email, templates, profile.Mail, reports)
+			if err != nil {
+				log.Printf("[%s] Error sending the email to %s: %v", profile.Name, profile.Email, err)
+				sdNotify(fmt.Sprintf("STATUS=[%s] notification to %s failed: %v", profile.Name, profile.Email, err))
+			}
+		}
+		if !profile.Scan.ReadOnly {
+			var runIDs []string
+			for _, report := range reports {
+				runIDs = append(runIDs, report.Run.RunID)
+			}
+			err = recordNotification(profile.Database, profile.Scan.LockWait, runIDs, err)
+			if err != nil {
+				log.Printf("[%s] Error recording the notification: %v", profile.Name, err)
+			}
+		}
+	}}
+	return &profileRunner{profile: profile, pending: pending}, nil
+}
+
+// run scans every interval until stop is closed, then sends whatever is
+// still pending.
+func (r *profileRunner) run(stop <-chan struct{}) {
+	profile := r.profile
+	next := time.Now()
+	lastFull, err := r.lastFullScan()
+	if err != nil {
+		log.Printf("[%s] Error reading when the root was last scanned in full: %v", profile.Name, err)
+	}
+	for {
+		options := &profile.Scan
+		if profile.FullInterval > 0 && time.Since(lastFull) >= profile.FullInterval {
+			options = profile.Scan.fullTier()
+		}
+		report, err := scanRoot(profile.Database, profile.Root, options, nil)
+		if err != nil {
+			log.Printf("[%s] Error %v", profile.Name, err)
+			r.notifyFailure(err)
+		} else {
+			r.notifyRecovery()
+			if report.Run.Tier == TierFull {
+				lastFull = report.Run.Started
+			}
+			data := newReportData([]*scanReport{report})
+			log.Printf("[%s] Scanned %s (run %s, %s tier): %s, %d findings (%d already reported), %d passed",
+				profile.Name, profile.Root, data.RunID, data.Tier, data.Status, data.Findings(), report.Suppressed, data.Passed)
+			sdNotify(fmt.Sprintf("STATUS=[%s] %s at %s", profile.Name, data.Status, data.Finished.Format(time.RFC3339)))
+			err = pageOnCall(profile.Database, profile.Scan.LockWait, report, profile.Pages)
+			if err != nil {
+				log.Printf("[%s] Error paging on-call: %v", profile.Name, err)
+			}
+			err = fileTickets(profile.Database, profile.Scan.LockWait, report.Run, profile.Tickets)
+			if err != nil {
+				log.Printf("[%s] Error filing tickets: %v", profile.Name, err)
+			}
+			err = publishMQTT(report, profile.MQTT)
+			if err != nil {
+				log.Printf("[%s] Error publishing to the MQTT broker: %v", profile.Name, err)
+			}
+			err = publishEvents(report, profile.Events)
+			if err != nil {
+				log.Printf("[%s] Error publishing to the event sink: %v", profile.Name, err)
+			}
+			err = pushSummary(profile.Database, report, profile.Summary)
+			if err != nil {
+				log.Printf("[%s] Error %v", profile.Name, err)
+			}
+			r.pending.add(report)
+		}
+
+		// A scan that overran the interval is followed immediately by the
+		// next one rather than by a burst of catch-up scans.
+		next = next.Add(profile.Interval)
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		for wait := true; wait; {
+			wake := next
+			if r.pending.due().Before(wake) {
+				wake = r.pending.due()
+			}
+			timer := time.NewTimer(time.Until(wake))
+			select {
+			case <-timer.C:
+				if !time.Now().Before(r.pending.due()) {
+					r.pending.flush()
+				}
+				wait = time.Now().Before(next)
+			case <-stop:
+				timer.Stop()
+				r.pending.flush()
+				return
+			}
+		}
+	}
+}
+
+// notifyFailure tells the profile's email, desktop and on-call channels
+// that a scan failed, as when the database was modified behind gohash's
+// back or couldn't be locked, which would otherwise only be logged.
+func (r *profileRunner) notifyFailure(scanErr error) {
+	profile := r.profile
+	if scanErr.Error() == r.failure {
+		return
+	}
+	r.failure = scanErr.Error()
+	hostname, _ := os.Hostname()
+	message := trf("The scan of %s on %s failed: %v", displayPath(profile.Root), hostname, scanErr)
+
+	if profile.Desktop {
+		err := showDesktop("gohash: "+trf("Scan failed"), message, true)
+		if err != nil {
+			log.Printf("[%s] Error showing the desktop notification: %v", profile.Name, err)
+		}
+	}
+	if profile.Email != "" {
+		subject := "gohash: " + trf("Scan of %s on %s failed", displayPath(profile.Root), hostname)
+		err := sendEmail(profile.Email, subject, strings.NewReader(message+"\n"), true, nil, profile.Mail)
+		if err != nil {
+			log.Printf("[%s] Error sending the failure notice to %s: %v", profile.Name, profile.Email, err)
+		}
+	}
+	if profile.Pages.Service != "" {
+		run, alert := r.failureAlert(hostname)
+		alert.Message = message
+		err := sendPage(profile.Pages, run, alert, true)
+		if err != nil {
+			log.Printf("[%s] Error paging on-call: %v", profile.Name, err)
+		}
+	}
+}
+
+// notifyRecovery resolves the on-call alert of a failed scan once a scan
+// succeeds again.
+func (r *profileRunner) notifyRecovery() {
+	if r.failure == "" {
+		return
+	}
+	r.failure = ""
+	if r.profile.Pages.Service != "" {
+		hostname, _ := os.Hostname()
+		run, alert := r.failureAlert(hostname)
+		err := sendPage(r.profile.Pages, run, alert, false)
+		if err != nil {
+			log.Printf("[%s] Error resolving the alert for the failed scan: %v", r.profile.Name, err)
+		}
+	}
+}
+
+// failureAlert returns the alert for the profile's scans failing, keyed
+// by the root rather than by one of its files.
+func (r *profileRunner) failureAlert(hostname string) (runInfo, pageAlert) {
+	rootID, err := r.profile.Scan.rootID(r.profile.Root)
+	if err != nil {
+		rootID = r.profile.Root
+	}
+	run := runInfo{Hostname: hostname, Root: r.profile.Root, RootID: rootID, Database: r.profile.Database}
+	return run, pageAlert{Kind: FindingError, Key: pageKey(hostname, rootID, "")}
+}
+
+// lastFullScan returns when the profile's root was last scanned in full, as
+// recorded in its database, so that restarting the daemon doesn't put off
+// or bring forward the next full scan.
+func (r *profileRunner) lastFullScan() (time.Time, error) {
+	profile := r.profile
+	if profile.FullInterval <= 0 || profile.Scan.ReadOnly {
+		return time.Time{}, nil
+	}
+	if _, err := os.Stat(profile.Database); os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	rootID, err := profile.Scan.rootID(profile.Root)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last time.Time
+	err = withDatabase(profile.Database, profile.Scan.LockWait, func(db *sql.DB) error {
+		last, err = lastRunOfTier(db, rootID, TierFull)
+		return err
+	})
+	return last, err
+}
+
+// alertHistory remembers when each finding was last reported, so a problem
+// that persists from scan to scan is only reported once per window.
+type alertHistory struct {
+	window time.Duration
+	sent   map[string]time.Time
+}
+
+// suppress reports whether finding was already reported within the window,
+// and otherwise records it as reported now.
+func (h *alertHistory) suppress(finding Finding) bool {
+	now := time.Now()
+	for key, sent := range h.sent {
+		if now.Sub(sent) >= h.window {
+			delete(h.sent, key)
+		}
+	}
+
+	key := finding.Kind + "\x00" + finding.FilePath + "\x00" + finding.StoredHash + "\x00" + finding.ComputedHash
+	if _, ok := h.sent[key]; ok {
+		return true
+	}
+	h.sent[key] = now
+	return false
+}
+
+// digest holds reports with findings until their window closes, then sends
+// them as one notification. With no window every report is sent at once.
+type digest struct {
+	window  time.Duration
+	send    func(reports []*scanReport)
+	reports []*scanReport
+	opened  time.Time
+}
+
+// add queues a report, discarding it if it has nothing to report.
+func (d *digest) add(report *scanReport) {
+	if report.Totals().findings() == 0 && report.Baselined == 0 {
+		report.Remove()
+		return
+	}
+	if len(d.reports) == 0 {
+		d.opened = time.Now()
+	}
+	d.reports = append(d.reports, report)
+	if d.window <= 0 {
+		d.flush()
+	}
+}
+
+// due is when the pending reports should be sent, or the far future if
+// there are none.
+func (d *digest) due() time.Time {
+	if len(d.reports) == 0 {
+		return time.Now().Add(24 * 365 * time.Hour)
+	}
+	return d.opened.Add(d.window)
+}
+
+// flush sends and removes the pending reports.
+func (d *digest) flush() {
+	if len(d.reports) == 0 {
+		return
+	}
+	d.send(d.reports)
+	for _, report := range d.reports {
+		report.Remove()
+	}
+	d.reports = nil
+}
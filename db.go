@@ -0,0 +1,504 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// migration upgrades the schema from version-1 to version.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations must be kept in order and never edited once released; add a new
+// entry for every schema change instead.
+var migrations = []migration{
+	{1, "create file_hashes", []string{`
+	CREATE TABLE IF NOT EXISTS file_hashes (
+		filename TEXT PRIMARY KEY,
+		hash TEXT
+	);
+	`}},
+	{2, "record size, modification time and last verification", []string{
+		"ALTER TABLE file_hashes ADD COLUMN size INTEGER",
+		"ALTER TABLE file_hashes ADD COLUMN mtime INTEGER",
+		"ALTER TABLE file_hashes ADD COLUMN last_verified INTEGER",
+	}},
+	{3, "store root-relative paths keyed by root", []string{`
+	CREATE TABLE file_hashes_v3 (
+		root_id TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		hash TEXT,
+		size INTEGER,
+		mtime INTEGER,
+		last_verified INTEGER,
+		PRIMARY KEY (root_id, filename)
+	);
+	`,
+		// Existing absolute paths keep an empty root ID until a scan of
+		// their root adopts them; see adoptLegacyRecords.
+		`INSERT INTO file_hashes_v3 (root_id, filename, hash, size, mtime, last_verified)
+		SELECT '', filename, hash, size, mtime, last_verified FROM file_hashes`,
+		"DROP TABLE file_hashes",
+		"ALTER TABLE file_hashes_v3 RENAME TO file_hashes",
+	}},
+	{4, "record per-root settings", []string{`
+	CREATE TABLE roots (
+		root_id TEXT PRIMARY KEY,
+		path_policy TEXT NOT NULL DEFAULT 'preserve'
+	);
+	`}},
+	{5, "mark the files seen by each scan", []string{
+		"ALTER TABLE file_hashes ADD COLUMN last_seen INTEGER",
+	}},
+	{6, "record each root's hash algorithm", []string{
+		"ALTER TABLE roots ADD COLUMN hash_algo TEXT NOT NULL DEFAULT 'md5'",
+	}},
+	{7, "record every scan", []string{`
+	CREATE TABLE runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hostname TEXT NOT NULL,
+		root TEXT NOT NULL,
+		root_id TEXT NOT NULL,
+		database TEXT NOT NULL,
+		version TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		changed INTEGER NOT NULL,
+		new INTEGER NOT NULL,
+		missing INTEGER NOT NULL,
+		errors INTEGER NOT NULL,
+		timed_out INTEGER NOT NULL,
+		passed INTEGER NOT NULL
+	);
+	`}},
+	{8, "count expected updates in runs", []string{
+		"ALTER TABLE runs ADD COLUMN expected INTEGER NOT NULL DEFAULT 0",
+	}},
+	{9, "approve baseline changes", []string{
+		"ALTER TABLE roots ADD COLUMN require_approval INTEGER NOT NULL DEFAULT 0",
+		`CREATE TABLE approvers (
+			name TEXT PRIMARY KEY,
+			public_key TEXT NOT NULL UNIQUE
+		)`,
+		`CREATE TABLE changesets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			root_id TEXT NOT NULL,
+			requested_by TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			requester_signature TEXT NOT NULL,
+			status TEXT NOT NULL,
+			approved_by TEXT,
+			approved_at INTEGER,
+			approver_signature TEXT
+		)`,
+		`CREATE TABLE changeset_entries (
+			changeset_id INTEGER NOT NULL REFERENCES changesets (id),
+			filename TEXT NOT NULL,
+			hash TEXT,
+			size INTEGER NOT NULL,
+			mtime INTEGER NOT NULL,
+			PRIMARY KEY (changeset_id, filename)
+		)`,
+	}},
+	{10, "audit baseline changes", []string{`
+	CREATE TABLE baseline_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at INTEGER NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		root_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		old_hash TEXT,
+		new_hash TEXT,
+		reason TEXT NOT NULL
+	);
+	`}},
+	{11, "remember each root's change journal position", []string{
+		"ALTER TABLE roots ADD COLUMN change_journal TEXT",
+	}},
+	{12, "record file entropy", []string{
+		"ALTER TABLE file_hashes ADD COLUMN entropy REAL",
+	}},
+	{13, "record file content types", []string{
+		"ALTER TABLE file_hashes ADD COLUMN content_type TEXT",
+	}},
+	{14, "quick-check large files", []string{
+		"ALTER TABLE file_hashes ADD COLUMN quick_hash TEXT",
+		"ALTER TABLE file_hashes ADD COLUMN full_verified INTEGER",
+	}},
+	{15, "keep named baselines", []string{
+		`CREATE TABLE baselines (
+			root_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			created_by TEXT NOT NULL,
+			note TEXT,
+			files INTEGER NOT NULL,
+			PRIMARY KEY (root_id, name)
+		)`,
+		`CREATE TABLE baseline_files (
+			root_id TEXT NOT NULL,
+			baseline TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			size INTEGER,
+			mtime INTEGER,
+			PRIMARY KEY (root_id, baseline, filename)
+		)`,
+	}},
+	{16, "identify each run", []string{
+		"ALTER TABLE runs ADD COLUMN run_id TEXT",
+	}},
+	{17, "record findings and add reporting views", []string{
+		`CREATE TABLE findings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id TEXT NOT NULL,
+			root_id TEXT NOT NULL,
+			found_at INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			path TEXT,
+			stored_hash TEXT,
+			computed_hash TEXT,
+			message TEXT NOT NULL
+		)`,
+		"CREATE INDEX findings_run ON findings (run_id)",
+		// The views are for dashboards such as Grafana's SQLite data
+		// source: each has a time column in Unix seconds. A failed scan
+		// is counted from the totals, since statuses may be translated.
+		`CREATE VIEW report_runs AS
+			SELECT started_at AS time, run_id, hostname, root_id, status, finished_at - started_at AS duration,
+				changed + new + missing + errors + timed_out + expected AS findings,
+				changed, new, missing, errors, timed_out, expected, passed
+			FROM runs`,
+		`CREATE VIEW report_findings AS
+			SELECT findings.found_at AS time, findings.run_id, runs.hostname, findings.root_id, findings.kind,
+				findings.path, findings.stored_hash, findings.computed_hash, findings.message
+			FROM findings LEFT JOIN runs ON runs.run_id = findings.run_id`,
+		`CREATE VIEW report_daily AS
+			SELECT CAST(strftime('%s', date(started_at, 'unixepoch')) AS INTEGER) AS time, date(started_at, 'unixepoch') AS day,
+				hostname, root_id, COUNT(*) AS scans, SUM(changed + missing + errors + timed_out > 0) AS failed,
+				SUM(changed) AS changed, SUM(new) AS new, SUM(missing) AS missing, SUM(errors) AS errors,
+				SUM(timed_out) AS timed_out, SUM(expected) AS expected, SUM(passed) AS passed
+			FROM runs GROUP BY day, hostname, root_id`,
+		`CREATE VIEW report_daily_kinds AS
+			SELECT CAST(strftime('%s', date(found_at, 'unixepoch')) AS INTEGER) AS time, date(found_at, 'unixepoch') AS day,
+				root_id, kind, COUNT(*) AS findings
+			FROM findings GROUP BY day, root_id, kind`,
+	}},
+	{18, "record notification delivery", []string{
+		"ALTER TABLE runs ADD COLUMN notification TEXT",
+		"DROP VIEW report_runs",
+		`CREATE VIEW report_runs AS
+			SELECT started_at AS time, run_id, hostname, root_id, status, finished_at - started_at AS duration,
+				changed + new + missing + errors + timed_out + expected AS findings,
+				changed, new, missing, errors, timed_out, expected, passed, notification
+			FROM runs`,
+	}},
+	{19, "resolve findings", []string{
+		"ALTER TABLE findings ADD COLUMN status TEXT NOT NULL DEFAULT 'open'",
+		"ALTER TABLE findings ADD COLUMN status_by TEXT",
+		"ALTER TABLE findings ADD COLUMN status_at INTEGER",
+		"ALTER TABLE findings ADD COLUMN note TEXT",
+		"CREATE INDEX findings_status ON findings (root_id, status)",
+	}},
+	{20, "remember filed tickets", []string{
+		`CREATE TABLE tickets (
+			system TEXT NOT NULL,
+			root_id TEXT NOT NULL,
+			directory TEXT NOT NULL,
+			ticket TEXT NOT NULL,
+			opened_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (system, root_id, directory)
+		)`,
+		`CREATE TABLE ticket_findings (
+			system TEXT NOT NULL,
+			root_id TEXT NOT NULL,
+			path TEXT NOT NULL,
+			computed_hash TEXT NOT NULL,
+			ticket TEXT NOT NULL,
+			PRIMARY KEY (system, root_id, path, computed_hash)
+		)`,
+	}},
+	{21, "remember open on-call alerts", []string{`
+	CREATE TABLE pages (
+		service TEXT NOT NULL,
+		root_id TEXT NOT NULL,
+		path TEXT NOT NULL,
+		dedup_key TEXT NOT NULL,
+		opened_at INTEGER NOT NULL,
+		PRIMARY KEY (service, root_id, path)
+	);
+	`}},
+	{22, "record macOS Gatekeeper attributes", []string{
+		"ALTER TABLE file_hashes ADD COLUMN gatekeeper TEXT",
+	}},
+	{23, "record setuid, setgid and file capabilities", []string{
+		"ALTER TABLE file_hashes ADD COLUMN privileges TEXT",
+	}},
+	{24, "record each file's device and inode", []string{
+		"ALTER TABLE file_hashes ADD COLUMN file_id TEXT",
+	}},
+	{25, "record the verification tier of runs", []string{
+		"ALTER TABLE runs ADD COLUMN tier TEXT",
+		"DROP VIEW report_runs",
+		`CREATE VIEW report_runs AS
+			SELECT started_at AS time, run_id, hostname, root_id, status, finished_at - started_at AS duration,
+				changed + new + missing + errors + timed_out + expected AS findings,
+				changed, new, missing, errors, timed_out, expected, passed, notification, tier
+			FROM runs`,
+	}},
+	{26, "record the files runs left pending", []string{
+		"ALTER TABLE runs ADD COLUMN pending INTEGER",
+		"DROP VIEW report_runs",
+		`CREATE VIEW report_runs AS
+			SELECT started_at AS time, run_id, hostname, root_id, status, finished_at - started_at AS duration,
+				changed + new + missing + errors + timed_out + expected AS findings,
+				changed, new, missing, errors, timed_out, expected, passed, notification, tier, pending
+			FROM runs`,
+	}},
+	{27, "hold changes to approvers in changesets", []string{
+		"ALTER TABLE changesets ADD COLUMN action TEXT",
+		"ALTER TABLE changesets ADD COLUMN action_approver TEXT",
+		"ALTER TABLE changesets ADD COLUMN action_key TEXT",
+	}},
+	{28, "remember the deployment manifests applied", []string{
+		`CREATE TABLE applied_manifests (
+			root_id TEXT NOT NULL,
+			signature_hash TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			applied_at INTEGER NOT NULL,
+			PRIMARY KEY (root_id, signature_hash)
+		)`,
+	}},
+}
+
+// expectedSchema lists the columns each table must have for the database to
+// be usable by this version of gohash.
+var expectedSchema = map[string][]string{
+	"schema_version": {"version"},
+	"roots":          {"root_id", "path_policy", "hash_algo", "require_approval", "change_journal"},
+	"file_hashes":    {"root_id", "filename", "hash", "size", "mtime", "last_verified", "last_seen", "entropy", "content_type", "quick_hash", "full_verified", "gatekeeper", "privileges", "file_id"},
+	"runs": {"id", "hostname", "root", "root_id", "database", "version", "started_at", "finished_at",
+		"status", "changed", "new", "missing", "errors", "timed_out", "expected", "passed", "run_id", "notification", "tier", "pending"},
+	"approvers": {"name", "public_key"},
+	"changesets": {"id", "root_id", "requested_by", "reason", "created_at", "requester_signature", "status",
+		"approved_by", "approved_at", "approver_signature", "action", "action_approver", "action_key"},
+	"changeset_entries": {"changeset_id", "filename", "hash", "size", "mtime"},
+	"applied_manifests": {"root_id", "signature_hash", "created_at", "applied_at"},
+	"baseline_audit":    {"id", "at", "actor", "action", "root_id", "filename", "old_hash", "new_hash", "reason"},
+	"baselines":         {"root_id", "name", "created_at", "created_by", "note", "files"},
+	"baseline_files":    {"root_id", "baseline", "filename", "hash", "size", "mtime"},
+	"findings": {"id", "run_id", "root_id", "found_at", "kind", "path", "stored_hash", "computed_hash",
+		"message", "status", "status_by", "status_at", "note"},
+	"report_runs": {"time", "run_id", "hostname", "root_id", "status", "duration", "findings", "changed",
+		"new", "missing", "errors", "timed_out", "expected", "passed", "notification", "tier", "pending"},
+	"report_findings": {"time", "run_id", "hostname", "root_id", "kind", "path", "stored_hash", "computed_hash",
+		"message"},
+	"report_daily": {"time", "day", "hostname", "root_id", "scans", "failed", "changed", "new", "missing",
+		"errors", "timed_out", "expected", "passed"},
+	"report_daily_kinds": {"time", "day", "root_id", "kind", "findings"},
+	"tickets":            {"system", "root_id", "directory", "ticket", "opened_at", "updated_at"},
+	"ticket_findings":    {"system", "root_id", "path", "computed_hash", "ticket"},
+	"pages":              {"service", "root_id", "path", "dedup_key", "opened_at"},
+}
+
+// openDatabase opens the SQLite baseline at databasePath, creating or
+// upgrading the schema as needed.
+func openDatabase(databasePath string) (*sql.DB, error) {
+	seal, err := checkSeal(databasePath)
+	if err != nil {
+		return nil, fmt.Errorf("checking the database seal: %w", err)
+	}
+	db, err := sql.Open("sqlite", databasePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	trackSeal(db, databasePath, seal)
+
+	err = migrateDatabase(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+	return db, nil
+}
+
+// openDatabaseReadOnly opens an existing baseline so that SQLite itself
+// refuses any write, for verifying without being able to modify it. The
+// schema is not upgraded, so it must already be current.
+func openDatabaseReadOnly(databasePath string) (*sql.DB, error) {
+	if _, err := os.Stat(databasePath); err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	// Nothing is written, so the seal is only checked.
+	if _, err := checkSeal(databasePath); err != nil {
+		return nil, fmt.Errorf("checking the database seal: %w", err)
+	}
+	escape := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+	db, err := sql.Open("sqlite", "file:"+escape.Replace(filepath.ToSlash(databasePath))+"?mode=ro&_pragma=query_only(1)")
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	latest := migrations[len(migrations)-1].version
+	if version != latest {
+		db.Close()
+		return nil, fmt.Errorf("opening database: schema version %d is not the current version %d; run once without -read-only to upgrade it", version, latest)
+	}
+	return db, nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// migrateDatabase applies every migration newer than the database's schema
+// version, each in its own transaction.
+func migrateDatabase(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return fmt.Errorf("schema version %d is newer than this gohash supports (%d)", version, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range m.statements {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+			}
+		}
+		_, err = tx.Exec("DELETE FROM schema_version")
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (?)", m.version)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootRecordCount returns the number of records stored under rootID.
+func rootRecordCount(db *sql.DB, rootID string) (int, error) {
+	var records int
+	err := db.QueryRow("SELECT COUNT(*) FROM file_hashes WHERE root_id = ?", rootID).Scan(&records)
+	return records, err
+}
+
+// adoptLegacyRecords moves records stored with full paths before root IDs
+// existed under rootID, rewriting them relative to rootDirectory. It returns
+// the number of records adopted.
+func adoptLegacyRecords(db *sql.DB, rootDirectory, rootID string) (int, error) {
+	rows, err := db.Query("SELECT filename FROM file_hashes WHERE root_id = ''")
+	if err != nil {
+		return 0, err
+	}
+	var legacy []string
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy = append(legacy, filename)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(legacy) == 0 {
+		return 0, err
+	}
+
+	absRoot, err := filepath.Abs(rootDirectory)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	adopted := 0
+	for _, filename := range legacy {
+		// Legacy paths were joined onto the root as given on the command
+		// line, which may have been relative to another working directory.
+		rel, err := recordPath(filepath.Clean(rootDirectory), filepath.Clean(filename))
+		if err != nil {
+			absPath, absErr := filepath.Abs(filename)
+			if absErr != nil {
+				continue
+			}
+			rel, err = recordPath(absRoot, absPath)
+			if err != nil {
+				continue
+			}
+		}
+
+		result, err := tx.Exec("UPDATE OR IGNORE file_hashes SET root_id = ?, filename = ? WHERE root_id = '' AND filename = ?",
+			rootID, dbPath(rel), dbPath(filename))
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		changed, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		adopted += int(changed)
+	}
+	return adopted, tx.Commit()
+}
+
+func closeDatabase(db *sql.DB) {
+	err := db.Close()
+	if err != nil {
+		log.Fatalf("Error closing the database: %v", err)
+	}
+	if databasePath, seal, ok := untrackSeal(db); ok {
+		err = writeSeal(databasePath, seal)
+		if err != nil {
+			log.Fatalf("Error sealing the database: %v", err)
+		}
+	}
+}
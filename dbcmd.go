@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+func runDB(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s db vacuum database_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s db check database_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s db backup [options] database_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s db seal|unseal [options] database_path\n", programName)
+	}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "vacuum":
+		runDBVacuum(arguments[1:])
+	case "check":
+		runDBCheck(arguments[1:])
+	case "backup":
+		runDBBackup(arguments[1:])
+	case "seal", "unseal":
+		runDBSeal(arguments[0], arguments[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// openExistingDatabase opens a database for maintenance, refusing to create
+// an empty one when the path is wrong.
+func openExistingDatabase(flags *flag.FlagSet) *sql.DB {
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath := flags.Arg(0)
+	if _, err := os.Stat(databasePath); err != nil {
+		log.Fatalf("Error reading the database: %v", err)
+	}
+	seal, err := checkSeal(databasePath)
+	if err != nil {
+		log.Fatalf("Error checking the database seal: %v", err)
+	}
+	db, err := sql.Open("sqlite", databasePath)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	trackSeal(db, databasePath, seal)
+	return db
+}
+
+func runDBVacuum(arguments []string) {
+	flags := flag.NewFlagSet("db vacuum", flag.ExitOnError)
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	parseFlags(flags, arguments)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// The lock is taken first so that it is still held while closing the
+	// database reseals it.
+	lock, err := acquireRunLock(flags.Arg(0), *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+
+	sizeBefore := databaseSize(flags.Arg(0))
+	_, err = db.Exec("VACUUM")
+	if err != nil {
+		log.Fatalf("Error vacuuming the database: %v", err)
+	}
+	fmt.Printf("Vacuumed %s: %d bytes -> %d bytes\n", flags.Arg(0), sizeBefore, databaseSize(flags.Arg(0)))
+}
+
+func runDBCheck(arguments []string) {
+	flags := flag.NewFlagSet("db check", flag.ExitOnError)
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	parseFlags(flags, arguments)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// As with vacuum, the lock is held while closing the database reseals
+	// it.
+	lock, err := acquireRunLock(flags.Arg(0), *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+
+	problems, err := checkDatabase(db)
+	if err != nil {
+		log.Fatalf("Error checking the database: %v", err)
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", flags.Arg(0))
+}
+
+// checkDatabase runs SQLite's own integrity check and verifies the tables
+// gohash relies on, returning a description of every problem found.
+func checkDatabase(db *sql.DB) ([]string, error) {
+	var problems []string
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, "integrity: "+line)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for table, columns := range expectedSchema {
+		existing, err := tableColumns(db, table)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) == 0 {
+			problems = append(problems, fmt.Sprintf("schema: table %s is missing", table))
+			continue
+		}
+		for _, column := range columns {
+			if !existing[column] {
+				problems = append(problems, fmt.Sprintf("schema: table %s has no column %s", table, column))
+			}
+		}
+	}
+	return problems, nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+func runDBBackup(arguments []string) {
+	flags := flag.NewFlagSet("db backup", flag.ExitOnError)
+	directory := flags.String("dir", "", "directory for the backup (default: next to the database)")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s db backup [options] database_path\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	lock, err := acquireRunLock(flags.Arg(0), *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+
+	databasePath := flags.Arg(0)
+	backupDirectory := *directory
+	if backupDirectory == "" {
+		backupDirectory = filepath.Dir(databasePath)
+	}
+	base := filepath.Base(databasePath)
+	extension := filepath.Ext(base)
+	backupPath := filepath.Join(backupDirectory,
+		fmt.Sprintf("%s-%s%s", strings.TrimSuffix(base, extension), time.Now().Format("20060102-150405"), extension))
+
+	err = backupDatabase(db, backupPath)
+	if err != nil {
+		log.Fatalf("Error backing up the database: %v", err)
+	}
+	fmt.Printf("Backed up %s to %s\n", databasePath, backupPath)
+}
+
+// backupDatabase copies db to backupPath using SQLite's online backup API,
+// so concurrent scans can keep writing while the copy is taken.
+func backupDatabase(db *sql.DB, backupPath string) error {
+	if _, err := os.Stat(backupPath); err == nil {
+		return fmt.Errorf("%s already exists", backupPath)
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		backuper, ok := driverConn.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("the SQLite driver does not support online backups")
+		}
+		backup, err := backuper.NewBackup(backupPath)
+		if err != nil {
+			return err
+		}
+		for more := true; more; {
+			more, err = backup.Step(256)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+		}
+		return backup.Finish()
+	})
+}
+
+// runDBSeal seals a database as it is now, or stops sealing it.
+func runDBSeal(action string, arguments []string) {
+	flags := flag.NewFlagSet("db "+action, flag.ExitOnError)
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s db %s [options] database_path\n", os.Args[0], action)
+		fmt.Fprintf(flags.Output(), "With GOHASH_DB_SEAL_KEY set to a key file, seal uses an HMAC with that key; without one, the SHA-256 seal only\n")
+		fmt.Fprintf(flags.Output(), "catches edits by someone unaware of it, since whoever can write the database can recompute it.\n")
+		fmt.Fprintf(flags.Output(), "A sealed database is listed in the seal registry, %s, so deleting its seal doesn't go unnoticed.\n", sealRegistryPath())
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath := flags.Arg(0)
+	if _, err := os.Stat(databasePath); err != nil {
+		log.Fatalf("Error reading the database: %v", err)
+	}
+	lock, err := acquireRunLock(databasePath, *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+
+	if action == "unseal" {
+		err = registerSeal(databasePath, false)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		err = os.Remove(sealPath(databasePath))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Error removing the seal: %v", err)
+		}
+		fmt.Printf("Removed the seal of %s\n", databasePath)
+		if required, _ := sealRequired(databasePath); required != "" {
+			fmt.Printf("It will be refused until it is sealed again, as long as %s\n", required)
+		}
+		return
+	}
+	algo := sealAlgorithm()
+	err = writeSeal(databasePath, algo)
+	if err == nil {
+		err = registerSeal(databasePath, true)
+	}
+	if err != nil {
+		log.Fatalf("Error sealing the database: %v", err)
+	}
+	fmt.Printf("Sealed %s with %s\n", databasePath, algo)
+	if algo == SealSHA256 {
+		fmt.Printf("Without GOHASH_DB_SEAL_KEY, whoever can write the database can recompute its seal\n")
+	}
+}
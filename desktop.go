@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Desktop notifications are shown with what each platform already has:
+// notify-send on Linux and the BSDs, osascript on macOS and PowerShell on
+// Windows, so gohash needs no GUI toolkit. They only appear when the daemon
+// runs in the user's desktop session, e.g. started at login, not as a
+// system service.
+
+// desktopTimeout bounds how long showing a notification may take.
+const desktopTimeout = 30 * time.Second
+
+// windowsBalloon shows a balloon notification from a tray icon, which
+// PowerShell can do without any module. The icon has to stay until the
+// balloon has been seen.
+const windowsBalloon = `Add-Type -AssemblyName System.Windows.Forms
+$icon = New-Object System.Windows.Forms.NotifyIcon
+$icon.Icon = [System.Drawing.SystemIcons]::Warning
+$icon.Visible = $true
+$icon.ShowBalloonTip(10000, $env:GOHASH_NOTIFY_TITLE, $env:GOHASH_NOTIFY_BODY, $env:GOHASH_NOTIFY_LEVEL)
+Start-Sleep -Seconds 10
+$icon.Dispose()`
+
+// desktopCommand returns the command that shows a notification on this
+// platform.
+func desktopCommand(title, body string, urgent bool) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		// The text is passed as arguments, so it needs no quoting.
+		return exec.Command("osascript", "-e", "on run argv", "-e", "display notification (item 2 of argv) with title (item 1 of argv)", "-e", "end run",
+			title, body)
+	case "windows":
+		level := "Info"
+		if urgent {
+			level = "Warning"
+		}
+		cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsBalloon)
+		cmd.Env = append(os.Environ(), "GOHASH_NOTIFY_TITLE="+title, "GOHASH_NOTIFY_BODY="+body, "GOHASH_NOTIFY_LEVEL="+level)
+		return cmd
+	}
+	urgency := "normal"
+	if urgent {
+		urgency = "critical"
+	}
+	return exec.Command("notify-send", "--app-name=gohash", "--urgency="+urgency, "--", title, body)
+}
+
+// checkDesktop checks that this platform's notifier can be run.
+func checkDesktop() error {
+	program := desktopCommand("", "", false).Path
+	_, err := exec.LookPath(program)
+	if err != nil {
+		return fmt.Errorf("desktop notifications need %s: %v", program, err)
+	}
+	return nil
+}
+
+// showDesktop pops up a desktop notification.
+func showDesktop(title, body string, urgent bool) error {
+	cmd := desktopCommand(title, body, urgent)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(desktopTimeout):
+		cmd.Process.Kill()
+		return errors.New("showing the desktop notification timed out")
+	}
+	if err != nil {
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return fmt.Errorf("%v: %s", err, detail)
+		}
+		return err
+	}
+	return nil
+}
+
+// notifyDesktop shows one notification summing up the reports, pointing
+// at the findings in the database, unless it is "", for the details an
+// email would carry.
+func notifyDesktop(databasePath string, reports []*scanReport) error {
+	data := newReportData(reports)
+	body := trf("%d findings in %s on %s.", data.Findings(), displayPath(data.Root), data.Hostname)
+	if data.Findings() == 0 && data.Baselined > 0 {
+		body = trf("Recorded the baseline of %d files in %s on %s.", data.Baselined, displayPath(data.Root), data.Hostname)
+	} else if databasePath != "" {
+		body += " " + trf("Run %s findings list %s for the details.", os.Args[0], databasePath)
+	}
+	return showDesktop("gohash: "+data.Status, body, data.Urgent())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanProgress tracks what a running scan is doing, for the progress dump.
+type scanProgress struct {
+	started  time.Time
+	queued   atomic.Int64
+	hashed   atomic.Int64
+	bytes    atomic.Int64
+	findings atomic.Int64
+
+	mu       sync.Mutex
+	inFlight map[string]time.Time
+}
+
+func newScanProgress() *scanProgress {
+	return &scanProgress{started: time.Now(), inFlight: make(map[string]time.Time)}
+}
+
+func (p *scanProgress) startFile(filePath string) {
+	p.mu.Lock()
+	p.inFlight[filePath] = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) finishFile(filePath string, size int64) {
+	p.mu.Lock()
+	delete(p.inFlight, filePath)
+	p.mu.Unlock()
+	p.hashed.Add(1)
+	p.bytes.Add(size)
+}
+
+// dump writes the scan's counters, the files currently being hashed (oldest
+// first, which is where a hung network filesystem shows up) and runtime stats.
+func (p *scanProgress) dump(w io.Writer) {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	fmt.Fprintf(w, "gohash progress after %s: %d files queued, %d hashed (%d bytes), %d findings\n",
+		time.Since(p.started).Round(time.Second), p.queued.Load(), p.hashed.Load(), p.bytes.Load(), p.findings.Load())
+	fmt.Fprintf(w, "runtime: %d goroutines, %d bytes heap in use, %d GC cycles\n",
+		runtime.NumGoroutine(), memory.HeapInuse, memory.NumGC)
+
+	p.mu.Lock()
+	type inFlightFile struct {
+		path  string
+		since time.Time
+	}
+	files := make([]inFlightFile, 0, len(p.inFlight))
+	for path, since := range p.inFlight {
+		files = append(files, inFlightFile{path, since})
+	}
+	p.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].since.Before(files[j].since)
+	})
+	for _, file := range files {
+		fmt.Fprintf(w, "  hashing for %s: %s\n", time.Since(file.since).Round(time.Millisecond), displayPath(file.path))
+	}
+}
+
+// dumpProgressOnSignal writes p to stderr whenever the progress signal
+// (SIGUSR1) is received, until stop is closed.
+func dumpProgressOnSignal(p *scanProgress, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	if !notifyProgressSignal(signals) {
+		return
+	}
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				p.dump(os.Stderr)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// servePprof exposes the net/http/pprof handlers on addr, which must be a
+// loopback address: profiles reveal file paths and memory contents.
+func servePprof(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("%s is not a loopback address", addr)
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the bytes of the volume holding dir that are available
+// to this user, which a quota may make less than the volume's free space.
+func freeSpace(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	err = windows.GetDiskFreeSpaceEx(path, &available, &total, &free)
+	if err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathRules are patterns matched against paths relative to the root, with
+// path.Match syntax. A pattern without a slash matches a file or directory
+// name anywhere, e.g. "*.log"; one with a slash matches a path from the
+// root, e.g. "var/spool/*". A match on a directory covers everything in it.
+type pathRules []string
+
+// checkPathRules reports the first malformed pattern.
+func checkPathRules(rules []string) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule, ""); err != nil || rule == "" {
+			return fmt.Errorf("bad path pattern %q", rule)
+		}
+	}
+	return nil
+}
+
+// normalized returns the rules matched the way policy matches paths.
+func (r pathRules) normalized(policy string) pathRules {
+	rules := make(pathRules, len(r))
+	for i, rule := range r {
+		rules[i] = normalizePath(policy, strings.Trim(rule, "/"))
+	}
+	return rules
+}
+
+// match reports whether rel, or a directory it is in, matches a rule.
+func (r pathRules) match(rel string) bool {
+	for _, rule := range r {
+		anywhere := !strings.Contains(rule, "/")
+		for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			name := p
+			if anywhere {
+				name = path.Base(p)
+			}
+			if ok, _ := path.Match(rule, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
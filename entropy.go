@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"math"
+	"os"
+)
+
+// Entropy is estimated from the start of each file: ransomware that only
+// encrypts the first part of large files still shows there.
+const (
+	entropySample = 1 << 20
+	// Files smaller than this have too few bytes for a useful estimate.
+	minEntropySize = 1024
+	// Text, documents and databases stay below lowEntropy bits per byte;
+	// encrypted data is close to 8.
+	lowEntropy  = 6.0
+	highEntropy = 7.5
+)
+
+// fileEntropy estimates the Shannon entropy of filePath in bits per byte.
+func fileEntropy(filePath string) (float64, error) {
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 64<<10)
+	var counts [256]int64
+	var total int64
+	reader := io.LimitReader(throttled(file), entropySample)
+	for {
+		n, err := reader.Read(buffer)
+		for _, b := range buffer[:n] {
+			counts[b]++
+		}
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy, nil
+}
+
+// looksEncrypted reports whether a file's entropy went from that of
+// ordinary content to that of encrypted data.
+func looksEncrypted(stored, now sql.NullFloat64) bool {
+	return stored.Valid && now.Valid && stored.Float64 < lowEntropy && now.Float64 > highEntropy
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Every flag can be set with a GOHASH_ environment variable named after
+// it, e.g. GOHASH_SMTP_SERVER for -smtp-server. The daemon's profile keys
+// use the same names, so one variable covers both, and
+// GOHASH_PROFILE_<NAME>_<KEY> sets a key of a single profile. The command
+// line beats the environment, which beats the configuration file.
+
+// envName returns the variable for a flag or key, e.g. smtp-server or
+// smtpServer.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString("GOHASH_")
+	afterLower := false
+	for _, r := range name {
+		switch {
+		case unicode.IsUpper(r):
+			if afterLower {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		default:
+			b.WriteByte('_')
+		}
+		afterLower = unicode.IsLower(r) || unicode.IsDigit(r)
+	}
+	return b.String()
+}
+
+// parseFlags sets flags from the environment and then parses arguments.
+func parseFlags(flags *flag.FlagSet, arguments []string) {
+	flags.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		err := flags.Set(f.Name, value)
+		if err != nil {
+			log.Fatalf("Error parsing %s: %v", name, err)
+		}
+	})
+	flags.Parse(arguments)
+}
+
+// applyProfileEnvironment overrides the keys of a profile that are set in
+// the environment, first for every profile and then for this one.
+func applyProfileEnvironment(profile *profileConfig) error {
+	value := reflect.ValueOf(profile).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		key := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if key == "name" {
+			continue
+		}
+		for _, name := range []string{envName(key), envName("profile-" + profile.Name + "-" + key)} {
+			text, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			err := setFromEnvironment(value.Field(i), text)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setFromEnvironment decodes text into field as the configuration file
+// would, writing lists as comma-separated values.
+func setFromEnvironment(field reflect.Value, text string) error {
+	var encoded []byte
+	switch field.Kind() {
+	case reflect.Bool, reflect.Int:
+		encoded = []byte(text)
+	case reflect.Slice:
+		encoded, _ = json.Marshal(parseRecipients(text))
+	default:
+		encoded, _ = json.Marshal(text)
+	}
+	return json.Unmarshal(encoded, field.Addr().Interface())
+}
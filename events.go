@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Event sinks a fleet's scan events can be streamed to. NATS is spoken to
+// directly; Kafka through a Kafka REST Proxy, which keeps gohash free of a
+// Kafka client. Credentials come from the environment: NATS_TOKEN, or
+// NATS_USER and NATS_PASSWORD, and for the proxy KAFKA_USER and
+// KAFKA_PASSWORD, if it wants basic authentication.
+const (
+	SinkNATS  = "nats"
+	SinkKafka = "kafka"
+)
+
+// sinkSecrets lists the optional credentials each sink reads from the
+// environment.
+var sinkSecrets = map[string][]string{
+	SinkNATS:  {"NATS_TOKEN", "NATS_USER", "NATS_PASSWORD"},
+	SinkKafka: {"KAFKA_USER", "KAFKA_PASSWORD"},
+}
+
+// sinkTimeout bounds each exchange with the sink.
+const sinkTimeout = 30 * time.Second
+
+// kafkaBatch is the most records sent to the REST proxy in one request.
+const kafkaBatch = 100
+
+// sinkOptions selects the event sink. Every event is one JSON object, the
+// same as a line of -stream ndjson: a finding event for each finding, then
+// the run's summary. NATS events are published to <subject>.<host>, Kafka
+// records to the topic <subject>, keyed by host so each host's events stay
+// in order.
+type sinkOptions struct {
+	Sink string
+	// URL is nats://host:port, or tls://host:port, of a NATS server, or the
+	// http(s) base URL of the Kafka REST Proxy.
+	URL     string
+	Subject string
+}
+
+func (o *sinkOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.Sink, "event-sink", "", "publish findings and the run summary as JSON events to nats or kafka, the latter through a Kafka REST Proxy (default: off)")
+	flags.StringVar(&o.URL, "event-url", "", "NATS server as nats://host:4222 or tls://host:4222, or base URL of the Kafka REST Proxy, e.g. https://kafka-rest:8082")
+	flags.StringVar(&o.Subject, "event-subject", "gohash.events", "NATS subject, suffixed with .<host>, or Kafka topic the events are published to")
+}
+
+// checkSinkOptions validates the event sink settings, if a sink is set.
+func checkSinkOptions(options sinkOptions) error {
+	var schemes []string
+	switch options.Sink {
+	case "":
+		return nil
+	case SinkNATS:
+		schemes = []string{"nats", "tls"}
+	case SinkKafka:
+		schemes = []string{"http", "https"}
+	default:
+		return fmt.Errorf("unknown event sink %q", options.Sink)
+	}
+	parsed, err := url.Parse(options.URL)
+	if err != nil || (parsed.Scheme != schemes[0] && parsed.Scheme != schemes[1]) || parsed.Host == "" {
+		return fmt.Errorf("-event-url must be a %s:// or %s:// URL for %s, not %q", schemes[0], schemes[1], options.Sink, options.URL)
+	}
+	if options.Subject == "" || strings.ContainsAny(options.Subject, " \t\r\n*>") {
+		return fmt.Errorf("-event-subject %q isn't a valid subject", options.Subject)
+	}
+	return nil
+}
+
+// publishEvents sends the report's events to the sink.
+func publishEvents(report *scanReport, options sinkOptions) error {
+	switch options.Sink {
+	case SinkNATS:
+		return publishNATS(report, options)
+	case SinkKafka:
+		return publishKafka(report, options)
+	}
+	return nil
+}
+
+// publishNATS publishes each event as a NATS message, then round-trips a
+// PING so that a message the server rejected is reported.
+func publishNATS(report *scanReport, options sinkOptions) error {
+	parsed, err := url.Parse(options.URL)
+	if err != nil {
+		return err
+	}
+	address := parsed.Host
+	if parsed.Port() == "" {
+		address = net.JoinHostPort(parsed.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", address, sinkTimeout)
+	if err != nil {
+		return fmt.Errorf("connecting to NATS: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sinkTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading the NATS server's INFO: %v", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("not a NATS server: %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if err != nil {
+		return fmt.Errorf("parsing the NATS server's INFO: %v", err)
+	}
+	if parsed.Scheme == "tls" || info.TLSRequired {
+		// NATS upgrades the connection to TLS after its INFO.
+		secure := tls.Client(conn, &tls.Config{ServerName: parsed.Hostname()})
+		err = secure.Handshake()
+		if err != nil {
+			return fmt.Errorf("connecting to NATS: %v", err)
+		}
+		conn = secure
+		reader = bufio.NewReader(conn)
+	}
+
+	connect := map[string]any{"verbose": false, "pedantic": false, "name": "gohash", "lang": "go", "protocol": 1}
+	if token := os.Getenv("NATS_TOKEN"); token != "" {
+		connect["auth_token"] = token
+	} else if user := os.Getenv("NATS_USER"); user != "" {
+		connect["user"] = user
+		connect["pass"] = os.Getenv("NATS_PASSWORD")
+	}
+	data, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\n", data)
+
+	subject := options.Subject + "." + natsToken(report.Run.Hostname)
+	err = reportEvents(report, func(event *streamEvent) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(sinkTimeout))
+		fmt.Fprintf(writer, "PUB %s %d\r\n", subject, len(payload))
+		writer.Write(payload)
+		_, err = writer.WriteString("\r\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writer.WriteString("PING\r\n")
+	conn.SetDeadline(time.Now().Add(sinkTimeout))
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("publishing to NATS: %v", err)
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("publishing to NATS: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// INFO updates and +OK are of no interest.
+	}
+}
+
+// natsToken makes name usable as one token of a subject.
+func natsToken(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || r <= ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// kafkaRecord is a record of the REST Proxy's JSON embedded format.
+type kafkaRecord struct {
+	Key   string       `json:"key"`
+	Value *streamEvent `json:"value"`
+}
+
+// publishKafka produces each event as a record through the REST Proxy, in
+// batches.
+func publishKafka(report *scanReport, options sinkOptions) error {
+	endpoint := strings.TrimSuffix(options.URL, "/") + "/topics/" + url.PathEscape(options.Subject)
+	var batch []kafkaRecord
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		data, err := json.Marshal(map[string]any{"records": batch})
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+		req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+		if user := os.Getenv("KAFKA_USER"); user != "" {
+			req.SetBasicAuth(user, os.Getenv("KAFKA_PASSWORD"))
+		}
+		var produced struct {
+			Offsets []struct {
+				ErrorCode *int   `json:"error_code"`
+				Error     string `json:"error"`
+			} `json:"offsets"`
+		}
+		err = doAPI(req, &produced)
+		if err != nil {
+			return fmt.Errorf("producing to Kafka: %v", err)
+		}
+		for _, offset := range produced.Offsets {
+			if offset.ErrorCode != nil && *offset.ErrorCode != 0 {
+				return fmt.Errorf("producing to Kafka: %s", offset.Error)
+			}
+		}
+		return nil
+	}
+	err := reportEvents(report, func(event *streamEvent) error {
+		batch = append(batch, kafkaRecord{Key: report.Run.Hostname, Value: event})
+		if len(batch) < kafkaBatch {
+			return nil
+		}
+		return send()
+	})
+	if err != nil {
+		return err
+	}
+	return send()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// FindingRun marks the evidence log entry that closes a scan, so even a scan
+// without findings extends the chain.
+const FindingRun = "run"
+
+// genesisHash is the previous hash of the first entry in an evidence log.
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// evidenceEntry is one line of an evidence log. Hash covers the entry's
+// encoding without Hash, which includes Prev, so changing, removing or
+// reordering any entry breaks every hash after it.
+type evidenceEntry struct {
+	Seq          int64  `json:"seq"`
+	Time         string `json:"time"`
+	Host         string `json:"host"`
+	RootID       string `json:"rootId"`
+	RunID        string `json:"runId,omitempty"`
+	Kind         string `json:"kind"`
+	Path         string `json:"path,omitempty"`
+	StoredHash   string `json:"storedHash,omitempty"`
+	ComputedHash string `json:"computedHash,omitempty"`
+	Message      string `json:"message"`
+	Prev         string `json:"prev"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// seal sets the entry's hash and returns its encoding.
+func (e *evidenceEntry) seal() ([]byte, error) {
+	e.Hash = ""
+	unsealed, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(unsealed)
+	e.Hash = hex.EncodeToString(sum[:])
+	return json.Marshal(e)
+}
+
+// evidenceLog appends findings to a hash-chained log file. The file is
+// locked while a scan writes to it, so scans sharing a log take turns.
+type evidenceLog struct {
+	file *os.File
+	run  runInfo
+	seq  int64
+	head string
+}
+
+// openEvidenceLog opens or creates the log at path and picks up the chain
+// from its last entry, which is checked first.
+func openEvidenceLog(path string, run runInfo) (*evidenceLog, error) {
+	file, err := os.OpenFile(longPath(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = tryLockFile(file)
+		if !errors.Is(err, errLockHeld) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking %s: %v", path, err)
+	}
+
+	l := &evidenceLog{file: file, run: run, head: genesisHash}
+	line, err := lastLine(file)
+	if err == nil && len(line) > 0 {
+		var last evidenceEntry
+		last, err = checkEvidenceEntry(line, "")
+		l.seq, l.head = last.Seq, last.Hash
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("reading the last entry of %s: %v; check it with gohash evidence verify", path, err)
+	}
+	return l, nil
+}
+
+// Append adds finding to the chain.
+func (l *evidenceLog) Append(finding Finding) error {
+	entry := evidenceEntry{
+		Seq:          l.seq + 1,
+		Time:         time.Now().UTC().Format(time.RFC3339Nano),
+		Host:         l.run.Hostname,
+		RootID:       displayPath(l.run.RootID),
+		RunID:        l.run.RunID,
+		Kind:         finding.Kind,
+		StoredHash:   finding.StoredHash,
+		ComputedHash: finding.ComputedHash,
+		Message:      finding.Message,
+		Prev:         l.head,
+	}
+	if finding.FilePath != "" {
+		entry.Path = displayPath(finding.FilePath)
+	}
+	encoded, err := entry.seal()
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(encoded, '\n'))
+	if err != nil {
+		return err
+	}
+	l.seq, l.head = entry.Seq, entry.Hash
+	return nil
+}
+
+// Head identifies the last entry written, for anchoring the chain somewhere
+// the log's owner can't rewrite.
+func (l *evidenceLog) Head() string {
+	return fmt.Sprintf("entry %d, sha256 %s", l.seq, l.head)
+}
+
+func (l *evidenceLog) Close() error {
+	err := l.file.Sync()
+	unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkEvidenceEntry parses one line of an evidence log and checks its hash
+// and, unless prev is empty, that it follows the entry hashed prev.
+func checkEvidenceEntry(line []byte, prev string) (evidenceEntry, error) {
+	var entry evidenceEntry
+	err := json.Unmarshal(line, &entry)
+	if err != nil {
+		return entry, err
+	}
+	stored := entry.Hash
+	encoded, err := entry.seal()
+	if err != nil {
+		return entry, err
+	}
+	// Anything but the exact encoding, such as an edit that keeps the
+	// parsed values, is rejected as well.
+	if entry.Hash != stored || !bytes.Equal(encoded, line) {
+		return entry, fmt.Errorf("entry %d doesn't match its hash", entry.Seq)
+	}
+	if prev != "" && entry.Prev != prev {
+		return entry, fmt.Errorf("entry %d doesn't follow the entry before it", entry.Seq)
+	}
+	return entry, nil
+}
+
+// lastLine returns the last line of file without its newline, reading
+// backwards from the end so a long log isn't read in full.
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	var line []byte
+	chunk := make([]byte, 4096)
+	for offset := end; offset > 0; {
+		n := int64(len(chunk))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		_, err = file.ReadAt(chunk[:n], offset)
+		if err != nil {
+			return nil, err
+		}
+		line = append(append([]byte(nil), chunk[:n]...), line...)
+		trimmed := bytes.TrimSuffix(line, []byte("\n"))
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		if offset == 0 {
+			return trimmed, nil
+		}
+	}
+	return nil, nil
+}
+
+func runEvidence(arguments []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s evidence verify|head log_path\n", os.Args[0])
+	}
+	if len(arguments) != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "verify":
+		file, err := os.Open(longPath(arguments[1]))
+		if err != nil {
+			log.Fatalf("Error reading the evidence log: %v", err)
+		}
+		defer file.Close()
+		entries, head, err := verifyEvidenceLog(file)
+		if err != nil {
+			log.Fatalf("Error verifying %s: %v", arguments[1], err)
+		}
+		fmt.Printf("%d entries, chain intact\nHead: entry %d, sha256 %s\n", entries, entries, head)
+	case "head":
+		file, err := os.Open(longPath(arguments[1]))
+		if err != nil {
+			log.Fatalf("Error reading the evidence log: %v", err)
+		}
+		defer file.Close()
+		line, err := lastLine(file)
+		if err != nil {
+			log.Fatalf("Error reading the evidence log: %v", err)
+		}
+		if len(line) == 0 {
+			fmt.Printf("entry 0, sha256 %s\n", genesisHash)
+			return
+		}
+		last, err := checkEvidenceEntry(line, "")
+		if err != nil {
+			log.Fatalf("Error reading the last entry of %s: %v", arguments[1], err)
+		}
+		fmt.Printf("entry %d, sha256 %s\n", last.Seq, last.Hash)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// verifyEvidenceLog checks every entry of a log and its links, returning
+// the number of entries and the hash of the last one.
+func verifyEvidenceLog(r io.Reader) (int64, string, error) {
+	reader := bufio.NewReader(r)
+	var seq int64
+	head := genesisHash
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			return seq, head, nil
+		}
+		if err != nil && err != io.EOF {
+			return seq, head, err
+		}
+		if err == io.EOF {
+			return seq, head, fmt.Errorf("line %d is incomplete", seq+1)
+		}
+		entry, err := checkEvidenceEntry(bytes.TrimSuffix(line, []byte("\n")), head)
+		if err == nil && entry.Seq != seq+1 {
+			err = fmt.Errorf("entry %d is out of sequence", entry.Seq)
+		}
+		if err != nil {
+			return seq, head, fmt.Errorf("line %d: %v", seq+1, err)
+		}
+		seq, head = entry.Seq, entry.Hash
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errTimedOut is returned when a file could not be hashed within the
+// per-file timeout.
+var errTimedOut = errors.New("timed out")
+
+// fileOptions bounds how long a single file may take and how often
+// transient failures are retried.
+type fileOptions struct {
+	Timeout    time.Duration
+	Retries    int
+	RetryDelay time.Duration
+	// Backend is the hash backend, one of the Backend constants.
+	Backend string
+	// BackupRead opens files with backup semantics, on Windows, and reads
+	// those another process holds open exclusively from shadows.
+	BackupRead bool
+	shadows    *shadowCopies
+	// links, if set, hashes hard-linked files once.
+	links *linkedFiles
+	// cache, if set, hashes files seen under several roots once per run.
+	cache *hashCache
+}
+
+// hashFile stats and hashes filePath, retrying transient errors with
+// exponential backoff. Each attempt is abandoned after the timeout; a read
+// blocked in the kernel can't be interrupted, so the abandoned attempt
+// finishes (or hangs) in the background while the worker moves on.
+func hashFile(filePath, algo string, options fileOptions) (string, os.FileInfo, error) {
+	delay := options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		hash, info, err := hashFileOnce(filePath, algo, options)
+		if err == nil || attempt >= options.Retries || !isTransientError(err) {
+			return hash, info, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// hashContent hashes the content of filePath, with backup semantics if
+// BackupRead is set.
+func (o fileOptions) hashContent(filePath, algo string) (string, error) {
+	if !o.BackupRead {
+		return computeFileHashWith(filePath, algo, o.Backend)
+	}
+	file, err := openBackup(longPath(filePath))
+	if isSharingViolation(err) && o.shadows != nil {
+		// Not even backup semantics get past a file opened without
+		// sharing, but its shadow copy can be read.
+		shadow, shadowErr := o.shadows.path(filePath)
+		if shadowErr != nil {
+			return "", fmt.Errorf("%w, and reading it from a shadow copy failed: %v", err, shadowErr)
+		}
+		file, err = openBackup(longPath(shadow))
+	}
+	if err != nil {
+		return "", err
+	}
+	return hashOpenFile(file, algo, o.Backend)
+}
+
+func hashFileOnce(filePath, algo string, options fileOptions) (string, os.FileInfo, error) {
+	type outcome struct {
+		hash string
+		info os.FileInfo
+		err  error
+	}
+
+	done := make(chan outcome, 1)
+	go func() {
+		info, err := os.Stat(longPath(filePath))
+		if err != nil {
+			done <- outcome{err: fmt.Errorf("reading: %w", err)}
+			return
+		}
+		if !info.Mode().IsRegular() {
+			done <- outcome{info: info, err: fmt.Errorf("reading: %w (%s)", errSpecialFile, specialKind(info.Mode()))}
+			return
+		}
+		hash, err := options.cache.hash(info, algo, func() (string, error) {
+			return options.links.hash(info, func() (string, error) {
+				return options.hashContent(filePath, algo)
+			})
+		})
+		if err != nil {
+			err = fmt.Errorf("hashing: %w", err)
+		}
+		done <- outcome{hash, info, err}
+	}()
+
+	ctx := context.Background()
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	select {
+	case o := <-done:
+		return o.hash, o.info, o.err
+	case <-ctx.Done():
+		return "", nil, errTimedOut
+	}
+}
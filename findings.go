@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Finding statuses. Every finding starts open; gohash findings ack resolves
+// it, and later scans that make the same finding store it with the same
+// status instead of alerting again.
+const (
+	StatusOpen          = "open"
+	StatusAcknowledged  = "acknowledged"
+	StatusAccepted      = "accepted"
+	StatusFalsePositive = "false-positive"
+)
+
+func validFindingStatus(status string) bool {
+	switch status {
+	case StatusOpen, StatusAcknowledged, StatusAccepted, StatusFalsePositive:
+		return true
+	}
+	return false
+}
+
+// findingAck is how a finding was resolved.
+type findingAck struct {
+	Status string
+	By     string
+	At     int64
+	Note   string
+}
+
+// acknowledgedFindings maps the key of each resolved finding of a root to
+// its resolution.
+type acknowledgedFindings map[string]findingAck
+
+// findingKey identifies a finding across scans: the same kind of finding
+// about the same path with the same hashes. A file that changes again
+// makes a new finding.
+func findingKey(kind, path, storedHash, computedHash string) string {
+	return kind + "\x00" + path + "\x00" + storedHash + "\x00" + computedHash
+}
+
+// loadAcknowledgedFindings reads the resolved findings of rootID.
+func loadAcknowledgedFindings(db *sql.DB, rootID string) (acknowledgedFindings, error) {
+	rows, err := db.Query(`SELECT kind, COALESCE(path, ''), COALESCE(stored_hash, ''), COALESCE(computed_hash, ''), status, status_by, status_at, COALESCE(note, '')
+		FROM findings WHERE root_id = ? AND status != ? ORDER BY id`, rootID, StatusOpen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	acks := make(acknowledgedFindings)
+	for rows.Next() {
+		var kind, path, stored, computed string
+		var ack findingAck
+		err = rows.Scan(&kind, &path, &stored, &computed, &ack.Status, &ack.By, &ack.At, &ack.Note)
+		if err != nil {
+			return nil, err
+		}
+		acks[findingKey(kind, path, stored, computed)] = ack
+	}
+	return acks, rows.Err()
+}
+
+// lookup returns the resolution of finding, if it was resolved.
+func (a acknowledgedFindings) lookup(finding Finding) (findingAck, bool) {
+	path := ""
+	if finding.FilePath != "" {
+		path = displayPath(finding.FilePath)
+	}
+	ack, ok := a[findingKey(finding.Kind, path, finding.StoredHash, finding.ComputedHash)]
+	return ack, ok
+}
+
+// findingSpool keeps a scan's findings in a temporary file until the run is
+// recorded, when they are stored with it in the findings table for
+// dashboards to query. Like the report, it doesn't grow in memory with the
+// number of findings.
+type findingSpool struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// spooledFinding is one line of the spool. The path is already shown with
+// displayPath, which JSON can hold whatever bytes it had. Ack carries over
+// the resolution of the same finding made before.
+type spooledFinding struct {
+	Finding
+	At  int64
+	Ack *findingAck `json:",omitempty"`
+}
+
+func newFindingSpool() (*findingSpool, error) {
+	file, err := os.CreateTemp("", "gohash-findings-*.json")
+	if err != nil {
+		return nil, err
+	}
+	return &findingSpool{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (s *findingSpool) Append(finding Finding, ack *findingAck) error {
+	if finding.FilePath != "" {
+		finding.FilePath = displayPath(finding.FilePath)
+	}
+	return s.encoder.Encode(spooledFinding{Finding: finding, At: time.Now().Unix(), Ack: ack})
+}
+
+// each calls fn with every spooled finding in the order they were made,
+// stopping at the first error.
+func (s *findingSpool) each(fn func(spooledFinding) error) error {
+	_, err := s.file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(s.file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var spooled spooledFinding
+		err = json.Unmarshal(scanner.Bytes(), &spooled)
+		if err != nil {
+			return err
+		}
+		err = fn(spooled)
+		if err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	// Later findings are appended after the last one read.
+	_, err = s.file.Seek(0, 2)
+	return err
+}
+
+// store inserts the spooled findings into the findings table under the run
+// and root of run.
+func (s *findingSpool) store(db *sql.DB, run runInfo) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(`INSERT INTO findings (run_id, root_id, found_at, kind, path, stored_hash, computed_hash, message, status, status_by, status_at, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	err = s.each(func(spooled spooledFinding) error {
+		finding := spooled.Finding
+		ack := findingAck{Status: StatusOpen}
+		if spooled.Ack != nil {
+			ack = *spooled.Ack
+		}
+		_, err := insert.Exec(run.RunID, run.RootID, spooled.At, finding.Kind, nullString(finding.FilePath),
+			nullString(finding.StoredHash), nullString(finding.ComputedHash), finding.Message,
+			ack.Status, nullString(ack.By), sql.NullInt64{Int64: ack.At, Valid: ack.At != 0}, nullString(ack.Note))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *findingSpool) Remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// runFindings lists the findings stored by scans and resolves them, so that
+// a finding looked into is not alerted on again by every later scan.
+func runFindings(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s findings list [options] database_path [root_directory]\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s findings ack [options] database_path finding_id...\n", programName)
+	}
+	if len(arguments) < 1 || (arguments[0] != "list" && arguments[0] != "ack") {
+		usage()
+		os.Exit(2)
+	}
+	command := arguments[0]
+
+	flags := flag.NewFlagSet("findings "+command, flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	status := flags.String("status", "", "list: only list findings with this status (default: open); ack: the status to set: acknowledged, accepted, false-positive or open to reopen (default: acknowledged)")
+	run := flags.String("run", "", "list: only list the findings of this run ID")
+	limit := flags.Int("limit", 100, "list: list at most this many findings, newest first; 0 lists them all")
+	note := flags.String("note", "", "ack: why the finding was resolved so")
+	lockWait := flags.Duration("wait", 0, "ack: how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments[1:])
+	if flags.NArg() < 1 || (command == "list" && flags.NArg() > 2) || (command == "ack" && flags.NArg() < 2) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *status != "" && !validFindingStatus(*status) {
+		log.Fatalf("Unknown finding status %q", *status)
+	}
+
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	if command == "list" {
+		rootID := *rootIDFlag
+		if rootID == "" && flags.NArg() > 1 {
+			var err error
+			rootID, err = defaultRootID(flags.Arg(1))
+			if err != nil {
+				log.Fatalf("Error %v", err)
+			}
+		}
+		if *status == "" {
+			*status = StatusOpen
+		}
+		err := listFindings(db, rootID, *status, *run, *limit)
+		if err != nil {
+			log.Fatalf("Error listing findings: %v", err)
+		}
+		return
+	}
+
+	if *status == "" {
+		*status = StatusAcknowledged
+	}
+	var ids []int64
+	for _, arg := range flags.Args()[1:] {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			log.Fatalf("Error %q is not a finding ID", arg)
+		}
+		ids = append(ids, id)
+	}
+	lock, err := acquireRunLock(flags.Arg(0), *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+	for _, id := range ids {
+		resolved, err := resolveFinding(db, id, findingAck{Status: *status, By: auditActor(), At: time.Now().Unix(), Note: *note})
+		if err != nil {
+			log.Fatalf("Error resolving finding %d: %v", id, err)
+		}
+		fmt.Printf("Finding %d is %s (%d records)\n", id, *status, resolved)
+	}
+}
+
+// resolveFinding sets the status of finding id and of every other record of
+// the same finding, returning how many were updated.
+func resolveFinding(db *sql.DB, id int64, ack findingAck) (int64, error) {
+	var rootID, kind, path, stored, computed string
+	err := db.QueryRow("SELECT root_id, kind, COALESCE(path, ''), COALESCE(stored_hash, ''), COALESCE(computed_hash, '') FROM findings WHERE id = ?", id).
+		Scan(&rootID, &kind, &path, &stored, &computed)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no such finding")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ack.Status == StatusOpen {
+		ack.By, ack.At, ack.Note = "", 0, ""
+	}
+	result, err := db.Exec(`UPDATE findings SET status = ?, status_by = ?, status_at = ?, note = ?
+		WHERE root_id = ? AND kind = ? AND COALESCE(path, '') = ? AND COALESCE(stored_hash, '') = ? AND COALESCE(computed_hash, '') = ?`,
+		ack.Status, nullString(ack.By), sql.NullInt64{Int64: ack.At, Valid: ack.At != 0}, nullString(ack.Note), rootID, kind, path, stored, computed)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func listFindings(db *sql.DB, rootID, status, runID string, limit int) error {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.Query(`SELECT id, found_at, root_id, kind, COALESCE(path, ''), status, COALESCE(note, '') FROM findings
+		WHERE (? = '' OR root_id = ?) AND status = ? AND (? = '' OR run_id = ?) ORDER BY id DESC LIMIT ?`,
+		rootID, rootID, status, runID, runID, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tFOUND\tROOT\tKIND\tPATH\tSTATUS\tNOTE")
+	for rows.Next() {
+		var id, found int64
+		var root, kind, path, status, note string
+		err = rows.Scan(&id, &found, &root, &kind, &path, &status, &note)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", id, time.Unix(found, 0).Format(time.RFC3339), root, kind, path, status, note)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ZFS and Btrfs checksum every block they store, so content they return
+// intact is what was last written through the filesystem. Whether they have
+// recorded checksum errors tells hardware-level corruption, which they catch,
+// apart from changes some program wrote, which they can't.
+
+// filesystemHealth is what a checksumming filesystem reports about itself.
+type filesystemHealth struct {
+	// Name describes the filesystem, e.g. "ZFS pool tank".
+	Name string
+	// Errors counts the checksum and read errors the filesystem recorded.
+	Errors int64
+	// Damaged lists the files ZFS knows to have permanent errors.
+	Damaged map[string]bool
+	// Err is why the error reports couldn't be read.
+	Err error
+}
+
+// filesystemErrors looks up the health of the filesystems mismatched files
+// are on, once per directory.
+type filesystemErrors struct {
+	cache map[string]*filesystemHealth
+}
+
+func newFilesystemErrors() *filesystemErrors {
+	return &filesystemErrors{cache: make(map[string]*filesystemHealth)}
+}
+
+// lookup returns the health of the filesystem filePath is on, or nil if it
+// doesn't checksum its data or f is nil.
+func (f *filesystemErrors) lookup(filePath string) *filesystemHealth {
+	if f == nil {
+		return nil
+	}
+	directory := filepath.Dir(filePath)
+	if health, ok := f.cache[directory]; ok {
+		return health
+	}
+	health := zfsHealth(directory)
+	if health == nil {
+		health = btrfsHealth(directory)
+	}
+	f.cache[directory] = health
+	return health
+}
+
+// describe says what the filesystem's reports mean for a file whose content
+// no longer matches the baseline. clean reports that the filesystem found no
+// errors, so the change was written through it.
+func (h *filesystemHealth) describe(filePath string) (note string, clean bool) {
+	absPath, _ := filepath.Abs(filePath)
+	switch {
+	case h.Err != nil:
+		return fmt.Sprintf("; %s error reports unavailable: %v", h.Name, h.Err), false
+	case h.Damaged[absPath]:
+		return fmt.Sprintf("; %s reports a permanent error in this file: hardware-level corruption", h.Name), false
+	case h.Errors > 0:
+		return fmt.Sprintf("; %s has recorded %d checksum or read errors: possibly hardware-level corruption", h.Name, h.Errors), false
+	}
+	return fmt.Sprintf("; %s has recorded no checksum errors, so the change was written through the filesystem", h.Name), true
+}
+
+// zfsHealth reads the error counters and the permanent errors of the pool
+// holding directory from zpool status.
+func zfsHealth(directory string) *filesystemHealth {
+	out, err := exec.Command("zfs", "list", "-H", "-o", "name", directory).Output()
+	if err != nil {
+		return nil
+	}
+	dataset := strings.TrimSpace(string(out))
+	pool, _, _ := strings.Cut(dataset, "/")
+	health := &filesystemHealth{Name: "ZFS pool " + pool, Damaged: make(map[string]bool)}
+
+	out, err = exec.Command("zpool", "status", "-v", "-p", pool).Output()
+	if err != nil {
+		health.Err = commandError(err)
+		return health
+	}
+	// The config section lists every vdev with its READ, WRITE and CKSUM
+	// counters; the errors section lists damaged files by path.
+	inConfig, inErrors := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 5 && fields[0] == "NAME" && fields[4] == "CKSUM":
+			inConfig = true
+		case strings.HasPrefix(line, "errors:"):
+			inConfig = false
+			inErrors = strings.Contains(line, "following files")
+		case inConfig && len(fields) == 0:
+			inConfig = false
+		case inConfig && len(fields) >= 5 && fields[0] == pool:
+			// The pool's own line totals its vdevs.
+			read, _ := strconv.ParseInt(fields[2], 10, 64)
+			checksum, _ := strconv.ParseInt(fields[4], 10, 64)
+			health.Errors += read + checksum
+		case inErrors && len(fields) > 0:
+			health.Damaged[filepath.Clean(strings.TrimSpace(line))] = true
+		}
+	}
+	return health
+}
+
+// btrfsHealth reads the device error counters of the Btrfs filesystem
+// holding directory. Btrfs doesn't keep a list of damaged files outside the
+// kernel log.
+func btrfsHealth(directory string) *filesystemHealth {
+	out, err := exec.Command("btrfs", "device", "stats", directory).Output()
+	if err != nil {
+		return nil
+	}
+	health := &filesystemHealth{Name: "Btrfs"}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Lines read "[/dev/sda].corruption_errs 0".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.HasSuffix(fields[0], ".corruption_errs") || strings.HasSuffix(fields[0], ".read_io_errs") {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			health.Errors += n
+		}
+	}
+	return health
+}
+
+// commandError includes what a command wrote to stderr in its error.
+func commandError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
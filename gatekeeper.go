@@ -0,0 +1,7 @@
+package main
+
+// gatekeeperAttributes are the extended attributes macOS's Gatekeeper
+// checks before running a downloaded program: the quarantine flag a
+// browser sets, and the provenance macOS 13 and later keeps once it has
+// been approved. Malware strips them to be run without the check.
+var gatekeeperAttributes = []string{"com.apple.quarantine", "com.apple.provenance"}
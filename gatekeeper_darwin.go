@@ -0,0 +1,25 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// gatekeeperAttrs returns the Gatekeeper attributes the file at path has,
+// comma-separated.
+func gatekeeperAttrs(path string) (string, error) {
+	var present []string
+	for _, name := range gatekeeperAttributes {
+		_, err := unix.Getxattr(path, name, nil)
+		if err == nil {
+			present = append(present, name)
+		} else if !errors.Is(err, unix.ENOATTR) {
+			return "", err
+		}
+	}
+	return strings.Join(present, ","), nil
+}
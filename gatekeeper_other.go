@@ -0,0 +1,10 @@
+//go:build !darwin
+
+package main
+
+import "errors"
+
+// gatekeeperAttrs can't be read outside macOS, so nothing is recorded.
+func gatekeeperAttrs(path string) (string, error) {
+	return "", errors.ErrUnsupported
+}
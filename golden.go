@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// goldenImage is a saved baseline exported to a file, so every host built
+// from the same image can be verified against it, reporting how each has
+// drifted from the image rather than only from its own past.
+type goldenImage struct {
+	Name       string       `json:"name"`
+	RootID     string       `json:"rootId"`
+	Host       string       `json:"host"`
+	SavedBy    string       `json:"savedBy"`
+	Saved      time.Time    `json:"saved"`
+	Algo       string       `json:"algo"`
+	PathPolicy string       `json:"pathPolicy"`
+	Files      []goldenFile `json:"files"`
+}
+
+// goldenFile is one record of an image. Path is relative to the root and
+// slash-separated, like stored records.
+type goldenFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// goldenPrefix starts the names golden images are imported under, so that
+// an import never replaces a baseline saved locally.
+const goldenPrefix = "golden:"
+
+// goldenBaseline returns the name of the saved baseline the golden image
+// called name is imported as.
+func goldenBaseline(name string) string {
+	return goldenPrefix + name
+}
+
+// exportGoldenImage writes the saved baseline name of rootID to file and,
+// with a key, its signature to file.sig.
+func exportGoldenImage(db *sql.DB, rootID, name, file string, key ed25519.PrivateKey) (int, error) {
+	image := goldenImage{Name: strings.TrimPrefix(name, goldenPrefix), RootID: rootID}
+	var saved int64
+	err := db.QueryRow("SELECT created_at, created_by FROM baselines WHERE root_id = ? AND name = ?", rootID, name).Scan(&saved, &image.SavedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no baseline %q for %s", name, rootID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	image.Saved = time.Unix(saved, 0).UTC()
+	image.Host, _ = os.Hostname()
+	image.Algo, err = rootHashAlgo(db, rootID)
+	if err == nil {
+		image.PathPolicy, err = rootPathPolicy(db, rootID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query("SELECT filename, hash, size FROM baseline_files WHERE root_id = ? AND baseline = ? ORDER BY filename", rootID, name)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record goldenFile
+		var size sql.NullInt64
+		err = rows.Scan(&record.Path, &record.Hash, &size)
+		if err != nil {
+			return 0, err
+		}
+		record.Size = size.Int64
+		image.Files = append(image.Files, record)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	data, err := json.MarshalIndent(image, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	err = os.WriteFile(file, append(data, '\n'), 0644)
+	if err == nil && key != nil {
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, append(data, '\n'))) + "\n"
+		err = os.WriteFile(file+".sig", []byte(signature), 0644)
+	}
+	return len(image.Files), err
+}
+
+// readGoldenImage reads an exported image, which with a key must carry a
+// valid signature in file.sig.
+func readGoldenImage(file string, key ed25519.PublicKey) (*goldenImage, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		encoded, err := os.ReadFile(file + ".sig")
+		if err != nil {
+			return nil, fmt.Errorf("no signature: %v", err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(key, data, signature) {
+			return nil, errors.New("invalid signature")
+		}
+	}
+	var image goldenImage
+	err = json.Unmarshal(data, &image)
+	if err == nil {
+		err = image.validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a golden image: %v", file, err)
+	}
+	return &image, nil
+}
+
+// validate checks that the image is complete and every record names a file
+// under the root.
+func (g *goldenImage) validate() error {
+	if g.Name == "" {
+		return errors.New("no name")
+	}
+	if _, ok := hashAlgorithms[g.Algo]; !ok {
+		return fmt.Errorf("unknown hash algorithm %q", g.Algo)
+	}
+	if !validPathPolicy(g.PathPolicy) {
+		return fmt.Errorf("unknown path policy %q", g.PathPolicy)
+	}
+	for _, file := range g.Files {
+		p := file.Path
+		if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("%q is not a clean path relative to the root", p)
+		}
+		if file.Hash == "" || !isHexString(file.Hash) {
+			return fmt.Errorf("%q has no valid hash", p)
+		}
+	}
+	return nil
+}
+
+// importGoldenImage saves image as a baseline of rootID named by
+// goldenBaseline, replacing an earlier import. A root new to the database takes the
+// image's hash algorithm and path policy; one already baselined must use
+// the same ones.
+func importGoldenImage(db *sql.DB, rootID string, image *goldenImage) error {
+	records, err := rootRecordCount(db, rootID)
+	if err != nil {
+		return err
+	}
+	policy, err := rootPathPolicy(db, rootID)
+	if err != nil {
+		return err
+	}
+	if records > 0 && policy != image.PathPolicy {
+		return fmt.Errorf("golden image %q uses path policy %s but %s uses %s", image.Name, image.PathPolicy, rootID, policy)
+	}
+	// On a root that requires approval an image may only be imported again
+	// as it was, since it changes what the root is verified against.
+	required, err := rootRequiresApproval(db, rootID)
+	if err != nil {
+		return err
+	}
+	if required {
+		unchanged, err := goldenImageUnchanged(db, rootID, image)
+		if err != nil {
+			return err
+		}
+		if !unchanged {
+			return fmt.Errorf("golden image %q can't change the baselines of root %s, which requires approval", image.Name, displayPath(rootID))
+		}
+		return nil
+	}
+	err = setRootPathPolicy(db, rootID, image.PathPolicy)
+	if err == nil {
+		err = setRootHashAlgo(db, rootID, image.Algo)
+	}
+	if err != nil {
+		return fmt.Errorf("golden image %q: %v", image.Name, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	name := goldenBaseline(image.Name)
+	_, err = tx.Exec("DELETE FROM baseline_files WHERE root_id = ? AND baseline = ?", rootID, name)
+	if err != nil {
+		return err
+	}
+	insert, err := tx.Prepare("INSERT INTO baseline_files (root_id, baseline, filename, hash, size) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, file := range image.Files {
+		_, err = insert.Exec(rootID, name, dbPath(normalizePath(image.PathPolicy, file.Path)), strings.ToLower(file.Hash), file.Size)
+		if err != nil {
+			return err
+		}
+	}
+	note := fmt.Sprintf("golden image of %s on %s", image.RootID, image.Host)
+	_, err = tx.Exec("INSERT OR REPLACE INTO baselines (root_id, name, created_at, created_by, note, files) VALUES (?, ?, ?, ?, ?, ?)",
+		rootID, name, image.Saved.Unix(), image.SavedBy, note, len(image.Files))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// goldenImageUnchanged reports whether image was imported into rootID
+// before with the same files.
+func goldenImageUnchanged(db *sql.DB, rootID string, image *goldenImage) (bool, error) {
+	rows, err := db.Query("SELECT filename, hash, COALESCE(size, 0) FROM baseline_files WHERE root_id = ? AND baseline = ?", rootID, goldenBaseline(image.Name))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	imported := make(map[string]goldenFile)
+	for rows.Next() {
+		var file goldenFile
+		err = rows.Scan(&file.Path, &file.Hash, &file.Size)
+		if err != nil {
+			return false, err
+		}
+		imported[file.Path] = file
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	if len(imported) != len(image.Files) {
+		return false, nil
+	}
+	for _, file := range image.Files {
+		if got, ok := imported[normalizePath(image.PathPolicy, file.Path)]; !ok || got.Hash != strings.ToLower(file.Hash) || got.Size != file.Size {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// loadGoldenImage imports the image in file into the database at
+// databasePath for a scan to verify against, returning the name of the
+// baseline it was imported as.
+func loadGoldenImage(databasePath, rootID, file, keyPath string, wait time.Duration) (string, error) {
+	var key ed25519.PublicKey
+	if keyPath != "" {
+		var err error
+		key, err = readPublicKey(keyPath)
+		if err != nil {
+			return "", err
+		}
+	}
+	image, err := readGoldenImage(file, key)
+	if err != nil {
+		return "", fmt.Errorf("reading the golden image: %v", err)
+	}
+
+	lock, err := acquireRunLock(databasePath, wait)
+	if err != nil {
+		return "", fmt.Errorf("acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db, err := openDatabase(databasePath)
+	if err != nil {
+		return "", err
+	}
+	defer closeDatabase(db)
+	err = importGoldenImage(db, rootID, image)
+	if err != nil {
+		return "", fmt.Errorf("importing the golden image: %v", err)
+	}
+	return goldenBaseline(image.Name), nil
+}
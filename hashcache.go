@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"time"
+)
+
+// hashCacheSize bounds how many hashes the cache holds, so a scan of
+// millions of files doesn't keep all of their hashes in memory; the files
+// after that are simply hashed again wherever they turn up.
+const hashCacheSize = 1 << 18
+
+// hashCacheKey identifies one version of a file's content: the same file,
+// by device and inode, with the same size and modification time.
+type hashCacheKey struct {
+	id      fileID
+	size    int64
+	modTime int64
+	algo    string
+}
+
+// hashCache hashes each file once per run, however many of the scanned
+// roots it turns up under, as through a bind mount or profiles whose roots
+// overlap. A run is the scans going on at the same time: the cache is
+// emptied whenever the last of them finishes, so a later scan hashes every
+// file again and a change that kept the size and modification time is
+// still noticed.
+type hashCache struct {
+	mu     sync.Mutex
+	scans  int
+	hashes map[hashCacheKey]string
+}
+
+// runHashes is the cache shared by the scans of this process.
+var runHashes = &hashCache{}
+
+// open registers a scan using the cache, which close unregisters.
+func (c *hashCache) open() *hashCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scans == 0 {
+		c.hashes = make(map[hashCacheKey]string)
+	}
+	c.scans++
+	return c
+}
+
+func (c *hashCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scans--; c.scans == 0 {
+		c.hashes = nil
+	}
+}
+
+// hash returns the cached hash of the file described by info, computing
+// and caching it if there is none.
+func (c *hashCache) hash(info os.FileInfo, algo string, compute func() (string, error)) (string, error) {
+	id, _, ok := fileIdentity(info)
+	if c == nil || !ok {
+		return compute()
+	}
+	key := hashCacheKey{id, info.Size(), info.ModTime().UnixNano(), algo}
+	c.mu.Lock()
+	hash, found := c.hashes[key]
+	c.mu.Unlock()
+	if found {
+		return hash, nil
+	}
+	hash, err := compute()
+	if err != nil {
+		return hash, err
+	}
+	c.mu.Lock()
+	if c.hashes != nil && len(c.hashes) < hashCacheSize {
+		c.hashes[key] = hash
+	}
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// fastRecord is what the baseline holds for a -fast check of a file: the
+// hash recorded with its identity, size and modification time, and when it
+// was last hashed in full.
+type fastRecord struct {
+	Hash    string
+	FileID  string
+	Size    int64
+	ModTime int64
+	Full    int64
+}
+
+// loadFastRecords returns the stored files under rootID whose identity,
+// size and modification time were recorded.
+func loadFastRecords(db *sql.DB, rootID string) (map[string]fastRecord, error) {
+	rows, err := db.Query("SELECT filename, hash, COALESCE(file_id, ''), size, mtime, full_verified FROM file_hashes WHERE root_id = ? AND size IS NOT NULL AND mtime IS NOT NULL AND full_verified IS NOT NULL",
+		rootID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make(map[string]fastRecord)
+	for rows.Next() {
+		var filename string
+		var record fastRecord
+		err = rows.Scan(&filename, &record.Hash, &record.FileID, &record.Size, &record.ModTime, &record.Full)
+		if err != nil {
+			return nil, err
+		}
+		records[filename] = record
+	}
+	return records, rows.Err()
+}
+
+// fastCheck reports whether source is the file recorded, by its identity,
+// size and modification time, so its stored hash can be taken as its own.
+// Where the system has no file IDs, the size and modification time must
+// do. -full-every still has the file hashed in full when that is due.
+func fastCheck(source string, record fastRecord, known bool, fullEvery time.Duration) (os.FileInfo, bool) {
+	if !known {
+		return nil, false
+	}
+	info, err := os.Stat(longPath(source))
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	unchanged := fileIDString(info) == record.FileID && info.Size() == record.Size && info.ModTime().UnixNano() == record.ModTime
+	return info, unchanged && quickRecord{Full: record.Full}.fresh(fullEvery)
+}
+
+// fileIDString is the device and inode of a file as recorded in the
+// baseline, or "" where the system has no file IDs.
+func fileIDString(info os.FileInfo) string {
+	id, _, ok := fileIdentity(info)
+	if !ok {
+		return ""
+	}
+	return id.String()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// hashAlgorithms are the digests a root can be baselined with.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func hashAlgorithmNames() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hashLabel is how an algorithm is named in reports, e.g. "MD5".
+func hashLabel(algo string) string {
+	return strings.ToUpper(algo)
+}
+
+// Hash backends. Go's own implementations use the CPU's SHA extensions
+// (SHA-NI, ARMv8 crypto) where it has them; the kernel's crypto API can
+// hand hashing to an offload engine instead. Auto picks the kernel only
+// when its best implementation of the algorithm is such an engine.
+const (
+	BackendAuto   = "auto"
+	BackendGo     = "go"
+	BackendKernel = "kernel"
+)
+
+func validHashBackend(backend string) bool {
+	switch backend {
+	case BackendAuto, BackendGo, BackendKernel:
+		return true
+	}
+	return false
+}
+
+func computeFileHash(filePath string, algo string) (string, error) {
+	return computeFileHashWith(filePath, algo, BackendAuto)
+}
+
+// computeFileHashWith hashes filePath with the given backend.
+func computeFileHashWith(filePath, algo, backend string) (string, error) {
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return "", err
+	}
+	return hashOpenFile(file, algo, backend)
+}
+
+// hashOpenFile hashes and closes file.
+func hashOpenFile(file *os.File, algo, backend string) (string, error) {
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Error closing the file: %v", err)
+		}
+	}(file)
+
+	if backend == BackendKernel || (backend != BackendGo && kernelHashPreferred(algo)) {
+		return kernelFileHash(throttled(file), algo)
+	}
+	hash := hashAlgorithms[algo]()
+	_, err := io.Copy(hash, throttled(file))
+	if err != nil {
+		return "", err
+	}
+
+	hashBytes := hash.Sum(nil)
+	hashStr := hex.EncodeToString(hashBytes)
+	return strings.ToLower(hashStr), nil
+}
+
+// rootHashAlgo returns the algorithm rootID is baselined with, or md5 for a
+// root that has never been scanned.
+func rootHashAlgo(db *sql.DB, rootID string) (string, error) {
+	var algo string
+	err := db.QueryRow("SELECT hash_algo FROM roots WHERE root_id = ?", rootID).Scan(&algo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "md5", nil
+	}
+	return algo, err
+}
+
+// setRootHashAlgo records algo for rootID. Stored hashes can't be converted,
+// so switching the algorithm of a root that already has records is refused.
+func setRootHashAlgo(db *sql.DB, rootID, algo string) error {
+	if _, ok := hashAlgorithms[algo]; !ok {
+		return fmt.Errorf("unknown hash algorithm %q (supported: %s)", algo, strings.Join(hashAlgorithmNames(), ", "))
+	}
+	current, err := rootHashAlgo(db, rootID)
+	if err != nil {
+		return err
+	}
+	if current != algo {
+		records, err := rootRecordCount(db, rootID)
+		if err != nil {
+			return err
+		}
+		if records > 0 {
+			return fmt.Errorf("root %s is baselined with %s; remove its records to re-baseline with %s", rootID, current, algo)
+		}
+	}
+
+	_, err = db.Exec("INSERT INTO roots (root_id, hash_algo) VALUES (?, ?) ON CONFLICT (root_id) DO UPDATE SET hash_algo = excluded.hash_algo",
+		rootID, algo)
+	return err
+}
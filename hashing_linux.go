@@ -0,0 +1,130 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelDriver is the implementation the kernel's crypto API uses for an
+// algorithm: the registered one with the highest priority.
+type kernelDriver struct {
+	Name     string
+	Priority int
+	// Async drivers are offload engines such as QAT or CAAM; CPU
+	// implementations are synchronous.
+	Async bool
+}
+
+var (
+	kernelDriversOnce sync.Once
+	kernelDrivers     map[string]kernelDriver
+)
+
+// kernelHashDriver returns the kernel's driver for algo, if it has one.
+func kernelHashDriver(algo string) (kernelDriver, bool) {
+	kernelDriversOnce.Do(func() {
+		// Containers may list the drivers but refuse the socket.
+		socket, err := unix.Socket(unix.AF_ALG, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return
+		}
+		unix.Close(socket)
+		kernelDrivers = readKernelDrivers()
+	})
+	driver, ok := kernelDrivers[algo]
+	return driver, ok
+}
+
+// readKernelDrivers reads the hash drivers listed in /proc/crypto.
+func readKernelDrivers() map[string]kernelDriver {
+	drivers := make(map[string]kernelDriver)
+	file, err := os.Open("/proc/crypto")
+	if err != nil {
+		return drivers
+	}
+	defer file.Close()
+
+	fields := make(map[string]string)
+	add := func() {
+		defer clear(fields)
+		name, kind := fields["name"], fields["type"]
+		priority, _ := strconv.Atoi(fields["priority"])
+		if _, ok := hashAlgorithms[name]; !ok || (kind != "shash" && kind != "ahash") {
+			return
+		}
+		if current, ok := drivers[name]; ok && current.Priority >= priority {
+			return
+		}
+		drivers[name] = kernelDriver{Name: fields["driver"], Priority: priority, Async: fields["async"] == "yes"}
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			add()
+			continue
+		}
+		fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	add()
+	return drivers
+}
+
+// kernelHashPreferred reports whether the kernel hashes algo on an offload
+// engine, leaving the CPU free.
+func kernelHashPreferred(algo string) bool {
+	driver, ok := kernelHashDriver(algo)
+	return ok && driver.Async
+}
+
+// kernelFileHash hashes what file reads through an AF_ALG socket.
+func kernelFileHash(file io.Reader, algo string) (string, error) {
+	socket, err := unix.Socket(unix.AF_ALG, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return "", fmt.Errorf("opening the kernel crypto API: %v", err)
+	}
+	defer unix.Close(socket)
+	err = unix.Bind(socket, &unix.SockaddrALG{Type: "hash", Name: algo})
+	if err != nil {
+		return "", fmt.Errorf("kernel crypto API has no %s: %v", algo, err)
+	}
+	op, _, err := unix.Accept(socket)
+	if err != nil {
+		return "", fmt.Errorf("opening a kernel %s hash: %v", algo, err)
+	}
+	defer unix.Close(op)
+
+	// Every write but the last flag that more data follows; reading the
+	// digest then finishes the hash.
+	buffer := make([]byte, 1<<20)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 {
+			if _, err := unix.SendmsgN(op, buffer[:n], nil, nil, unix.MSG_MORE); err != nil {
+				return "", fmt.Errorf("hashing in the kernel: %v", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	digest := make([]byte, hashAlgorithms[algo]().Size())
+	n, err := unix.Read(op, digest)
+	if err != nil {
+		return "", fmt.Errorf("hashing in the kernel: %v", err)
+	}
+	return hex.EncodeToString(digest[:n]), nil
+}
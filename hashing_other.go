@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+type kernelDriver struct {
+	Name  string
+	Async bool
+}
+
+func kernelHashDriver(algo string) (kernelDriver, bool) {
+	return kernelDriver{}, false
+}
+
+func kernelHashPreferred(algo string) bool {
+	return false
+}
+
+func kernelFileHash(file io.Reader, algo string) (string, error) {
+	return "", errors.New("the kernel hash backend is only available on Linux")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// starterProfile is a built-in set of daemon profiles for a common use
+// case, a starting point the operator adapts rather than a finished
+// configuration.
+type starterProfile struct {
+	Description string
+	// Profiles edits the profiles of the use case, which start with the
+	// command-line defaults.
+	Profiles []func(*profileConfig)
+}
+
+// starterProfiles are the use cases gohash init writes a configuration for.
+var starterProfiles = map[string]starterProfile{
+	"linux-system": {
+		Description: "the programs, libraries and configuration of a Linux host, for intrusion detection",
+		Profiles: []func(*profileConfig){
+			func(p *profileConfig) {
+				p.Name, p.Root = "binaries", "/usr"
+				p.Interval = duration(6 * time.Hour)
+				// New setuid programs and capabilities are what a
+				// rootkit leaves behind.
+				p.Privileges = true
+				p.ContentType = true
+			},
+			func(p *profileConfig) {
+				p.Name, p.Root = "boot", "/boot"
+				p.Interval = duration(6 * time.Hour)
+			},
+			func(p *profileConfig) {
+				p.Name, p.Root = "config", "/etc"
+				p.Interval = duration(time.Hour)
+				p.Privileges = true
+				// Files the system rewrites by itself.
+				p.Dynamic = []string{"mtab", "resolv.conf", "adjtime", "ld.so.cache", "*.cache", "*.lock", "*-"}
+				p.Suppress = duration(24 * time.Hour)
+			},
+		},
+	},
+	"web-root": {
+		Description: "the document root of a web server, for defacement and web shells",
+		Profiles: []func(*profileConfig){
+			func(p *profileConfig) {
+				p.Name, p.Root = "web", "/var/www"
+				p.Interval = duration(15 * time.Minute)
+				// A web shell is often a script uploaded as an image.
+				p.ContentType = true
+				p.Dynamic = []string{"cache", "*.log", "sessions"}
+				p.DigestWindow = duration(time.Hour)
+			},
+		},
+	},
+	"media-archive": {
+		Description: "a large archive of photos, music and video, for bit rot and ransomware",
+		Profiles: []func(*profileConfig){
+			func(p *profileConfig) {
+				p.Name, p.Root = "archive", "/srv/media"
+				p.Interval = duration(24 * time.Hour)
+				// A large archive is verified a random part at a time;
+				// new and missing files are still found every day.
+				p.Sample = "5%"
+				p.Entropy = 20
+				p.SortBySize = false
+				p.Empty = PolicySkip
+			},
+		},
+	},
+}
+
+// runInit writes a daemon configuration for one of the starter profiles.
+func runInit(arguments []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	profileName := flags.String("profile", "", "starter profile to configure: linux-system, web-root or media-archive")
+	output := flags.String("output", "gohash.json", "configuration file to write")
+	email := flags.String("email", "root@localhost", "who the reports are emailed to")
+	databaseDir := flags.String("database-dir", "/var/lib/gohash", "directory the databases of the profiles are kept in, one per profile")
+	algo := flags.String("algo", "sha256", "hash algorithm of the new baselines")
+	force := flags.Bool("force", false, "overwrite an existing configuration file")
+	list := flags.Bool("list", false, "list the starter profiles")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s init -profile name [options]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Writes a starting daemon configuration for a common use case, to adapt and check with %s config check.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *list {
+		var names []string
+		for name := range starterProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-14s %s\n", name, starterProfiles[name].Description)
+		}
+		return
+	}
+	starter, ok := starterProfiles[*profileName]
+	if !ok {
+		if *profileName != "" {
+			fmt.Fprintf(os.Stderr, "Unknown profile %q; %s init -list shows them\n", *profileName, os.Args[0])
+		}
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, ok := hashAlgorithms[*algo]; !ok {
+		log.Fatalf("Error: unknown hash algorithm %q (supported: %s)", *algo, strings.Join(hashAlgorithmNames(), ", "))
+	}
+
+	defaults := defaultProfile()
+	var profiles []any
+	for _, edit := range starter.Profiles {
+		profile := defaultProfile()
+		profile.Recursive = true
+		profile.Email = *email
+		profile.Algo = *algo
+		edit(&profile)
+		profile.Database = filepath.Join(*databaseDir, profile.Name+".db")
+		settings, err := changedSettings(defaults, profile)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		profiles = append(profiles, settings)
+	}
+	encoded, err := json.MarshalIndent(map[string]any{"profiles": profiles}, "", "  ")
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(*output, mode, 0o644)
+	if err != nil {
+		log.Fatalf("Error writing the configuration: %v", err)
+	}
+	_, err = file.Write(append(encoded, '\n'))
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		log.Fatalf("Error writing the configuration: %v", err)
+	}
+	fmt.Printf("Wrote %s with %d profiles for %s.\n", *output, len(profiles), starter.Description)
+	fmt.Printf("Review the roots and email, then run %s config check %s and %s daemon -config %s.\n", os.Args[0], *output, os.Args[0], *output)
+}
+
+// changedSettings returns the settings of profile that differ from
+// defaults as a JSON object, in the order of profileConfig, so that a
+// starting configuration holds only what the use case chose. The settings
+// a profile needs are always written.
+func changedSettings(defaults, profile profileConfig) (json.RawMessage, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	have, want := reflect.ValueOf(defaults), reflect.ValueOf(profile)
+	for i := 0; i < want.NumField(); i++ {
+		key := want.Type().Field(i).Tag.Get("json")
+		switch key {
+		case "name", "database", "root", "email", "interval":
+		default:
+			if reflect.DeepEqual(want.Field(i).Interface(), have.Field(i).Interface()) {
+				continue
+			}
+		}
+		value, err := json.Marshal(want.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%q:%s", key, value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
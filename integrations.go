@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// wazuhEvents maps finding kinds to the events of Wazuh's file integrity
+// monitoring.
+var wazuhEvents = map[string]string{
+	FindingMismatch:   "modified",
+	FindingCorruption: "modified",
+	FindingTypeChange: "modified",
+	FindingTruncation: "modified",
+	FindingPrivilege:  "modified",
+	FindingQuarantine: "modified",
+	FindingNew:        "added",
+	FindingExecutable: "added",
+	FindingMissing:    "deleted",
+	FindingExpected:   "modified",
+	FindingError:      "error",
+	FindingTimeout:    "error",
+	FindingEncryption: "error",
+}
+
+type wazuhEvent struct {
+	Timestamp string         `json:"timestamp"`
+	Agent     wazuhAgent     `json:"agent"`
+	Syscheck  map[string]any `json:"syscheck"`
+	Gohash    wazuhGohash    `json:"gohash"`
+}
+
+type wazuhAgent struct {
+	Name string `json:"name"`
+}
+
+type wazuhGohash struct {
+	RunID   string `json:"runId"`
+	Rule    string `json:"rule"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// wazuhWriter writes one JSON object per finding, shaped like a Wazuh
+// syscheck event, for a Wazuh agent to collect with a localfile block in
+// json format.
+type wazuhWriter struct {
+	w        io.Writer
+	hostname string
+}
+
+func newWazuhWriter(w io.Writer) *wazuhWriter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &wazuhWriter{w: w, hostname: hostname}
+}
+
+func (z *wazuhWriter) WriteFinding(finding Finding) error {
+	syscheck := map[string]any{
+		"path":  displayPath(finding.FilePath),
+		"event": wazuhEvents[finding.Kind],
+	}
+	// Wazuh names hashes by algorithm, which the digest's length gives away.
+	if algo := hashAlgoOf(finding.StoredHash); algo != "" {
+		syscheck[algo+"_before"] = finding.StoredHash
+	}
+	if algo := hashAlgoOf(finding.ComputedHash); algo != "" {
+		syscheck[algo+"_after"] = finding.ComputedHash
+	}
+	encoded, err := json.Marshal(wazuhEvent{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Agent:     wazuhAgent{Name: z.hostname},
+		Syscheck:  syscheck,
+		Gohash:    wazuhGohash{RunID: finding.RunID, Rule: findingRules[finding.Kind].name, Kind: finding.Kind, Message: finding.Message},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(z.w, "%s\n", encoded)
+	return err
+}
+
+func (z *wazuhWriter) Close(run runInfo, rollup []directoryCounts) error {
+	return nil
+}
+
+// hashAlgoOf names the algorithm of a hex digest from its length.
+func hashAlgoOf(hash string) string {
+	for _, algo := range hashAlgorithmNames() {
+		if len(hash) == hashAlgorithms[algo]().Size()*2 {
+			return algo
+		}
+	}
+	return ""
+}
+
+// osqueryTable is one table of osquery's auto table construction, which
+// exposes a query over a SQLite database as a read-only osquery table.
+type osqueryTable struct {
+	Query   string   `json:"query"`
+	Path    string   `json:"path"`
+	Columns []string `json:"columns"`
+}
+
+// runOsquery prints the auto_table_construction section of an osquery
+// configuration exposing a baseline and its scan history, so they can be
+// queried from osquery and the consoles built on it.
+func runOsquery(arguments []string) {
+	flags := flag.NewFlagSet("osquery", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s osquery database_path\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+
+	tables := map[string]osqueryTable{
+		"gohash_files": {
+			Query:   "SELECT root_id, filename, hash, size, mtime / 1000000000 AS mtime, last_verified, last_seen / 1000000000 AS last_seen FROM file_hashes",
+			Path:    databasePath,
+			Columns: []string{"root_id", "filename", "hash", "size", "mtime", "last_verified", "last_seen"},
+		},
+		"gohash_runs": {
+			Query: "SELECT id, run_id, hostname, root, root_id, version, started_at, finished_at, status, changed, new, missing, errors, timed_out, expected, passed, notification, tier, pending FROM runs",
+			Path:  databasePath,
+			Columns: []string{"id", "run_id", "hostname", "root", "root_id", "version", "started_at", "finished_at", "status",
+				"changed", "new", "missing", "errors", "timed_out", "expected", "passed", "notification", "tier", "pending"},
+		},
+		"gohash_findings": {
+			Query:   "SELECT id, run_id, root_id, found_at, kind, path, stored_hash, computed_hash, message FROM findings",
+			Path:    databasePath,
+			Columns: []string{"id", "run_id", "root_id", "found_at", "kind", "path", "stored_hash", "computed_hash", "message"},
+		},
+	}
+	encoded, err := json.MarshalIndent(map[string]any{"auto_table_construction": tables}, "", "  ")
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	fmt.Printf("%s\n", encoded)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// changeSet is what a filesystem change journal reported since the root's
+// last scan. Journals name changed files within their directory, so files
+// are matched by base name: a file that wasn't changed but shares its name
+// with one that was is hashed as well, which costs time but misses nothing.
+type changeSet struct {
+	// Source names the journal, e.g. "the USN journal of C:".
+	Source string
+	// Full, with Reason, means the journal can't tell what changed since
+	// the last scan, and every file must be hashed.
+	Full   bool
+	Reason string
+	names  map[string]bool
+	// fold matches names case-insensitively, as NTFS does.
+	fold bool
+	// commit records that a scan has covered the changes, so the next one
+	// starts from here.
+	commit func() error
+}
+
+// changed reports whether the journal may have seen rel change.
+func (c *changeSet) changed(rel string) bool {
+	// A stream's changes are journaled under its file.
+	rel, _ = streamHost(rel)
+	name := path.Base(rel)
+	if c.fold {
+		name = strings.ToLower(name)
+	}
+	return c.Full || c.names[name]
+}
+
+// describe is the coverage note of an incremental scan.
+func (c *changeSet) describe() string {
+	if c.Full {
+		return "full scan, as " + c.Reason
+	}
+	return "incremental from " + c.Source
+}
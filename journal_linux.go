@@ -0,0 +1,159 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxWatchedNames bounds the names a watcher remembers between scans; past
+// it the next scan hashes everything instead.
+const maxWatchedNames = 1 << 20
+
+// changeWatcher follows changes to the filesystem holding a root with
+// fanotify, which only reports changes while it runs, so it lives in the
+// daemon between scans.
+type changeWatcher struct {
+	root string
+
+	mu      sync.Mutex
+	names   map[string]uint64
+	seq     uint64
+	started bool
+	// complete is set once a scan has covered everything before the
+	// names being remembered, and cleared if events are lost.
+	complete bool
+	err      error
+}
+
+// newChangeWatcher starts watching the filesystem holding rootDirectory.
+// It needs CAP_SYS_ADMIN and Linux 5.9 or later.
+func newChangeWatcher(rootDirectory string) (*changeWatcher, error) {
+	root, err := filepath.Abs(rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("starting fanotify (needs CAP_SYS_ADMIN and Linux 5.9): %v", err)
+	}
+	mask := uint64(unix.FAN_MODIFY | unix.FAN_ATTRIB | unix.FAN_CLOSE_WRITE | unix.FAN_CREATE | unix.FAN_MOVED_TO)
+	err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, mask, unix.AT_FDCWD, root)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("watching %s with fanotify: %v", root, err)
+	}
+	w := &changeWatcher{root: root, names: make(map[string]uint64)}
+	go w.watch(fd)
+	return w, nil
+}
+
+// watch records the name of every file the events are about.
+func (w *changeWatcher) watch(fd int) {
+	defer unix.Close(fd)
+	buffer := make([]byte, 64<<10)
+	metadataLen := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	for {
+		n, err := unix.Read(fd, buffer)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+			log.Printf("Error watching %s for changes: %v", w.root, err)
+			return
+		}
+
+		w.mu.Lock()
+		for offset := 0; offset+metadataLen <= n; {
+			event := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buffer[offset]))
+			if event.Event_len < uint32(metadataLen) || offset+int(event.Event_len) > n {
+				break
+			}
+			name := eventName(buffer[offset+int(event.Metadata_len) : offset+int(event.Event_len)])
+			switch {
+			case event.Mask&unix.FAN_Q_OVERFLOW != 0, len(w.names) >= maxWatchedNames:
+				w.complete = false
+			case name != "":
+				w.seq++
+				w.names[name] = w.seq
+			}
+			offset += int(event.Event_len)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// eventName finds the file name in an event's directory-and-name record:
+// a header, the filesystem ID, the directory's file handle, then the name.
+func eventName(info []byte) string {
+	for len(info) >= 4 {
+		infoType, length := info[0], int(binary.NativeEndian.Uint16(info[2:]))
+		if length < 4 || length > len(info) {
+			return ""
+		}
+		if infoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME && length >= 16 {
+			handleBytes := int(binary.NativeEndian.Uint32(info[12:]))
+			nameStart := 12 + 8 + handleBytes
+			if nameStart < length {
+				name := info[nameStart:length]
+				if i := bytes.IndexByte(name, 0); i >= 0 {
+					name = name[:i]
+				}
+				return string(name)
+			}
+		}
+		info = info[length:]
+	}
+	return ""
+}
+
+// readChangeJournal returns the names the watcher saw change since the
+// last scan it covered.
+func readChangeJournal(db *sql.DB, rootID, rootDirectory string, watcher *changeWatcher) (*changeSet, error) {
+	if watcher == nil {
+		return nil, errors.New("on Linux, -incremental needs gohash daemon, which watches for changes between scans")
+	}
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	changes := &changeSet{Source: "fanotify", names: make(map[string]bool)}
+	switch {
+	case watcher.err != nil:
+		changes.Full, changes.Reason = true, fmt.Sprintf("watching for changes failed: %v", watcher.err)
+		return changes, nil
+	case !watcher.started:
+		changes.Full, changes.Reason = true, "changes are only watched for since the daemon started"
+	case !watcher.complete:
+		changes.Full, changes.Reason = true, "change events were lost"
+	}
+	for name := range watcher.names {
+		changes.names[name] = true
+	}
+	watcher.started = true
+	seq := watcher.seq
+	changes.commit = func() error {
+		watcher.mu.Lock()
+		defer watcher.mu.Unlock()
+		for name, last := range watcher.names {
+			if last <= seq {
+				delete(watcher.names, name)
+			}
+		}
+		watcher.complete = true
+		return nil
+	}
+	return changes, nil
+}
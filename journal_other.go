@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type changeWatcher struct{}
+
+func newChangeWatcher(rootDirectory string) (*changeWatcher, error) {
+	return nil, errors.New("-incremental is only available on Linux and Windows")
+}
+
+func readChangeJournal(db *sql.DB, rootID, rootDirectory string, watcher *changeWatcher) (*changeSet, error) {
+	return nil, errors.New("-incremental is only available on Linux and Windows")
+}
@@ -0,0 +1,170 @@
+//go:build windows
+
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Change journal controls, missing from x/sys/windows.
+const (
+	fsctlQueryUsnJournal = 0x000900f4
+	fsctlReadUsnJournal  = 0x000900bb
+)
+
+// usnJournalData is USN_JOURNAL_DATA_V0.
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// readUsnJournalData is READ_USN_JOURNAL_DATA_V0.
+type readUsnJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+// changeWatcher isn't needed on Windows: NTFS keeps its journal whether or
+// not gohash is running.
+type changeWatcher struct{}
+
+func newChangeWatcher(rootDirectory string) (*changeWatcher, error) {
+	return nil, nil
+}
+
+// readChangeJournal reads the names of files changed since the root's last
+// scan from the USN journal of the root's volume. The position reached is
+// kept in the roots table as "journal ID:next USN".
+func readChangeJournal(db *sql.DB, rootID, rootDirectory string, watcher *changeWatcher) (*changeSet, error) {
+	root, err := filepath.Abs(rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	volume := filepath.VolumeName(root)
+	if len(volume) != 2 || volume[1] != ':' {
+		return nil, fmt.Errorf("-incremental needs a root on a local drive, not %s", root)
+	}
+	name, err := windows.UTF16PtrFromString(`\\.\` + volume)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := windows.CreateFile(name, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening volume %s (needs administrator rights): %v", volume, err)
+	}
+	defer windows.CloseHandle(handle)
+
+	var data usnJournalData
+	var returned uint32
+	err = windows.DeviceIoControl(handle, fsctlQueryUsnJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&data)), uint32(unsafe.Sizeof(data)), &returned, nil)
+	if errors.Is(err, windows.ERROR_JOURNAL_NOT_ACTIVE) {
+		return nil, fmt.Errorf("%s has no USN journal; create one with fsutil usn createjournal m=1073741824 a=134217728 %s", volume, volume)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying the USN journal of %s: %v", volume, err)
+	}
+
+	var stored sql.NullString
+	err = db.QueryRow("SELECT change_journal FROM roots WHERE root_id = ?", rootID).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	position := fmt.Sprintf("%x:%d", data.UsnJournalID, data.NextUsn)
+	changes := &changeSet{Source: "the USN journal of " + volume, names: make(map[string]bool), fold: true}
+	changes.commit = func() error {
+		_, err := db.Exec("UPDATE roots SET change_journal = ? WHERE root_id = ?", position, rootID)
+		return err
+	}
+
+	var journalID uint64
+	var start int64
+	if _, err := fmt.Sscanf(stored.String, "%x:%d", &journalID, &start); !stored.Valid || err != nil {
+		changes.Full, changes.Reason = true, "this is the first incremental scan of the root"
+		return changes, nil
+	}
+	if journalID != data.UsnJournalID {
+		changes.Full, changes.Reason = true, "the USN journal was recreated since the last scan"
+		return changes, nil
+	}
+	if start < data.LowestValidUsn {
+		changes.Full, changes.Reason = true, "the USN journal wrapped since the last scan; consider making it larger"
+		return changes, nil
+	}
+
+	request := readUsnJournalData{StartUsn: start, ReasonMask: 0xffffffff, UsnJournalID: data.UsnJournalID}
+	buffer := make([]byte, 64<<10)
+	for request.StartUsn < data.NextUsn {
+		err = windows.DeviceIoControl(handle, fsctlReadUsnJournal, (*byte)(unsafe.Pointer(&request)),
+			uint32(unsafe.Sizeof(request)), &buffer[0], uint32(len(buffer)), &returned, nil)
+		if err != nil {
+			return nil, fmt.Errorf("reading the USN journal of %s: %v", volume, err)
+		}
+		if returned < 8 {
+			break
+		}
+		next := int64(binary.LittleEndian.Uint64(buffer))
+		for offset := uint32(8); offset+8 <= returned; {
+			record := buffer[offset:returned]
+			length := binary.LittleEndian.Uint32(record)
+			if length < 8 || length > uint32(len(record)) {
+				break
+			}
+			if name := usnRecordName(record[:length]); name != "" {
+				changes.names[strings.ToLower(name)] = true
+			}
+			offset += length
+		}
+		if next <= request.StartUsn {
+			break
+		}
+		request.StartUsn = next
+	}
+	return changes, nil
+}
+
+// usnRecordName returns the file name of a USN_RECORD_V2 or V3, which keep
+// its length and offset at different places.
+func usnRecordName(record []byte) string {
+	var at int
+	switch binary.LittleEndian.Uint16(record[4:]) {
+	case 2:
+		at = 56
+	case 3:
+		at = 72
+	default:
+		return ""
+	}
+	if len(record) < at+4 {
+		return ""
+	}
+	length := int(binary.LittleEndian.Uint16(record[at:]))
+	offset := int(binary.LittleEndian.Uint16(record[at+2:]))
+	if offset+length > len(record) {
+		return ""
+	}
+	units := make([]uint16, length/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(record[offset+2*i:])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errLockHeld is returned by tryLockFile when another process holds the lock.
+var errLockHeld = errors.New("lock held by another process")
+
+// heldRunLocks are the lockfiles this process holds.
+var heldRunLocks sync.Map
+
+// acquireRunLock takes an exclusive advisory lock on databasePath's lockfile
+// so overlapping runs against the same baseline can't interleave. It waits
+// up to wait for a running scan to finish before giving up.
+func acquireRunLock(databasePath string, wait time.Duration) (*os.File, error) {
+	lockPath := databasePath + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lockfile: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = tryLockFile(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockHeld) || time.Now().After(deadline) {
+			owner := lockOwner(file)
+			file.Close()
+			if errors.Is(err, errLockHeld) {
+				return nil, fmt.Errorf("another gohash run%s is using %s; use -wait to wait for it", owner, databasePath)
+			}
+			return nil, fmt.Errorf("locking %s: %w", lockPath, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Record who holds the lock so a blocked run can say so.
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		releaseRunLock(file)
+		return nil, fmt.Errorf("writing lockfile: %w", err)
+	}
+	heldRunLocks.Store(lockPath, true)
+	return file, nil
+}
+
+func releaseRunLock(file *os.File) {
+	heldRunLocks.Delete(file.Name())
+	unlockFile(file)
+	file.Close()
+}
+
+// holdRunLock waits up to wait for no other process to be running against
+// databasePath and keeps any from starting until release is called. Unlike
+// acquireRunLock it doesn't record an owner, so a reader without write
+// access to the lockfile can take the lock as well. A lock this process
+// already holds is left as it is.
+func holdRunLock(databasePath string, wait time.Duration) (func(), error) {
+	lockPath := databasePath + ".lock"
+	if _, ok := heldRunLocks.Load(lockPath); ok {
+		return func() {}, nil
+	}
+	file, err := os.Open(lockPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// No run has ever locked the database.
+		return func() {}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening lockfile: %w", err)
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err = tryLockFile(file)
+		if err == nil {
+			return func() {
+				unlockFile(file)
+				file.Close()
+			}, nil
+		}
+		if !errors.Is(err, errLockHeld) || time.Now().After(deadline) {
+			owner := lockOwner(file)
+			file.Close()
+			if errors.Is(err, errLockHeld) {
+				return nil, fmt.Errorf("another gohash run%s is still using %s", owner, databasePath)
+			}
+			return nil, fmt.Errorf("locking %s: %w", lockPath, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func lockOwner(file *os.File) string {
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 32))
+	if err != nil {
+		return ""
+	}
+	pid := strings.TrimSpace(string(content))
+	if pid == "" {
+		return ""
+	}
+	return " (pid " + pid + ")"
+}
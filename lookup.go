@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runLookup(arguments []string) {
+	flags := flag.NewFlagSet("lookup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s lookup database_path path|hash...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return
+	}
+	databasePath := flags.Arg(0)
+
+	if _, err := os.Stat(databasePath); err != nil {
+		log.Fatalf("Error reading the database: %v", err)
+	}
+	db, err := openDatabaseReadOnly(databasePath)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	defer closeDatabase(db)
+
+	found := false
+	for _, query := range flags.Args()[1:] {
+		records, err := lookupRecords(db, query)
+		if err != nil {
+			log.Fatalf("Error querying the database: %v", err)
+		}
+		if len(records) == 0 {
+			fmt.Fprintf(os.Stderr, "No records found for %s\n", query)
+			continue
+		}
+		found = true
+		for _, record := range records {
+			fmt.Printf("%s  %s  %s\n", record.Hash, displayPath(record.RootID), displayPath(record.RelPath))
+		}
+	}
+	if !found {
+		os.Exit(1)
+	}
+}
+
+// storedRecord is a row of the file_hashes table.
+type storedRecord struct {
+	RootID  string
+	RelPath string
+	Hash    string
+}
+
+// lookupRecords returns the records stored for query when it is a path, or
+// every record with that hash when it looks like one. A path may be given
+// relative to its root or in full, in which case it is matched against the
+// root IDs that are absolute paths. Each root's path policy is applied.
+func lookupRecords(db *sql.DB, query string) ([]storedRecord, error) {
+	records, err := lookupPath(db, query)
+	if err != nil || len(records) > 0 || !isHexString(query) {
+		return records, err
+	}
+	return queryRecords(db, "SELECT root_id, filename, hash FROM file_hashes WHERE hash = ? ORDER BY root_id, filename",
+		strings.ToLower(query))
+}
+
+func lookupPath(db *sql.DB, query string) ([]storedRecord, error) {
+	rows, err := db.Query(`SELECT DISTINCT file_hashes.root_id, COALESCE(roots.path_policy, ?)
+		FROM file_hashes LEFT JOIN roots ON roots.root_id = file_hashes.root_id
+		ORDER BY file_hashes.root_id`, PathPreserve)
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]string)
+	var rootIDs []string
+	for rows.Next() {
+		var rootID, policy string
+		err = rows.Scan(&rootID, &policy)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rootIDs = append(rootIDs, rootID)
+		policies[rootID] = policy
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slashPath := filepath.ToSlash(filepath.Clean(query))
+	var records []storedRecord
+	for _, rootID := range rootIDs {
+		rel := slashPath
+		rootPrefix := strings.TrimSuffix(filepath.ToSlash(rootID), "/") + "/"
+		if rootID != "" && strings.HasPrefix(slashPath, rootPrefix) {
+			rel = slashPath[len(rootPrefix):]
+		}
+		found, err := queryRecords(db, "SELECT root_id, filename, hash FROM file_hashes WHERE root_id = ? AND filename = ?",
+			rootID, dbPath(normalizePath(policies[rootID], rel)))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	return records, nil
+}
+
+func queryRecords(db *sql.DB, query string, args ...any) ([]storedRecord, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []storedRecord
+	for rows.Next() {
+		var record storedRecord
+		err = rows.Scan(&record.RootID, &record.RelPath, &record.Hash)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func isHexString(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Mail transports. smtp submits to an authenticated server over STARTTLS;
+// sendmail hands the message to the local sendmail binary; local speaks
+// plain SMTP to an MTA on this host, over TCP or a unix socket, relying on
+// its configured smarthost.
+const (
+	MailSMTP     = "smtp"
+	MailSendmail = "sendmail"
+	MailLocal    = "local"
+)
+
+// mailOptions selects how notification emails are delivered.
+type mailOptions struct {
+	Transport string
+	// Server is host:port for smtp and local, or a socket path for local.
+	Server   string
+	Sendmail string
+	PGP      pgpOptions
+	// Attempts is how many times a notification is tried before its
+	// delivery counts as failed, waiting Backoff before the first retry
+	// and twice as long before each one after.
+	Attempts int
+	Backoff  time.Duration
+}
+
+func (o *mailOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.Transport, "mailer", MailSMTP, "how the email is delivered: smtp, sendmail, local (plain SMTP to an MTA on this host), graph, sendgrid or ses")
+	flags.StringVar(&o.Server, "smtp-server", "", "host:port to deliver to, or a unix socket path for -mailer local (default smtp.gmail.com:587, or localhost:25 for local)")
+	flags.StringVar(&o.Sendmail, "sendmail", "/usr/sbin/sendmail", "sendmail binary used by -mailer sendmail")
+	flags.IntVar(&o.Attempts, "mail-attempts", 3, "how many times to try delivering a notification before the delivery counts as failed")
+	flags.DurationVar(&o.Backoff, "mail-backoff", 30*time.Second, "how long to wait before retrying a failed delivery, doubling after each retry")
+	o.PGP.register(flags)
+}
+
+// checkMailOptions validates the transport and fills in its default server.
+func checkMailOptions(options *mailOptions) error {
+	if options.Attempts < 1 {
+		return fmt.Errorf("-mail-attempts must be at least 1")
+	}
+	switch options.Transport {
+	case MailSMTP:
+		if options.Server == "" {
+			options.Server = "smtp.gmail.com:587"
+		}
+	case MailLocal:
+		if options.Server == "" {
+			options.Server = "localhost:25"
+		}
+	case MailSendmail:
+		_, err := exec.LookPath(options.Sendmail)
+		if err != nil {
+			return fmt.Errorf("finding sendmail: %v", err)
+		}
+	default:
+		err := checkMailAPI(options)
+		if err != nil {
+			return err
+		}
+	}
+	if options.PGP.enabled() {
+		_, err := exec.LookPath(options.PGP.Program)
+		if err != nil {
+			return fmt.Errorf("finding gpg: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendEmail delivers a report with the configured transport, protected with
+// PGP/MIME if enabled. An urgent report is marked high priority, and the
+// runs it covers are listed in an X-Gohash-Run-ID header for filtering.
+func sendEmail(dest string, subject string, body io.Reader, urgent bool, runIDs []string, options mailOptions) error {
+	from := From
+
+	// The message is protected before connecting, so a gpg failure doesn't
+	// leave a half-sent message behind.
+	mimeHeader := ""
+	if options.PGP.enabled() {
+		contentType, protected, err := pgpProtect(options.PGP, body)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(protected.Name())
+		defer protected.Close()
+		mimeHeader = "MIME-Version: 1.0\n" +
+			"Content-Type: " + contentType + "\n"
+		body = protected
+	} else {
+		// Translated reports aren't plain ASCII.
+		mimeHeader = "MIME-Version: 1.0\n" +
+			"Content-Type: text/plain; charset=utf-8\n" +
+			"Content-Transfer-Encoding: 8bit\n"
+	}
+
+	priorityHeader := ""
+	if urgent {
+		priorityHeader = "X-Priority: 1 (Highest)\nImportance: high\n"
+	}
+	runHeader := ""
+	if len(runIDs) > 0 {
+		runHeader = "X-Gohash-Run-ID: " + strings.Join(runIDs, ", ") + "\n"
+	}
+
+	// The body is streamed from the spooled report rather than built in
+	// memory.
+	message := io.MultiReader(
+		strings.NewReader("From: "+from+"\n"+
+			"To: "+dest+"\n"+
+			"Subject: "+mime.QEncoding.Encode("utf-8", subject)+"\n"+
+			runHeader+
+			priorityHeader+
+			mimeHeader+"\n"),
+		body,
+		strings.NewReader("\n"))
+
+	var err error
+	switch options.Transport {
+	case MailSendmail:
+		err = deliverSendmail(options.Sendmail, from, dest, message)
+	case MailLocal:
+		err = deliverSMTP(options.Server, false, from, dest, message)
+	case MailGraph:
+		err = deliverGraph(from, message)
+	case MailSendGrid:
+		err = deliverSendGrid(from, dest, subject, body)
+	case MailSES:
+		err = deliverSES(from, dest, message)
+	default:
+		err = deliverSMTP(options.Server, true, from, dest, message)
+	}
+	return err
+}
+
+// deliverSMTP sends message to server. An authenticated submission requires
+// STARTTLS; a local MTA is trusted as is.
+func deliverSMTP(server string, authenticate bool, from, dest string, message io.Reader) error {
+	network, host := "tcp", "localhost"
+	if strings.HasPrefix(server, "/") {
+		network = "unix"
+	} else {
+		var err error
+		host, _, err = net.SplitHostPort(server)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, err := net.Dial(network, server)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if authenticate {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err == nil {
+			err = client.Auth(smtp.PlainAuth("", from, Password, host))
+		}
+	}
+	if err == nil {
+		err = client.Mail(from)
+	}
+	if err == nil {
+		err = client.Rcpt(dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, message)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// deliverSendmail pipes message to the sendmail binary, which queues it for
+// the system's MTA.
+func deliverSendmail(program, from, dest string, message io.Reader) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, "-i", "-f", from, "--", dest)
+	cmd.Stdin = message
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("running %s: %v: %s", program, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
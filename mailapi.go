@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API mail transports, for environments where SMTP is blocked entirely.
+// Credentials come from each provider's conventional environment variables.
+const (
+	MailGraph    = "graph"
+	MailSendGrid = "sendgrid"
+	MailSES      = "ses"
+)
+
+// apiClient is used for every API request, of mail transports and
+// ticketing systems alike; they are called once at the end of a scan, so a
+// generous timeout is fine.
+var apiClient = &http.Client{Timeout: time.Minute}
+
+// requireEnv returns an error naming the first of names that isn't set.
+func requireEnv(names ...string) error {
+	for _, name := range names {
+		if os.Getenv(name) == "" {
+			return fmt.Errorf("%s is not set", name)
+		}
+	}
+	return nil
+}
+
+// awsRegion is the region SES requests are sent to.
+func awsRegion() string {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return region
+}
+
+// checkMailAPI validates the credentials an API transport needs.
+func checkMailAPI(options *mailOptions) error {
+	switch options.Transport {
+	case MailGraph:
+		return requireEnv("AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET")
+	case MailSendGrid:
+		// SendGrid only accepts structured content, not a raw MIME message.
+		if options.PGP.enabled() {
+			return fmt.Errorf("the sendgrid mailer can't send PGP/MIME messages")
+		}
+		return requireEnv("SENDGRID_API_KEY")
+	case MailSES:
+		if awsRegion() == "" {
+			return fmt.Errorf("AWS_REGION is not set")
+		}
+		return requireEnv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY")
+	}
+	return fmt.Errorf("unknown mail transport: %s", options.Transport)
+}
+
+// canonicalMessage reads a whole message, converting bare line feeds to
+// CRLF as raw MIME APIs expect. The APIs take the message inside a JSON
+// document, so it has to be held in memory.
+func canonicalMessage(message io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")), nil
+}
+
+// doAPI sends a request and turns a non-2xx response into an error. A
+// successful response is decoded into result as JSON, unless it is nil.
+func doAPI(req *http.Request, result any) error {
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Host, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// deliverGraph sends a raw MIME message as From through Microsoft Graph,
+// authenticating as an app registration with the Mail.Send permission.
+func deliverGraph(from string, message io.Reader) error {
+	data, err := canonicalMessage(message)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {os.Getenv("AZURE_CLIENT_ID")},
+		"client_secret": {os.Getenv("AZURE_CLIENT_SECRET")},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	}
+	tokenURL := "https://login.microsoftonline.com/" + url.PathEscape(os.Getenv("AZURE_TENANT_ID")) + "/oauth2/v2.0/token"
+	resp, err := apiClient.PostForm(tokenURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return fmt.Errorf("reading the Graph token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("getting a Graph token: %s: %s", resp.Status, token.ErrorDescription)
+	}
+
+	sendURL := "https://graph.microsoft.com/v1.0/users/" + url.PathEscape(from) + "/sendMail"
+	req, err := http.NewRequest(http.MethodPost, sendURL, strings.NewReader(base64.StdEncoding.EncodeToString(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Content-Type", "text/plain")
+	return doAPI(req, nil)
+}
+
+// deliverSendGrid sends a plain text message through the SendGrid v3 API.
+func deliverSendGrid(from, dest, subject string, body io.Reader) error {
+	text, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	type address struct {
+		Email string `json:"email"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	payload, err := json.Marshal(struct {
+		Personalizations []map[string][]address `json:"personalizations"`
+		From             address                `json:"from"`
+		Subject          string                 `json:"subject"`
+		Content          []content              `json:"content"`
+	}{
+		Personalizations: []map[string][]address{{"to": {{dest}}}},
+		From:             address{from},
+		Subject:          subject,
+		Content:          []content{{"text/plain", string(text)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("SENDGRID_API_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+	return doAPI(req, nil)
+}
+
+// deliverSES sends a raw MIME message through the Amazon SES v2 API.
+func deliverSES(from, dest string, message io.Reader) error {
+	data, err := canonicalMessage(message)
+	if err != nil {
+		return err
+	}
+
+	type raw struct {
+		Data []byte
+	}
+	payload, err := json.Marshal(struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct{ Raw raw }
+	}{
+		FromEmailAddress: from,
+		Destination:      struct{ ToAddresses []string }{[]string{dest}},
+		Content:          struct{ Raw raw }{raw{data}},
+	})
+	if err != nil {
+		return err
+	}
+
+	region := awsRegion()
+	req, err := http.NewRequest(http.MethodPost, "https://email."+region+".amazonaws.com/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, payload, region, "ses", time.Now())
+	return doAPI(req, nil)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header to
+// req, using the standard AWS credential environment variables.
+func signAWSRequest(req *http.Request, payload []byte, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	// Every header set so far is signed, along with the host.
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+os.Getenv("AWS_ACCESS_KEY_ID")+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
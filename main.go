@@ -1,209 +1,367 @@
 package main
 
 import (
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	_ "modernc.org/sqlite"
-	"net/smtp"
 	"os"
-	"path/filepath"
-	"sort"
-	"strings"
-	"sync"
+	"time"
 )
 
+// writeBatchSize is the number of results looked up and written to the
+// database per transaction.
+const writeBatchSize = 256
+
 type HashResult struct {
 	FilePath string
+	RelPath  string
 	Hash     string
+	Size     int64
+	ModTime  int64
+	Mode     os.FileMode
+	// Entropy is the estimated entropy of the file's content, if measured.
+	Entropy sql.NullFloat64
+	// MIME is the file's detected content type, if detected.
+	MIME     string
+	Err      error
+	TimedOut bool
+	// Deferred marks a stored file that wasn't hashed because it isn't due
+	// for verification in this run.
+	Deferred bool
+	// Skipped marks an empty or special file left out of the baseline by
+	// policy unless it is already in it.
+	Skipped bool
+	// Parity is what was found in the file's repair data, if it is kept.
+	Parity *parityScan
+	// Quick is the quick hash of a large file, and QuickOnly reports that
+	// it matched the baseline, so the file wasn't hashed in full.
+	Quick     string
+	QuickOnly bool
+	// Fast reports that the file's stored hash was taken under -fast, which
+	// also sets QuickOnly.
+	Fast bool
+	// Gatekeeper is the comma-separated Gatekeeper attributes the file
+	// has, if read.
+	Gatekeeper sql.NullString
+	// Privileges is the comma-separated setuid, setgid and capabilities
+	// the file runs with, if read.
+	Privileges sql.NullString
+	// FileID is the file's device and inode, where the system has them.
+	FileID sql.NullString
+	// walkPath is the path relative to the root as the walk found it, by
+	// which the file can be hashed again.
+	walkPath string
+}
+
+// commands maps subcommand names to their entry points. Anything else on the
+// command line is treated as the arguments of a scan.
+var commands = map[string]func(args []string){
+	"stats":           runStats,
+	"lookup":          runLookup,
+	"db":              runDB,
+	"bench":           runBench,
+	"daemon":          runDaemon,
+	"manifest":        runManifest,
+	"accept":          runAccept,
+	"approve":         runApprove,
+	"approvers":       runApprovers,
+	"prune":           runPrune,
+	"report":          runReport,
+	"evidence":        runEvidence,
+	"aide":            runAIDE,
+	"osquery":         runOsquery,
+	"install-service": runInstallService,
+	"service":         runService,
+	"config":          runConfig,
+	"init":            runInit,
+	"sidecar":         runSidecar,
+	"repair":          runRepair,
+	"baseline":        runBaseline,
+	"notify":          runNotify,
+	"findings":        runFindings,
+	"verify-backup":   runVerifyBackup,
+	"verify-summary":  runVerifySummary,
 }
 
 func main() {
-	if len(os.Args) < 3 {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	runScan(os.Args[1:])
+}
+
+func runScan(arguments []string) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	format := flags.String("format", "text", "report format written to stdout: text, sarif, cef or wazuh (one Wazuh FIM-style JSON event per line)")
+	outputPath := flags.String("output", "", "write the report to this file instead of stdout")
+	streamFormat := flags.String("stream", "", "write every file result to stdout as it arrives, one JSON object per line (ndjson), leaving the report to -output")
+	var options scanOptions
+	options.register(flags)
+	subjectTemplate := flags.String("subject-template", "", "Go template for the email subject, e.g. '[gohash][{{.Hostname}}] {{.Changed}} mismatches'")
+	bodyTemplate := flags.String("body-template", "", "file with a Go template for the email body (default: the text report)")
+	pprofAddr := flags.String("pprof", "", "serve net/http/pprof on this loopback address, e.g. localhost:6060")
+	maxMemory := flags.String("max-memory", "", "abort the scan if the heap grows beyond this size, e.g. 512M")
+	translations := flags.String("translations", "", translationsUsage)
+	var mail mailOptions
+	mail.register(flags)
+	var tickets ticketOptions
+	tickets.register(flags)
+	var pages pageOptions
+	pages.register(flags)
+	var mqtt mqttOptions
+	mqtt.register(flags)
+	var events sinkOptions
+	events.register(flags)
+	var summary summaryOptions
+	summary.register(flags)
+	var self selfCheckOptions
+	self.register(flags)
+	var resources resourceOptions
+	resources.register(flags)
+	flags.Usage = func() {
 		programName := os.Args[0]
-		fmt.Printf("Usage: %s database_path root_directory email", programName)
-		return
+		fmt.Fprintf(flags.Output(), "Usage: %s [options] database_path root_directory [email]\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s daemon [options] database_path root_directory email\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s config check|print config_file\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s init [options] -profile linux-system|web-root|media-archive\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s stats database_path\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s lookup database_path path|hash...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s db vacuum|check|backup|seal|unseal database_path\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s bench [options] directory\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s sidecar write|verify [options] directory\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s manifest keygen|create|sign ...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s accept [options] database_path root_directory path...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s approve [options] database_path [changeset_id]\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s approvers add|remove|list|require|release database_path ...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s repair [options] database_path root_directory path...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s prune [options] database_path root_directory\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s baseline save|delete|list [options] database_path root_directory [name]\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s report audit [options] database_path\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s findings list|ack [options] database_path ...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s verify-backup [options] database_path root_directory backup_directory\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s verify-summary -key public_key summary_file...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s notify test [options] email | -config file\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s evidence verify|head log_path\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s aide import|export [options] database_path root_directory ...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s osquery database_path\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s install-service [options] -- daemon_arguments...\n", programName)
+		fmt.Fprintf(flags.Output(), "       %s service install|start|stop|remove [options] (Windows)\n", programName)
+		fmt.Fprintf(flags.Output(), "Any option can also be set with a GOHASH_ environment variable, e.g. GOHASH_SMTP_SERVER for -smtp-server.\n")
+		flags.PrintDefaults()
 	}
+	parseFlags(flags, arguments)
+	self.check()
 
-	databasePath := os.Args[1]
-	rootDirectory := os.Args[2]
+	args := flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		return
+	}
 
-	files, err := os.ReadDir(rootDirectory)
-	SortFileSizeDescend(files)
+	switch *format {
+	case "text", "sarif", "cef", "wazuh":
+	default:
+		log.Fatalf("Unknown report format: %s", *format)
+	}
+	switch *streamFormat {
+	case "":
+	case "ndjson":
+		options.Stream = newResultStream(os.Stdout)
+	default:
+		log.Fatalf("Unknown stream format: %s", *streamFormat)
+	}
+	options.PrintMatches = *format == "text" && options.Stream == nil
 
-	if err != nil {
-		log.Fatalf("Error reading the specified directory: %v", err)
+	if *maxMemory != "" {
+		limit, err := parseByteSize(*maxMemory)
+		if err != nil {
+			log.Fatalf("Error parsing -max-memory: %v", err)
+		}
+		limitMemory(limit)
+	}
+	resources.apply()
+	if *translations != "" {
+		if err := loadTranslations(*translations); err != nil {
+			log.Fatalf("Error %v", err)
+		}
 	}
 
-	db, err := sql.Open("sqlite", databasePath)
+	templates, err := loadEmailTemplates(*subjectTemplate, *bodyTemplate)
 	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
+		log.Fatalf("Error %v", err)
 	}
-	defer func(db *sql.DB) {
-		err := db.Close()
+
+	if len(args) > 2 {
+		err = checkMailOptions(&mail)
 		if err != nil {
-			log.Fatalf("Error closing the database: %v", err)
+			log.Fatalf("Error checking the mail settings: %v", err)
 		}
-	}(db)
-
-	// Create the "file_hashes" table if it doesn't exist.
-	createTableStmt := `
-	CREATE TABLE IF NOT EXISTS file_hashes (
-		filename TEXT PRIMARY KEY,
-		hash TEXT
-	);
-	`
-	_, err = db.Exec(createTableStmt)
+	}
+	err = checkTicketOptions(tickets)
 	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
-	}
-
-	fileCh := make(chan string)
-	hashCh := make(chan HashResult)
-
-	var wg sync.WaitGroup
-	numWorkers := 8
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for filePath := range fileCh {
-				// Compute the MD5 hash of the file.
-				hash, err := computeFileMD5Hash(filePath)
-				if err != nil {
-					log.Printf("Error computing MD5 hash for %s: %v", filePath, err)
-					continue
-				}
-
-				hashCh <- HashResult{FilePath: filePath, Hash: hash}
-			}
-		}()
+		log.Fatalf("Error checking the ticket settings: %v", err)
 	}
-
-	go func() {
-		for _, file := range files {
-			if !file.IsDir() {
-				fileCh <- filepath.Join(rootDirectory, file.Name())
-			}
-		}
-		close(fileCh)
-
-		wg.Wait()
-		close(hashCh)
-	}()
-
-	var hashError = false
-	var hashNew = false
-	var hashLogs = ""
-	var hashSuccess = 0
-
-	for result := range hashCh {
-		var dbHash string
-		err = db.QueryRow("SELECT hash FROM file_hashes WHERE filename = ?", result.FilePath).Scan(&dbHash)
-
-		if errors.Is(sql.ErrNoRows, err) {
-			// File is not in the database; insert it.
-			_, err = db.Exec("INSERT INTO file_hashes (filename, hash) VALUES (?, ?)", result.FilePath, result.Hash)
-			if err != nil {
-				hashLogs += fmt.Sprintf("Error inserting MD5 hash for %s: %v\n", result.FilePath, err)
-				hashError = true
-			} else {
-				hashLogs += fmt.Sprintf("Inserted MD5 hash for %s: %s\n", result.FilePath, result.Hash)
-				hashNew = true
-			}
-		} else if err != nil {
-			hashLogs += fmt.Sprintf("Error querying MD5 hash for %s: %v\n", result.FilePath, err)
-			hashError = true
-		} else if result.Hash != dbHash {
-			hashLogs += fmt.Sprintf("MD5 hash mismatch for %s: stored=%s, computed=%s\n", result.FilePath, dbHash, result.Hash)
-			hashError = true
-		} else {
-			hashSuccess++
-			fmt.Printf("MD5 hash match for %s: computed=%s\n", result.FilePath, dbHash)
-		}
+	err = checkPageOptions(pages)
+	if err != nil {
+		log.Fatalf("Error checking the paging settings: %v", err)
 	}
-	hashLogs += fmt.Sprintf("%d files have passed the integrity tests\n", hashSuccess)
-
-	fmt.Print(hashLogs)
-
-	if len(os.Args) > 3 {
-		dest := os.Args[3]
-		subject := ""
+	err = checkMQTTOptions(mqtt)
+	if err != nil {
+		log.Fatalf("Error checking the MQTT settings: %v", err)
+	}
+	err = checkSinkOptions(events)
+	if err != nil {
+		log.Fatalf("Error checking the event sink settings: %v", err)
+	}
+	err = checkSummaryOptions(summary)
+	if err != nil {
+		log.Fatalf("Error checking the run summary settings: %v", err)
+	}
+	preflight := preflightCheck{
+		Database: args[0],
+		Root:     args[1],
+		ReadOnly: options.ReadOnly || options.Against != "",
+		Tickets:  tickets,
+		Pages:    pages,
+		MQTT:     mqtt,
+		Events:   events,
+		Summary:  summary,
+	}
+	if len(args) > 2 {
+		preflight.Mail = &mail
+	}
+	requirePreflight(preflight.problems())
 
-		if hashError {
-			subject = "Error detected while verifying integrity"
-		} else if hashNew {
-			subject = "New files found in the database"
-		} else {
-			subject = "Integrity check successful"
+	if *pprofAddr != "" {
+		err := servePprof(*pprofAddr)
+		if err != nil {
+			log.Fatalf("Error starting the pprof server: %v", err)
 		}
-
-		sendEmail(dest, subject, hashLogs)
 	}
-}
 
-func SortFileSizeDescend(files []os.DirEntry) {
-	sort.Slice(files, func(i, j int) bool {
-		info1, err := files[i].Info()
+	output := os.Stdout
+	if *outputPath != "" {
+		output, err = os.Create(*outputPath)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Error creating the report file: %v", err)
 		}
-		info2, err := files[j].Info()
+	}
+	reportOutput := io.Writer(output)
+	if options.Stream != nil && *outputPath == "" {
+		// Stdout only carries the stream.
+		reportOutput = io.Discard
+	}
+	var stream findingWriter
+	if *format != "text" {
+		stream, err = newFindingWriter(reportOutput, *format)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Error writing the report: %v", err)
 		}
-		return info1.Size() > info2.Size()
-	})
-}
+	}
 
-func computeFileMD5Hash(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+	options.TrackMatches = pages.Service != ""
+	report, err := scanRoot(args[0], args[1], &options, stream)
 	if err != nil {
-		return "", err
+		log.Fatalf("Error %v", err)
 	}
-	defer func(file *os.File) {
-		err := file.Close()
+	defer report.Remove()
+
+	if *format == "text" {
+		var text io.Reader
+		text, err = report.Text()
+		if err == nil {
+			_, err = io.Copy(reportOutput, text)
+		}
+	} else {
+		err = report.CloseStream()
+	}
+	if err != nil {
+		log.Fatalf("Error writing the report: %v", err)
+	}
+	if output != os.Stdout {
+		err = output.Close()
 		if err != nil {
-			log.Fatalf("Error closing the file: %v", err)
+			log.Fatalf("Error closing the report file: %v", err)
 		}
-	}(file)
+	}
 
-	hash := md5.New()
-	_, err = io.Copy(hash, file)
+	// Paging on-call comes first, and a failure to page, file tickets or
+	// publish events doesn't keep the email from being sent.
+	failed := false
+	err = pageOnCall(args[0], options.LockWait, report, pages)
 	if err != nil {
-		return "", err
+		log.Printf("Error paging on-call: %v", err)
+		failed = true
+	}
+	err = fileTickets(args[0], options.LockWait, report.Run, tickets)
+	if err != nil {
+		log.Printf("Error filing tickets: %v", err)
+		failed = true
+	}
+	err = publishMQTT(report, mqtt)
+	if err != nil {
+		log.Printf("Error publishing to the MQTT broker: %v", err)
+		failed = true
+	}
+	err = publishEvents(report, events)
+	if err != nil {
+		log.Printf("Error publishing to the event sink: %v", err)
+		failed = true
+	}
+	err = pushSummary(args[0], report, summary)
+	if err != nil {
+		log.Printf("Error %v", err)
+		failed = true
+	}
+	if len(args) > 2 {
+		err = notify(args[2], templates, mail, []*scanReport{report})
+		if !options.ReadOnly {
+			recordErr := recordNotification(args[0], options.LockWait, []string{report.Run.RunID}, err)
+			if recordErr != nil {
+				log.Printf("Error recording the notification: %v", recordErr)
+			}
+		}
+		if err != nil {
+			log.Printf("Error sending the email to %s: %v", args[2], err)
+			failed = true
+		}
+	}
+	if failed {
+		// os.Exit skips the deferred removal.
+		report.Remove()
+		os.Exit(1)
 	}
-
-	hashBytes := hash.Sum(nil)
-	hashStr := hex.EncodeToString(hashBytes)
-	return strings.ToLower(hashStr), nil
 }
 
-func sendEmail(dest string, subject string, body string) {
-	from := From
-	password := Password
-
-	to := []string{
-		dest,
+// notify emails the reports to dest as a single message, retrying with
+// backoff, and returns the last error if every attempt failed.
+func notify(dest string, templates *emailTemplates, mail mailOptions, reports []*scanReport) error {
+	data := newReportData(reports)
+	subject, err := templates.Subject(data)
+	if err != nil {
+		log.Fatalf("Error rendering the email subject: %v", err)
 	}
+	urgent := data.Urgent()
 
-	smtpHost := "smtp.gmail.com"
-	smtpPort := "587"
-
-	message := []byte("From: " + from + "\n" +
-		"To: " + dest + "\n" +
-		"Subject: " + subject + "\n\n" +
-		body + "\n")
-
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, message)
-	if err != nil {
-		fmt.Println(err)
-		return
+	delay := mail.Backoff
+	for attempt := 1; ; attempt++ {
+		// The body is rendered again for each attempt, since a failed one
+		// may have read part of it.
+		body, err := templates.Body(data)
+		if err != nil {
+			log.Fatalf("Error rendering the email body: %v", err)
+		}
+		err = sendEmail(dest, subject, body, urgent, data.RunIDs, mail)
+		if err == nil || attempt >= mail.Attempts {
+			return err
+		}
+		log.Printf("Error sending the email to %s (attempt %d of %d, retrying in %s): %v", dest, attempt, mail.Attempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
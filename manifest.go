@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deploymentManifest announces changes a deployment makes under a root, so
+// the next scan can accept them into the baseline instead of reporting
+// them as mismatches. It is only trusted with a valid ed25519 signature in
+// a .sig file alongside it.
+type deploymentManifest struct {
+	RootID  string           `json:"rootId"`
+	Algo    string           `json:"algo"`
+	Created time.Time        `json:"created"`
+	Changes []manifestChange `json:"changes"`
+}
+
+// manifestChange is the hash a file is expected to have after deployment.
+// Path is relative to the root and slash-separated, like stored records.
+type manifestChange struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+func runManifest(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s manifest keygen key_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s manifest create [options] root_directory path...\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s manifest sign key_path manifest_path\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s manifest sign-binary key_path binary_path\n", programName)
+	}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "keygen":
+		runManifestKeygen(arguments[1:])
+	case "create":
+		runManifestCreate(arguments[1:])
+	case "sign":
+		runManifestSign(arguments[1:])
+	case "sign-binary":
+		runManifestSignBinary(arguments[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// runManifestKeygen writes a new ed25519 private key to key_path and its
+// public key, which scans are given with -manifest-key, to key_path.pub.
+func runManifestKeygen(arguments []string) {
+	if len(arguments) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s manifest keygen key_path\n", os.Args[0])
+		os.Exit(2)
+	}
+	keyPath := arguments[0]
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Error generating the key: %v", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err == nil {
+		err = writeNewFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	}
+	if err != nil {
+		log.Fatalf("Error writing the private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err == nil {
+		err = writeNewFile(keyPath+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+	}
+	if err != nil {
+		log.Fatalf("Error writing the public key: %v", err)
+	}
+	fmt.Printf("Wrote %s and %s\n", keyPath, keyPath+".pub")
+}
+
+// writeNewFile is os.WriteFile that refuses to overwrite an existing file.
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runManifestCreate hashes the given files as they are now and prints a
+// manifest announcing them, for deployment tooling to sign and drop in the
+// manifest directory.
+func runManifestCreate(arguments []string) {
+	flags := flag.NewFlagSet("manifest create", flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "root ID the manifest applies to (default: the root's absolute path)")
+	algo := flags.String("algo", "md5", "hash algorithm of the root: md5, sha1, sha256 or sha512")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s manifest create [options] root_directory path...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, ok := hashAlgorithms[*algo]; !ok {
+		log.Fatalf("Error: unknown hash algorithm %q (supported: %s)", *algo, strings.Join(hashAlgorithmNames(), ", "))
+	}
+
+	rootDirectory := flags.Arg(0)
+	rootID := *rootIDFlag
+	if rootID == "" {
+		var err error
+		rootID, err = defaultRootID(rootDirectory)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+	}
+
+	manifest := deploymentManifest{RootID: rootID, Algo: *algo, Created: time.Now().UTC()}
+	for _, name := range flags.Args()[1:] {
+		filePath, rel, err := resolveRootPath(rootDirectory, name)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		hash, err := computeFileHash(filePath, *algo)
+		if err != nil {
+			log.Fatalf("Error computing %s hash for %s: %v", hashLabel(*algo), displayPath(filePath), err)
+		}
+		manifest.Changes = append(manifest.Changes, manifestChange{Path: rel, Hash: hash})
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(manifest)
+	if err != nil {
+		log.Fatalf("Error writing the manifest: %v", err)
+	}
+}
+
+// runManifestSign writes manifest_path.sig, the base64 ed25519 signature of
+// the manifest file exactly as it is.
+func runManifestSign(arguments []string) {
+	if len(arguments) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s manifest sign key_path manifest_path\n", os.Args[0])
+		os.Exit(2)
+	}
+	private, err := readPrivateKey(arguments[0])
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+
+	data, err := os.ReadFile(arguments[1])
+	if err != nil {
+		log.Fatalf("Error reading the manifest: %v", err)
+	}
+	var manifest deploymentManifest
+	err = json.Unmarshal(data, &manifest)
+	if err == nil {
+		err = manifest.validate()
+	}
+	if err != nil {
+		log.Fatalf("Error in the manifest: %v", err)
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, data)) + "\n"
+	err = os.WriteFile(arguments[1]+".sig", []byte(signature), 0644)
+	if err != nil {
+		log.Fatalf("Error writing the signature: %v", err)
+	}
+}
+
+// validate checks that every change names a file under the root.
+func (m *deploymentManifest) validate() error {
+	if m.RootID == "" {
+		return errors.New("no rootId")
+	}
+	if m.Created.IsZero() {
+		return errors.New("no created time")
+	}
+	for _, change := range m.Changes {
+		p := change.Path
+		if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("%q is not a clean path relative to the root", p)
+		}
+		if change.Hash == "" || !isHexString(change.Hash) {
+			return fmt.Errorf("%q has no valid hash", p)
+		}
+	}
+	return nil
+}
+
+// readPrivateKey reads a PEM ed25519 private key written by manifest keygen.
+func readPrivateKey(keyPath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading the private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM private key", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the private key: %v", err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", keyPath)
+	}
+	return private, nil
+}
+
+// readPublicKey reads a PEM ed25519 public key written by manifest keygen.
+func readPublicKey(keyPath string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading the public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM public key", keyPath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the public key: %v", err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", keyPath)
+	}
+	return public, nil
+}
+
+// expectedChanges is what the manifests waiting for a root announce.
+type expectedChanges struct {
+	// Hashes maps record paths, normalized for the root's path policy, to
+	// their expected hash. Later manifests override earlier ones.
+	Hashes map[string]string
+	// Consumed lists the manifests that apply to the root, to be marked
+	// applied once the scan has used them.
+	Consumed []appliedManifest
+	// Rejected describes manifests that can't be trusted or used.
+	Rejected []Finding
+}
+
+// appliedManifest is a manifest as the database remembers it once applied,
+// so that one can't be replayed by renaming it back or copying it again.
+type appliedManifest struct {
+	Name string
+	// SignatureHash is the hex SHA-256 of the manifest's signature.
+	SignatureHash string
+	Created       time.Time
+}
+
+// loadExpectedChanges reads the signed manifests in dir, in name order,
+// that apply to rootID. Manifests for other roots are left untouched;
+// those already applied to it, or created before the last one applied,
+// are rejected.
+func loadExpectedChanges(db *sql.DB, dir string, key ed25519.PublicKey, rootID, pathPolicy, algo string) (*expectedChanges, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	applied, lastCreated, err := appliedManifests(db, rootID)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := &expectedChanges{Hashes: make(map[string]string)}
+	reject := func(name string, format string, args ...any) {
+		message := fmt.Sprintf("Rejected deployment manifest %s: %s", displayPath(name), fmt.Sprintf(format, args...))
+		expected.Rejected = append(expected.Rejected, Finding{Kind: FindingError, FilePath: name, Message: message})
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			reject(name, "%v", err)
+			continue
+		}
+		encoded, err := os.ReadFile(name + ".sig")
+		if err != nil {
+			reject(name, "no signature: %v", err)
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(key, data, signature) {
+			reject(name, "invalid signature")
+			continue
+		}
+
+		var manifest deploymentManifest
+		err = json.Unmarshal(data, &manifest)
+		if err == nil {
+			err = manifest.validate()
+		}
+		if err != nil {
+			reject(name, "%v", err)
+			continue
+		}
+		if manifest.RootID != rootID {
+			continue
+		}
+		if manifest.Algo != algo {
+			reject(name, "hashes are %s but the root uses %s", manifest.Algo, algo)
+			continue
+		}
+		sum := sha256.Sum256(signature)
+		signatureHash := hex.EncodeToString(sum[:])
+		if applied[signatureHash] {
+			reject(name, "already applied")
+			continue
+		}
+		if manifest.Created.Unix() < lastCreated {
+			reject(name, "created at %s, before the last manifest applied to the root", manifest.Created.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		for _, change := range manifest.Changes {
+			expected.Hashes[normalizePath(pathPolicy, change.Path)] = strings.ToLower(change.Hash)
+		}
+		expected.Consumed = append(expected.Consumed, appliedManifest{Name: name, SignatureHash: signatureHash, Created: manifest.Created})
+	}
+	return expected, nil
+}
+
+// appliedManifests returns the signature hashes of the manifests applied
+// to rootID and when the latest of them was created.
+func appliedManifests(db *sql.DB, rootID string) (map[string]bool, int64, error) {
+	rows, err := db.Query("SELECT signature_hash, created_at FROM applied_manifests WHERE root_id = ?", rootID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	applied := make(map[string]bool)
+	var lastCreated int64
+	for rows.Next() {
+		var signatureHash string
+		var created int64
+		err = rows.Scan(&signatureHash, &created)
+		if err != nil {
+			return nil, 0, err
+		}
+		applied[signatureHash] = true
+		lastCreated = max(lastCreated, created)
+	}
+	return applied, lastCreated, rows.Err()
+}
+
+// markApplied records the consumed manifests as applied to rootID, and
+// renames them and their signatures so they are not read again.
+func (e *expectedChanges) markApplied(db *sql.DB, rootID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	for _, manifest := range e.Consumed {
+		_, err = tx.Exec("INSERT OR IGNORE INTO applied_manifests (root_id, signature_hash, created_at, applied_at) VALUES (?, ?, ?, ?)",
+			rootID, manifest.SignatureHash, manifest.Created.Unix(), now)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, manifest := range e.Consumed {
+		name := manifest.Name
+		for _, file := range []string{name, name + ".sig"} {
+			err := os.Rename(file, file+".applied")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
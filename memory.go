@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseByteSize parses sizes such as "512M", "2GiB" or "1048576".
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// limitMemory makes the garbage collector work to keep the heap under limit
+// and aborts the run if it still grows past it, rather than letting a
+// runaway scan push the host into swap or the OOM killer.
+func limitMemory(limit int64) {
+	debug.SetMemoryLimit(limit)
+
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	go func() {
+		for range time.Tick(time.Second) {
+			metrics.Read(sample)
+			if sample[0].Value.Uint64() <= uint64(limit) {
+				continue
+			}
+			// Garbage that simply hasn't been collected yet doesn't count.
+			runtime.GC()
+			metrics.Read(sample)
+			if used := sample[0].Value.Uint64(); used > uint64(limit) {
+				log.Fatalf("Error: heap usage of %d bytes exceeds -max-memory (%d bytes)", used, limit)
+			}
+		}
+	}()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// mqttSecrets lists the broker credentials read from the environment. Both
+// are optional, for brokers that allow anonymous clients.
+var mqttSecrets = []string{"MQTT_USERNAME", "MQTT_PASSWORD"}
+
+// mqttTimeout bounds each exchange with the broker.
+const mqttTimeout = 30 * time.Second
+
+// mqttOptions selects the MQTT broker scan events are published to, for
+// home automation such as Home Assistant or Node-RED to act on. Each
+// finding is published to <topic>/<host>/finding, and the run's summary,
+// retained so a new subscriber sees the last one, to <topic>/<host>/summary.
+// The payloads are the events of -stream ndjson.
+type mqttOptions struct {
+	// Broker is mqtt://host[:port], or mqtts://host[:port] for TLS.
+	Broker string
+	Topic  string
+	QoS    int
+	// CA is a PEM file of the certificates a TLS broker is verified with,
+	// instead of the system's, for a broker with its own CA.
+	CA string
+}
+
+func (o *mqttOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.Broker, "mqtt-broker", "", "publish findings and the run summary to this MQTT broker, mqtt://host:port or mqtts://host:port for TLS, with credentials from MQTT_USERNAME and MQTT_PASSWORD if set (default: off)")
+	flags.StringVar(&o.Topic, "mqtt-topic", "gohash", "topic prefix events are published under, as <topic>/<host>/finding and <topic>/<host>/summary")
+	flags.IntVar(&o.QoS, "mqtt-qos", 1, "MQTT quality of service level events are published with: 0, 1 or 2")
+	flags.StringVar(&o.CA, "mqtt-ca", "", "PEM file of the CA certificates an mqtts broker is verified with (default: the system's)")
+}
+
+// checkMQTTOptions validates the MQTT settings, if publishing is on.
+func checkMQTTOptions(options mqttOptions) error {
+	if options.Broker == "" {
+		return nil
+	}
+	parsed, err := url.Parse(options.Broker)
+	if err != nil || (parsed.Scheme != "mqtt" && parsed.Scheme != "mqtts") || parsed.Hostname() == "" {
+		return fmt.Errorf("-mqtt-broker must be an mqtt:// or mqtts:// URL, not %q", options.Broker)
+	}
+	if options.QoS < 0 || options.QoS > 2 {
+		return fmt.Errorf("-mqtt-qos must be 0, 1 or 2, not %d", options.QoS)
+	}
+	if options.Topic == "" || strings.ContainsAny(options.Topic, "+#") {
+		return fmt.Errorf("-mqtt-topic must be a topic without wildcards, not %q", options.Topic)
+	}
+	if options.CA != "" {
+		_, err = mqttRootCAs(options.CA)
+	}
+	return err
+}
+
+// publishMQTT publishes an event for each of the report's findings that
+// wasn't acknowledged, then the run's summary.
+func publishMQTT(report *scanReport, options mqttOptions) error {
+	if options.Broker == "" {
+		return nil
+	}
+	client, err := dialMQTT(options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	prefix := strings.TrimSuffix(options.Topic, "/") + "/" + mqttTopicLevel(report.Run.Hostname)
+	err = reportEvents(report, func(event *streamEvent) error {
+		// The summary is retained as the host's last known state.
+		return client.publishEvent(prefix+"/"+event.Type, event.Type == "summary", event)
+	})
+	if err != nil {
+		return err
+	}
+	return client.disconnect()
+}
+
+// mqttTopicLevel makes name usable as one level of a topic.
+func mqttTopicLevel(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '+' || r == '#' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func mqttRootCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the MQTT CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// mqttClient is a connection to an MQTT 3.1.1 broker that only publishes.
+type mqttClient struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	qos      int
+	packetID uint16
+}
+
+// MQTT control packet types, in the high nibble of the first byte.
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttPubRec     = 5
+	mqttPubRel     = 6
+	mqttPubComp    = 7
+	mqttDisconnect = 14
+)
+
+// mqttRefusals explains the CONNACK return codes.
+var mqttRefusals = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// dialMQTT connects to the broker of options and logs in.
+func dialMQTT(options mqttOptions) (*mqttClient, error) {
+	parsed, err := url.Parse(options.Broker)
+	if err != nil {
+		return nil, err
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "1883"
+		if parsed.Scheme == "mqtts" {
+			port = "8883"
+		}
+	}
+	address := net.JoinHostPort(parsed.Hostname(), port)
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	if parsed.Scheme == "mqtts" {
+		config := &tls.Config{ServerName: parsed.Hostname()}
+		if options.CA != "" {
+			config.RootCAs, err = mqttRootCAs(options.CA)
+			if err != nil {
+				return nil, err
+			}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the MQTT broker: %v", err)
+	}
+	client := &mqttClient{conn: conn, reader: bufio.NewReader(conn), qos: options.QoS}
+	err = client.connect()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to the MQTT broker %s: %v", address, err)
+	}
+	return client, nil
+}
+
+// connect logs in with a fresh client identifier and a clean session,
+// since nothing is subscribed to.
+func (c *mqttClient) connect() error {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	body = mqttAppendString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	flags := byte(0x02)    // clean session
+	user, password := os.Getenv("MQTT_USERNAME"), os.Getenv("MQTT_PASSWORD")
+	if user != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, 60) // keep alive, in seconds
+	body = mqttAppendString(body, "gohash-"+hex.EncodeToString(id))
+	if user != "" {
+		body = mqttAppendString(body, user)
+		if password != "" {
+			body = mqttAppendString(body, password)
+		}
+	}
+	err = c.write(mqttConnect<<4, body)
+	if err != nil {
+		return err
+	}
+	ack, err := c.read(mqttConnAck)
+	if err != nil {
+		return err
+	}
+	if len(ack) != 2 {
+		return fmt.Errorf("malformed CONNACK")
+	}
+	if ack[1] != 0 {
+		reason, ok := mqttRefusals[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[1])
+		}
+		return fmt.Errorf("connection refused: %s", reason)
+	}
+	return nil
+}
+
+func (c *mqttClient) publishEvent(topic string, retain bool, event *streamEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	err = c.publish(topic, retain, payload)
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %v", topic, err)
+	}
+	return nil
+}
+
+// publish sends payload to topic, waiting for the broker to acknowledge it
+// at QoS 1 and 2.
+func (c *mqttClient) publish(topic string, retain bool, payload []byte) error {
+	header := byte(mqttPublish<<4 | c.qos<<1)
+	if retain {
+		header |= 0x01
+	}
+	body := mqttAppendString(nil, topic)
+	if c.qos > 0 {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		body = binary.BigEndian.AppendUint16(body, c.packetID)
+	}
+	body = append(body, payload...)
+	err := c.write(header, body)
+	if err != nil || c.qos == 0 {
+		return err
+	}
+	if c.qos == 1 {
+		return c.expectAck(mqttPubAck)
+	}
+	err = c.expectAck(mqttPubRec)
+	if err != nil {
+		return err
+	}
+	err = c.write(mqttPubRel<<4|0x02, binary.BigEndian.AppendUint16(nil, c.packetID))
+	if err != nil {
+		return err
+	}
+	return c.expectAck(mqttPubComp)
+}
+
+// expectAck reads the acknowledgement of the last packet published.
+func (c *mqttClient) expectAck(kind byte) error {
+	body, err := c.read(kind)
+	if err != nil {
+		return err
+	}
+	if len(body) < 2 || binary.BigEndian.Uint16(body) != c.packetID {
+		return fmt.Errorf("the broker acknowledged another message")
+	}
+	return nil
+}
+
+func (c *mqttClient) disconnect() error {
+	return c.write(mqttDisconnect<<4, nil)
+}
+
+func (c *mqttClient) Close() error {
+	return c.conn.Close()
+}
+
+// write sends one packet with its remaining length.
+func (c *mqttClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+	c.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// read returns the body of the next packet, which must be of kind.
+func (c *mqttClient) read(kind byte) ([]byte, error) {
+	c.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return nil, fmt.Errorf("malformed packet length")
+		}
+		digit, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(c.reader, body)
+	if err != nil {
+		return nil, err
+	}
+	if header>>4 != kind {
+		return nil, fmt.Errorf("unexpected packet type %d from the broker", header>>4)
+	}
+	return body, nil
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
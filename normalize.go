@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Path normalization policies decide which spellings of a path refer to the
+// same record, so that case-insensitive or NFD filesystems (Windows, macOS)
+// don't produce spurious new and missing pairs.
+const (
+	PathPreserve = "preserve"
+	PathNFC      = "nfc"
+	PathCasefold = "casefold"
+)
+
+var caseFolder = cases.Fold()
+
+func validPathPolicy(policy string) bool {
+	switch policy {
+	case PathPreserve, PathNFC, PathCasefold:
+		return true
+	}
+	return false
+}
+
+// normalizePath returns the form of rel that is stored and looked up under
+// policy. Casefolding also applies NFC so that composed and decomposed
+// spellings fold alike. Names that aren't valid UTF-8 are left untouched.
+func normalizePath(policy, rel string) string {
+	if !utf8.ValidString(rel) {
+		return rel
+	}
+	switch policy {
+	case PathNFC:
+		return norm.NFC.String(rel)
+	case PathCasefold:
+		return caseFolder.String(norm.NFC.String(rel))
+	default:
+		return rel
+	}
+}
+
+// rootPathPolicy returns the policy recorded for rootID, or PathPreserve if
+// the root has never been scanned.
+func rootPathPolicy(db *sql.DB, rootID string) (string, error) {
+	var policy string
+	err := db.QueryRow("SELECT path_policy FROM roots WHERE root_id = ?", rootID).Scan(&policy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PathPreserve, nil
+	}
+	return policy, err
+}
+
+// setRootPathPolicy records policy for rootID, re-keying the root's existing
+// records if it differs from the policy they were stored under. Of records
+// that collapse onto the same path the first is kept and the others are
+// removed, with each collision logged and audited.
+func setRootPathPolicy(db *sql.DB, rootID, policy string) error {
+	if !validPathPolicy(policy) {
+		return fmt.Errorf("unknown path policy %q", policy)
+	}
+	current, err := rootPathPolicy(db, rootID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if current != policy {
+		rows, err := tx.Query("SELECT filename, hash FROM file_hashes WHERE root_id = ? ORDER BY filename", rootID)
+		if err != nil {
+			return err
+		}
+		var records [][2]string
+		for rows.Next() {
+			var filename, hash string
+			err = rows.Scan(&filename, &hash)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			records = append(records, [2]string{filename, hash})
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		actor := auditActor()
+		for _, record := range records {
+			filename, hash := record[0], record[1]
+			normalized := normalizePath(policy, filename)
+			if normalized == filename {
+				continue
+			}
+			result, err := tx.Exec("UPDATE OR IGNORE file_hashes SET filename = ? WHERE root_id = ? AND filename = ?",
+				dbPath(normalized), rootID, dbPath(filename))
+			if err != nil {
+				return err
+			}
+			if renamed, err := result.RowsAffected(); err != nil || renamed > 0 {
+				continue
+			}
+			// The record collapses onto an existing one, and left under
+			// its old spelling it would be reported missing by every scan.
+			_, err = tx.Exec("DELETE FROM file_hashes WHERE root_id = ? AND filename = ?", rootID, dbPath(filename))
+			if err == nil {
+				err = recordAudit(tx, auditEntry{Actor: actor, Action: AuditRemove, RootID: rootID, RelPath: filename, OldHash: hash,
+					Reason: fmt.Sprintf("same path as %s under the %s path policy", normalized, policy)})
+			}
+			if err != nil {
+				return err
+			}
+			log.Printf("Removed the record of %s, the same path as %s under the %s path policy: stored=%s",
+				displayPath(filename), displayPath(normalized), policy, hash)
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO roots (root_id, path_policy) VALUES (?, ?) ON CONFLICT (root_id) DO UPDATE SET path_policy = excluded.path_policy",
+		rootID, policy)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifier is one destination notifications are delivered to.
+type notifier struct {
+	Name string
+	Dest string
+	Mail mailOptions
+	// Desktop makes the notifier the desktop's rather than an email.
+	Desktop bool
+}
+
+// via names how n delivers notifications.
+func (n notifier) via() string {
+	if n.Desktop {
+		return "desktop notification"
+	}
+	return n.Mail.Transport
+}
+
+// runNotify sends a test message through every configured notifier, so that
+// broken credentials or an unreachable server show up before the first
+// real alert is lost.
+func runNotify(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s notify test [options] email\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s notify test -desktop\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s notify test -config file\n", programName)
+	}
+	if len(arguments) < 1 || arguments[0] != "test" {
+		usage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("notify test", flag.ExitOnError)
+	configPath := flags.String("config", "", "test the notifiers of every profile in this daemon configuration file")
+	desktop := flags.Bool("desktop", false, "show a test desktop notification instead of sending an email")
+	var mail mailOptions
+	mail.register(flags)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments[1:])
+
+	var notifiers []notifier
+	if *configPath != "" {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		// Profiles sharing a recipient and transport are tested once.
+		tested := make(map[string]bool)
+		for _, c := range config.Profiles {
+			profile := newDaemonProfile(c, config.Workers)
+			if profile.Desktop && !tested["desktop"] {
+				tested["desktop"] = true
+				notifiers = append(notifiers, notifier{Name: "profile " + profile.Name, Dest: "this session", Desktop: true})
+			}
+			if profile.Email == "" {
+				continue
+			}
+			key := strings.Join([]string{profile.Email, profile.Mail.Transport, profile.Mail.Server, profile.Mail.Sendmail}, "\x00")
+			if tested[key] {
+				continue
+			}
+			tested[key] = true
+			notifiers = append(notifiers, notifier{Name: "profile " + profile.Name, Dest: profile.Email, Mail: profile.Mail})
+		}
+	} else if *desktop {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		notifiers = append(notifiers, notifier{Name: "desktop", Dest: "this session", Desktop: true})
+	} else {
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		notifiers = append(notifiers, notifier{Name: "email", Dest: flags.Arg(0), Mail: mail})
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	failed := 0
+	for _, n := range notifiers {
+		err := testNotifier(n, hostname)
+		if err != nil {
+			failed++
+			fmt.Printf("%s: %s via %s: FAILED: %v\n", n.Name, n.Dest, n.via(), err)
+		} else {
+			fmt.Printf("%s: %s via %s: ok\n", n.Name, n.Dest, n.via())
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d notifiers failed\n", failed, len(notifiers))
+		os.Exit(1)
+	}
+}
+
+// testNotifier sends n a message saying it is a test.
+func testNotifier(n notifier, hostname string) error {
+	if n.Desktop {
+		err := checkDesktop()
+		if err != nil {
+			return err
+		}
+		return showDesktop(fmt.Sprintf("gohash notification test from %s", hostname), "gohash can show you its findings with these settings.", false)
+	}
+	if n.Dest == "" {
+		return fmt.Errorf("no recipient")
+	}
+	err := checkMailOptions(&n.Mail)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("gohash notification test from %s", hostname)
+	body := fmt.Sprintf("This is a test message sent by %s notify test on %s at %s.\n"+
+		"gohash can deliver its reports to you with these settings.\n",
+		os.Args[0], hostname, time.Now().Format(time.RFC3339))
+	// A test is sent once, without notify's retries, so a failure is
+	// reported right away.
+	return sendEmail(n.Dest, subject, strings.NewReader(body), false, nil, n.Mail)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// On-call alerting services critical findings can page through.
+// Credentials come from the environment: PAGERDUTY_ROUTING_KEY, the
+// integration key of an Events API v2 integration, or OPSGENIE_API_KEY,
+// with OPSGENIE_API_URL for an instance outside the US.
+const (
+	PagePagerDuty = "pagerduty"
+	PageOpsgenie  = "opsgenie"
+)
+
+// pageSecrets lists the credentials each alerting service reads from the
+// environment.
+var pageSecrets = map[string][]string{
+	PagePagerDuty: {"PAGERDUTY_ROUTING_KEY"},
+	PageOpsgenie:  {"OPSGENIE_API_KEY"},
+}
+
+// pageOptions selects the service that pages on-call for critical
+// findings. Each file paged for is one alert, which is resolved once a
+// full scan finds the file matching its baseline again, as after the
+// change was accepted or the file restored.
+type pageOptions struct {
+	Service string
+	// Severity is the lowest severity paged for, on the 0-10 scale of CEF.
+	Severity int
+}
+
+func (o *pageOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.Service, "page", "", "page on-call for critical findings through pagerduty or opsgenie, with the key from PAGERDUTY_ROUTING_KEY or OPSGENIE_API_KEY, resolving each alert when its file matches again (default: off)")
+	flags.IntVar(&o.Severity, "page-severity", 9, "only page for findings of at least this severity from 0 to 10: 9 is a content type change or new executable, 10 silent corruption or mass encryption")
+}
+
+// checkPageOptions validates the paging settings, if paging is on.
+func checkPageOptions(options pageOptions) error {
+	switch options.Service {
+	case "":
+		return nil
+	case PagePagerDuty, PageOpsgenie:
+	default:
+		return fmt.Errorf("unknown alerting service %q", options.Service)
+	}
+	return requireEnv(pageSecrets[options.Service]...)
+}
+
+// pageAlert is one alert, triggered or to be resolved.
+type pageAlert struct {
+	Path    string
+	Kind    string
+	Message string
+	// Key deduplicates the alerts of the same file, so a finding made
+	// again by a later scan doesn't page again.
+	Key string
+}
+
+// pageKey is the deduplication key of the alerts of path under rootID.
+func pageKey(hostname, rootID, path string) string {
+	sum := sha256.Sum256([]byte(hostname + "\x00" + rootID + "\x00" + path))
+	return "gohash-" + hex.EncodeToString(sum[:16])
+}
+
+// pageOnCall triggers an alert for each critical open finding of the run
+// in report, and resolves the alerts of files the run hashed in full and
+// found matching. A file the run made no finding about may not have been
+// checked at all, as when it was pending, skipped or couldn't be read.
+func pageOnCall(databasePath string, wait time.Duration, report *scanReport, options pageOptions) error {
+	if options.Service == "" {
+		return nil
+	}
+	run := report.Run
+	var trigger, resolve []pageAlert
+	err := withDatabase(databasePath, wait, func(db *sql.DB) error {
+		var err error
+		trigger, resolve, err = pendingPages(db, run, options, report.matched)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var triggered, resolved []pageAlert
+	var failures []string
+	for _, alert := range trigger {
+		err := sendPage(options, run, alert, true)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("paging for %s: %v", alert.Path, err))
+			continue
+		}
+		triggered = append(triggered, alert)
+	}
+	for _, alert := range resolve {
+		err := sendPage(options, run, alert, false)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("resolving the alert for %s: %v", alert.Path, err))
+			continue
+		}
+		resolved = append(resolved, alert)
+	}
+
+	if len(triggered) > 0 || len(resolved) > 0 {
+		err = withDatabase(databasePath, wait, func(db *sql.DB) error {
+			return recordPages(db, options.Service, run.RootID, triggered, resolved)
+		})
+	}
+	if err == nil && len(failures) > 0 {
+		err = fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return err
+}
+
+// pendingPages returns the alerts to trigger for the critical findings of
+// run without an open alert, and the open alerts of the matched files the
+// run made no finding about.
+func pendingPages(db *sql.DB, run runInfo, options pageOptions, matched map[string]bool) ([]pageAlert, []pageAlert, error) {
+	var recorded bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM runs WHERE run_id = ?)", run.RunID).Scan(&recorded)
+	if err != nil || !recorded {
+		// A run that wasn't recorded, such as a read-only one, has no
+		// findings to go by.
+		return nil, nil, err
+	}
+
+	open := make(map[string]bool)
+	rows, err := db.Query("SELECT path FROM pages WHERE service = ? AND root_id = ?", options.Service, run.RootID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		open[path] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var trigger []pageAlert
+	found := make(map[string]bool)
+	rows, err = db.Query("SELECT kind, COALESCE(path, ''), message, status FROM findings WHERE run_id = ? ORDER BY id", run.RunID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alert pageAlert
+		var status string
+		err = rows.Scan(&alert.Kind, &alert.Path, &alert.Message, &status)
+		if err != nil {
+			return nil, nil, err
+		}
+		found[alert.Path] = true
+		if status != StatusOpen || open[alert.Path] || findingRules[alert.Kind].cefSeverity < options.Severity {
+			continue
+		}
+		alert.Key = pageKey(run.Hostname, run.RootID, alert.Path)
+		open[alert.Path] = true
+		trigger = append(trigger, alert)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var resolve []pageAlert
+	for path := range open {
+		if matched[path] && !found[path] {
+			resolve = append(resolve, pageAlert{Path: path, Key: pageKey(run.Hostname, run.RootID, path)})
+		}
+	}
+	return trigger, resolve, nil
+}
+
+// recordPages remembers the alerts triggered and forgets those resolved.
+func recordPages(db *sql.DB, service, rootID string, triggered, resolved []pageAlert) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	for _, alert := range triggered {
+		_, err = tx.Exec("INSERT OR REPLACE INTO pages (service, root_id, path, dedup_key, opened_at) VALUES (?, ?, ?, ?, ?)",
+			service, rootID, alert.Path, alert.Key, now)
+		if err != nil {
+			return err
+		}
+	}
+	for _, alert := range resolved {
+		_, err = tx.Exec("DELETE FROM pages WHERE service = ? AND root_id = ? AND path = ?", service, rootID, alert.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sendPage triggers or resolves alert.
+func sendPage(options pageOptions, run runInfo, alert pageAlert, trigger bool) error {
+	var method, endpoint string
+	var payload any
+	switch options.Service {
+	case PagePagerDuty:
+		method, endpoint = http.MethodPost, "https://events.pagerduty.com/v2/enqueue"
+		event := map[string]any{
+			"routing_key":  os.Getenv("PAGERDUTY_ROUTING_KEY"),
+			"event_action": "resolve",
+			"dedup_key":    alert.Key,
+		}
+		if trigger {
+			event["event_action"] = "trigger"
+			event["payload"] = map[string]any{
+				"summary":  truncate(alert.Message, 1024),
+				"source":   run.Hostname,
+				"severity": "critical",
+				"class":    findingRules[alert.Kind].name,
+				"custom_details": map[string]string{
+					"root":  displayPath(run.RootID),
+					"path":  alert.Path,
+					"runId": run.RunID,
+				},
+			}
+		}
+		payload = event
+	default:
+		base := os.Getenv("OPSGENIE_API_URL")
+		if base == "" {
+			base = "https://api.opsgenie.com"
+		}
+		base = strings.TrimSuffix(base, "/")
+		if trigger {
+			method, endpoint = http.MethodPost, base+"/v2/alerts"
+			payload = map[string]any{
+				"message":     truncate(alert.Message, 130),
+				"alias":       alert.Key,
+				"description": fmt.Sprintf("%s\n\nRoot: %s\nRun: %s", alert.Message, displayPath(run.RootID), run.RunID),
+				"source":      run.Hostname,
+				"priority":    "P1",
+				"tags":        []string{"gohash", findingRules[alert.Kind].name},
+			}
+		} else {
+			method, endpoint = http.MethodPost, base+"/v2/alerts/"+url.PathEscape(alert.Key)+"/close?identifierType=alias"
+			payload = map[string]string{"source": run.Hostname, "note": "The file matches its baseline again"}
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if options.Service == PageOpsgenie {
+		req.Header.Set("Authorization", "GenieKey "+os.Getenv("OPSGENIE_API_KEY"))
+	}
+	return doAPI(req, nil)
+}
+
+// truncate shortens s to at most n bytes, which alerting services limit
+// summaries to, without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n-3], "") + "..."
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Repair data is kept in one .parity file per record, under a directory
+// mirroring the root. A file is cut into blocks, and every stripe of
+// parityStripe blocks gets its own parity blocks, so damage spread through
+// a large file is repairable as long as no stripe loses more blocks than it
+// has parity for. Each file holds:
+//
+//	GOHASHP1
+//	{header JSON}
+//	per stripe: the SHA-256 of each data block and of each parity block,
+//	followed by the parity blocks
+const (
+	parityMagic     = "GOHASHP1\n"
+	parityBlockSize = 64 << 10
+	parityStripe    = 16
+)
+
+// errParityFormat marks repair data that can't be read, which is replaced
+// rather than trusted.
+var errParityFormat = errors.New("not gohash repair data")
+
+// parityHeader describes the file repair data was made from.
+type parityHeader struct {
+	Size      int64  `json:"size"`
+	BlockSize int    `json:"blockSize"`
+	Data      int    `json:"data"`
+	Parity    int    `json:"parity"`
+	Algo      string `json:"algo"`
+	Hash      string `json:"hash"`
+}
+
+func (h *parityHeader) stripes() int64 {
+	blocks := (h.Size + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+	return (blocks + int64(h.Data) - 1) / int64(h.Data)
+}
+
+// stripeLength is the length of a full stripe's hashes and parity blocks.
+func (h *parityHeader) stripeLength() int64 {
+	return int64(h.Data+h.Parity)*sha256.Size + int64(h.Parity)*int64(h.BlockSize)
+}
+
+// stripeBlocks is how many data blocks stripe s has; only the last one can
+// have fewer than Data.
+func (h *parityHeader) stripeBlocks(s int64) int {
+	remaining := (h.Size - s*int64(h.Data)*int64(h.BlockSize) + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+	return int(min(remaining, int64(h.Data)))
+}
+
+// parityLength is the length of stripe s's parity blocks, that of its
+// longest data block, so a small file doesn't get whole empty blocks.
+func (h *parityHeader) parityLength(s int64) int {
+	return int(min(h.Size-s*int64(h.Data)*int64(h.BlockSize), int64(h.BlockSize)))
+}
+
+// parityFile names the repair data of a record.
+func parityFile(dir, rel string) string {
+	return filepath.Join(dir, filepath.FromSlash(rel)+".parity")
+}
+
+// parityReader reads the stripes of existing repair data.
+type parityReader struct {
+	Header parityHeader
+	file   *os.File
+	base   int64
+}
+
+func openParity(path string) (*parityReader, error) {
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(parityMagic))
+	_, err = io.ReadFull(reader, magic)
+	var line []byte
+	if err == nil {
+		line, err = reader.ReadBytes('\n')
+	}
+	var header parityHeader
+	if err == nil && string(magic) == parityMagic && json.Unmarshal(line, &header) == nil &&
+		header.Size >= 0 && header.BlockSize > 0 && header.Data > 0 && header.Parity > 0 && header.Data+header.Parity <= 256 {
+		return &parityReader{Header: header, file: file, base: int64(len(magic) + len(line))}, nil
+	}
+	file.Close()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return nil, errParityFormat
+}
+
+func (r *parityReader) Close() error {
+	return r.file.Close()
+}
+
+// stripe reads the stored hashes of stripe s's data blocks and its parity
+// blocks. Parity blocks whose hash doesn't match are returned as nil.
+func (r *parityReader) stripe(s int64) ([][]byte, [][]byte, error) {
+	h := &r.Header
+	blocks, length := h.stripeBlocks(s), h.parityLength(s)
+	record := make([]byte, (blocks+h.Parity)*sha256.Size+h.Parity*length)
+	_, err := r.file.ReadAt(record, r.base+s*h.stripeLength())
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading stripe %d of the repair data: %v", s, err)
+	}
+	hashes := make([][]byte, blocks+h.Parity)
+	for i := range hashes {
+		hashes[i] = record[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	parity := make([][]byte, h.Parity)
+	offset := len(hashes) * sha256.Size
+	for i := range parity {
+		block := record[offset+i*length : offset+(i+1)*length]
+		if sum := sha256.Sum256(block); bytes.Equal(sum[:], hashes[blocks+i]) {
+			parity[i] = block
+		}
+	}
+	return hashes[:blocks], parity, nil
+}
+
+// readStripe reads the next stripe of data blocks from file into blocks,
+// zero-padding the last block, and returns the blocks' actual lengths.
+func readStripe(file io.Reader, blocks [][]byte, count int) ([]int, error) {
+	lengths := make([]int, count)
+	for i := 0; i < count; i++ {
+		n, err := io.ReadFull(file, blocks[i])
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		clear(blocks[i][n:])
+		lengths[i] = n
+	}
+	return lengths, nil
+}
+
+// parityScan is what a scan learned from a file's repair data.
+type parityScan struct {
+	// Old is the header of the repair data already on disk, if any.
+	Old *parityHeader
+	// Resized reports that the file's size no longer matches Old.
+	Resized bool
+	// Damaged counts the blocks that differ from those Old was made from,
+	// and Unrecoverable how many of them its parity can't rebuild.
+	Damaged       int
+	Unrecoverable int
+	// Err is why the repair data couldn't be read or written.
+	Err error
+
+	temp, target string
+}
+
+// checkParity compares a file just hashed to its repair data. Unless the
+// repair data is already for this content, new repair data is written to a
+// temporary file if write is set, made the file's by keep once the scan
+// knows the content is trusted.
+func checkParity(dir, rel, filePath, algo, hash string, size int64, parity int, write bool) *parityScan {
+	result := &parityScan{target: parityFile(dir, rel)}
+	old, err := openParity(result.target)
+	if err == nil {
+		defer old.Close()
+		if old.Header.Hash == hash && old.Header.Size == size {
+			return nil
+		}
+		result.Old = &old.Header
+		result.Resized = old.Header.Size != size
+	} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errParityFormat) {
+		result.Err = err
+		return result
+	} else {
+		old = nil
+	}
+
+	result.Err = result.scan(old, filePath, algo, hash, size, parity, write)
+	if result.Err != nil {
+		result.discard()
+	}
+	return result
+}
+
+func (p *parityScan) scan(old *parityReader, filePath, algo, hash string, size int64, parity int, write bool) error {
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := parityHeader{Size: size, BlockSize: parityBlockSize, Data: parityStripe, Parity: parity, Algo: algo, Hash: hash}
+	compare := old != nil && !p.Resized && old.Header.BlockSize == header.BlockSize && old.Header.Data == header.Data
+	if !compare && !write {
+		return nil
+	}
+
+	var out *bufio.Writer
+	if write {
+		err = os.MkdirAll(filepath.Dir(p.target), 0755)
+		if err != nil {
+			return err
+		}
+		temp, err := os.CreateTemp(filepath.Dir(p.target), ".parity-*")
+		if err != nil {
+			return err
+		}
+		p.temp = temp.Name()
+		defer temp.Close()
+		out = bufio.NewWriter(temp)
+		encoded, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s%s\n", parityMagic, encoded)
+	}
+
+	digest := hashAlgorithms[algo]()
+	data := make([][]byte, header.Data)
+	for i := range data {
+		data[i] = make([]byte, header.BlockSize)
+	}
+	parityBlocks := make([][]byte, parity)
+	for i := range parityBlocks {
+		parityBlocks[i] = make([]byte, header.BlockSize)
+	}
+	for s := int64(0); s < header.stripes(); s++ {
+		blocks := header.stripeBlocks(s)
+		lengths, err := readStripe(file, data, blocks)
+		if err != nil {
+			return err
+		}
+		sums := make([][sha256.Size]byte, blocks)
+		for i := range sums {
+			digest.Write(data[i][:lengths[i]])
+			sums[i] = sha256.Sum256(data[i][:lengths[i]])
+		}
+
+		if compare {
+			stored, goodParity, err := old.stripe(s)
+			if err != nil {
+				return err
+			}
+			damaged := 0
+			for i := range sums {
+				if !bytes.Equal(sums[i][:], stored[i]) {
+					damaged++
+				}
+			}
+			available := 0
+			for _, block := range goodParity {
+				if block != nil {
+					available++
+				}
+			}
+			p.Damaged += damaged
+			if damaged > available {
+				p.Unrecoverable += damaged
+			}
+		}
+
+		if write {
+			length := header.parityLength(s)
+			shards := make([][]byte, blocks)
+			for i := range shards {
+				shards[i] = data[i][:length]
+			}
+			for i := range parityBlocks {
+				parityBlocks[i] = parityBlocks[i][:length]
+			}
+			rsEncode(shards, parityBlocks)
+			for i := range sums {
+				out.Write(sums[i][:])
+			}
+			for _, block := range parityBlocks {
+				sum := sha256.Sum256(block)
+				out.Write(sum[:])
+			}
+			for _, block := range parityBlocks {
+				out.Write(block)
+			}
+		}
+	}
+
+	if hex.EncodeToString(digest.Sum(nil)) != hash {
+		return errors.New("the file changed while its repair data was being made")
+	}
+	if write {
+		return out.Flush()
+	}
+	return nil
+}
+
+// keep makes new repair data the file's.
+func (p *parityScan) keep() error {
+	if p == nil || p.temp == "" {
+		return nil
+	}
+	err := os.Rename(p.temp, p.target)
+	p.temp = ""
+	return err
+}
+
+// discard removes new repair data that wasn't kept.
+func (p *parityScan) discard() {
+	if p != nil && p.temp != "" {
+		os.Remove(p.temp)
+		p.temp = ""
+	}
+}
+
+// describe says whether a file that no longer has its stored hash can be
+// repaired, if its repair data was made from the stored content.
+func (p *parityScan) describe(storedHash string) string {
+	switch {
+	case p == nil || p.Old == nil || p.Old.Hash != storedHash:
+		return ""
+	case p.Resized:
+		return fmt.Sprintf("; unrecoverable: the size changed from %d bytes", p.Old.Size)
+	case p.Unrecoverable > 0:
+		return fmt.Sprintf("; unrecoverable: %d of %d damaged blocks are in stripes with too little parity", p.Unrecoverable, p.Damaged)
+	case p.Damaged > 0:
+		return fmt.Sprintf("; corrupted but repairable: %d damaged blocks, run gohash repair", p.Damaged)
+	}
+	return ""
+}
+
+// runRepair rebuilds files whose content no longer matches the baseline
+// from the repair data scans kept with -parity-dir.
+func runRepair(arguments []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	parityDir := flags.String("parity-dir", "", "directory the repair data was kept in by scans")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s repair [options] database_path root_directory path...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() < 3 || *parityDir == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath, rootDirectory := flags.Arg(0), flags.Arg(1)
+
+	rootID := *rootIDFlag
+	if rootID == "" {
+		var err error
+		rootID, err = defaultRootID(rootDirectory)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+	}
+
+	// Only files are written, so the database is only read.
+	db, err := openDatabaseReadOnly(databasePath)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	defer closeDatabase(db)
+	pathPolicy, err := rootPathPolicy(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+	hashAlgo, err := rootHashAlgo(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+
+	failed := 0
+	for _, name := range flags.Args()[2:] {
+		filePath, rel, err := resolveRootPath(rootDirectory, name)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		rel = normalizePath(pathPolicy, rel)
+		var stored sql.NullString
+		err = db.QueryRow("SELECT hash FROM file_hashes WHERE root_id = ? AND filename = ?", rootID, dbPath(rel)).Scan(&stored)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && !stored.Valid {
+			fmt.Printf("No record of %s\n", displayPath(filePath))
+			failed++
+			continue
+		} else if err != nil {
+			log.Fatalf("Error reading the baseline: %v", err)
+		}
+
+		rebuilt, err := repairFile(filePath, parityFile(*parityDir, rel), hashAlgo, stored.String)
+		switch {
+		case err != nil:
+			fmt.Printf("Can't repair %s: %v\n", displayPath(filePath), err)
+			failed++
+		case rebuilt == 0:
+			fmt.Printf("%s is intact\n", displayPath(filePath))
+		default:
+			fmt.Printf("Repaired %s: rebuilt %d blocks, %s hash %s\n", displayPath(filePath), rebuilt, hashLabel(hashAlgo), stored.String)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// repairFile rebuilds the damaged blocks of filePath from its repair data,
+// returning how many there were. The repaired copy replaces the file only
+// once it has the stored hash.
+func repairFile(filePath, repairPath, algo, storedHash string) (int, error) {
+	old, err := openParity(repairPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, errors.New("no repair data")
+	} else if err != nil {
+		return 0, fmt.Errorf("reading the repair data: %v", err)
+	}
+	defer old.Close()
+	header := &old.Header
+	if header.Algo != algo || header.Hash != storedHash {
+		return 0, errors.New("the repair data is not for the baselined content")
+	}
+
+	info, err := os.Stat(longPath(filePath))
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != header.Size {
+		return 0, fmt.Errorf("the size changed from %d to %d bytes", header.Size, info.Size())
+	}
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	temp, err := os.CreateTemp(filepath.Dir(filePath), ".gohash-repair-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	out := bufio.NewWriter(temp)
+
+	digest := hashAlgorithms[algo]()
+	rebuilt := 0
+	data := make([][]byte, header.Data)
+	for i := range data {
+		data[i] = make([]byte, header.BlockSize)
+	}
+	for s := int64(0); s < header.stripes(); s++ {
+		blocks := header.stripeBlocks(s)
+		lengths, err := readStripe(file, data, blocks)
+		if err != nil {
+			return 0, err
+		}
+		stored, parity, err := old.stripe(s)
+		if err != nil {
+			return 0, err
+		}
+		shards := make([][]byte, blocks)
+		damaged := 0
+		for i := range shards {
+			if sum := sha256.Sum256(data[i][:lengths[i]]); bytes.Equal(sum[:], stored[i]) {
+				shards[i] = data[i][:header.parityLength(s)]
+			} else {
+				damaged++
+			}
+		}
+		if damaged > 0 {
+			err = rsReconstruct(shards, parity)
+			if err != nil {
+				return 0, fmt.Errorf("stripe %d: %d damaged blocks: %v", s, damaged, err)
+			}
+			rebuilt += damaged
+		}
+		for i, shard := range shards {
+			digest.Write(shard[:lengths[i]])
+			out.Write(shard[:lengths[i]])
+		}
+	}
+	if rebuilt == 0 {
+		return 0, nil
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != storedHash {
+		return 0, fmt.Errorf("the rebuilt content has %s hash %s, not %s", hashLabel(algo), sum, storedHash)
+	}
+
+	err = out.Flush()
+	if err == nil {
+		err = temp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = temp.Close()
+	}
+	if err == nil {
+		err = os.Chtimes(temp.Name(), time.Now(), info.ModTime())
+	}
+	if err == nil {
+		file.Close()
+		err = os.Rename(temp.Name(), longPath(filePath))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("replacing the file: %v", err)
+	}
+	return rebuilt, nil
+}
+
+// validParity checks a -parity count.
+func validParity(parity int) error {
+	if parity < 1 || parity > parityStripe {
+		return fmt.Errorf("-parity must be between 1 and %d", parityStripe)
+	}
+	return nil
+}
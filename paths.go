@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultRootID identifies a scan root when no -root-id is given: its
+// absolute path, so unrelated roots never share records.
+func defaultRootID(rootDirectory string) (string, error) {
+	absRoot, err := filepath.Abs(rootDirectory)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", rootDirectory, err)
+	}
+	return absRoot, nil
+}
+
+// parsePrefixMap splits a -map-prefix value, old=new.
+func parsePrefixMap(value string) (string, string, error) {
+	old, mounted, ok := strings.Cut(value, "=")
+	if !ok || old == "" || mounted == "" {
+		return "", "", fmt.Errorf("-map-prefix must be old=new, not %q", value)
+	}
+	return filepath.Clean(old), filepath.Clean(mounted), nil
+}
+
+// mapRootID maps the absolute path of a root mounted under one of the new
+// prefixes of maps, each old=new, to the path under the old prefix its
+// baseline was recorded with. The first prefix that matches whole path
+// components wins; a root under none of them keeps its path.
+func mapRootID(rootID string, maps []string) string {
+	for _, m := range maps {
+		old, mounted, err := parsePrefixMap(m)
+		if err != nil {
+			continue
+		}
+		if rootID == mounted {
+			return old
+		}
+		prefix := mounted
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if rest, ok := strings.CutPrefix(rootID, prefix); ok {
+			return filepath.Join(old, rest)
+		}
+	}
+	return rootID
+}
+
+// recordPath converts a path on disk to the root-relative, slash-separated
+// form stored in the database, so the same tree matches wherever it is
+// mounted.
+func recordPath(rootDirectory, filePath string) (string, error) {
+	rel, err := filepath.Rel(rootDirectory, filePath)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside %s", filePath, rootDirectory)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// resolveRootPath interprets a path named on the command line, either
+// relative to the root or as it is on disk, returning both forms.
+func resolveRootPath(rootDirectory, name string) (string, string, error) {
+	filePath := name
+	if !filepath.IsAbs(name) && !strings.HasPrefix(filepath.Clean(name), filepath.Clean(rootDirectory)+string(filepath.Separator)) {
+		filePath = filepath.Join(rootDirectory, name)
+	}
+	rel, err := recordPath(rootDirectory, filePath)
+	return filePath, rel, err
+}
+
+// diskPath is the inverse of recordPath.
+func diskPath(rootDirectory, rel string) string {
+	return filepath.Join(rootDirectory, filepath.FromSlash(rel))
+}
+
+// recordDepth reports how many directories deep rel is below its root.
+func recordDepth(rel string) int {
+	return strings.Count(path.Clean(rel), "/")
+}
+
+// dbPath returns the value a stored path is bound as. Names that aren't
+// valid UTF-8 are kept as BLOBs so their exact bytes survive the round trip
+// through SQLite instead of being mangled as text.
+func dbPath(rel string) any {
+	if utf8.ValidString(rel) {
+		return rel
+	}
+	return []byte(rel)
+}
+
+// displayPath escapes the bytes of a path that aren't valid UTF-8 as \xNN so
+// it can be printed, emailed and embedded in JSON unambiguously.
+func displayPath(p string) string {
+	if utf8.ValidString(p) {
+		return p
+	}
+	var b strings.Builder
+	for len(p) > 0 {
+		r, size := utf8.DecodeRuneInString(p)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, `\x%02x`, p[0])
+		} else {
+			b.WriteString(p[:size])
+		}
+		p = p[size:]
+	}
+	return b.String()
+}
+
+// executableExtensions are the names Windows runs, loads or scripts, and
+// shell scripts, which often lack execute permission.
+var executableExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".sys": true, ".com": true, ".scr": true, ".cpl": true, ".msi": true,
+	".bat": true, ".cmd": true, ".ps1": true, ".psm1": true, ".vbs": true, ".js": true, ".jar": true,
+	".sh": true, ".so": true, ".dylib": true,
+}
+
+// isExecutable reports whether the file at rel, with mode, can be run.
+func isExecutable(rel string, mode os.FileMode) bool {
+	return mode.IsRegular() && mode&0o111 != 0 || executableExtensions[strings.ToLower(path.Ext(rel))]
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pgpBoundary separates the parts of a PGP/MIME message. The report is
+// quoted-printable and the armored parts are base64, so it can't occur in
+// either.
+const pgpBoundary = "gohash-pgp-mime-boundary"
+
+// pgpOptions selects PGP/MIME (RFC 3156) protection for notification
+// emails. Keys are anything gpg accepts as a user ID: a fingerprint, key ID
+// or email address. gpg's own configuration, including GNUPGHOME, applies.
+type pgpOptions struct {
+	Program    string
+	SignKey    string
+	Recipients []string
+}
+
+func (o pgpOptions) enabled() bool {
+	return o.SignKey != "" || len(o.Recipients) > 0
+}
+
+func (o *pgpOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.SignKey, "pgp-sign", "", "sign the email with this gpg key (PGP/MIME)")
+	flags.Func("pgp-encrypt", "comma-separated gpg keys to encrypt the email to (PGP/MIME)", func(list string) error {
+		o.Recipients = append(o.Recipients, parseRecipients(list)...)
+		return nil
+	})
+	flags.StringVar(&o.Program, "gpg", "gpg", "gpg binary used for -pgp-sign and -pgp-encrypt")
+}
+
+// parseRecipients splits a comma-separated list of keys.
+func parseRecipients(list string) []string {
+	var recipients []string
+	for _, recipient := range strings.Split(list, ",") {
+		recipient = strings.TrimSpace(recipient)
+		if recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients
+}
+
+// pgpProtect wraps a plain text body in a signed and/or encrypted PGP/MIME
+// entity, spooled to a temporary file. It returns the Content-Type header
+// for the message and the file positioned at its start; the caller closes
+// and removes it.
+func pgpProtect(options pgpOptions, body io.Reader) (string, *os.File, error) {
+	entity, err := spoolTextEntity(body)
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(entity.Name())
+	defer entity.Close()
+
+	out, err := os.CreateTemp("", "gohash-mail-*.eml")
+	if err != nil {
+		return "", nil, err
+	}
+	fail := func(err error) (string, *os.File, error) {
+		out.Close()
+		os.Remove(out.Name())
+		return "", nil, err
+	}
+
+	var contentType string
+	if len(options.Recipients) > 0 {
+		contentType = fmt.Sprintf("multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"%s\"", pgpBoundary)
+		fmt.Fprintf(out, "This is an OpenPGP/MIME encrypted message (RFC 4880 and 3156)\r\n"+
+			"--%s\r\n"+
+			"Content-Type: application/pgp-encrypted\r\n"+
+			"Content-Description: PGP/MIME version identification\r\n\r\n"+
+			"Version: 1\r\n\r\n"+
+			"--%s\r\n"+
+			"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n"+
+			"Content-Description: OpenPGP encrypted message\r\n"+
+			"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n",
+			pgpBoundary, pgpBoundary)
+
+		gpgArgs := []string{"--encrypt"}
+		for _, recipient := range options.Recipients {
+			gpgArgs = append(gpgArgs, "--recipient", recipient)
+		}
+		if options.SignKey != "" {
+			gpgArgs = append(gpgArgs, "--sign", "--local-user", options.SignKey)
+		}
+		err = runGPG(options.Program, gpgArgs, entity, out)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = fmt.Fprintf(out, "\r\n--%s--\r\n", pgpBoundary)
+	} else {
+		contentType = fmt.Sprintf("multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; boundary=\"%s\"", pgpBoundary)
+		var signature bytes.Buffer
+		err = runGPG(options.Program, []string{"--detach-sign", "--digest-algo", "SHA256", "--local-user", options.SignKey}, entity, &signature)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = entity.Seek(0, io.SeekStart)
+		if err != nil {
+			return fail(err)
+		}
+
+		// The signature covers the entity exactly as written between the
+		// boundaries, so it is copied back byte for byte.
+		fmt.Fprintf(out, "This is an OpenPGP/MIME signed message (RFC 4880 and 3156)\r\n--%s\r\n", pgpBoundary)
+		_, err = io.Copy(out, entity)
+		if err == nil {
+			_, err = fmt.Fprintf(out, "\r\n--%s\r\n"+
+				"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n"+
+				"Content-Description: OpenPGP digital signature\r\n"+
+				"Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n"+
+				"%s\r\n--%s--\r\n",
+				pgpBoundary, signature.Bytes(), pgpBoundary)
+		}
+	}
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return contentType, out, nil
+}
+
+// spoolTextEntity writes body as a quoted-printable text/plain MIME entity
+// with CRLF line endings, the canonical form that gets signed, and returns
+// the file positioned at its start.
+func spoolTextEntity(body io.Reader) (*os.File, error) {
+	entity, err := os.CreateTemp("", "gohash-mail-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(entity, "Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	if err == nil {
+		qp := quotedprintable.NewWriter(entity)
+		_, err = io.Copy(qp, body)
+		if err == nil {
+			err = qp.Close()
+		}
+	}
+	if err == nil {
+		_, err = entity.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		entity.Close()
+		os.Remove(entity.Name())
+		return nil, err
+	}
+	return entity, nil
+}
+
+// runGPG runs gpg non-interactively with ASCII armored output.
+func runGPG(program string, args []string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, append([]string{"--batch", "--yes", "--armor", "--output", "-"}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("running %s: %v: %s", program, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// preflightTimeout bounds each lookup and connection of the preflight.
+const preflightTimeout = 10 * time.Second
+
+// preflightFreeSpace is the free space a database needs on top of its own
+// size. A scan that rewrites the whole baseline, as a rehash does,
+// journals up to the database's size again before it commits.
+const preflightFreeSpace = 64 << 20
+
+// errFreeSpaceUnknown is returned where the free space of a filesystem
+// can't be found out, which the preflight doesn't hold against a scan.
+var errFreeSpaceUnknown = errors.New("free space unknown on this platform")
+
+// preflightCheck is what a scan needs before it starts: a database it can
+// write, a root it can read and the endpoints its findings are sent to.
+type preflightCheck struct {
+	Database string
+	Root     string
+	ReadOnly bool
+	// Mail is nil when no email is sent. Its defaults must have been
+	// applied by checkMailOptions.
+	Mail    *mailOptions
+	Tickets ticketOptions
+	Pages   pageOptions
+	MQTT    mqttOptions
+	Events  sinkOptions
+	Summary summaryOptions
+}
+
+// problems runs the checks, returning what would stop the scan or its
+// report, each with what to do about it, so that a scan fails in seconds
+// rather than after hours of hashing.
+func (c preflightCheck) problems() []string {
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if err := checkDatabaseWritable(c.Database, c.ReadOnly); err != nil {
+		report("%v", err)
+	}
+	if err := checkRootReadable(c.Root); err != nil {
+		report("%v", err)
+	}
+	for _, endpoint := range c.endpoints() {
+		if err := resolveEndpoint(endpoint); err != nil {
+			report("%v", err)
+		}
+	}
+	if c.Mail != nil {
+		if transport := c.Mail.Transport; transport == MailSMTP || transport == MailLocal {
+			network := "tcp"
+			if strings.HasPrefix(c.Mail.Server, "/") {
+				network = "unix"
+			}
+			conn, err := net.DialTimeout(network, c.Mail.Server, preflightTimeout)
+			if err != nil {
+				report("can't reach the mail server %s: %v; check -smtp-server and that the server is up", c.Mail.Server, err)
+			} else {
+				conn.Close()
+			}
+		}
+	}
+	return problems
+}
+
+// requirePreflight exits, listing the problems, if the preflight found any.
+func requirePreflight(problems []string) {
+	if len(problems) == 0 {
+		return
+	}
+	for _, problem := range problems {
+		log.Printf("Preflight: %s", problem)
+	}
+	log.Fatalf("Error: %d preflight checks failed, nothing was hashed", len(problems))
+}
+
+// checkDatabaseWritable checks that the database, or the directory it
+// would be created in, can be written and has room to grow. A read-only
+// scan only needs to read an existing database.
+func checkDatabaseWritable(databasePath string, readOnly bool) error {
+	dir := filepath.Dir(databasePath)
+	info, err := os.Stat(databasePath)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't read the database %s: %v", databasePath, err)
+	}
+	if readOnly {
+		if !exists {
+			return fmt.Errorf("the database %s doesn't exist; a -read-only scan needs an existing baseline", databasePath)
+		}
+		file, err := os.Open(databasePath)
+		if err != nil {
+			return fmt.Errorf("can't read the database %s: %v; run as a user who can read it", databasePath, err)
+		}
+		file.Close()
+		return nil
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("the database directory %s doesn't exist; create it or point the database elsewhere", dir)
+	}
+	// SQLite writes its journal next to the database, so the directory
+	// has to be writable as well as the file.
+	probe, err := os.CreateTemp(dir, ".gohash-preflight-*")
+	if err != nil {
+		return fmt.Errorf("can't write to the database directory %s: %v; run as a user who can write to it, or use -read-only", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	if exists {
+		file, err := os.OpenFile(databasePath, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("can't write to the database %s: %v; run as a user who can write to it, or use -read-only", databasePath, err)
+		}
+		file.Close()
+	}
+
+	free, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("can't find the free space for the database in %s: %v", dir, err)
+	}
+	needed := int64(preflightFreeSpace)
+	if exists {
+		needed += info.Size()
+	}
+	if free < needed {
+		return fmt.Errorf("only %d MB are free for the database in %s, which needs %d MB; free up space or move the database", free>>20, dir, needed>>20)
+	}
+	return nil
+}
+
+// checkRootReadable checks that the root is a directory whose entries can
+// be listed.
+func checkRootReadable(root string) error {
+	info, err := os.Stat(longPath(root))
+	if err != nil {
+		return fmt.Errorf("can't find the root %s: %v; check that it exists and is mounted", root, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("the root %s is not a directory", root)
+	}
+	dir, err := os.Open(longPath(root))
+	if err == nil {
+		_, err = dir.Readdirnames(1)
+		dir.Close()
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("can't read the root %s: %v; run as a user who can read it", root, err)
+	}
+	return nil
+}
+
+// preflightEndpoint is a host findings are sent to and the setting that
+// names it.
+type preflightEndpoint struct {
+	Setting string
+	Host    string
+}
+
+// endpoints returns the hosts the scan's findings are sent to, as the
+// senders address them.
+func (c preflightCheck) endpoints() []preflightEndpoint {
+	var endpoints []preflightEndpoint
+	add := func(setting, host string) {
+		if host != "" {
+			endpoints = append(endpoints, preflightEndpoint{setting, host})
+		}
+	}
+	addURL := func(setting, rawURL string) {
+		if parsed, err := url.Parse(rawURL); err == nil {
+			add(setting, parsed.Hostname())
+		}
+	}
+
+	if c.Mail != nil {
+		switch c.Mail.Transport {
+		case MailGraph:
+			add("-mailer graph", "login.microsoftonline.com")
+			add("-mailer graph", "graph.microsoft.com")
+		case MailSendGrid:
+			add("-mailer sendgrid", "api.sendgrid.com")
+		case MailSES:
+			add("-mailer ses", "email."+awsRegion()+".amazonaws.com")
+		}
+	}
+	addURL("-ticket-url", c.Tickets.URL)
+	switch c.Pages.Service {
+	case "pagerduty":
+		add("-page pagerduty", "events.pagerduty.com")
+	case "opsgenie":
+		base := os.Getenv("OPSGENIE_API_URL")
+		if base == "" {
+			base = "https://api.opsgenie.com"
+		}
+		addURL("-page opsgenie", base)
+	}
+	addURL("-mqtt-broker", c.MQTT.Broker)
+	addURL("-event-url", c.Events.URL)
+	if c.Summary.URL != "" {
+		if parsed, err := url.Parse(c.Summary.URL); err == nil && parsed.Scheme == "s3" {
+			if custom := os.Getenv("AWS_ENDPOINT_URL_S3"); custom != "" {
+				addURL("AWS_ENDPOINT_URL_S3", custom)
+			} else {
+				add("-summary-url", parsed.Host+".s3."+awsRegion()+".amazonaws.com")
+			}
+		} else {
+			addURL("-summary-url", c.Summary.URL)
+		}
+	}
+	return endpoints
+}
+
+// resolveEndpoint looks up the host of an endpoint.
+func resolveEndpoint(endpoint preflightEndpoint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(ctx, endpoint.Host)
+	if err != nil {
+		return fmt.Errorf("can't resolve %s of %s: %v; check the setting and this host's DNS", endpoint.Host, endpoint.Setting, err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// filePrivileges returns what the file at path with mode lets it run with,
+// comma-separated: setuid and setgid, and on Linux each file capability it
+// grants, e.g. "setuid" or "cap_net_raw,cap_sys_admin".
+func filePrivileges(path string, mode os.FileMode) (string, error) {
+	var privileges []string
+	if mode&os.ModeSetuid != 0 {
+		privileges = append(privileges, "setuid")
+	}
+	if mode&os.ModeSetgid != 0 && mode&0o010 != 0 {
+		// Without group execute, setgid marks mandatory locking instead.
+		privileges = append(privileges, "setgid")
+	}
+	if mode.IsRegular() {
+		capabilities, err := fileCapabilities(path)
+		if err != nil {
+			return "", err
+		}
+		privileges = append(privileges, capabilities...)
+	}
+	return strings.Join(privileges, ","), nil
+}
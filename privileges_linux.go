@@ -0,0 +1,69 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilityNames are the Linux capabilities by number, as getcap names
+// them.
+var capabilityNames = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner", "cap_fsetid", "cap_kill",
+	"cap_setgid", "cap_setuid", "cap_setpcap", "cap_linux_immutable", "cap_net_bind_service",
+	"cap_net_broadcast", "cap_net_admin", "cap_net_raw", "cap_ipc_lock", "cap_ipc_owner",
+	"cap_sys_module", "cap_sys_rawio", "cap_sys_chroot", "cap_sys_ptrace", "cap_sys_pacct",
+	"cap_sys_admin", "cap_sys_boot", "cap_sys_nice", "cap_sys_resource", "cap_sys_time",
+	"cap_sys_tty_config", "cap_mknod", "cap_lease", "cap_audit_write", "cap_audit_control",
+	"cap_setfcap", "cap_mac_override", "cap_mac_admin", "cap_syslog", "cap_wake_alarm",
+	"cap_block_suspend", "cap_audit_read", "cap_perfmon", "cap_bpf", "cap_checkpoint_restore",
+}
+
+// fileCapabilities decodes the security.capability attribute of the file
+// at path: the capabilities it is permitted or inherits when run.
+func fileCapabilities(path string) ([]string, error) {
+	// struct vfs_ns_cap_data, the largest revision.
+	data := make([]byte, 24)
+	n, err := unix.Getxattr(path, "security.capability", data)
+	if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data = data[:n]
+	if len(data) < 4 {
+		return nil, fmt.Errorf("malformed file capabilities")
+	}
+	words := 2
+	switch binary.LittleEndian.Uint32(data) & 0xff000000 {
+	case 0x01000000:
+		words = 1
+	case 0x02000000, 0x03000000:
+	default:
+		return nil, fmt.Errorf("unknown file capabilities revision %#x", binary.LittleEndian.Uint32(data)>>24)
+	}
+	if len(data) < 4+8*words {
+		return nil, fmt.Errorf("malformed file capabilities")
+	}
+	var capabilities []string
+	for word := 0; word < words; word++ {
+		permitted := binary.LittleEndian.Uint32(data[4+8*word:])
+		inheritable := binary.LittleEndian.Uint32(data[8+8*word:])
+		for bit := 0; bit < 32; bit++ {
+			if (permitted|inheritable)&(1<<bit) == 0 {
+				continue
+			}
+			number := 32*word + bit
+			name := fmt.Sprintf("cap_%d", number)
+			if number < len(capabilityNames) {
+				name = capabilityNames[number]
+			}
+			capabilities = append(capabilities, name)
+		}
+	}
+	return capabilities, nil
+}
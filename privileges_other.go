@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// fileCapabilities finds none outside Linux, which alone has them.
+func fileCapabilities(path string) ([]string, error) {
+	return nil, nil
+}
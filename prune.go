@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runPrune removes the records of files that no longer exist under a root,
+// so deliberate deletions stop being reported as missing. On a root that
+// requires approval the removals are requested as a changeset instead.
+func runPrune(arguments []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	rootIDFlag := flags.String("root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	reason := flags.String("reason", "", "why the records are being removed, for the audit log")
+	dryRun := flags.Bool("dry-run", false, "list the records that would be removed without removing them")
+	keyPath := flags.String("key", "", "approver's ed25519 private key, required for roots that require approval")
+	lockWait := flags.Duration("wait", 0, "how long to wait for a running scan to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s prune [options] database_path root_directory\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	databasePath, rootDirectory := flags.Arg(0), flags.Arg(1)
+
+	rootID := *rootIDFlag
+	if rootID == "" {
+		var err error
+		rootID, err = defaultRootID(rootDirectory)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+	}
+	if _, err := os.Stat(longPath(rootDirectory)); err != nil {
+		log.Fatalf("Error reading the specified directory: %v", err)
+	}
+
+	lock, err := acquireRunLock(databasePath, *lockWait)
+	if err != nil {
+		log.Fatalf("Error acquiring the run lock: %v", err)
+	}
+	defer releaseRunLock(lock)
+	db := openExistingDatabase(flags)
+	defer closeDatabase(db)
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+
+	rows, err := db.Query("SELECT filename, hash FROM file_hashes WHERE root_id = ?", rootID)
+	if err != nil {
+		log.Fatalf("Error reading the baseline: %v", err)
+	}
+	var gone []auditEntry
+	for rows.Next() {
+		entry := auditEntry{Actor: auditActor(), Action: AuditPrune, RootID: rootID, Reason: *reason}
+		err = rows.Scan(&entry.RelPath, &entry.OldHash)
+		if err != nil {
+			log.Fatalf("Error reading the baseline: %v", err)
+		}
+		// Only records whose file is certainly gone are removed; one that
+		// can't be checked, say under an unreadable directory, is kept.
+		_, err = os.Lstat(longPath(diskPath(rootDirectory, entry.RelPath)))
+		if errors.Is(err, os.ErrNotExist) {
+			gone = append(gone, entry)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Fatalf("Error reading the baseline: %v", err)
+	}
+
+	if *dryRun {
+		for _, entry := range gone {
+			fmt.Printf("Would remove %s: stored=%s\n", displayPath(entry.RelPath), entry.OldHash)
+		}
+		return
+	}
+
+	required, err := rootRequiresApproval(db, rootID)
+	if err != nil {
+		log.Fatalf("Error reading the root's settings: %v", err)
+	}
+	if required {
+		if len(gone) == 0 {
+			fmt.Printf("Removed 0 records of files no longer under %s\n", displayPath(rootDirectory))
+			return
+		}
+		if *keyPath == "" {
+			log.Fatalf("Error: root %s requires approval; give -key to request the removals", displayPath(rootID))
+		}
+		entries := make([]changeEntry, len(gone))
+		for i, entry := range gone {
+			entries[i] = changeEntry{RelPath: entry.RelPath}
+		}
+		id, err := requestChangeset(db, *keyPath, rootID, *reason, changesetAction{}, entries)
+		if err != nil {
+			log.Fatalf("Error %v", err)
+		}
+		fmt.Printf("Changeset %d removing %d records is pending approval by another approver\n", id, len(entries))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Error updating the baseline: %v", err)
+	}
+	defer tx.Rollback()
+	for _, entry := range gone {
+		_, err = tx.Exec("DELETE FROM file_hashes WHERE root_id = ? AND filename = ?", rootID, dbPath(entry.RelPath))
+		if err == nil {
+			err = recordAudit(tx, entry)
+		}
+		if err != nil {
+			log.Fatalf("Error updating the baseline: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalf("Error updating the baseline: %v", err)
+	}
+	fmt.Printf("Removed %d records of files no longer under %s\n", len(gone), displayPath(rootDirectory))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// quickRecord is what the baseline holds for a quick check of a large
+// file: its full hash and modification time, the quick hash taken with
+// them, and when the full hash was last computed.
+type quickRecord struct {
+	Hash    string
+	ModTime int64
+	Quick   string
+	Full    int64
+}
+
+// quickOptions select which files are checked quickly: those of at least
+// Size bytes, by their first and last Edge bytes, hashing them in full only
+// if that check fails or the last full hash is older than FullEvery.
+type quickOptions struct {
+	Size      int64
+	Edge      int64
+	FullEvery time.Duration
+}
+
+// parseQuickOptions reads the -quick-size and -quick-edge sizes.
+func parseQuickOptions(size, edge string, fullEvery time.Duration) (quickOptions, error) {
+	var o quickOptions
+	if size == "" {
+		return o, nil
+	}
+	if edge == "" {
+		edge = "64M"
+	}
+	var err error
+	o.Size, err = parseByteSize(size)
+	if err != nil {
+		return o, fmt.Errorf("-quick-size: %v", err)
+	}
+	o.Edge, err = parseByteSize(edge)
+	if err != nil {
+		return o, fmt.Errorf("-quick-edge: %v", err)
+	}
+	if o.Edge <= 0 || o.Size < 2*o.Edge {
+		return o, fmt.Errorf("-quick-size must be at least twice -quick-edge")
+	}
+	o.FullEvery = fullEvery
+	return o, nil
+}
+
+// loadQuickRecords returns the stored files under rootID that can be
+// checked quickly.
+func loadQuickRecords(db *sql.DB, rootID string, minSize int64) (map[string]quickRecord, error) {
+	rows, err := db.Query("SELECT filename, hash, mtime, quick_hash, full_verified FROM file_hashes WHERE root_id = ? AND size >= ? AND mtime IS NOT NULL AND quick_hash IS NOT NULL AND full_verified IS NOT NULL",
+		rootID, minSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make(map[string]quickRecord)
+	for rows.Next() {
+		var filename string
+		var record quickRecord
+		err = rows.Scan(&filename, &record.Hash, &record.ModTime, &record.Quick, &record.Full)
+		if err != nil {
+			return nil, err
+		}
+		records[filename] = record
+	}
+	return records, rows.Err()
+}
+
+// quickHash hashes a file's size and its first and last edge bytes, which
+// are what changes whenever most large media files are edited, re-encoded
+// or truncated.
+func quickHash(filePath, algo string, edge, size int64) (string, error) {
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := hashAlgorithms[algo]()
+	binary.Write(hash, binary.BigEndian, size)
+	binary.Write(hash, binary.BigEndian, edge)
+	if _, err = io.CopyN(hash, throttled(file), edge); err != nil {
+		return "", err
+	}
+	if _, err = file.Seek(size-edge, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err = io.CopyN(hash, throttled(file), edge); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// check hashes the ends of source if it is large enough, reporting whether
+// that matched record, so its full hash can be taken as the file's. A file
+// written since, whatever its ends, and any error just mean hashing it in
+// full.
+func (o quickOptions) check(source, algo string, record quickRecord, known bool) (os.FileInfo, string, bool) {
+	info, err := os.Stat(longPath(source))
+	if err != nil || info.Size() < o.Size {
+		return nil, "", false
+	}
+	quick, err := quickHash(source, algo, o.Edge, info.Size())
+	if err != nil {
+		return nil, "", false
+	}
+	untouched := known && info.ModTime().UnixNano() == record.ModTime
+	return info, quick, untouched && quick == record.Quick && record.fresh(o.FullEvery)
+}
+
+// fresh reports whether the record's full hash is recent enough to stand
+// in for one.
+func (r quickRecord) fresh(fullEvery time.Duration) bool {
+	return fullEvery <= 0 || time.Since(time.Unix(r.Full, 0)) < fullEvery
+}
@@ -0,0 +1,152 @@
+package main
+
+import "errors"
+
+// Reed-Solomon erasure coding over GF(2^8), as used by PAR2 and RAID 6.
+// Parity shards are combinations of the data shards given by a Cauchy
+// matrix, so any data shards lost can be rebuilt from as many surviving
+// parity shards. Which shards are bad is known from their hashes, so only
+// erasures, not errors, need correcting.
+
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	// The tables use the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d).
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// cauchyCoefficient is entry (i, j) of the matrix giving parity shard i
+// from data shard j: 1 / (x_i + y_j) with x_i = dataShards + i and y_j = j,
+// which are distinct while there are at most 256 shards in all.
+func cauchyCoefficient(dataShards, i, j int) byte {
+	return gfInv(byte(dataShards+i) ^ byte(j))
+}
+
+// mulAdd adds coefficient * in to out.
+func mulAdd(out, in []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	logC := int(gfLog[coefficient])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= gfExp[logC+int(gfLog[b])]
+		}
+	}
+}
+
+// rsEncode computes parity shards from equally sized data shards.
+func rsEncode(data, parity [][]byte) {
+	for i := range parity {
+		for k := range parity[i] {
+			parity[i][k] = 0
+		}
+		for j := range data {
+			mulAdd(parity[i], data[j], cauchyCoefficient(len(data), i, j))
+		}
+	}
+}
+
+// rsReconstruct rebuilds the nil entries of data from the surviving data
+// and parity shards, of which a nil entry is lost as well.
+func rsReconstruct(data, parity [][]byte) error {
+	k := len(data)
+	var rows [][]byte
+	var shards [][]byte
+	for j, shard := range data {
+		if shard != nil {
+			row := make([]byte, k)
+			row[j] = 1
+			rows, shards = append(rows, row), append(shards, shard)
+		}
+	}
+	if len(rows) == k {
+		return nil
+	}
+	for i, shard := range parity {
+		if shard == nil || len(rows) == k {
+			continue
+		}
+		row := make([]byte, k)
+		for j := range row {
+			row[j] = cauchyCoefficient(k, i, j)
+		}
+		rows, shards = append(rows, row), append(shards, shard)
+	}
+	if len(rows) < k {
+		return errors.New("too many shards lost")
+	}
+
+	inverse, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	size := len(shards[0])
+	for j := range data {
+		if data[j] != nil {
+			continue
+		}
+		rebuilt := make([]byte, size)
+		for c, shard := range shards {
+			mulAdd(rebuilt, shard, inverse[j][c])
+		}
+		data[j] = rebuilt
+	}
+	return nil
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination.
+func gfInvert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for i := range matrix {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r != col && work[r][col] != 0 {
+				mulAdd(work[r], work[col], work[r][col])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
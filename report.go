@@ -0,0 +1,729 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FindingMismatch = "mismatch"
+	// FindingCorruption is a mismatch of a file whose size and modification
+	// time are still those recorded. Nothing that writes files normally
+	// leaves both alone, so the content probably rotted in place.
+	FindingCorruption = "corruption"
+	FindingNew        = "new"
+	// FindingExecutable is a new file that can be run: one with execute
+	// permission or a name ending in .exe, .dll, .ps1, .sh and the like.
+	FindingExecutable = "executable"
+	// FindingTypeChange is a mismatch of a file whose content type changed,
+	// reported even where changes are otherwise expected.
+	FindingTypeChange = "content-type"
+	// FindingTruncation is a mismatch of a file that was emptied or shrank
+	// to a small fraction of its recorded size, as when logs are wiped.
+	FindingTruncation = "truncation"
+	// FindingPrivilege is a tracked file that became setuid or setgid or
+	// gained file capabilities, with its content unchanged.
+	FindingPrivilege = "privilege"
+	// FindingQuarantine is a tracked executable that lost the attributes
+	// macOS's Gatekeeper checks, with its content unchanged.
+	FindingQuarantine = "quarantine"
+	FindingMissing    = "missing"
+	FindingError      = "error"
+	FindingTimeout    = "timeout"
+	FindingExpected   = "expected"
+	// FindingEncryption is raised once per scan when many changed files
+	// went from low to high entropy, as when ransomware encrypts them.
+	FindingEncryption = "encryption"
+)
+
+// Finding describes a single notable result of an integrity check.
+type Finding struct {
+	Kind         string
+	FilePath     string
+	StoredHash   string
+	ComputedHash string
+	Message      string
+	// RunID identifies the scan that made the finding.
+	RunID string
+}
+
+type findingRule struct {
+	name        string
+	description string
+	sarifLevel  string
+	cefSeverity int
+}
+
+var findingRules = map[string]findingRule{
+	FindingMismatch:   {"HashMismatch", "The computed hash differs from the stored baseline", "error", 8},
+	FindingCorruption: {"SilentCorruption", "The content changed but the size and modification time did not, suggesting bit rot", "error", 10},
+	FindingTypeChange: {"ContentTypeChange", "The file's content type changed, e.g. an image that became an executable", "error", 9},
+	FindingTruncation: {"FileTruncated", "The file was emptied or shrank to a small fraction of its size, as when logs or configuration are wiped", "error", 9},
+	FindingPrivilege:  {"PrivilegeGained", "A tracked file became setuid or setgid or gained file capabilities", "error", 9},
+	FindingQuarantine: {"QuarantineRemoved", "A tracked executable lost the quarantine or provenance attributes Gatekeeper checks before running it", "error", 8},
+	FindingNew:        {"NewFile", "The file was not present in the baseline", "note", 3},
+	FindingExecutable: {"NewExecutable", "An executable file that was not present in the baseline appeared", "error", 9},
+	FindingMissing:    {"MissingFile", "The file is in the baseline but no longer exists", "warning", 6},
+	FindingError:      {"CheckError", "The file could not be verified", "warning", 5},
+	FindingTimeout:    {"HashTimeout", "The file could not be hashed within the per-file timeout", "warning", 5},
+	FindingExpected:   {"ExpectedUpdate", "The file changed as announced by a signed deployment manifest", "note", 2},
+	FindingEncryption: {"MassEncryption", "Many changed files went from low to high entropy, as when ransomware encrypts them", "error", 10},
+}
+
+// findingWriter streams findings in a machine-readable format as they are
+// produced, so the report never has to be held in memory.
+type findingWriter interface {
+	WriteFinding(finding Finding) error
+	// Close completes the output once every finding has been written.
+	Close(run runInfo, rollup []directoryCounts) error
+}
+
+func newFindingWriter(w io.Writer, format string) (findingWriter, error) {
+	switch format {
+	case "sarif":
+		return newSARIFWriter(w)
+	case "cef":
+		return &cefWriter{w: w}, nil
+	case "wazuh":
+		return newWazuhWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// scanReport accumulates the outcome of a scan. The human-readable lines are
+// spooled to a temporary file and only the per-directory counts are kept in
+// memory, so its size doesn't grow with the number of findings.
+type scanReport struct {
+	Run runInfo
+	// Suppressed counts findings left out because they were already
+	// reported recently.
+	Suppressed int
+	// Acknowledged counts findings left out because the same finding was
+	// resolved with gohash findings ack.
+	Acknowledged int
+	// Baselined counts the files recorded by the scan that created the
+	// root's baseline, which are not reported individually.
+	Baselined int
+	// Coverage says how much of the baseline a budgeted or sampled scan
+	// verified.
+	Coverage string
+	// Dynamic counts the changed files under dynamic content rules, whose
+	// new hashes were recorded without a finding.
+	Dynamic int
+	// Quick counts the passed files whose quick check stood in for a full
+	// hash.
+	Quick int
+	// Fast counts the passed files whose unchanged identity, size and
+	// modification time stood in for a hash, under -fast.
+	Fast int
+	// Skipped counts the new empty and special files not recorded.
+	Skipped int
+	// EvidenceHead identifies the last evidence log entry written by the
+	// scan, if it keeps one.
+	EvidenceHead string
+	spool        *os.File
+	findings     *findingSpool
+	stream       findingWriter
+	rollup       map[string]*directoryCounts
+	totals       directoryCounts
+	Passed       int
+	// Detail is how many findings notifications list, summarizing the
+	// others by directory, or 0 to list them all.
+	Detail int
+	// unrecorded is set when the findings aren't stored in the database,
+	// as by a read-only scan.
+	unrecorded bool
+	// matched holds the files hashed in full and found matching, if the
+	// scan tracks them.
+	matched map[string]bool
+	// added counts the findings in the spool, and detailSize is the size
+	// of the spool up to the last one notifications list. overflow counts
+	// the others by directory.
+	added      int
+	detailSize int64
+	overflow   map[string]*directoryCounts
+}
+
+func newScanReport(run runInfo, stream findingWriter) (*scanReport, error) {
+	spool, err := os.CreateTemp("", "gohash-report-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	return &scanReport{Run: run, spool: spool, stream: stream, rollup: make(map[string]*directoryCounts), matched: make(map[string]bool)}, nil
+}
+
+// Add records finding in the text report, the rollup and the stream.
+func (r *scanReport) Add(finding Finding) error {
+	n, err := io.WriteString(r.spool, finding.Message+"\n")
+	if err != nil {
+		return err
+	}
+
+	directory := filepath.Dir(finding.FilePath)
+	addTo(r.rollup, directory, finding.Kind)
+	r.totals.add(finding.Kind)
+	r.added++
+	if r.Detail == 0 || r.added <= r.Detail {
+		r.detailSize += int64(n)
+	} else {
+		if r.overflow == nil {
+			r.overflow = make(map[string]*directoryCounts)
+		}
+		addTo(r.overflow, directory, finding.Kind)
+	}
+
+	if r.stream != nil {
+		return r.stream.WriteFinding(finding)
+	}
+	return nil
+}
+
+// addTo counts a finding of kind under directory in rollup.
+func addTo(rollup map[string]*directoryCounts, directory, kind string) {
+	counts, ok := rollup[directory]
+	if !ok {
+		counts = &directoryCounts{Directory: directory}
+		rollup[directory] = counts
+	}
+	counts.add(kind)
+}
+
+// Rollup returns the per-directory counts sorted by directory.
+func (r *scanReport) Rollup() []directoryCounts {
+	return sortedRollup(r.rollup)
+}
+
+func sortedRollup(counts map[string]*directoryCounts) []directoryCounts {
+	rollup := make([]directoryCounts, 0, len(counts))
+	for _, c := range counts {
+		rollup = append(rollup, *c)
+	}
+	sort.Slice(rollup, func(i, j int) bool {
+		return rollup[i].Directory < rollup[j].Directory
+	})
+	return rollup
+}
+
+// Totals returns the number of findings of each kind across all directories.
+func (r *scanReport) Totals() directoryCounts {
+	return r.totals
+}
+
+// Text returns a reader over the full text report: the run header, the
+// directory summary, every finding and the final tally. Each call starts
+// from the beginning.
+func (r *scanReport) Text() (io.Reader, error) {
+	_, err := r.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(
+		strings.NewReader(r.Run.header()),
+		strings.NewReader(directoryRollup(r.Rollup())),
+		io.LimitReader(r.spool, r.spoolSize()),
+		strings.NewReader(r.tally()),
+	), nil
+}
+
+// Excerpt returns a reader over the text report as notifications show it:
+// with more than Detail findings, only the first Detail are listed and the
+// others are counted by directory, and only the Detail directories with the
+// most findings are summarized, so that even a scan that found every file
+// encrypted makes a deliverable notification. The full list stays in the
+// text report and the database.
+func (r *scanReport) Excerpt() (io.Reader, error) {
+	if r.Detail == 0 || r.added <= r.Detail {
+		return r.Text()
+	}
+	_, err := r.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if r.unrecorded {
+		b.WriteString(trf("%d more findings aren't listed here; the full report has them all. By directory:\n", r.added-r.Detail))
+	} else {
+		b.WriteString(trf("%d more findings aren't listed here; the full report and %s findings list %s have them all. By directory:\n",
+			r.added-r.Detail, os.Args[0], displayPath(r.Run.Database)))
+	}
+	b.WriteString(directoryLines(sortedRollup(r.overflow), r.Detail))
+	b.WriteString("\n")
+	return io.MultiReader(
+		strings.NewReader(r.Run.header()),
+		strings.NewReader(limitedRollup(r.Rollup(), r.Detail)),
+		io.LimitReader(r.spool, r.detailSize),
+		strings.NewReader(b.String()),
+		strings.NewReader(r.tally()),
+	), nil
+}
+
+// Status is the one-line outcome of the scan.
+func (r *scanReport) Status() string {
+	if r.Baselined > 0 && r.totals.findings() == 0 {
+		return trf("Baseline created: %d files", r.Baselined)
+	}
+	return reportStatus(r.totals)
+}
+
+// tally is the last part of the text report.
+func (r *scanReport) tally() string {
+	tally := trf("%d files have passed the integrity tests\n", r.Passed)
+	if r.Baselined > 0 {
+		// Nothing can pass on the scan that creates the baseline.
+		tally = trf("Baseline created: %d files recorded\n", r.Baselined)
+	}
+	if r.Coverage != "" {
+		tally += trf("Coverage: %s\n", r.Coverage)
+	}
+	if r.Dynamic > 0 {
+		tally += trf("%d files under dynamic content rules changed and were updated\n", r.Dynamic)
+	}
+	if r.Skipped > 0 {
+		tally += trf("%d new empty or special files were skipped\n", r.Skipped)
+	}
+	if r.totals.Pending > 0 {
+		tally += trf("%d new or changed files were modified too recently to judge and are left for the next scan\n", r.totals.Pending)
+	}
+	if r.Quick > 0 {
+		tally += trf("%d of the files passed were only checked by their size and first and last bytes\n", r.Quick)
+	}
+	if r.Fast > 0 {
+		tally += trf("%d of the files passed weren't read, since their inode, size and modification time were unchanged\n", r.Fast)
+	}
+	if r.Suppressed > 0 {
+		tally += trf("%d findings already reported recently are not shown\n", r.Suppressed)
+	}
+	if r.Acknowledged > 0 {
+		tally += trf("%d findings already acknowledged are not shown\n", r.Acknowledged)
+	}
+	if r.EvidenceHead != "" {
+		tally += trf("Evidence log head: %s\n", r.EvidenceHead)
+	}
+	return tally
+}
+
+func (r *scanReport) spoolSize() int64 {
+	info, err := r.spool.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// CloseStream completes the machine-readable output, if any.
+func (r *scanReport) CloseStream() error {
+	if r.stream == nil {
+		return nil
+	}
+	return r.stream.Close(r.Run, r.Rollup())
+}
+
+// Remove deletes the spooled report.
+func (r *scanReport) Remove() {
+	r.spool.Close()
+	os.Remove(r.spool.Name())
+	if r.findings != nil {
+		r.findings.Remove()
+	}
+}
+
+// directoryCounts tallies findings of each kind under a single directory.
+type directoryCounts struct {
+	Directory string `json:"directory,omitempty"`
+	Changed   int    `json:"changed"`
+	New       int    `json:"new"`
+	Missing   int    `json:"missing"`
+	Errors    int    `json:"errors"`
+	TimedOut  int    `json:"timedOut"`
+	Expected  int    `json:"expected"`
+	// Corrupted counts the changed files that are probably bit rot rather
+	// than modified.
+	Corrupted int `json:"corrupted"`
+	// Retyped counts the changed files whose content type changed.
+	Retyped int `json:"retyped"`
+	// Truncated counts the changed files that were emptied or shrank
+	// dramatically.
+	Truncated int `json:"truncated"`
+	// Executables counts the new files that are executable.
+	Executables int `json:"executables"`
+	// Elevated counts the files that gained privileges, counted as
+	// changed.
+	Elevated int `json:"elevated"`
+	// Stripped counts the executables that lost their Gatekeeper
+	// attributes, counted as changed.
+	Stripped int `json:"stripped"`
+	// Encryption counts the possible ransomware findings.
+	Encryption int `json:"encryption"`
+	// Pending counts the new and changed files the grace period left for
+	// the next scan, which aren't findings.
+	Pending int `json:"pending"`
+}
+
+func (c *directoryCounts) add(kind string) {
+	switch kind {
+	case FindingMismatch:
+		c.Changed++
+	case FindingCorruption:
+		c.Changed++
+		c.Corrupted++
+	case FindingTypeChange:
+		c.Changed++
+		c.Retyped++
+	case FindingTruncation:
+		c.Changed++
+		c.Truncated++
+	case FindingPrivilege:
+		c.Changed++
+		c.Elevated++
+	case FindingQuarantine:
+		c.Changed++
+		c.Stripped++
+	case FindingNew:
+		c.New++
+	case FindingExecutable:
+		c.New++
+		c.Executables++
+	case FindingMissing:
+		c.Missing++
+	case FindingError:
+		c.Errors++
+	case FindingTimeout:
+		c.TimedOut++
+	case FindingExpected:
+		c.Expected++
+	case FindingEncryption:
+		c.Encryption++
+	}
+}
+
+// findings is the number of findings of every kind.
+func (c directoryCounts) findings() int {
+	return c.Changed + c.New + c.Missing + c.Errors + c.TimedOut + c.Expected + c.Encryption
+}
+
+func (c *directoryCounts) merge(other directoryCounts) {
+	c.Changed += other.Changed
+	c.New += other.New
+	c.Missing += other.Missing
+	c.Errors += other.Errors
+	c.TimedOut += other.TimedOut
+	c.Expected += other.Expected
+	c.Corrupted += other.Corrupted
+	c.Retyped += other.Retyped
+	c.Truncated += other.Truncated
+	c.Executables += other.Executables
+	c.Elevated += other.Elevated
+	c.Stripped += other.Stripped
+	c.Encryption += other.Encryption
+	c.Pending += other.Pending
+}
+
+// mergeRollups combines the per-directory counts of several reports.
+func mergeRollups(reports []*scanReport) []directoryCounts {
+	if len(reports) == 1 {
+		return reports[0].Rollup()
+	}
+	merged := make(map[string]*directoryCounts)
+	for _, report := range reports {
+		for _, counts := range report.rollup {
+			total, ok := merged[counts.Directory]
+			if !ok {
+				total = &directoryCounts{Directory: counts.Directory}
+				merged[counts.Directory] = total
+			}
+			total.merge(*counts)
+		}
+	}
+	return sortedRollup(merged)
+}
+
+// directoryRollup renders the per-directory summary shown at the top of text
+// reports and emails. It is empty when there is nothing to report.
+func directoryRollup(rollup []directoryCounts) string {
+	return limitedRollup(rollup, 0)
+}
+
+// limitedRollup renders the per-directory summary of at most limit
+// directories, those with the most findings, or of all of them if limit is
+// 0.
+func limitedRollup(rollup []directoryCounts, limit int) string {
+	if len(rollup) == 0 {
+		return ""
+	}
+	return trf("Summary by directory:\n") + directoryLines(rollup, limit) + "\n"
+}
+
+// directoryLines renders a line of counts for each directory in rollup or,
+// if there are more than limit and limit isn't 0, for the limit with the
+// most findings, in the order of rollup, followed by a line counting the
+// rest.
+func directoryLines(rollup []directoryCounts, limit int) string {
+	var rest, restFindings int
+	if limit > 0 && len(rollup) > limit {
+		largest := make([]directoryCounts, len(rollup))
+		copy(largest, rollup)
+		sort.SliceStable(largest, func(i, j int) bool {
+			return largest[i].findings() > largest[j].findings()
+		})
+		shown := make(map[string]bool)
+		for _, counts := range largest[:limit] {
+			shown[counts.Directory] = true
+		}
+		for _, counts := range largest[limit:] {
+			rest++
+			restFindings += counts.findings()
+		}
+		kept := rollup[:0:0]
+		for _, counts := range rollup {
+			if shown[counts.Directory] {
+				kept = append(kept, counts)
+			}
+		}
+		rollup = kept
+	}
+
+	var b strings.Builder
+	for _, counts := range rollup {
+		b.WriteString(trf("  %s: %d changed, %d new, %d missing, %d errors",
+			displayPath(counts.Directory), counts.Changed, counts.New, counts.Missing, counts.Errors))
+		if counts.Corrupted > 0 {
+			b.WriteString(trf(" (%d probably corrupted)", counts.Corrupted))
+		}
+		if counts.Retyped > 0 {
+			b.WriteString(trf(" (%d changed type)", counts.Retyped))
+		}
+		if counts.Truncated > 0 {
+			b.WriteString(trf(" (%d truncated)", counts.Truncated))
+		}
+		if counts.Executables > 0 {
+			b.WriteString(trf(" (%d executable)", counts.Executables))
+		}
+		if counts.Elevated > 0 {
+			b.WriteString(trf(" (%d gained privileges)", counts.Elevated))
+		}
+		if counts.Stripped > 0 {
+			b.WriteString(trf(" (%d lost Gatekeeper attributes)", counts.Stripped))
+		}
+		if counts.TimedOut > 0 {
+			b.WriteString(trf(", %d timed out", counts.TimedOut))
+		}
+		if counts.Encryption > 0 {
+			b.WriteString(trf(", possible ransomware"))
+		}
+		if counts.Expected > 0 {
+			b.WriteString(trf(", %d expected updates", counts.Expected))
+		}
+		b.WriteString("\n")
+	}
+	if rest > 0 {
+		b.WriteString(trf("  %d more directories: %d findings\n", rest, restFindings))
+	}
+	return b.String()
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifInvocation struct {
+	StartTimeUTC        string `json:"startTimeUtc"`
+	EndTimeUTC          string `json:"endTimeUtc"`
+	Machine             string `json:"machine"`
+	ExecutionSuccessful bool   `json:"executionSuccessful"`
+}
+
+// sarifAutomationDetails identifies the run by its run ID.
+type sarifAutomationDetails struct {
+	GUID string `json:"guid"`
+}
+
+type sarifRunProperties struct {
+	Root             string            `json:"root"`
+	RootID           string            `json:"rootId"`
+	Database         string            `json:"database"`
+	DirectorySummary []directoryCounts `json:"directorySummary"`
+}
+
+// sarifWriter writes a SARIF 2.1.0 log with a single run, emitting each
+// result as it arrives rather than building the whole document.
+type sarifWriter struct {
+	w       io.Writer
+	results int
+}
+
+func newSARIFWriter(w io.Writer) (*sarifWriter, error) {
+	driver := sarifDriver{Name: "gohash", Version: version, InformationURI: "https://github.com/mawumag/gohash"}
+	for _, kind := range []string{FindingMismatch, FindingCorruption, FindingTypeChange, FindingTruncation, FindingPrivilege, FindingQuarantine, FindingNew, FindingExecutable, FindingMissing, FindingError, FindingTimeout, FindingExpected, FindingEncryption} {
+		rule := findingRules[kind]
+		driver.Rules = append(driver.Rules, sarifRule{ID: rule.name, ShortDescription: sarifMessage{Text: rule.description}})
+	}
+	tool, err := json.Marshal(sarifTool{Driver: driver})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(w, `{"$schema":"https://json.schemastore.org/sarif-2.1.0.json","version":"2.1.0","runs":[{"tool":%s,"results":[`, tool)
+	return &sarifWriter{w: w}, err
+}
+
+func (s *sarifWriter) WriteFinding(finding Finding) error {
+	rule := findingRules[finding.Kind]
+	result := sarifResult{
+		RuleID:  rule.name,
+		Level:   rule.sarifLevel,
+		Message: sarifMessage{Text: finding.Message},
+		Locations: []sarifLocation{{
+			PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: fileURI(finding.FilePath)},
+			},
+		}},
+		Properties: map[string]string{},
+	}
+	if finding.StoredHash != "" {
+		result.Properties["storedHash"] = finding.StoredHash
+	}
+	if finding.ComputedHash != "" {
+		result.Properties["computedHash"] = finding.ComputedHash
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	separator := "\n"
+	if s.results > 0 {
+		separator = ",\n"
+	}
+	s.results++
+	_, err = fmt.Fprintf(s.w, "%s%s", separator, encoded)
+	return err
+}
+
+func (s *sarifWriter) Close(run runInfo, rollup []directoryCounts) error {
+	invocations, err := json.Marshal([]sarifInvocation{{
+		StartTimeUTC:        run.Started.UTC().Format(time.RFC3339),
+		EndTimeUTC:          run.Finished.UTC().Format(time.RFC3339),
+		Machine:             run.Hostname,
+		ExecutionSuccessful: true,
+	}})
+	if err != nil {
+		return err
+	}
+	properties, err := json.Marshal(sarifRunProperties{
+		Root:             displayPath(run.Root),
+		RootID:           displayPath(run.RootID),
+		Database:         displayPath(run.Database),
+		DirectorySummary: rollup,
+	})
+	if err != nil {
+		return err
+	}
+	automation, err := json.Marshal(sarifAutomationDetails{GUID: run.RunID})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "\n],\"automationDetails\":%s,\"invocations\":%s,\"properties\":%s}]}\n", automation, invocations, properties)
+	return err
+}
+
+// fileURI returns a file URI for path, percent-encoding anything that isn't
+// allowed in a URI path, including bytes that aren't valid UTF-8.
+func fileURI(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+	absPath = filepath.ToSlash(absPath)
+	if !strings.HasPrefix(absPath, "/") {
+		// Windows drive paths need a leading slash in file URIs.
+		absPath = "/" + absPath
+	}
+	return (&url.URL{Scheme: "file", Path: absPath}).String()
+}
+
+// cefWriter writes one ArcSight Common Event Format line per finding.
+type cefWriter struct {
+	w io.Writer
+}
+
+func (c *cefWriter) WriteFinding(finding Finding) error {
+	rule := findingRules[finding.Kind]
+	extension := []string{
+		"fname=" + cefExtensionEscape(displayPath(filepath.Base(finding.FilePath))),
+		"filePath=" + cefExtensionEscape(displayPath(finding.FilePath)),
+	}
+	if finding.ComputedHash != "" {
+		extension = append(extension, "fileHash="+cefExtensionEscape(finding.ComputedHash))
+	}
+	if finding.StoredHash != "" {
+		extension = append(extension, "oldFileHash="+cefExtensionEscape(finding.StoredHash))
+	}
+	if finding.RunID != "" {
+		extension = append(extension, "cs1Label=runId", "cs1="+cefExtensionEscape(finding.RunID))
+	}
+	extension = append(extension, "msg="+cefExtensionEscape(finding.Message))
+
+	_, err := fmt.Fprintf(c.w, "CEF:0|gohash|gohash|%s|%s|%s|%d|%s\n",
+		cefHeaderEscape(version), cefHeaderEscape(rule.name), cefHeaderEscape(rule.description), rule.cefSeverity, strings.Join(extension, " "))
+	return err
+}
+
+func (c *cefWriter) Close(run runInfo, rollup []directoryCounts) error {
+	return nil
+}
+
+func cefHeaderEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+func cefExtensionEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "=", `\=`)
+	s = strings.ReplaceAll(s, "\r", `\r`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// I/O scheduling classes, as numbered by Linux.
+const (
+	ioClassBestEffort = 2
+	ioClassIdle       = 3
+)
+
+// resourceOptions keep a run out of the way of the host's other work, for
+// scans scheduled while the machine is in use.
+type resourceOptions struct {
+	Nice   int
+	IONice string
+	CPUs   int
+	// CPULimit, if not zero, is the share of the time hashing may run.
+	CPULimit float64
+}
+
+func (o *resourceOptions) register(flags *flag.FlagSet) {
+	flags.IntVar(&o.Nice, "nice", 0, "run at this niceness, 1 (slightly lower priority) to 19 (lowest); on Windows below-normal priority, or idle from 10")
+	flags.StringVar(&o.IONice, "ionice", "", "I/O scheduling class: idle, or best-effort with a level from 0 (highest) to 7, e.g. best-effort:7; Windows only has idle")
+	flags.IntVar(&o.CPUs, "cpus", 0, "run on at most this many CPUs at a time (default: all)")
+	flags.Func("cpu-limit", "pause hashing so it runs this share of the time, e.g. 25% (default: no limit)", func(value string) error {
+		limit, err := parsePercent(value)
+		o.CPULimit = limit
+		return err
+	})
+}
+
+// apply lowers the process's priorities and starts the CPU limit.
+func (o *resourceOptions) apply() {
+	if o.Nice < 0 || o.Nice > 19 {
+		log.Fatalf("Error: -nice must be between 0 and 19")
+	}
+	if o.Nice > 0 {
+		err := setNice(o.Nice)
+		if err != nil {
+			log.Fatalf("Error setting -nice: %v", err)
+		}
+	}
+	if o.IONice != "" {
+		class, level, err := parseIONice(o.IONice)
+		if err == nil {
+			err = setIOPriority(class, level)
+		}
+		if err != nil {
+			log.Fatalf("Error setting -ionice: %v", err)
+		}
+	}
+	if o.CPUs > 0 {
+		runtime.GOMAXPROCS(o.CPUs)
+	}
+	if o.CPULimit > 0 && o.CPULimit < 1 {
+		hashThrottle = newDutyCycle(o.CPULimit, 100*time.Millisecond)
+	}
+}
+
+// parseIONice reads an -ionice class such as "idle" or "best-effort:7".
+func parseIONice(value string) (int, int, error) {
+	name, levelText, hasLevel := strings.Cut(value, ":")
+	switch name {
+	case "idle":
+		if hasLevel {
+			return 0, 0, fmt.Errorf("the idle class has no levels")
+		}
+		return ioClassIdle, 0, nil
+	case "best-effort":
+		level := 4
+		if hasLevel {
+			var err error
+			level, err = strconv.Atoi(levelText)
+			if err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("best-effort levels are 0 to 7, not %q", levelText)
+			}
+		}
+		return ioClassBestEffort, level, nil
+	}
+	return 0, 0, fmt.Errorf("unknown class %q (supported: idle, best-effort)", name)
+}
+
+// hashThrottle, if set, paces every file being hashed.
+var hashThrottle *dutyCycle
+
+// dutyCycle lets work run for a share of every period. The gate is held
+// for the rest of the period, and workers pass through it between reads.
+type dutyCycle struct {
+	gate sync.RWMutex
+}
+
+func newDutyCycle(share float64, period time.Duration) *dutyCycle {
+	d := &dutyCycle{}
+	run := time.Duration(share * float64(period))
+	go func() {
+		for {
+			time.Sleep(run)
+			d.gate.Lock()
+			time.Sleep(period - run)
+			d.gate.Unlock()
+		}
+	}()
+	return d
+}
+
+// wait blocks while the work is paused.
+func (d *dutyCycle) wait() {
+	d.gate.RLock()
+	d.gate.RUnlock()
+}
+
+// throttled returns r, paced by hashThrottle if there is one.
+func throttled(r io.Reader) io.Reader {
+	if hashThrottle == nil {
+		return r
+	}
+	return &throttledReader{r, hashThrottle}
+}
+
+type throttledReader struct {
+	r     io.Reader
+	cycle *dutyCycle
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	t.cycle.wait()
+	return t.r.Read(p)
+}
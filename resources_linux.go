@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Linux keeps priorities per thread, so every thread the runtime has
+// started so far is changed; threads started later inherit from them.
+
+func setNice(nice int) error {
+	return eachThread(func(tid int) error {
+		return unix.Setpriority(unix.PRIO_PROCESS, tid, nice)
+	})
+}
+
+func setIOPriority(class, level int) error {
+	const whoProcess = 1
+	priority := class<<13 | level
+	return eachThread(func(tid int) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, whoProcess, uintptr(tid), uintptr(priority))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+func eachThread(f func(tid int) error) error {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// A thread that exited in the meantime doesn't matter.
+		if err := f(tid); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
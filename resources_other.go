@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+func setNice(nice int) error {
+	return errors.New("-nice is not available on this platform")
+}
+
+func setIOPriority(class, level int) error {
+	return errors.New("I/O classes are only available on Linux and Windows")
+}
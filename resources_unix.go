@@ -0,0 +1,17 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+func setNice(nice int) error {
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, nice)
+}
+
+func setIOPriority(class, level int) error {
+	return errors.New("I/O classes are only available on Linux and Windows")
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+func setNice(nice int) error {
+	class := uint32(windows.BELOW_NORMAL_PRIORITY_CLASS)
+	if nice >= 10 {
+		class = windows.IDLE_PRIORITY_CLASS
+	}
+	return windows.SetPriorityClass(windows.CurrentProcess(), class)
+}
+
+// setIOPriority puts the process in background mode, which lowers its I/O
+// and memory priority as well as its CPU priority.
+func setIOPriority(class, level int) error {
+	if class != ioClassIdle {
+		return errors.New("only the idle class is available on Windows")
+	}
+	return windows.SetPriorityClass(windows.CurrentProcess(), windows.PROCESS_MODE_BACKGROUND_BEGIN)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// runInfo describes a single scan: where it ran, over what, and when.
+type runInfo struct {
+	// RunID is a random UUID identifying the scan in every report, log
+	// line and event it produces, so they can be correlated across hosts.
+	RunID    string
+	Hostname string
+	Root     string
+	RootID   string
+	Database string
+	// Snapshot names the snapshot the root was scanned in, if any.
+	Snapshot string
+	// Baseline describes the saved baseline the root was verified
+	// against, if not the current one.
+	Baseline string
+	// Tier is how deeply the root was verified: TierFull or TierQuick.
+	Tier     string
+	Version  string
+	Started  time.Time
+	Finished time.Time
+}
+
+func newRunInfo(rootDirectory, rootID, databasePath string) runInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return runInfo{
+		RunID:    newRunID(),
+		Hostname: hostname,
+		Root:     rootDirectory,
+		RootID:   rootID,
+		Database: databasePath,
+		Version:  version,
+		Started:  time.Now(),
+	}
+}
+
+// newRunID returns a random (version 4) UUID.
+func newRunID() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Duration is how long the scan took, rounded for display.
+func (r runInfo) Duration() time.Duration {
+	return r.Finished.Sub(r.Started).Round(time.Millisecond)
+}
+
+// header is the block at the top of text reports and emails identifying
+// the machine and directory they cover.
+func (r runInfo) header() string {
+	var b strings.Builder
+	b.WriteString(trf("gohash %s on %s\n", r.Version, r.Hostname))
+	b.WriteString(trf("Root: %s", displayPath(r.Root)))
+	if r.RootID != r.Root {
+		b.WriteString(trf(" (root ID %s)", displayPath(r.RootID)))
+	}
+	b.WriteString(trf("\nDatabase: %s\n", displayPath(r.Database)))
+	if r.Snapshot != "" {
+		b.WriteString(trf("Snapshot: %s\n", r.Snapshot))
+	}
+	if r.Baseline != "" {
+		b.WriteString(trf("Baseline: %s\n", r.Baseline))
+	}
+	switch r.Tier {
+	case TierFull:
+		b.WriteString(trf("Tier: full, every file hashed\n"))
+	case TierQuick:
+		b.WriteString(trf("Tier: quick, some files checked by their metadata or left for later scans\n"))
+	}
+	b.WriteString(trf("Run: %s\n", r.RunID))
+	b.WriteString(trf("Started: %s\n", r.Started.Format(time.RFC3339)))
+	if !r.Finished.IsZero() {
+		b.WriteString(trf("Finished: %s (%s)\n", r.Finished.Format(time.RFC3339), r.Duration()))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// recordRun stores the outcome of a scan in the runs table.
+func recordRun(db *sql.DB, run runInfo, status string, report *scanReport) (int64, error) {
+	totals := report.Totals()
+	result, err := db.Exec(`INSERT INTO runs (run_id, hostname, root, root_id, database, version, started_at, finished_at,
+		status, changed, new, missing, errors, timed_out, expected, passed, tier, pending)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.RunID, run.Hostname, run.Root, run.RootID, run.Database, run.Version, run.Started.Unix(), run.Finished.Unix(),
+		status, totals.Changed, totals.New, totals.Missing, totals.Errors, totals.TimedOut, totals.Expected, report.Passed, nullString(run.Tier), totals.Pending)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// lastRunOfTier returns when the last recorded scan of rootID at tier
+// started, or the zero time if there was none.
+func lastRunOfTier(db *sql.DB, rootID, tier string) (time.Time, error) {
+	var started sql.NullInt64
+	err := db.QueryRow("SELECT MAX(started_at) FROM runs WHERE root_id = ? AND tier = ?", rootID, tier).Scan(&started)
+	if err != nil || !started.Valid {
+		return time.Time{}, err
+	}
+	return time.Unix(started.Int64, 0), nil
+}
+
+// recordNotification stores the outcome of delivering the notification of
+// some runs: "sent", or why it failed, so monitoring can catch alerts that
+// never arrived.
+func recordNotification(databasePath string, wait time.Duration, runIDs []string, sendErr error) error {
+	outcome := "sent"
+	if sendErr != nil {
+		outcome = "failed: " + sendErr.Error()
+	}
+	return withDatabase(databasePath, wait, func(db *sql.DB) error {
+		for _, runID := range runIDs {
+			_, err := db.Exec("UPDATE runs SET notification = ? WHERE run_id = ?", outcome, runID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// withDatabase runs f on the database at databasePath while holding its
+// run lock, for the short updates made after a scan, such as recording
+// what was delivered where.
+func withDatabase(databasePath string, wait time.Duration, f func(db *sql.DB) error) error {
+	lock, err := acquireRunLock(databasePath, wait)
+	if err != nil {
+		return err
+	}
+	defer releaseRunLock(lock)
+	db, err := openDatabase(databasePath)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+	return f(db)
+}
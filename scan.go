@@ -0,0 +1,1184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanOptions controls how a root is scanned. They are shared by one-shot
+// scans and the daemon.
+type scanOptions struct {
+	LockWait   time.Duration
+	RootID     string
+	PathPolicy string
+	Recursive  bool
+	Walkers    int
+	Workers    int
+	SortBySize bool
+	HashAlgo   string
+	File       fileOptions
+	// ManifestDir and ManifestKey select signed deployment manifests whose
+	// announced changes are accepted into the baseline.
+	ManifestDir string
+	ManifestKey string
+	// ReadOnly verifies without writing anything to the database.
+	ReadOnly bool
+	// Against, if set, names a saved baseline to verify against instead
+	// of the current one; the scan is then read-only.
+	Against string
+	// Golden, if set, is a golden image file exported by gohash baseline
+	// export, imported into the database on every scan and verified
+	// against like Against; with GoldenKey, it must be signed by that key.
+	Golden    string
+	GoldenKey string
+	// EvidenceLog, if set, is a hash-chained log every finding is appended
+	// to.
+	EvidenceLog string
+	// ParityDir, if set, keeps Reed-Solomon repair data for every trusted
+	// file, with Parity parity blocks per stripe, so bit rot found later
+	// can be repaired.
+	ParityDir string
+	Parity    int
+	// FSErrors checks mismatches against the error reports of
+	// ZFS and Btrfs.
+	FSErrors bool
+	// Streams hashes the alternate data streams of NTFS files and the
+	// resource forks of macOS files as entries of their own.
+	Streams bool
+	// Gatekeeper records the Gatekeeper attributes of macOS files and
+	// reports tracked executables that lose them.
+	Gatekeeper bool
+	// Privileges records the setuid and setgid bits and Linux file
+	// capabilities of files and reports files that gain any.
+	Privileges bool
+	// Snapshot, if set, is the kind of snapshot the root is scanned in
+	// instead of the live tree; SnapSize sizes LVM snapshots.
+	Snapshot string
+	SnapSize string
+	// Budget, if not zero, limits a scan to verifying that many stored
+	// files, those verified longest ago, so a tree too big to hash in one
+	// run is covered over several.
+	Budget int
+	// Sample, if not zero, is the fraction of stored files verified, picked
+	// by hashing their paths with SampleSeed so a run can be repeated.
+	Sample     float64
+	SampleSeed int64
+	// Incremental only hashes stored files the filesystem's change journal
+	// reports changed since the last scan, plus any Budget or Sample picks;
+	// on Linux, the Watcher a daemon keeps running between scans.
+	Incremental bool
+	Watcher     *changeWatcher
+	// Dynamic are paths, such as logs and caches, whose files are kept
+	// in the inventory but whose changes aren't reported; new and missing
+	// files still are.
+	Dynamic []string
+	// Entropy, if not zero, estimates the entropy of every file and reports
+	// possible ransomware once that many changed files went from low to
+	// high entropy, as files being encrypted do.
+	Entropy int
+	// ContentType records every file's content type and reports a file
+	// whose type changed, even under Dynamic rules.
+	ContentType bool
+	// QuickSize, if set, is the size from which files are checked quickly
+	// by their first and last QuickEdge bytes, and only hashed in full
+	// when that fails or their last full hash is older than FullEvery.
+	QuickSize string
+	QuickEdge string
+	FullEvery time.Duration
+	// Fast takes the stored hash of a file whose device, inode, size and
+	// modification time are unchanged instead of hashing it, unless its
+	// last full hash is older than FullEvery.
+	Fast bool
+	// Grace, if not zero, leaves new and changed files modified less than
+	// this long ago pending, neither recorded nor reported, as they may
+	// still be being written; they are hashed again at the end of the
+	// scan and left for the next one if they are still that recent.
+	Grace time.Duration
+	// Special is the policy for FIFOs, sockets and devices, and Empty the
+	// one for zero-byte files: one of the Policy constants, skip and
+	// record by default.
+	Special string
+	Empty   string
+	// PrintMatches prints a line to stdout for every file that passed.
+	PrintMatches bool
+	// TrackMatches keeps the paths of the files the scan hashed in full
+	// and found matching, which alone have their on-call alerts resolved.
+	TrackMatches bool
+	// MaxFindings is how many findings notifications list; the others are
+	// summarized by directory. 0 lists them all.
+	MaxFindings int
+	// MapPrefix maps the path of a root mounted elsewhere than where its
+	// baseline was recorded back to the recorded one, as old=new pairs,
+	// when RootID isn't set.
+	MapPrefix []string
+	// Suppress, if set, drops findings that shouldn't be reported again.
+	Suppress func(Finding) bool
+	// Slots, if set, is shared with other scans running at the same time;
+	// a file is only hashed while holding a slot.
+	Slots chan struct{}
+	// Stream, if set, is sent every result as it arrives.
+	Stream *resultStream
+}
+
+func (o *scanOptions) register(flags *flag.FlagSet) {
+	flags.DurationVar(&o.LockWait, "wait", 0, "how long to wait for another run on the same database to finish")
+	flags.StringVar(&o.RootID, "root-id", "", "identifier the root's records are stored under (default: its absolute path)")
+	flags.StringVar(&o.PathPolicy, "path-policy", "", "how paths are matched: preserve, nfc or casefold (default: the root's stored policy)")
+	flags.BoolVar(&o.Recursive, "recursive", false, "scan subdirectories of the root as well")
+	flags.IntVar(&o.Walkers, "walkers", 4, "number of directories read concurrently when scanning recursively")
+	flags.IntVar(&o.Workers, "workers", 8, "number of files hashed concurrently")
+	flags.BoolVar(&o.SortBySize, "sort-size", true, "hash the largest files first; requires listing every file in memory before hashing starts")
+	flags.StringVar(&o.HashAlgo, "algo", "", "hash algorithm for a new root: md5, sha1, sha256 or sha512 (default: the root's stored algorithm)")
+	flags.DurationVar(&o.File.Timeout, "timeout", 0, "give up on a file that takes longer than this to hash, e.g. 5m (default: no limit)")
+	flags.IntVar(&o.File.Retries, "retries", 2, "times to retry a file after a transient error")
+	flags.DurationVar(&o.File.RetryDelay, "retry-delay", time.Second, "delay before the first retry, doubled for each subsequent one")
+	flags.BoolVar(&o.File.BackupRead, "backup-read", false, "on Windows, open files with backup semantics and SeBackupPrivilege so their ACLs don't keep them from being hashed, and read files other processes hold open exclusively, such as databases and mail stores, from a shadow copy of the volume")
+	flags.StringVar(&o.File.Backend, "hash-backend", BackendAuto, "hash with go, which uses SHA-NI or ARMv8 crypto extensions where present, or kernel, the Linux crypto API (AF_ALG); auto uses the kernel where it offloads to a hardware engine")
+	flags.StringVar(&o.ManifestDir, "manifests", "", "directory of signed deployment manifests announcing expected changes")
+	flags.StringVar(&o.ManifestKey, "manifest-key", "", "ed25519 public key manifests must be signed with, from gohash manifest keygen")
+	flags.BoolVar(&o.ReadOnly, "read-only", false, "open the database read-only and never modify the baseline; new files are reported but not recorded")
+	flags.StringVar(&o.Golden, "golden", "", "verify against the golden image in this file from gohash baseline export, shared by every host built from it, reporting their drift from it (implies -read-only)")
+	flags.StringVar(&o.GoldenKey, "golden-key", "", "public key the -golden image must be signed with")
+	flags.StringVar(&o.Against, "against", "", "verify against this baseline saved with gohash baseline save instead of the current one, changing neither (implies -read-only)")
+	flags.StringVar(&o.EvidenceLog, "evidence-log", "", "append every finding to this hash-chained log; the report ends with the chain's head")
+	flags.StringVar(&o.ParityDir, "parity-dir", "", "keep Reed-Solomon repair data for the root's files in this directory, outside the root, for gohash repair")
+	flags.IntVar(&o.Parity, "parity", 2, "parity blocks per stripe of 16 data blocks with -parity-dir; a stripe survives that many damaged blocks")
+	flags.StringVar(&o.Snapshot, "snapshot", "", "scan a read-only snapshot of the root's filesystem so files changing mid-scan don't mismatch: zfs, btrfs (root must be a subvolume), lvm or vss")
+	flags.StringVar(&o.SnapSize, "snapshot-size", "1G", "space an LVM snapshot keeps for changes to the live volume while the scan runs")
+	flags.IntVar(&o.Budget, "budget", 0, "verify at most this many stored files per run, those verified longest ago; new and missing files are always found (default: all)")
+	flags.Func("sample", "verify a random sample of the stored files, e.g. 5% (default: all)", func(value string) error {
+		sample, err := parsePercent(value)
+		o.Sample = sample
+		return err
+	})
+	flags.Int64Var(&o.SampleSeed, "sample-seed", 0, "seed picking the -sample; the same seed picks the same files (default: today's date, e.g. 20250131)")
+	flags.BoolVar(&o.Incremental, "incremental", false, "only hash stored files the change journal reports changed since the last scan, plus any -budget or -sample picks: the USN journal on Windows, fanotify in gohash daemon on Linux")
+	flags.Func("dynamic", "path pattern whose content changes are recorded without a finding, e.g. '*.log' or var/spool; new and missing files are still reported (repeatable)", func(value string) error {
+		o.Dynamic = append(o.Dynamic, value)
+		return checkPathRules(o.Dynamic)
+	})
+	flags.IntVar(&o.Entropy, "entropy", 0, "estimate each file's entropy and report possible ransomware when at least this many changed files went from low to high entropy in one run (default: off)")
+	flags.BoolVar(&o.ContentType, "content-type", false, "record each file's content type from its first bytes and report files whose type changed, e.g. an image that became an executable, even under -dynamic")
+	flags.StringVar(&o.QuickSize, "quick-size", "", "check files of at least this size, e.g. 10G, by their size and first and last -quick-edge bytes, hashing them in full only when that fails or -full-every has passed (default: off)")
+	flags.StringVar(&o.QuickEdge, "quick-edge", "64M", "how much of the start and end of a file -quick-size checks")
+	flags.DurationVar(&o.FullEvery, "full-every", 30*24*time.Hour, "with -quick-size or -fast, hash files in full at least this often even when their quick check passes; 0 never forces it")
+	flags.BoolVar(&o.Fast, "fast", false, "take the stored hash of files whose device, inode, size and modification time are unchanged instead of reading them; a change that keeps all four, as by a tool that restores the modification time, goes unnoticed until -full-every")
+	flags.DurationVar(&o.Grace, "grace", 0, "leave new and changed files modified less than this long ago, e.g. 10m, pending instead of reporting them, since they may be being written; they are hashed again at the end of the scan and left for the next one if still that recent (default: off)")
+	flags.StringVar(&o.Special, "special", PolicySkip, "what to do with FIFOs, sockets and devices, which can't be hashed: skip them, record their type and device number, or report each as an error")
+	flags.StringVar(&o.Empty, "empty", PolicyRecord, "whether to record zero-byte files or skip them")
+	flags.BoolVar(&o.FSErrors, "fs-errors", false, "on ZFS and Btrfs, tell hardware corruption from changes written through the filesystem by its checksum error reports (Btrfs needs root)")
+	flags.BoolVar(&o.Streams, "streams", false, "also hash the alternate data streams of NTFS files and directories, recorded as file:stream, and the resource forks of macOS files, as file/..namedfork/rsrc, so content hidden in them is tracked too")
+	flags.BoolVar(&o.Gatekeeper, "gatekeeper", false, "on macOS, record each file's com.apple.quarantine and com.apple.provenance attributes and report tracked executables that lose them, as when malware strips them to get past Gatekeeper")
+	flags.BoolVar(&o.Privileges, "privileges", false, "record each file's setuid and setgid bits and, on Linux, its file capabilities as getcap shows them, and report files that gain any, even with their content unchanged")
+	flags.Func("map-prefix", "old=new: verify a root mounted under new, such as a snapshot, restore or replica, against the baseline recorded for it under old (repeatable)", func(value string) error {
+		_, _, err := parsePrefixMap(value)
+		o.MapPrefix = append(o.MapPrefix, value)
+		return err
+	})
+	flags.IntVar(&o.MaxFindings, "max-findings", 1000, "list at most this many findings in notifications and summarize the rest by directory, so a mass change still makes a readable email; the report on stdout or -output and the database keep them all (0: no limit)")
+}
+
+// Verification tiers of a scan. A full scan hashes every file; a quick one
+// takes a shortcut, checking some files only by their metadata, their first
+// and last bytes or what the change journal reported, or leaving them for a
+// later scan.
+const (
+	TierFull  = "full"
+	TierQuick = "quick"
+)
+
+// tier is how deeply a scan with these options verifies the root; an
+// incremental scan that had to read every file is a full one.
+func (o *scanOptions) tier(incremental bool) string {
+	if o.Budget > 0 || o.Sample > 0 || incremental || o.QuickSize != "" || o.Fast {
+		return TierQuick
+	}
+	return TierFull
+}
+
+// fullTier returns a copy of the options with every shortcut of the quick
+// tier turned off.
+func (o *scanOptions) fullTier() *scanOptions {
+	full := *o
+	full.Budget, full.Sample, full.Incremental, full.QuickSize, full.Fast = 0, 0, false, "", false
+	return &full
+}
+
+// rootID is the ID the records of rootDirectory are stored under: RootID
+// if set, or else its absolute path, mapped by MapPrefix.
+func (o *scanOptions) rootID(rootDirectory string) (string, error) {
+	if o.RootID != "" {
+		return o.RootID, nil
+	}
+	rootID, err := defaultRootID(rootDirectory)
+	if err != nil {
+		return "", err
+	}
+	return mapRootID(rootID, o.MapPrefix), nil
+}
+
+// reportStatus is the one-line outcome of a scan, used as the default email
+// subject.
+func reportStatus(totals directoryCounts) string {
+	if totals.Encryption > 0 {
+		return trf("Possible ransomware encryption detected while verifying integrity")
+	} else if totals.Corrupted > 0 {
+		return trf("Probable silent corruption detected while verifying integrity")
+	} else if totals.Truncated > 0 {
+		return trf("Files were emptied or truncated while verifying integrity")
+	} else if totals.Elevated > 0 {
+		return trf("Files gained setuid, setgid or capabilities while verifying integrity")
+	} else if totals.Executables > 0 {
+		return trf("New executable files found while verifying integrity")
+	} else if totals.Retyped > 0 {
+		return trf("File content types changed while verifying integrity")
+	} else if totals.Stripped > 0 {
+		return trf("Executables lost their Gatekeeper attributes while verifying integrity")
+	} else if totals.Changed+totals.Missing+totals.Errors+totals.TimedOut > 0 {
+		return trf("Error detected while verifying integrity")
+	} else if totals.New > 0 {
+		return trf("New files found in the database")
+	} else if totals.Expected > 0 {
+		return trf("Expected updates applied")
+	} else if totals.Pending > 0 {
+		return trf("Integrity check incomplete: files modified too recently to verify")
+	}
+	return trf("Integrity check successful")
+}
+
+// scanRoot verifies rootDirectory against its baseline in the database at
+// databasePath, recording new files and the run itself. Findings are
+// streamed to stream, if not nil, as they are made. The caller removes the
+// returned report.
+func scanRoot(databasePath, rootDirectory string, options *scanOptions, stream findingWriter) (*scanReport, error) {
+	rootID, err := options.rootID(rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	rootInfo, err := os.Stat(longPath(rootDirectory))
+	if err == nil && !rootInfo.IsDir() {
+		err = fmt.Errorf("%s is not a directory", rootDirectory)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the specified directory: %v", err)
+	}
+
+	if options.Golden != "" {
+		if options.Against != "" {
+			return nil, errors.New("-golden and -against can't be combined")
+		}
+		name, err := loadGoldenImage(databasePath, rootID, options.Golden, options.GoldenKey, options.LockWait)
+		if err != nil {
+			return nil, err
+		}
+		golden := *options
+		golden.Against = name
+		options = &golden
+	}
+	if options.Against != "" {
+		if options.Budget > 0 || options.Sample > 0 || options.Incremental || options.QuickSize != "" || options.Fast {
+			return nil, errors.New("-against verifies every file, so it can't be combined with -budget, -sample, -incremental, -quick-size or -fast")
+		}
+		// Comparing with a saved baseline must not update the current one.
+		readOnly := *options
+		readOnly.ReadOnly = true
+		options = &readOnly
+	}
+
+	var db *sql.DB
+	var pathPolicy, hashAlgo string
+	if options.ReadOnly {
+		// SQLite keeps a reader consistent on its own, so the run lock,
+		// which would mean creating a file, isn't needed.
+		db, err = openDatabaseReadOnly(databasePath)
+		if err != nil {
+			return nil, err
+		}
+		defer closeDatabase(db)
+
+		pathPolicy, hashAlgo, err = storedRootSettings(db, rootID, options)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		lock, err := acquireRunLock(databasePath, options.LockWait)
+		if err != nil {
+			return nil, fmt.Errorf("acquiring the run lock: %v", err)
+		}
+		defer releaseRunLock(lock)
+
+		db, err = openDatabase(databasePath)
+		if err != nil {
+			return nil, err
+		}
+		defer closeDatabase(db)
+
+		pathPolicy, hashAlgo, err = applyRootSettings(db, rootDirectory, rootID, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	label := hashLabel(hashAlgo)
+	against := ""
+	if options.Against != "" {
+		against, err = savedBaseline(db, rootID, options.Against)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.ParityDir != "" {
+		if err := validParity(options.Parity); err != nil {
+			return nil, err
+		}
+	}
+	if options.MaxFindings < 0 {
+		return nil, errors.New("-max-findings can't be negative")
+	}
+	if options.Grace < 0 {
+		return nil, errors.New("-grace can't be negative")
+	}
+	if options.Snapshot != "" && !validSnapshotKind(options.Snapshot) {
+		return nil, fmt.Errorf("unknown snapshot kind %q", options.Snapshot)
+	}
+	if err := checkPathRules(options.Dynamic); err != nil {
+		return nil, err
+	}
+	quick, err := parseQuickOptions(options.QuickSize, options.QuickEdge, options.FullEvery)
+	if err != nil {
+		return nil, err
+	}
+	var quickRecords map[string]quickRecord
+	if quick.Size > 0 {
+		quickRecords, err = loadQuickRecords(db, rootID, quick.Size)
+		if err != nil {
+			return nil, fmt.Errorf("reading the baseline: %v", err)
+		}
+	}
+	var fastRecords map[string]fastRecord
+	if options.Fast {
+		fastRecords, err = loadFastRecords(db, rootID)
+		if err != nil {
+			return nil, fmt.Errorf("reading the baseline: %v", err)
+		}
+	}
+	if options.Special != "" && !validSpecialPolicy(options.Special) {
+		return nil, fmt.Errorf("unknown -special policy %q", options.Special)
+	}
+	if options.Empty != "" && !validEmptyPolicy(options.Empty) {
+		return nil, fmt.Errorf("unknown -empty policy %q", options.Empty)
+	}
+	if backend := options.File.Backend; backend != "" && !validHashBackend(backend) {
+		return nil, fmt.Errorf("unknown hash backend %q", backend)
+	} else if _, ok := kernelHashDriver(hashAlgo); backend == BackendKernel && !ok {
+		return nil, fmt.Errorf("using the kernel hash backend: no %s in the kernel crypto API (AF_ALG)", hashAlgo)
+	}
+	if options.File.BackupRead {
+		err = enableBackupPrivilege()
+		if err != nil {
+			return nil, fmt.Errorf("enabling backup reads: %v", err)
+		}
+	}
+
+	var expected *expectedChanges
+	if options.ManifestDir != "" {
+		if options.ReadOnly {
+			return nil, errors.New("deployment manifests can't be applied with -read-only")
+		}
+		if options.ManifestKey == "" {
+			return nil, errors.New("-manifests needs -manifest-key to verify them")
+		}
+		required, err := rootRequiresApproval(db, rootID)
+		if err != nil {
+			return nil, fmt.Errorf("reading the root's settings: %v", err)
+		}
+		if required {
+			return nil, fmt.Errorf("deployment manifests can't update root %s, which requires approval", displayPath(rootID))
+		}
+		key, err := readPublicKey(options.ManifestKey)
+		if err != nil {
+			return nil, err
+		}
+		expected, err = loadExpectedChanges(db, options.ManifestDir, key, rootID, pathPolicy, hashAlgo)
+		if err != nil {
+			return nil, fmt.Errorf("reading deployment manifests: %v", err)
+		}
+	}
+	// Dynamic content rules record changed hashes without a finding, which
+	// on a root that requires approval only an approved changeset may do.
+	if len(options.Dynamic) > 0 && !options.ReadOnly {
+		required, err := rootRequiresApproval(db, rootID)
+		if err != nil {
+			return nil, fmt.Errorf("reading the root's settings: %v", err)
+		}
+		if required {
+			return nil, fmt.Errorf("-dynamic can't update root %s, which requires approval", displayPath(rootID))
+		}
+	}
+
+	// A root without records is being baselined: every file is new, and
+	// reporting each one would bury anything that actually needs attention.
+	initial := false
+	if !options.ReadOnly {
+		records, err := rootRecordCount(db, rootID)
+		if err != nil {
+			return nil, fmt.Errorf("reading the baseline: %v", err)
+		}
+		initial = records == 0
+	}
+
+	var changes *changeSet
+	if options.Incremental {
+		changes, err = readChangeJournal(db, rootID, rootDirectory, options.Watcher)
+		if err != nil {
+			return nil, fmt.Errorf("reading the change journal: %v", err)
+		}
+	}
+
+	var deferred map[string]bool
+	coverage := ""
+	incremental := changes != nil && !changes.Full
+	if options.Budget > 0 || options.Sample > 0 || incremental {
+		seed := options.SampleSeed
+		if seed == 0 {
+			seed, _ = strconv.ParseInt(time.Now().Format("20060102"), 10, 64)
+		}
+		budget := options.Budget
+		if incremental && options.Budget == 0 && options.Sample == 0 {
+			budget = -1
+		}
+		deferred, err = deferredFiles(db, rootID, budget, options.Sample, seed)
+		if err != nil {
+			return nil, fmt.Errorf("reading the baseline: %v", err)
+		}
+		if options.Sample > 0 {
+			coverage = trf(", a %s sample with seed %d", formatPercent(options.Sample), seed)
+		}
+		if incremental {
+			for filename := range deferred {
+				if changes.changed(filename) {
+					delete(deferred, filename)
+				}
+			}
+		}
+		// The files manifests announce are always hashed, since the
+		// manifests are marked applied at the end of the scan.
+		if expected != nil {
+			for relPath := range expected.Hashes {
+				delete(deferred, relPath)
+			}
+		}
+	}
+	if changes != nil {
+		coverage += "; " + changes.describe()
+	}
+
+	// Files are read from the snapshot but reported, like the records
+	// are stored, by where they are in the live tree.
+	scanDirectory := rootDirectory
+	var snap *snapshot
+	if options.Snapshot != "" {
+		snap, err = createSnapshot(options.Snapshot, rootDirectory, options.SnapSize)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			err := snap.Remove()
+			if err != nil {
+				log.Printf("Error removing snapshot %s: %v", snap.Name, err)
+			}
+		}()
+		scanDirectory = snap.Root
+	}
+
+	report, err := newScanReport(newRunInfo(rootDirectory, rootID, databasePath), stream)
+	if err != nil {
+		return nil, fmt.Errorf("creating the report: %v", err)
+	}
+	if snap != nil {
+		report.Run.Snapshot = snap.Name
+	}
+	report.Detail, report.unrecorded = options.MaxFindings, options.ReadOnly
+	report.Run.Baseline = against
+	report.Run.Tier = options.tier(incremental)
+	if (deferred != nil || changes != nil) && !initial {
+		records, err := rootRecordCount(db, rootID)
+		if err != nil {
+			report.Remove()
+			return nil, fmt.Errorf("reading the baseline: %v", err)
+		}
+		verified := records - len(deferred)
+		report.Coverage = trf("verified %d of %d stored files (%.1f%%)%s", verified, records, 100*float64(verified)/float64(max(records, 1)), coverage)
+	}
+
+	var evidence *evidenceLog
+	if options.EvidenceLog != "" {
+		evidence, err = openEvidenceLog(options.EvidenceLog, report.Run)
+		if err != nil {
+			report.Remove()
+			return nil, fmt.Errorf("opening the evidence log: %v", err)
+		}
+		defer evidence.Close()
+	}
+	findings, err := newFindingSpool()
+	if err != nil {
+		report.Remove()
+		return nil, fmt.Errorf("creating the findings spool: %v", err)
+	}
+	// The report keeps the findings for the integrations run after the
+	// scan, and removes them with the rest of it.
+	report.findings = findings
+	acks, err := loadAcknowledgedFindings(db, rootID)
+	if err != nil {
+		report.Remove()
+		return nil, fmt.Errorf("reading the acknowledged findings: %v", err)
+	}
+
+	// Every stage is connected by small bounded channels, so a slow stage
+	// holds the others back instead of letting work pile up in memory.
+	fileOpts := options.File
+	fileOpts.links = newLinkedFiles()
+	fileOpts.cache = runHashes.open()
+	defer fileOpts.cache.close()
+	if fileOpts.BackupRead && snap == nil {
+		// Nothing in a snapshot is held open, so only a scan of the live
+		// root needs shadow copies of its own.
+		fileOpts.shadows = &shadowCopies{root: scanDirectory}
+		defer func() {
+			err := fileOpts.shadows.Remove()
+			if err != nil {
+				log.Printf("Error removing the shadow copy: %v", err)
+			}
+		}()
+	}
+	fileCh := make(chan string, options.Workers)
+	hashCh := make(chan HashResult, writeBatchSize)
+
+	progress := newScanProgress()
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	dumpProgressOnSignal(progress, stopProgress)
+
+	// hashEntry hashes one file the walk found, by its path relative to
+	// the root, and gathers what the options record about it.
+	hashEntry := func(relPath string) HashResult {
+		filePath := diskPath(rootDirectory, relPath)
+		source := diskPath(scanDirectory, relPath)
+		result := HashResult{FilePath: filePath, RelPath: normalizePath(pathPolicy, relPath), walkPath: relPath}
+		progress.queued.Add(1)
+		if deferred[result.RelPath] {
+			result.Deferred = true
+			return result
+		}
+		progress.startFile(filePath)
+
+		if options.Slots != nil {
+			options.Slots <- struct{}{}
+		}
+		var hash string
+		var info os.FileInfo
+		var err error
+		if quick.Size > 0 {
+			record, known := quickRecords[result.RelPath]
+			info, result.Quick, result.QuickOnly = quick.check(source, hashAlgo, record, known)
+			hash = record.Hash
+		}
+		if options.Fast && !result.QuickOnly {
+			record, known := fastRecords[result.RelPath]
+			info, result.Fast = fastCheck(source, record, known, options.FullEvery)
+			result.QuickOnly, hash = result.Fast, record.Hash
+		}
+		if !result.QuickOnly {
+			hash, info, err = hashFile(source, hashAlgo, fileOpts)
+		}
+		special := errors.Is(err, errSpecialFile)
+		if special && options.Special != PolicyError {
+			hash, err = specialHash(info), nil
+			result.Skipped = options.Special != PolicyRecord
+		} else if err == nil && info.Size() == 0 {
+			result.Skipped = options.Empty == PolicySkip
+		}
+		if err == nil && !special && options.Entropy > 0 && info.Size() >= minEntropySize {
+			// An estimate that can't be made is simply left out.
+			if entropy, err := fileEntropy(source); err == nil {
+				result.Entropy = sql.NullFloat64{Float64: entropy, Valid: true}
+			}
+		}
+		if err == nil && !special && options.ContentType {
+			if contentType, err := fileContentType(source); err == nil {
+				result.MIME = contentType
+			}
+		}
+		if err == nil && !special && options.Privileges {
+			if privileges, err := filePrivileges(source, info.Mode()); err == nil {
+				result.Privileges = sql.NullString{String: privileges, Valid: true}
+			}
+		}
+		if err == nil && !special && options.Gatekeeper {
+			if attrs, err := gatekeeperAttrs(source); err == nil {
+				result.Gatekeeper = sql.NullString{String: attrs, Valid: true}
+			}
+		}
+		if options.Slots != nil {
+			<-options.Slots
+		}
+		if errors.Is(err, errTimedOut) {
+			result.TimedOut = true
+			result.Err = fmt.Errorf("Timed out after %s computing %s hash for %s", fileOpts.Timeout, label, displayPath(filePath))
+			progress.finishFile(filePath, 0)
+			return result
+		} else if err != nil {
+			result.Err = fmt.Errorf("Error computing %s hash for %s: %v", label, displayPath(filePath), err)
+			progress.finishFile(filePath, 0)
+			return result
+		}
+
+		result.Hash = hash
+		result.Size = info.Size()
+		result.ModTime = info.ModTime().UnixNano()
+		result.Mode = info.Mode()
+		if id := fileIDString(info); id != "" {
+			result.FileID = sql.NullString{String: id, Valid: true}
+		}
+		if options.ParityDir != "" && !result.QuickOnly && !special {
+			result.Parity = checkParity(options.ParityDir, result.RelPath, source, hashAlgo, hash, result.Size, options.Parity, !options.ReadOnly)
+		}
+		progress.finishFile(filePath, info.Size())
+		return result
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relPath := range fileCh {
+				hashCh <- hashEntry(relPath)
+			}
+		}()
+	}
+
+	walkDone := make(chan []walkError, 1)
+	go func() {
+		walkDone <- walkRoot(scanDirectory, walkOptions{
+			Recursive:  options.Recursive,
+			Walkers:    options.Walkers,
+			SortBySize: options.SortBySize,
+			Streams:    options.Streams,
+		}, fileCh)
+
+		wg.Wait()
+		close(hashCh)
+	}()
+
+	// current is the stream event of the file being reported on, which
+	// takes the finding about it, if any.
+	var current *streamEvent
+	streamError := func(err error) {
+		if err != nil {
+			log.Fatalf("Error writing the result stream: %v", err)
+		}
+	}
+	if options.Stream != nil {
+		streamError(options.Stream.start(report.Run))
+	}
+	addFinding := func(finding Finding) {
+		finding.RunID = report.Run.RunID
+		progress.findings.Add(1)
+		if current != nil {
+			current.Finding, current.Message = finding.Kind, finding.Message
+		} else if options.Stream != nil {
+			streamError(options.Stream.finding(finding))
+		}
+		// Suppression only spares the recipients; the evidence log keeps
+		// everything.
+		if evidence != nil {
+			err := evidence.Append(finding)
+			if err != nil {
+				log.Fatalf("Error writing the evidence log: %v", err)
+			}
+		}
+		ack, acknowledged := acks.lookup(finding)
+		var carried *findingAck
+		if acknowledged {
+			carried = &ack
+		}
+		err := findings.Append(finding, carried)
+		if err != nil {
+			log.Fatalf("Error spooling the findings: %v", err)
+		}
+		if acknowledged {
+			report.Acknowledged++
+			return
+		}
+		if options.Suppress != nil && options.Suppress(finding) {
+			report.Suppressed++
+			return
+		}
+		err = report.Add(finding)
+		if err != nil {
+			log.Fatalf("Error writing the report: %v", err)
+		}
+	}
+
+	// Each file seen is stamped with the time the scan started; whatever is
+	// left with an older stamp afterwards is missing.
+	scanStamp := time.Now().UnixNano()
+
+	writer := &baselineWriter{db: db, rootID: rootID, baseline: options.Against, scanStamp: scanStamp, batchSize: writeBatchSize, actor: auditActor(), grace: options.Grace}
+	if options.ReadOnly {
+		writer.seen = make(map[string]bool)
+	}
+	writer.dynamic = pathRules(options.Dynamic).normalized(pathPolicy)
+	if expected != nil {
+		writer.expected = expected.Hashes
+		for _, rejected := range expected.Rejected {
+			addFinding(rejected)
+		}
+	}
+	var filesystems *filesystemErrors
+	if options.FSErrors {
+		filesystems = newFilesystemErrors()
+	}
+	verdictCh := make(chan verdict, writeBatchSize)
+	go writer.run(hashCh, verdictCh)
+
+	// encrypted counts the changed files that look encrypted now.
+	encrypted := 0
+	// pending are the files left pending by the grace period, by their
+	// walk paths, until they are hashed again.
+	var pending []string
+	rechecking := false
+	handle := func(v verdict) {
+		result := v.Result
+		if options.Stream != nil {
+			current = fileEvent(v)
+		}
+		if parity := result.Parity; parity != nil {
+			// Repair data is only kept for content the baseline trusts.
+			if parity.Err == nil && (v.Kind == verdictNew || v.Kind == verdictExpected || v.Kind == verdictMatch && v.StoredHash == result.Hash) {
+				parity.Err = parity.keep()
+			}
+			parity.discard()
+			if parity.Err != nil {
+				message := trf("Error keeping repair data for %s: %v", displayPath(result.FilePath), parity.Err)
+				addFinding(Finding{Kind: FindingError, FilePath: result.FilePath, Message: message})
+			}
+		}
+		switch v.Kind {
+		case verdictError:
+			kind := FindingError
+			message := ""
+			if result.Err != nil {
+				message = result.Err.Error()
+				if result.TimedOut {
+					kind = FindingTimeout
+				}
+			} else {
+				message = trf("Error updating %s hash for %s: %v", label, displayPath(result.FilePath), v.Err)
+			}
+			addFinding(Finding{Kind: kind, FilePath: result.FilePath, ComputedHash: result.Hash, Message: message})
+		case verdictNew:
+			if initial {
+				report.Baselined++
+				break
+			}
+			kind, what := FindingNew, "file"
+			if isExecutable(result.RelPath, result.Mode) {
+				kind, what = FindingExecutable, "executable"
+			}
+			message := trf("Inserted %s hash for new %s %s: %s", label, what, displayPath(result.FilePath), result.Hash)
+			if kind == FindingNew {
+				message = trf("Inserted %s hash for %s: %s", label, displayPath(result.FilePath), result.Hash)
+			}
+			if options.ReadOnly {
+				message = trf("New %s %s not recorded (read-only): %s hash %s", what, displayPath(result.FilePath), label, result.Hash)
+			}
+			if privileges := result.Privileges.String; privileges != "" {
+				message += trf(", with %s", strings.ReplaceAll(privileges, ",", ", "))
+			}
+			if inFuture(result.ModTime) {
+				message += trf(", modified in the future at %s", time.Unix(0, result.ModTime).UTC().Format(time.RFC3339))
+			}
+			addFinding(Finding{Kind: kind, FilePath: result.FilePath, ComputedHash: result.Hash, Message: message})
+		case verdictExpected:
+			if initial && v.StoredHash == "" {
+				report.Baselined++
+				break
+			}
+			message := trf("Expected update of %s from a deployment manifest: stored=%s, computed=%s", displayPath(result.FilePath), v.StoredHash, result.Hash)
+			if v.StoredHash == "" {
+				message = trf("Expected new file %s from a deployment manifest: %s hash %s", displayPath(result.FilePath), label, result.Hash)
+			}
+			addFinding(Finding{Kind: FindingExpected, FilePath: result.FilePath, StoredHash: v.StoredHash, ComputedHash: result.Hash, Message: message})
+		case verdictMismatch:
+			kind := FindingMismatch
+			if v.Untouched {
+				kind = FindingCorruption
+			}
+			note := ""
+			if health := filesystems.lookup(result.FilePath); health != nil {
+				var clean bool
+				note, clean = health.describe(result.FilePath)
+				if clean && kind == FindingCorruption {
+					// The filesystem would have caught rot, so whatever
+					// wrote the change put the timestamps back.
+					kind = FindingMismatch
+					note += ", with the modification time restored"
+				}
+			}
+			message := trf("%s hash mismatch for %s: stored=%s, computed=%s", label, displayPath(result.FilePath), v.StoredHash, result.Hash)
+			if v.truncated() {
+				// Wiping a log or emptying a configuration file is how
+				// an intruder covers their tracks or disables a check.
+				kind = FindingTruncation
+				message = trf("%s hash mismatch for %s, truncated from %d to %d bytes: stored=%s, computed=%s",
+					label, displayPath(result.FilePath), v.StoredSize.Int64, result.Size, v.StoredHash, result.Hash)
+			} else if kind == FindingCorruption {
+				message = trf("%s hash mismatch for %s with unchanged size and modification time, probable silent corruption: stored=%s, computed=%s",
+					label, displayPath(result.FilePath), v.StoredHash, result.Hash)
+			}
+			if typeChanged(v.StoredType, result.MIME) {
+				if kind == FindingMismatch {
+					kind = FindingTypeChange
+				}
+				note += trf(", content type changed from %s to %s", v.StoredType, result.MIME)
+			}
+			if looksEncrypted(v.StoredEntropy, result.Entropy) {
+				encrypted++
+				note += trf(", entropy rose from %.2f to %.2f bits per byte", v.StoredEntropy.Float64, result.Entropy.Float64)
+			}
+			if gained := listDifference(result.Privileges, v.StoredPrivileges); len(gained) > 0 {
+				note += trf(", gained %s", strings.Join(gained, ", "))
+			}
+			if lost := listDifference(v.StoredGatekeeper, result.Gatekeeper); len(lost) > 0 {
+				note += trf(", lost its %s attributes", strings.Join(lost, ", "))
+			}
+			if inFuture(result.ModTime) {
+				// A timestamp set ahead, as to stay within -grace, is
+				// itself suspicious.
+				note += trf(", modified in the future at %s", time.Unix(0, result.ModTime).UTC().Format(time.RFC3339))
+			}
+			message += note
+			message += result.Parity.describe(v.StoredHash)
+			if want, ok := writer.expected[result.RelPath]; ok {
+				message += trf(", expected=%s from a deployment manifest", want)
+			}
+			addFinding(Finding{Kind: kind, FilePath: result.FilePath, StoredHash: v.StoredHash, ComputedHash: result.Hash, Message: message})
+		case verdictDynamic:
+			report.Dynamic++
+		case verdictDeferred:
+			// Left for a later run; the coverage line accounts for it.
+		case verdictPending:
+			if rechecking {
+				report.totals.Pending++
+			} else {
+				pending = append(pending, result.walkPath)
+			}
+		case verdictSkipped:
+			report.Skipped++
+		case verdictMatch:
+			if want, ok := writer.expected[result.RelPath]; ok && want != result.Hash {
+				message := trf("Expected update of %s not applied: manifest=%s, computed=%s", displayPath(result.FilePath), want, result.Hash)
+				addFinding(Finding{Kind: FindingMismatch, FilePath: result.FilePath, StoredHash: want, ComputedHash: result.Hash, Message: message})
+				break
+			}
+			// Metadata changes that matter are findings even when the
+			// content is unchanged.
+			reported := false
+			if gained := listDifference(result.Privileges, v.StoredPrivileges); len(gained) > 0 {
+				message := trf("%s gained %s with its content unchanged: %s hash %s",
+					displayPath(result.FilePath), strings.Join(gained, ", "), label, result.Hash)
+				addFinding(Finding{Kind: FindingPrivilege, FilePath: result.FilePath, StoredHash: v.StoredHash, ComputedHash: result.Hash, Message: message})
+				reported = true
+			}
+			if lost := listDifference(v.StoredGatekeeper, result.Gatekeeper); len(lost) > 0 && isExecutable(result.RelPath, result.Mode) {
+				message := trf("Executable %s lost its %s attributes, which Gatekeeper checks before running it, with its content unchanged: %s hash %s",
+					displayPath(result.FilePath), strings.Join(lost, ", "), label, result.Hash)
+				addFinding(Finding{Kind: FindingQuarantine, FilePath: result.FilePath, StoredHash: v.StoredHash, ComputedHash: result.Hash, Message: message})
+				reported = true
+			}
+			if reported {
+				break
+			}
+			report.Passed++
+			if result.Fast {
+				report.Fast++
+			} else if result.QuickOnly {
+				report.Quick++
+			} else if options.TrackMatches {
+				report.matched[result.FilePath] = true
+			}
+			if options.PrintMatches {
+				fmt.Printf("%s hash match for %s: computed=%s\n", label, displayPath(result.FilePath), v.StoredHash)
+			}
+		}
+		if current != nil {
+			streamError(options.Stream.write(current))
+			current = nil
+		}
+	}
+	for v := range verdictCh {
+		handle(v)
+	}
+
+	// By now the files left pending may have been written in full. Those
+	// that settled are judged as usual; those modified since are left for
+	// the next scan, as are those gone, like a temporary file renamed into
+	// place.
+	if len(pending) > 0 {
+		rechecks := make(chan HashResult, len(pending))
+		for _, walkPath := range pending {
+			if _, err := os.Lstat(longPath(diskPath(scanDirectory, walkPath))); errors.Is(err, os.ErrNotExist) {
+				report.totals.Pending++
+				continue
+			}
+			rechecks <- hashEntry(walkPath)
+		}
+		close(rechecks)
+		rechecking = true
+		verdicts := make(chan verdict, writeBatchSize)
+		go writer.run(rechecks, verdicts)
+		for v := range verdicts {
+			handle(v)
+		}
+	}
+
+	if options.Entropy > 0 && encrypted >= options.Entropy {
+		message := trf("Possible ransomware: %d changed files went from low to high entropy, as files being encrypted do", encrypted)
+		addFinding(Finding{Kind: FindingEncryption, FilePath: rootDirectory, Message: message})
+	}
+
+	walkErrors := <-walkDone
+	for _, failed := range walkErrors {
+		dir := diskPath(rootDirectory, failed.RelPath)
+		message := trf("Error reading directory %s: %v", displayPath(dir), failed.Err)
+		switch {
+		case failed.Streams:
+			message = trf("Error listing the alternate data streams of %s: %v", displayPath(dir), failed.Err)
+		case failed.Loop != "" && failed.Err != nil:
+			message = trf("Symbolic link loop at %s, which points to %s and never resolves to a file; not hashed", displayPath(dir), failed.Loop)
+		case failed.Loop != "":
+			message = trf("Filesystem loop at %s, which is %s again, as through a bind mount; not descended into", displayPath(dir), displayPath(diskPath(rootDirectory, failed.Loop)))
+		}
+		addFinding(Finding{Kind: FindingError, FilePath: dir, Message: message})
+	}
+
+	// Files recorded under this root that were not seen during the scan have
+	// been removed since the baseline was taken.
+	err = findMissingFiles(db, rootDirectory, rootID, options.Against, scanStamp, writer.seen, options.Recursive, options.Streams, walkErrors, func(file HashResult) {
+		message := trf("File missing since the baseline for %s: stored=%s", displayPath(file.FilePath), file.Hash)
+		if options.Stream != nil {
+			current = &streamEvent{Type: "file", Path: displayPath(file.FilePath), Result: "missing", StoredHash: file.Hash}
+		}
+		addFinding(Finding{Kind: FindingMissing, FilePath: file.FilePath, StoredHash: file.Hash, Message: message})
+		if current != nil {
+			streamError(options.Stream.write(current))
+			current = nil
+		}
+	})
+	if err != nil {
+		message := trf("Error looking up missing files: %v", err)
+		addFinding(Finding{Kind: FindingError, FilePath: rootDirectory, Message: message})
+	}
+
+	if expected != nil {
+		err = expected.markApplied(db, rootID)
+		if err != nil {
+			log.Printf("Error marking deployment manifests applied: %v", err)
+		}
+	}
+
+	report.Run.Finished = time.Now()
+	if evidence != nil {
+		totals := report.Totals()
+		message := trf("%s: %d changed, %d new, %d missing, %d errors, %d timed out, %d expected updates, %d passed",
+			report.Status(), totals.Changed, totals.New, totals.Missing, totals.Errors, totals.TimedOut, totals.Expected, report.Passed)
+		err = evidence.Append(Finding{Kind: FindingRun, FilePath: rootDirectory, Message: message})
+		if err != nil {
+			log.Fatalf("Error writing the evidence log: %v", err)
+		}
+		report.EvidenceHead = evidence.Head()
+	}
+	if options.Stream != nil {
+		streamError(options.Stream.summary(report))
+	}
+	if !options.ReadOnly {
+		_, err = recordRun(db, report.Run, report.Status(), report)
+		if err == nil {
+			err = findings.store(db, report.Run)
+		}
+		if err != nil {
+			log.Printf("Error recording the run: %v", err)
+		} else if changes != nil && changes.commit != nil {
+			err = changes.commit()
+			if err != nil {
+				log.Printf("Error recording the change journal position: %v", err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// deferredFiles returns the stored files under rootID a scan leaves for
+// later: those outside the sample, if there is one, and beyond the budget
+// those least in need of verification. Files never verified come first,
+// then those verified longest ago. A negative budget defers every file.
+func deferredFiles(db *sql.DB, rootID string, budget int, sample float64, seed int64) (map[string]bool, error) {
+	rows, err := db.Query("SELECT filename FROM file_hashes WHERE root_id = ? ORDER BY last_verified IS NOT NULL, last_verified, filename", rootID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deferred := make(map[string]bool)
+	due := 0
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			return nil, err
+		}
+		if (sample > 0 && !inSample(filename, sample, seed)) || budget < 0 || (budget > 0 && due == budget) {
+			deferred[filename] = true
+		} else {
+			due++
+		}
+	}
+	return deferred, rows.Err()
+}
+
+// inSample picks a file with probability sample, the same way for the same
+// seed every time.
+func inSample(filename string, sample float64, seed int64) bool {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, seed)
+	h.Write([]byte(filename))
+	return float64(binary.BigEndian.Uint64(h.Sum(nil))) < sample*math.MaxUint64
+}
+
+// parsePercent reads a percentage such as "5%" as a fraction.
+func parsePercent(value string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("%q is not a percentage between 0 and 100", value)
+	}
+	return percent / 100, nil
+}
+
+func formatPercent(fraction float64) string {
+	return strconv.FormatFloat(fraction*100, 'f', -1, 64) + "%"
+}
+
+// applyRootSettings brings the root's stored records up to date with the
+// current layout, path policy and hash algorithm, returning the last two.
+func applyRootSettings(db *sql.DB, rootDirectory, rootID string, options *scanOptions) (string, string, error) {
+	adopted, err := adoptLegacyRecords(db, rootDirectory, rootID)
+	if err != nil {
+		return "", "", fmt.Errorf("migrating stored paths: %v", err)
+	}
+	if adopted > 0 {
+		log.Printf("Stored %d existing records relative to %s under root ID %s", adopted, rootDirectory, rootID)
+	}
+
+	pathPolicy := options.PathPolicy
+	if pathPolicy == "" {
+		pathPolicy, err = rootPathPolicy(db, rootID)
+		if err != nil {
+			return "", "", fmt.Errorf("reading the root's settings: %v", err)
+		}
+	}
+	err = setRootPathPolicy(db, rootID, pathPolicy)
+	if err != nil {
+		return "", "", fmt.Errorf("applying the path policy: %v", err)
+	}
+
+	hashAlgo := options.HashAlgo
+	if hashAlgo == "" {
+		hashAlgo, err = rootHashAlgo(db, rootID)
+		if err != nil {
+			return "", "", fmt.Errorf("reading the root's settings: %v", err)
+		}
+	}
+	err = setRootHashAlgo(db, rootID, hashAlgo)
+	if err != nil {
+		return "", "", fmt.Errorf("selecting the hash algorithm: %v", err)
+	}
+	return pathPolicy, hashAlgo, nil
+}
+
+// storedRootSettings returns the root's stored path policy and hash
+// algorithm for a read-only scan, which can't change either.
+func storedRootSettings(db *sql.DB, rootID string, options *scanOptions) (string, string, error) {
+	pathPolicy, err := rootPathPolicy(db, rootID)
+	if err == nil && options.PathPolicy != "" && options.PathPolicy != pathPolicy {
+		err = fmt.Errorf("-path-policy %s differs from the root's stored policy %s", options.PathPolicy, pathPolicy)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("reading the root's settings: %v", err)
+	}
+	hashAlgo, err := rootHashAlgo(db, rootID)
+	if err == nil && options.HashAlgo != "" && options.HashAlgo != hashAlgo {
+		err = fmt.Errorf("-algo %s differs from the root's stored algorithm %s", options.HashAlgo, hashAlgo)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("reading the root's settings: %v", err)
+	}
+	return pathPolicy, hashAlgo, nil
+}
+
+// findMissingFiles calls missing for every record under rootID that the scan
+// stamped with scanStamp could have seen but didn't. A read-only scan can't
+// stamp records and passes the set of paths it saw instead, and one against
+// a saved baseline reads that baseline's records.
+func findMissingFiles(db *sql.DB, rootDirectory, rootID, baseline string, scanStamp int64, seen map[string]bool, recursive, streams bool, unreadable []walkError, missing func(HashResult)) error {
+	var rows *sql.Rows
+	var err error
+	if baseline != "" {
+		rows, err = db.Query("SELECT filename, hash FROM baseline_files WHERE root_id = ? AND baseline = ?", rootID, baseline)
+	} else if seen != nil {
+		rows, err = db.Query("SELECT filename, hash FROM file_hashes WHERE root_id = ?", rootID)
+	} else {
+		rows, err = db.Query("SELECT filename, hash FROM file_hashes WHERE root_id = ? AND (last_seen IS NULL OR last_seen <> ?)",
+			rootID, scanStamp)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var file HashResult
+		err = rows.Scan(&file.RelPath, &file.Hash)
+		if err != nil {
+			return err
+		}
+		if seen[file.RelPath] || underUnreadable(file.RelPath, unreadable) {
+			continue
+		}
+		// Streams recorded by an earlier scan with -streams aren't looked
+		// for without it.
+		host, stream := streamHost(file.RelPath)
+		if stream && !streams {
+			continue
+		}
+		// Without -recursive only files directly under the root are scanned,
+		// with their streams.
+		if recursive || recordDepth(host) == 0 {
+			file.FilePath = diskPath(rootDirectory, file.RelPath)
+			missing(file)
+		}
+	}
+	return rows.Err()
+}
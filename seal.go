@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sealed database has a sidecar file, database_path.seal, holding the
+// hash of the database file as gohash last closed it. It is checked before
+// the database is opened and rewritten when gohash closes it again, so a
+// baseline edited while gohash wasn't running is refused rather than
+// trusted. With GOHASH_DB_SEAL_KEY naming a key file, the hash is an HMAC,
+// which can't be recomputed without the key. Without one it is a plain
+// SHA-256, which only catches edits made without gohash in mind: whoever
+// can write the database can also recompute its seal.
+//
+// Deleting the seal mustn't turn the check off, so a database is expected
+// to be sealed when GOHASH_DB_SEAL_KEY or GOHASH_DB_REQUIRE_SEAL is set, or
+// when gohash db seal listed it in the seal registry, a file kept away
+// from the database: GOHASH_DB_SEAL_REGISTRY, by default gohash/sealed in
+// the user's configuration directory.
+const (
+	SealSHA256 = "sha256"
+	SealHMAC   = "hmac-sha256"
+)
+
+// sealedDatabases maps each open sealed database to its path and seal
+// algorithm, for closeDatabase to reseal it.
+var sealedDatabases = struct {
+	sync.Mutex
+	open map[*sql.DB][2]string
+}{open: make(map[*sql.DB][2]string)}
+
+func sealPath(databasePath string) string {
+	return databasePath + ".seal"
+}
+
+// computeSeal hashes the database file with algo.
+func computeSeal(databasePath, algo string) (string, error) {
+	var h hash.Hash
+	switch algo {
+	case SealSHA256:
+		h = sha256.New()
+	case SealHMAC:
+		keyPath := os.Getenv("GOHASH_DB_SEAL_KEY")
+		if keyPath == "" {
+			return "", errors.New("the seal is an HMAC but GOHASH_DB_SEAL_KEY is not set")
+		}
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			return "", fmt.Errorf("reading the seal key: %v", err)
+		}
+		h = hmac.New(sha256.New, bytes.TrimSpace(key))
+	default:
+		return "", fmt.Errorf("unknown seal algorithm %q", algo)
+	}
+	file, err := os.Open(databasePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(h, file)
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// sealCheckWait is how long checking a seal waits for a run writing to the
+// database to finish, since the file is expected to differ until then.
+const sealCheckWait = 30 * time.Second
+
+// sealAlgorithm is the algorithm new seals are made with.
+func sealAlgorithm() string {
+	if os.Getenv("GOHASH_DB_SEAL_KEY") != "" {
+		return SealHMAC
+	}
+	return SealSHA256
+}
+
+// sealRequired reports why databasePath must be sealed, or "" if it needn't
+// be.
+func sealRequired(databasePath string) (string, error) {
+	if os.Getenv("GOHASH_DB_SEAL_KEY") != "" {
+		return "GOHASH_DB_SEAL_KEY is set", nil
+	}
+	if value := os.Getenv("GOHASH_DB_REQUIRE_SEAL"); value != "" {
+		required, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("parsing GOHASH_DB_REQUIRE_SEAL: %v", err)
+		}
+		if required {
+			return "GOHASH_DB_REQUIRE_SEAL is set", nil
+		}
+	}
+	registered, err := sealRegistered(databasePath)
+	if err != nil || !registered {
+		return "", err
+	}
+	return "gohash db seal registered it in " + sealRegistryPath(), nil
+}
+
+// checkSeal verifies a sealed database, returning the seal's algorithm, or
+// "" if the database isn't sealed and needn't be. A database that must be
+// sealed but doesn't exist yet is sealed once created. A run writing to
+// the database is waited for, since the file is expected to differ until
+// it has finished.
+func checkSeal(databasePath string) (string, error) {
+	required, err := sealRequired(databasePath)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(sealPath(databasePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		if required == "" {
+			return "", nil
+		}
+		if _, err := os.Stat(databasePath); errors.Is(err, fs.ErrNotExist) {
+			return sealAlgorithm(), nil
+		}
+		return "", fmt.Errorf("%s has no seal, but must have one since %s; if it was unsealed on purpose, run gohash db seal to seal it as it is", databasePath, required)
+	} else if err != nil {
+		return "", err
+	}
+	algo, want, ok := strings.Cut(strings.TrimSpace(string(content)), " ")
+	if !ok {
+		return "", fmt.Errorf("%s is not a seal", sealPath(databasePath))
+	}
+	if algo == SealSHA256 && os.Getenv("GOHASH_DB_SEAL_KEY") != "" {
+		// A keyless seal can be forged by whoever edited the database.
+		return "", fmt.Errorf("%s has a SHA-256 seal, but GOHASH_DB_SEAL_KEY is set; run gohash db seal to seal it with the key", databasePath)
+	}
+	release, err := holdRunLock(databasePath, sealCheckWait)
+	if err != nil {
+		return "", fmt.Errorf("the seal of %s can't be checked: %v", databasePath, err)
+	}
+	defer release()
+
+	got, err := computeSeal(databasePath, algo)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%s is sealed but missing", databasePath)
+	} else if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		return "", fmt.Errorf("%s was modified since gohash last closed it; if that was intended, run gohash db seal to accept it", databasePath)
+	}
+	return algo, nil
+}
+
+// writeSeal records the current hash of the database file.
+func writeSeal(databasePath, algo string) error {
+	seal, err := computeSeal(databasePath, algo)
+	if err != nil {
+		return err
+	}
+	// The new seal replaces the old one in a single rename, so a crash
+	// can't leave a truncated seal behind.
+	temporary := sealPath(databasePath) + ".tmp"
+	err = os.WriteFile(temporary, []byte(algo+" "+seal+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(temporary, sealPath(databasePath))
+	}
+	return err
+}
+
+// sealRegistryPath is the seal registry, which lists the databases gohash
+// db seal sealed, one absolute path per line.
+func sealRegistryPath() string {
+	if path := os.Getenv("GOHASH_DB_SEAL_REGISTRY"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gohash", "sealed")
+}
+
+// readSealRegistry returns the databases listed in the seal registry.
+func readSealRegistry() ([]string, error) {
+	path := sealRegistryPath()
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading the seal registry: %v", err)
+	}
+	return strings.Fields(string(content)), nil
+}
+
+func sealRegistered(databasePath string) (bool, error) {
+	absolute, err := filepath.Abs(databasePath)
+	if err != nil {
+		return false, err
+	}
+	registered, err := readSealRegistry()
+	return slices.Contains(registered, absolute), err
+}
+
+// registerSeal adds databasePath to the seal registry, or with sealed false
+// removes it.
+func registerSeal(databasePath string, sealed bool) error {
+	path := sealRegistryPath()
+	if path == "" {
+		return errors.New("there is no configuration directory for the seal registry; set GOHASH_DB_SEAL_REGISTRY")
+	}
+	absolute, err := filepath.Abs(databasePath)
+	if err != nil {
+		return err
+	}
+	registered, err := readSealRegistry()
+	if err != nil {
+		return err
+	}
+	registered = slices.DeleteFunc(registered, func(p string) bool { return p == absolute })
+	if sealed {
+		registered = append(registered, absolute)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return fmt.Errorf("writing the seal registry: %v", err)
+	}
+	temporary := path + ".tmp"
+	err = os.WriteFile(temporary, []byte(strings.Join(registered, "\n")+"\n"), 0o600)
+	if err == nil {
+		err = os.Rename(temporary, path)
+	}
+	if err != nil {
+		return fmt.Errorf("writing the seal registry: %v", err)
+	}
+	return nil
+}
+
+// trackSeal arranges for closeDatabase to reseal db.
+func trackSeal(db *sql.DB, databasePath, algo string) {
+	if algo == "" {
+		return
+	}
+	sealedDatabases.Lock()
+	defer sealedDatabases.Unlock()
+	sealedDatabases.open[db] = [2]string{databasePath, algo}
+}
+
+// untrackSeal returns the path and algorithm db is to be resealed with.
+func untrackSeal(db *sql.DB) (string, string, bool) {
+	sealedDatabases.Lock()
+	defer sealedDatabases.Unlock()
+	seal, ok := sealedDatabases.open[db]
+	delete(sealedDatabases.open, db)
+	return seal[0], seal[1], ok
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfCheckOptions pin the gohash binary itself, so a replaced binary
+// can't quietly report that everything is fine.
+type selfCheckOptions struct {
+	Hash string
+	Key  string
+	Warn bool
+}
+
+func (o *selfCheckOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.Hash, "self-hash", "", "SHA-256 the gohash binary must have, e.g. from sha256sum; refuse to run otherwise")
+	flags.StringVar(&o.Key, "self-key", "", "ed25519 public key the binary's sidecar signature, BINARY.sig from gohash manifest sign-binary, must verify with")
+	flags.BoolVar(&o.Warn, "self-warn", false, "only warn, instead of refusing to run, when the binary fails -self-hash or -self-key")
+}
+
+// check verifies the running binary if a hash or key is pinned.
+func (o *selfCheckOptions) check() {
+	if o.Hash == "" && o.Key == "" {
+		return
+	}
+	err := verifySelf(o.Hash, o.Key)
+	if err == nil {
+		return
+	}
+	if o.Warn {
+		log.Printf("WARNING: the gohash binary failed its self-check: %v", err)
+		return
+	}
+	log.Fatalf("Error: the gohash binary failed its self-check, refusing to run: %v", err)
+}
+
+func verifySelf(pinnedHash, keyPath string) error {
+	program, err := os.Executable()
+	if err == nil {
+		program, err = filepath.EvalSymlinks(program)
+	}
+	if err != nil {
+		return fmt.Errorf("finding the binary: %v", err)
+	}
+	data, err := os.ReadFile(program)
+	if err != nil {
+		return fmt.Errorf("reading the binary: %v", err)
+	}
+
+	if pinnedHash != "" {
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, pinnedHash) {
+			return fmt.Errorf("%s has SHA-256 %s, not %s", program, actual, pinnedHash)
+		}
+	}
+	if keyPath != "" {
+		key, err := readPublicKey(keyPath)
+		if err != nil {
+			return err
+		}
+		encoded, err := os.ReadFile(program + ".sig")
+		if err != nil {
+			return fmt.Errorf("reading the signature: %v", err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(key, data, signature) {
+			return errors.New(program + ".sig is not a valid signature of " + program)
+		}
+	}
+	return nil
+}
+
+// runManifestSignBinary writes binary_path.sig, checked by -self-key, with
+// the same key format and signature encoding as manifests.
+func runManifestSignBinary(arguments []string) {
+	if len(arguments) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s manifest sign-binary key_path binary_path\n", os.Args[0])
+		os.Exit(2)
+	}
+	private, err := readPrivateKey(arguments[0])
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	data, err := os.ReadFile(arguments[1])
+	if err != nil {
+		log.Fatalf("Error reading the binary: %v", err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, data)) + "\n"
+	err = os.WriteFile(arguments[1]+".sig", []byte(signature), 0644)
+	if err != nil {
+		log.Fatalf("Error writing the signature: %v", err)
+	}
+}
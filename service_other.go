@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "log"
+
+func runService(arguments []string) {
+	log.Fatalf("Error: gohash service manages Windows services; on Linux use gohash install-service")
+}
+
+// runAsService does nothing where there are no Windows services.
+func runAsService(stop chan<- string) func() {
+	return func() {}
+}
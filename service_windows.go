@@ -0,0 +1,241 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func runService(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s service install [options] -- daemon_arguments...\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s service start|stop|remove [options]\n", programName)
+		fmt.Fprintf(os.Stderr, "Services start in the system directory, so give the daemon absolute paths.\n")
+	}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("service "+arguments[0], flag.ExitOnError)
+	name := flags.String("name", "gohash", "name of the Windows service")
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments[1:])
+
+	var err error
+	switch arguments[0] {
+	case "install":
+		if flags.NArg() == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err = installService(*name, flags.Args())
+	case "start", "stop", "remove":
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err = controlService(*name, arguments[0])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+}
+
+// installService registers a service running gohash daemon with daemonArgs,
+// restarted by the service manager if it fails, and an Event Log source of
+// the same name for its messages.
+func installService(name string, daemonArgs []string) error {
+	program, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding the gohash binary: %v", err)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	service, err := m.CreateService(name, program, mgr.Config{
+		DisplayName: "gohash file integrity daemon",
+		Description: "Scans directories on a schedule and reports files that changed.",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"daemon"}, daemonArgs...)...)
+	if err != nil {
+		return fmt.Errorf("creating service %s: %v", name, err)
+	}
+	defer service.Close()
+
+	err = service.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		return fmt.Errorf("setting the recovery actions: %v", err)
+	}
+	err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		service.Delete()
+		return fmt.Errorf("registering the Event Log source: %v", err)
+	}
+	fmt.Printf("Installed service %s; start it with: %s service start -name %s\n", name, os.Args[0], name)
+	return nil
+}
+
+func controlService(name, action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %v", name, err)
+	}
+	defer service.Close()
+
+	switch action {
+	case "start":
+		err = service.Start()
+	case "stop":
+		err = stopService(service)
+	case "remove":
+		err = service.Delete()
+		if err == nil {
+			err = eventlog.Remove(name)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s service %s: %v", map[string]string{"start": "starting", "stop": "stopping", "remove": "removing"}[action], name, err)
+	}
+	fmt.Printf("Service %s: %s done\n", name, action)
+	return nil
+}
+
+// stopService asks the service to stop and waits while it finishes its
+// scans and sends its pending notifications.
+func stopService(service *mgr.Service) error {
+	status, err := service.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	for status.State != svc.Stopped {
+		time.Sleep(time.Second)
+		status, err = service.Query()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAsService hands the daemon over to the service manager when it was
+// started as a Windows service: stop requests are passed on as stop
+// reasons, and log messages go to the Event Log. The returned function
+// reports the service stopped; it does nothing when not running as one.
+func runAsService(stop chan<- string) func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}
+	}
+	handler := &serviceHandler{stop: stop, stopped: make(chan struct{}), exited: make(chan struct{})}
+	// The name is only used by services sharing a process.
+	go func() {
+		err := svc.Run("", handler)
+		if err != nil {
+			log.Printf("Error running as a service: %v", err)
+		}
+		close(handler.exited)
+	}()
+	return func() {
+		close(handler.stopped)
+		<-handler.exited
+	}
+}
+
+type serviceHandler struct {
+	stop    chan<- string
+	stopped chan struct{}
+	exited  chan struct{}
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	// The service manager passes the service's name, which installService
+	// also registered as an Event Log source.
+	if events, err := eventlog.Open(args[0]); err == nil {
+		log.SetOutput(&eventLogWriter{events})
+	}
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				select {
+				case h.stop <- "Service stop requested":
+				default:
+				}
+				h.waitStopped(status)
+				return false, 0
+			}
+		case <-h.stopped:
+			return false, 0
+		}
+	}
+}
+
+// waitStopped keeps telling the service manager the service is still
+// stopping, so it waits for scans in progress to finish instead of giving
+// up on the service.
+func (h *serviceHandler) waitStopped(status chan<- svc.Status) {
+	const step = 30 * time.Second
+	ticker := time.NewTicker(step / 2)
+	defer ticker.Stop()
+	for checkpoint := uint32(1); ; checkpoint++ {
+		status <- svc.Status{State: svc.StopPending, CheckPoint: checkpoint, WaitHint: uint32(step.Milliseconds())}
+		select {
+		case <-ticker.C:
+		case <-h.stopped:
+			return
+		}
+	}
+}
+
+// eventLogWriter sends each log message to the Event Log, as an error if
+// it reports one.
+type eventLogWriter struct {
+	events *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	var err error
+	if strings.Contains(message, "Error") {
+		err = w.events.Error(1, message)
+	} else {
+		err = w.events.Info(1, message)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
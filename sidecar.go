@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Sidecar formats: SFV lists a CRC32 per file, BSD lines read
+// "SHA256 (file) = hash" as written by BSD's md5 and sha256 tools.
+const (
+	SidecarSFV = "sfv"
+	SidecarBSD = "bsd"
+)
+
+// bsdLine matches a line of a BSD-style checksum file.
+var bsdLine = regexp.MustCompile(`^([A-Z0-9]+) \((.*)\) = ([0-9a-fA-F]+)$`)
+
+// sidecarEntry is one file listed in a sidecar.
+type sidecarEntry struct {
+	Name string
+	Algo string
+	Hash string
+}
+
+func runSidecar(arguments []string) {
+	usage := func() {
+		programName := os.Args[0]
+		fmt.Fprintf(os.Stderr, "Usage: %s sidecar write [options] directory\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s sidecar verify [options] directory\n", programName)
+	}
+	if len(arguments) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "write":
+		runSidecarWrite(arguments[1:])
+	case "verify":
+		runSidecarVerify(arguments[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// runSidecarWrite writes a checksum file into each directory listing the
+// files in it.
+func runSidecarWrite(arguments []string) {
+	flags := flag.NewFlagSet("sidecar write", flag.ExitOnError)
+	format := flags.String("format", SidecarBSD, "sidecar format: sfv (CRC32) or bsd (ALGO (file) = hash)")
+	algo := flags.String("algo", "sha256", "hash algorithm of bsd sidecars: md5, sha1, sha256 or sha512")
+	recursive := flags.Bool("recursive", false, "write sidecars in subdirectories as well")
+	name := flags.String("name", "", "sidecar file name (default: checksums.sfv, or CHECKSUM.ALGO for bsd)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s sidecar write [options] directory\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	switch *format {
+	case SidecarSFV:
+		*algo = "crc32"
+	case SidecarBSD:
+		if _, ok := hashAlgorithms[*algo]; !ok {
+			log.Fatalf("Error: unknown hash algorithm %q (supported: %s)", *algo, strings.Join(hashAlgorithmNames(), ", "))
+		}
+	default:
+		log.Fatalf("Unknown sidecar format: %s", *format)
+	}
+	if *name == "" {
+		*name = "CHECKSUM." + hashLabel(*algo)
+		if *format == SidecarSFV {
+			*name = "checksums.sfv"
+		}
+	}
+
+	written := 0
+	err := sidecarDirectories(flags.Arg(0), *recursive, func(directory string, files []string) error {
+		var b strings.Builder
+		if *format == SidecarSFV {
+			fmt.Fprintf(&b, "; Generated by gohash %s\n", version)
+		}
+		for _, file := range files {
+			if file == *name || isSidecar(file) {
+				continue
+			}
+			sum, err := sidecarHash(filepath.Join(directory, file), *algo)
+			if err != nil {
+				return err
+			}
+			if *format == SidecarSFV {
+				fmt.Fprintf(&b, "%s %s\n", file, strings.ToUpper(sum))
+			} else {
+				fmt.Fprintf(&b, "%s (%s) = %s\n", hashLabel(*algo), file, sum)
+			}
+		}
+		written++
+		return os.WriteFile(filepath.Join(directory, *name), []byte(b.String()), 0644)
+	})
+	if err != nil {
+		log.Fatalf("Error writing sidecars: %v", err)
+	}
+	fmt.Printf("Wrote %d %s sidecars\n", written, *name)
+}
+
+// runSidecarVerify checks every file listed in the SFV and BSD-style
+// sidecars found in each directory.
+func runSidecarVerify(arguments []string) {
+	flags := flag.NewFlagSet("sidecar verify", flag.ExitOnError)
+	recursive := flags.Bool("recursive", false, "verify sidecars in subdirectories as well")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s sidecar verify [options] directory\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	passed, failed := 0, 0
+	err := sidecarDirectories(flags.Arg(0), *recursive, func(directory string, files []string) error {
+		for _, file := range files {
+			if !isSidecar(file) {
+				continue
+			}
+			entries, err := readSidecar(filepath.Join(directory, file))
+			if err != nil {
+				fmt.Printf("Error reading %s: %v\n", displayPath(filepath.Join(directory, file)), err)
+				failed++
+				continue
+			}
+			for _, entry := range entries {
+				filePath := filepath.Join(directory, filepath.FromSlash(entry.Name))
+				sum, err := sidecarHash(filePath, entry.Algo)
+				switch {
+				case errors.Is(err, fs.ErrNotExist):
+					fmt.Printf("File listed in %s is missing: %s\n", file, displayPath(filePath))
+					failed++
+				case err != nil:
+					fmt.Printf("Error computing %s hash for %s: %v\n", hashLabel(entry.Algo), displayPath(filePath), err)
+					failed++
+				case !strings.EqualFold(sum, entry.Hash):
+					fmt.Printf("%s hash mismatch for %s: stored=%s, computed=%s\n", hashLabel(entry.Algo), displayPath(filePath), entry.Hash, sum)
+					failed++
+				default:
+					passed++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Error reading the specified directory: %v", err)
+	}
+	fmt.Printf("%d files have passed the integrity tests, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// isSidecar reports whether a file name is that of a checksum sidecar.
+func isSidecar(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".sfv") || strings.HasPrefix(name, "CHECKSUM.")
+}
+
+// sidecarDirectories calls fn with each directory under root, or just root,
+// and the names of the regular files in it, sorted.
+func sidecarDirectories(root string, recursive bool, fn func(directory string, files []string) error) error {
+	entries, err := os.ReadDir(longPath(root))
+	if err != nil {
+		return err
+	}
+	var files, subdirectories []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, entry.Name())
+		} else if entry.IsDir() {
+			subdirectories = append(subdirectories, entry.Name())
+		}
+	}
+	sort.Strings(files)
+	err = fn(root, files)
+	if err != nil || !recursive {
+		return err
+	}
+	for _, subdirectory := range subdirectories {
+		err = sidecarDirectories(filepath.Join(root, subdirectory), true, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSidecar parses an SFV or BSD-style checksum file, telling them apart
+// by the file name.
+func readSidecar(sidecarPath string) ([]sidecarEntry, error) {
+	file, err := os.Open(longPath(sidecarPath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sfv := strings.HasSuffix(strings.ToLower(sidecarPath), ".sfv")
+	var entries []sidecarEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" || (sfv && strings.HasPrefix(text, ";")) {
+			continue
+		}
+		var entry sidecarEntry
+		if sfv {
+			i := strings.LastIndexByte(text, ' ')
+			if i < 0 {
+				return nil, fmt.Errorf("line %d: no CRC", line)
+			}
+			entry = sidecarEntry{Name: text[:i], Algo: "crc32", Hash: text[i+1:]}
+		} else {
+			match := bsdLine.FindStringSubmatch(text)
+			if match == nil {
+				return nil, fmt.Errorf("line %d: not ALGO (file) = hash", line)
+			}
+			entry = sidecarEntry{Name: match[2], Algo: strings.ToLower(match[1]), Hash: match[3]}
+			if _, ok := hashAlgorithms[entry.Algo]; !ok {
+				return nil, fmt.Errorf("line %d: unknown algorithm %s", line, match[1])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// sidecarHash hashes a file with one of the root algorithms or crc32.
+func sidecarHash(filePath, algo string) (string, error) {
+	var h hash.Hash
+	if algo == "crc32" {
+		h = crc32.NewIEEE()
+	} else {
+		h = hashAlgorithms[algo]()
+	}
+	file, err := os.Open(longPath(filePath))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(h, file)
+	return hex.EncodeToString(h.Sum(nil)), err
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyProgressSignal reports false where there is no SIGUSR1.
+func notifyProgressSignal(c chan<- os.Signal) bool {
+	return false
+}
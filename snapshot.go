@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot kinds: a scan of a snapshot sees the whole tree as it was at one
+// instant, so files being written during a long scan don't show up as
+// mismatches.
+const (
+	SnapshotZFS   = "zfs"
+	SnapshotBtrfs = "btrfs"
+	SnapshotLVM   = "lvm"
+	SnapshotVSS   = "vss"
+)
+
+// snapshot is a point-in-time, read-only copy of the filesystem holding a
+// root, made with the filesystem's or volume manager's own tools.
+type snapshot struct {
+	// Name identifies the snapshot, e.g. a ZFS snapshot name or a VSS
+	// shadow copy ID.
+	Name string
+	// Root is where the root directory is found in the snapshot.
+	Root string
+	// cleanup undoes the steps that created the snapshot, last first.
+	cleanup []func() error
+}
+
+func validSnapshotKind(kind string) bool {
+	switch kind {
+	case SnapshotZFS, SnapshotBtrfs, SnapshotLVM, SnapshotVSS:
+		return true
+	}
+	return false
+}
+
+// createSnapshot snapshots the filesystem holding rootDirectory. size is
+// the space an LVM snapshot reserves for changes made while it exists.
+func createSnapshot(kind, rootDirectory, size string) (*snapshot, error) {
+	absRoot, err := filepath.Abs(rootDirectory)
+	if err == nil {
+		absRoot, err = filepath.EvalSymlinks(absRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Profiles of one daemon can snapshot the same filesystem at once.
+	name := "gohash-" + time.Now().UTC().Format("20060102T150405.000000000Z")
+
+	s := &snapshot{}
+	switch kind {
+	case SnapshotZFS:
+		err = s.createZFS(absRoot, name)
+	case SnapshotBtrfs:
+		err = s.createBtrfs(absRoot, name)
+	case SnapshotLVM:
+		err = s.createLVM(absRoot, name, size)
+	case SnapshotVSS:
+		err = s.createVSS(absRoot)
+	default:
+		err = fmt.Errorf("unknown snapshot kind %q", kind)
+	}
+	if err != nil {
+		s.Remove()
+		return nil, fmt.Errorf("creating a %s snapshot: %v", kind, err)
+	}
+	return s, nil
+}
+
+// Remove deletes the snapshot.
+func (s *snapshot) Remove() error {
+	var first error
+	for i := len(s.cleanup) - 1; i >= 0; i-- {
+		if err := s.cleanup[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.cleanup = nil
+	return first
+}
+
+// runCommand runs a snapshot tool, returning its trimmed output.
+func runCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), commandError(err))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// inside returns where path, under mountpoint, is found under
+// snapshotRoot, the same filesystem's snapshot.
+func inside(snapshotRoot, mountpoint, path string) (string, error) {
+	rel, err := filepath.Rel(mountpoint, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under its mountpoint %s", path, mountpoint)
+	}
+	return filepath.Join(snapshotRoot, rel), nil
+}
+
+// createZFS snapshots the dataset holding root, reached through the
+// dataset's .zfs/snapshot directory.
+func (s *snapshot) createZFS(root, name string) error {
+	out, err := runCommand("zfs", "list", "-H", "-o", "name,mountpoint", root)
+	if err != nil {
+		return err
+	}
+	dataset, mountpoint, ok := strings.Cut(out, "\t")
+	if !ok || !filepath.IsAbs(mountpoint) {
+		return fmt.Errorf("dataset %s is not mounted", dataset)
+	}
+	s.Name = dataset + "@" + name
+	if _, err = runCommand("zfs", "snapshot", s.Name); err != nil {
+		return err
+	}
+	s.cleanup = append(s.cleanup, func() error {
+		_, err := runCommand("zfs", "destroy", s.Name)
+		return err
+	})
+	s.Root, err = inside(filepath.Join(mountpoint, ".zfs", "snapshot", name), mountpoint, root)
+	return err
+}
+
+// createBtrfs makes a read-only snapshot of root, which must be a
+// subvolume, next to it.
+func (s *snapshot) createBtrfs(root, name string) error {
+	s.Name = filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+"."+name)
+	if _, err := runCommand("btrfs", "subvolume", "snapshot", "-r", root, s.Name); err != nil {
+		return fmt.Errorf("%v (the root must be a Btrfs subvolume)", err)
+	}
+	s.cleanup = append(s.cleanup, func() error {
+		_, err := runCommand("btrfs", "subvolume", "delete", s.Name)
+		return err
+	})
+	s.Root = s.Name
+	return nil
+}
+
+// createLVM snapshots the logical volume mounted at root's mountpoint and
+// mounts the snapshot read-only in a temporary directory.
+func (s *snapshot) createLVM(root, name, size string) error {
+	out, err := runCommand("findmnt", "-n", "-o", "SOURCE,TARGET,FSTYPE", "-T", root)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return fmt.Errorf("unexpected findmnt output %q", out)
+	}
+	device, mountpoint, fstype := fields[0], fields[1], fields[2]
+	out, err = runCommand("lvs", "--noheadings", "-o", "vg_name", device)
+	if err != nil {
+		return fmt.Errorf("%s is not an LVM logical volume: %v", device, err)
+	}
+	group := out
+
+	if _, err = runCommand("lvcreate", "--snapshot", "--name", name, "--size", size, device); err != nil {
+		return err
+	}
+	s.Name = group + "/" + name
+	s.cleanup = append(s.cleanup, func() error {
+		_, err := runCommand("lvremove", "--force", s.Name)
+		return err
+	})
+
+	directory, err := os.MkdirTemp("", "gohash-snapshot-")
+	if err != nil {
+		return err
+	}
+	s.cleanup = append(s.cleanup, func() error { return os.Remove(directory) })
+	options := "ro"
+	if fstype == "xfs" {
+		// XFS refuses to mount two filesystems with the same UUID.
+		options += ",nouuid"
+	}
+	if _, err = runCommand("mount", "-o", options, "/dev/"+s.Name, directory); err != nil {
+		return err
+	}
+	s.cleanup = append(s.cleanup, func() error {
+		_, err := runCommand("umount", directory)
+		return err
+	})
+	s.Root, err = inside(directory, mountpoint, root)
+	return err
+}
+
+// shadowCopies makes a shadow copy of a root's volume the first time a file
+// under it turns out to be held open exclusively, so that file and any
+// later ones can be read from it instead.
+type shadowCopies struct {
+	root string
+	once sync.Once
+	snap *snapshot
+	err  error
+}
+
+// path returns where filePath, under the root, is in the shadow copy.
+func (s *shadowCopies) path(filePath string) (string, error) {
+	s.once.Do(func() {
+		log.Printf("Files under %s are held open exclusively; making a shadow copy to read them from", displayPath(s.root))
+		s.snap, s.err = createSnapshot(SnapshotVSS, s.root, "")
+	})
+	if s.err != nil {
+		return "", s.err
+	}
+	rel, err := filepath.Rel(s.root, filePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.snap.Root, rel), nil
+}
+
+// Remove deletes the shadow copy, if one was made, waiting for one being
+// made to be finished.
+func (s *shadowCopies) Remove() error {
+	s.once.Do(func() {
+		s.err = errors.New("the scan is over")
+	})
+	if s.snap == nil {
+		return nil
+	}
+	return s.snap.Remove()
+}
+
+// createVSS makes a shadow copy of root's volume through WMI, reached by
+// the shadow copy's device path.
+func (s *snapshot) createVSS(root string) error {
+	if runtime.GOOS != "windows" {
+		return fmt.Errorf("shadow copies are only available on Windows")
+	}
+	volume := filepath.VolumeName(root) + `\`
+	script := fmt.Sprintf(`$r = (Get-WmiObject -List Win32_ShadowCopy).Create('%s', 'ClientAccessible'); `+
+		`if ($r.ReturnValue -ne 0) { throw "error $($r.ReturnValue)" }; `+
+		`$s = Get-WmiObject Win32_ShadowCopy -Filter "ID='$($r.ShadowID)'"; `+
+		`Write-Output $s.ID $s.DeviceObject`, strings.ReplaceAll(volume, "'", "''"))
+	out, err := runCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	if err != nil {
+		return err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return fmt.Errorf("unexpected output %q", out)
+	}
+	s.Name = lines[0]
+	s.cleanup = append(s.cleanup, func() error {
+		_, err := runCommand("vssadmin", "delete", "shadows", "/shadow="+s.Name, "/quiet")
+		return err
+	})
+
+	// Paths under the \\?\GLOBALROOT device don't survive being cleaned,
+	// so the shadow copy is reached through a directory link to it.
+	directory, err := os.MkdirTemp("", "gohash-snapshot-")
+	if err != nil {
+		return err
+	}
+	s.cleanup = append(s.cleanup, func() error { return os.Remove(directory) })
+	link := filepath.Join(directory, "volume")
+	if err = os.Symlink(lines[1]+`\`, link); err != nil {
+		return err
+	}
+	s.cleanup = append(s.cleanup, func() error { return os.Remove(link) })
+	s.Root, err = inside(link, volume, root)
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Policies for files with nothing to hash: special files (FIFOs, sockets
+// and devices) and, for -empty, zero-byte files. Skipped files aren't added
+// to the baseline, but those already in it are still checked, so a file
+// replaced by a FIFO is reported as changed rather than missing.
+const (
+	PolicySkip   = "skip"
+	PolicyRecord = "record"
+	PolicyError  = "error"
+)
+
+// errSpecialFile is returned for files that can't be hashed by reading
+// them; opening a FIFO would block until something writes to it.
+var errSpecialFile = errors.New("not a regular file")
+
+func validSpecialPolicy(policy string) bool {
+	return policy == PolicySkip || policy == PolicyRecord || policy == PolicyError
+}
+
+func validEmptyPolicy(policy string) bool {
+	return policy == PolicySkip || policy == PolicyRecord
+}
+
+// specialKind names the type of a file that isn't regular.
+func specialKind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "char-device"
+	case mode&fs.ModeDevice != 0:
+		return "block-device"
+	}
+	return "irregular"
+}
+
+// specialHash stands in for the hash of a special file: its type and, for
+// devices, the device number, so replacing one is noticed.
+func specialHash(info os.FileInfo) string {
+	hash := "special:" + specialKind(info.Mode())
+	if rdev, ok := deviceNumber(info); ok && info.Mode()&fs.ModeDevice != 0 {
+		hash += fmt.Sprintf(":%d", rdev)
+	}
+	return hash
+}
+
+// linkedFiles hashes each file with several hard links once per scan, however
+// many of its names are under the root.
+type linkedFiles struct {
+	mu    sync.Mutex
+	files map[fileID]*linkedHash
+}
+
+type linkedHash struct {
+	done chan struct{}
+	hash string
+	err  error
+	// left is how many more of the file's names may still turn up.
+	left uint64
+}
+
+func newLinkedFiles() *linkedFiles {
+	return &linkedFiles{files: make(map[fileID]*linkedHash)}
+}
+
+// hash returns the hash of the file described by info, computing it only
+// for the first of its names; the others wait for that result.
+func (l *linkedFiles) hash(info os.FileInfo, compute func() (string, error)) (string, error) {
+	id, links, ok := fileIdentity(info)
+	if l == nil || !ok || links < 2 {
+		return compute()
+	}
+	l.mu.Lock()
+	entry, found := l.files[id]
+	if !found {
+		entry = &linkedHash{done: make(chan struct{}), left: links - 1}
+		l.files[id] = entry
+	} else if entry.left--; entry.left == 0 {
+		delete(l.files, id)
+	}
+	l.mu.Unlock()
+
+	if found {
+		<-entry.done
+		return entry.hash, entry.err
+	}
+	entry.hash, entry.err = compute()
+	if entry.err != nil {
+		// Let a retry hash the file again.
+		l.mu.Lock()
+		if l.files[id] == entry {
+			delete(l.files, id)
+		}
+		l.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.hash, entry.err
+}
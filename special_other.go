@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+type fileID struct{}
+
+func (fileID) String() string {
+	return ""
+}
+
+// fileIdentity reports false where os.FileInfo doesn't carry a file ID, so
+// hard links are hashed once per name.
+func fileIdentity(info os.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}
+
+func deviceNumber(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+type fileID struct {
+	dev, ino uint64
+}
+
+// String writes the file ID as device:inode.
+func (id fileID) String() string {
+	return strconv.FormatUint(id.dev, 10) + ":" + strconv.FormatUint(id.ino, 10)
+}
+
+// fileIdentity returns the device and inode of a file, and how many links
+// it has.
+func fileIdentity(info os.FileInfo) (fileID, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{uint64(stat.Dev), uint64(stat.Ino)}, uint64(stat.Nlink), true
+}
+
+func deviceNumber(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Rdev), true
+}
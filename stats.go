@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statCount is a label and the number of tracked files that share it.
+type statCount struct {
+	Label string
+	Files int
+	Bytes int64
+}
+
+func runStats(arguments []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	top := flags.Int("top", 10, "number of extensions and directories to list")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s stats [options] database_path\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return
+	}
+	databasePath := flags.Arg(0)
+
+	if _, err := os.Stat(databasePath); err != nil {
+		log.Fatalf("Error reading the database: %v", err)
+	}
+	db, err := openDatabaseReadOnly(databasePath)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	defer closeDatabase(db)
+
+	rows, err := db.Query("SELECT root_id, filename, size, last_verified FROM file_hashes")
+	if err != nil {
+		log.Fatalf("Error querying the database: %v", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var totalFiles, unreadable int
+	var totalBytes int64
+	byRoot := make(map[string]*statCount)
+	byExtension := make(map[string]*statCount)
+	byDirectory := make(map[string]*statCount)
+	ageCounts := make([]int, len(verifiedAgeBuckets)+1)
+	for rows.Next() {
+		var rootID, filePath string
+		var storedSize, lastVerified sql.NullInt64
+		err = rows.Scan(&rootID, &filePath, &storedSize, &lastVerified)
+		if err != nil {
+			log.Fatalf("Error reading the database: %v", err)
+		}
+		totalFiles++
+
+		// Records from before sizes were stored fall back to the file on disk.
+		size := storedSize.Int64
+		if !storedSize.Valid {
+			info, err := os.Stat(diskPath(rootID, filePath))
+			if err != nil {
+				unreadable++
+			} else {
+				size = info.Size()
+			}
+		}
+		totalBytes += size
+
+		if lastVerified.Valid {
+			ageCounts[verifiedAgeBucket(now.Sub(time.Unix(lastVerified.Int64, 0)))]++
+		} else {
+			ageCounts[len(verifiedAgeBuckets)]++
+		}
+
+		extension := strings.ToLower(filepath.Ext(filePath))
+		if extension == "" {
+			extension = "(none)"
+		}
+		if rootID == "" {
+			rootID = "(not yet adopted by a root)"
+		}
+		addStatCount(byRoot, rootID, size)
+		addStatCount(byExtension, extension, size)
+		addStatCount(byDirectory, topLevelDirectory(filePath), size)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalf("Error reading the database: %v", err)
+	}
+
+	fmt.Printf("Files tracked: %d\n", totalFiles)
+	fmt.Printf("Total bytes: %d\n", totalBytes)
+	if unreadable > 0 {
+		fmt.Printf("Files not readable on disk: %d\n", unreadable)
+	}
+	fmt.Printf("Database size: %d bytes\n", databaseSize(databasePath))
+
+	printStatCounts("By root", byRoot, *top)
+	printStatCounts("By extension", byExtension, *top)
+	printStatCounts("By top-level directory", byDirectory, *top)
+
+	fmt.Printf("\nLast verified:\n")
+	for i, bucket := range verifiedAgeBuckets {
+		fmt.Printf("  %-30s %8d files\n", bucket.label, ageCounts[i])
+	}
+	fmt.Printf("  %-30s %8d files\n", "never", ageCounts[len(verifiedAgeBuckets)])
+}
+
+var verifiedAgeBuckets = []struct {
+	label  string
+	maxAge time.Duration
+}{
+	{"within a day", 24 * time.Hour},
+	{"within a week", 7 * 24 * time.Hour},
+	{"within 30 days", 30 * 24 * time.Hour},
+	{"within 90 days", 90 * 24 * time.Hour},
+	{"more than 90 days ago", math.MaxInt64},
+}
+
+func verifiedAgeBucket(age time.Duration) int {
+	for i, bucket := range verifiedAgeBuckets {
+		if age < bucket.maxAge {
+			return i
+		}
+	}
+	return len(verifiedAgeBuckets) - 1
+}
+
+func addStatCount(counts map[string]*statCount, label string, size int64) {
+	count, ok := counts[label]
+	if !ok {
+		count = &statCount{Label: label}
+		counts[label] = count
+	}
+	count.Files++
+	count.Bytes += size
+}
+
+func printStatCounts(title string, counts map[string]*statCount, top int) {
+	sorted := make([]statCount, 0, len(counts))
+	for _, count := range counts {
+		sorted = append(sorted, *count)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Files != sorted[j].Files {
+			return sorted[i].Files > sorted[j].Files
+		}
+		return sorted[i].Label < sorted[j].Label
+	})
+	if top > 0 && len(sorted) > top {
+		sorted = sorted[:top]
+	}
+
+	fmt.Printf("\n%s:\n", title)
+	for _, count := range sorted {
+		fmt.Printf("  %-30s %8d files %14d bytes\n", count.Label, count.Files, count.Bytes)
+	}
+}
+
+// topLevelDirectory returns the first directory component of a stored
+// path, or "." for files directly under their root.
+func topLevelDirectory(rel string) string {
+	first, _, found := strings.Cut(strings.TrimPrefix(rel, "/"), "/")
+	if !found {
+		return "."
+	}
+	return first
+}
+
+// databaseSize returns the on-disk size of the database including its
+// write-ahead log, if any.
+func databaseSize(databasePath string) int64 {
+	var size int64
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if info, err := os.Stat(databasePath + suffix); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// resultStream writes -stream ndjson: one JSON object per line as results
+// arrive, so a pipeline can act on a long scan while it runs. A "start"
+// event begins the stream, each file result is a "file" event, findings
+// that aren't about one file, such as an unreadable directory, are
+// "finding" events, and a "summary" event ends it. Every event carries the
+// scan's run ID.
+type resultStream struct {
+	encoder *json.Encoder
+	runID   string
+}
+
+// streamEvent is one line of the stream.
+type streamEvent struct {
+	Type  string `json:"type"`
+	Time  string `json:"time"`
+	RunID string `json:"runId"`
+	// Host is set on start events, whose Path is the root, and on the
+	// events of reportEvents.
+	Host string `json:"host,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Result is the verdict on the file: new, match, mismatch, error,
+	// expected, deferred, dynamic, skipped or missing.
+	Result     string `json:"result,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	StoredHash string `json:"storedHash,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	// Finding and Message are set when the result was reported.
+	Finding string `json:"finding,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Summary events only.
+	Status string           `json:"status,omitempty"`
+	Tier   string           `json:"tier,omitempty"`
+	Totals *directoryCounts `json:"totals,omitempty"`
+	Passed *int             `json:"passed,omitempty"`
+}
+
+func newResultStream(w io.Writer) *resultStream {
+	return &resultStream{encoder: json.NewEncoder(w)}
+}
+
+// fileEvent starts the event for one file's verdict; a finding about the
+// file is filled in before it is written.
+func fileEvent(v verdict) *streamEvent {
+	result := v.Result
+	return &streamEvent{Type: "file", Path: displayPath(result.FilePath), Result: v.Kind, Hash: result.Hash, StoredHash: v.StoredHash, Size: result.Size}
+}
+
+// start begins the events of the scan run.
+func (s *resultStream) start(run runInfo) error {
+	s.runID = run.RunID
+	return s.write(&streamEvent{Type: "start", Host: run.Hostname, Path: displayPath(run.Root)})
+}
+
+func (s *resultStream) write(event *streamEvent) error {
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.RunID = s.runID
+	return s.encoder.Encode(event)
+}
+
+func (s *resultStream) finding(finding Finding) error {
+	return s.write(&streamEvent{Type: "finding", Path: displayPath(finding.FilePath), Finding: finding.Kind, Message: finding.Message})
+}
+
+func (s *resultStream) summary(report *scanReport) error {
+	totals := report.Totals()
+	return s.write(&streamEvent{Type: "summary", Status: report.Status(), Tier: report.Run.Tier, Totals: &totals, Passed: &report.Passed})
+}
+
+// reportEvents calls fn with a finding event for each of the report's
+// findings that wasn't acknowledged, then with the run's summary, for the
+// integrations that publish a run's events after the scan. Those carry the
+// host, since they leave the machine.
+func reportEvents(report *scanReport, fn func(*streamEvent) error) error {
+	run := report.Run
+	if report.findings != nil {
+		err := report.findings.each(func(spooled spooledFinding) error {
+			if spooled.Ack != nil {
+				return nil
+			}
+			finding := spooled.Finding
+			return fn(&streamEvent{
+				Type:       "finding",
+				Time:       time.Unix(spooled.At, 0).UTC().Format(time.RFC3339Nano),
+				RunID:      run.RunID,
+				Host:       run.Hostname,
+				Path:       finding.FilePath,
+				Hash:       finding.ComputedHash,
+				StoredHash: finding.StoredHash,
+				Finding:    finding.Kind,
+				Message:    finding.Message,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	totals := report.Totals()
+	return fn(&streamEvent{
+		Type:   "summary",
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		RunID:  run.RunID,
+		Host:   run.Hostname,
+		Path:   displayPath(run.Root),
+		Status: report.Status(),
+		Tier:   run.Tier,
+		Totals: &totals,
+		Passed: &report.Passed,
+	})
+}
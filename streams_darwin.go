@@ -0,0 +1,40 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// resourceFork is the path suffix macOS opens a file's resource fork at.
+const resourceFork = "/..namedfork/rsrc"
+
+// alternateStreams returns a file's resource fork, if it has one, the
+// macOS counterpart of an alternate data stream that old applications and
+// malware alike keep code and data in.
+func alternateStreams(path string) ([]dataStream, error) {
+	size, err := unix.Getxattr(path, "com.apple.ResourceFork", nil)
+	if errors.Is(err, unix.ENOATTR) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EISDIR) || err == nil && size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []dataStream{{Name: "rsrc", Size: int64(size)}}, nil
+}
+
+// streamPath is where the stream name of the file at rel is recorded and
+// opened: file/..namedfork/rsrc.
+func streamPath(rel, name string) string {
+	return rel + "/..namedfork/" + name
+}
+
+// streamHost returns the file a resource fork's path belongs to.
+func streamHost(rel string) (string, bool) {
+	if host, ok := strings.CutSuffix(rel, resourceFork); ok {
+		return host, true
+	}
+	return rel, false
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !darwin
+
+package main
+
+// alternateStreams finds no streams outside Windows and macOS: extended
+// attributes elsewhere aren't file contents the scan hashes.
+func alternateStreams(path string) ([]dataStream, error) {
+	return nil, nil
+}
+
+func streamPath(rel, name string) string {
+	return rel + ":" + name
+}
+
+// streamHost never sees a stream here, where a colon is just part of a
+// name.
+func streamHost(rel string) (string, bool) {
+	return rel, false
+}
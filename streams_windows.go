@@ -0,0 +1,80 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32        = windows.NewLazySystemDLL("kernel32.dll")
+	findFirstStream = kernel32.NewProc("FindFirstStreamW")
+	findNextStream  = kernel32.NewProc("FindNextStreamW")
+)
+
+// findStreamData is WIN32_FIND_STREAM_DATA.
+type findStreamData struct {
+	StreamSize int64
+	StreamName [windows.MAX_PATH + 36]uint16
+}
+
+// alternateStreams lists the named data streams of the file or directory
+// at path, leaving out its unnamed main stream. Filesystems without streams
+// have none.
+func alternateStreams(path string) ([]dataStream, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var data findStreamData
+	handle, _, err := findFirstStream.Call(uintptr(unsafe.Pointer(name)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	if windows.Handle(handle) == windows.InvalidHandle {
+		for _, errno := range []windows.Errno{windows.ERROR_HANDLE_EOF, windows.ERROR_INVALID_PARAMETER, windows.ERROR_INVALID_FUNCTION, windows.ERROR_NOT_SUPPORTED} {
+			if errors.Is(err, errno) {
+				return nil, nil
+			}
+		}
+		return nil, err
+	}
+	defer windows.FindClose(windows.Handle(handle))
+
+	var streams []dataStream
+	for {
+		// Names are ":name:$DATA", the main stream's "::$DATA".
+		stream := strings.TrimPrefix(windows.UTF16ToString(data.StreamName[:]), ":")
+		if i := strings.LastIndexByte(stream, ':'); i >= 0 {
+			stream = stream[:i]
+		}
+		if stream != "" {
+			streams = append(streams, dataStream{Name: stream, Size: data.StreamSize})
+		}
+		ok, _, err := findNextStream.Call(handle, uintptr(unsafe.Pointer(&data)))
+		if ok == 0 {
+			if errors.Is(err, windows.ERROR_HANDLE_EOF) {
+				return streams, nil
+			}
+			return streams, err
+		}
+	}
+}
+
+// streamPath is where the stream name of the file at rel is recorded and
+// opened: file:stream.
+func streamPath(rel, name string) string {
+	return rel + ":" + name
+}
+
+// streamHost returns the file an alternate data stream's path, file:stream,
+// belongs to.
+func streamHost(rel string) (string, bool) {
+	i := strings.IndexByte(path.Base(rel), ':')
+	if i < 0 {
+		return rel, false
+	}
+	return rel[:len(rel)-len(path.Base(rel))+i], true
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Each run's summary can be pushed, signed, to storage the host can write
+// but not overwrite or delete: an S3 bucket with Object Lock, or an HTTPS
+// endpoint that refuses to replace what it holds. If the host and its
+// database are later compromised, the record of what past scans found, and
+// of the baseline they left, survives where the intruder can't rewrite it.
+// S3 credentials are the standard AWS ones, AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, with AWS_ENDPOINT_URL_S3 for
+// an S3-compatible store; an endpoint gets GOHASH_SUMMARY_TOKEN as a bearer
+// token, if set.
+type summaryOptions struct {
+	// URL is s3://bucket/prefix, or the http(s) base URL of the endpoint.
+	// Summaries are stored under it as <host>/<start time>-<run ID>.json.
+	URL string
+	// Key is the ed25519 private key, from gohash manifest keygen, the
+	// summaries are signed with.
+	Key string
+	// Retain, if set, locks each S3 object in compliance mode for this
+	// long; otherwise the bucket's default retention applies.
+	Retain time.Duration
+}
+
+func (o *summaryOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.URL, "summary-url", "", "push a signed summary of each run to write-once storage: s3://bucket/prefix for a bucket with Object Lock, or the http(s) URL of an endpoint that refuses overwrites (default: off)")
+	flags.StringVar(&o.Key, "summary-key", "", "ed25519 private key from gohash manifest keygen that run summaries are signed with")
+	flags.DurationVar(&o.Retain, "summary-retain", 0, "lock each summary pushed to S3 in compliance mode for this long, e.g. 8760h (default: the bucket's default retention)")
+}
+
+// summarySecrets returns the credentials pushing to url reads from the
+// environment.
+func summarySecrets(url string) []string {
+	if strings.HasPrefix(url, "s3://") {
+		return []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"}
+	} else if url != "" {
+		return []string{"GOHASH_SUMMARY_TOKEN"}
+	}
+	return nil
+}
+
+// checkSummaryOptions validates the summary settings, if pushing is on.
+func checkSummaryOptions(options summaryOptions) error {
+	if options.URL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(options.URL)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("-summary-url must be an s3://, http:// or https:// URL, not %q", options.URL)
+	}
+	switch parsed.Scheme {
+	case "s3":
+		if awsRegion() == "" && os.Getenv("AWS_ENDPOINT_URL_S3") == "" {
+			return errors.New("AWS_REGION is not set")
+		}
+		err = requireEnv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY")
+	case "http", "https":
+		if options.Retain > 0 {
+			return errors.New("-summary-retain only applies to S3; the endpoint decides how long it keeps summaries")
+		}
+	default:
+		return fmt.Errorf("-summary-url must be an s3://, http:// or https:// URL, not %q", options.URL)
+	}
+	if err != nil {
+		return err
+	}
+	if options.Retain < 0 {
+		return errors.New("-summary-retain can't be negative")
+	}
+	if options.Key == "" {
+		return errors.New("-summary-url needs -summary-key to sign the summaries with")
+	}
+	_, err = readPrivateKey(options.Key)
+	return err
+}
+
+// runSummary is the compact record of a run that is pushed.
+type runSummary struct {
+	RunID    string          `json:"runId"`
+	Host     string          `json:"host"`
+	Root     string          `json:"root"`
+	RootID   string          `json:"rootId"`
+	Version  string          `json:"version"`
+	Tier     string          `json:"tier,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Status   string          `json:"status"`
+	Totals   directoryCounts `json:"totals"`
+	Passed   int             `json:"passed"`
+	// Files and BaselineHash describe the root's baseline as the run left
+	// it: how many records it holds and the SHA-256 of them all, so a
+	// baseline later edited to hide a change no longer matches.
+	Files        int64  `json:"files"`
+	BaselineHash string `json:"baselineHash"`
+	// EvidenceHead is the hash of the run's last evidence log entry, if
+	// it kept one, which vouches for the log up to it.
+	EvidenceHead string `json:"evidenceHead,omitempty"`
+}
+
+// signedSummary is the document pushed: the summary exactly as signed, the
+// signature and the public key that verifies it.
+type signedSummary struct {
+	Summary   json.RawMessage `json:"summary"`
+	Key       string          `json:"key"`
+	Signature string          `json:"signature"`
+}
+
+// pushSummary signs the report's summary and stores it under the URL of
+// options.
+func pushSummary(databasePath string, report *scanReport, options summaryOptions) error {
+	if options.URL == "" {
+		return nil
+	}
+	key, err := readPrivateKey(options.Key)
+	if err != nil {
+		return err
+	}
+	run := report.Run
+	summary := runSummary{
+		RunID:        run.RunID,
+		Host:         run.Hostname,
+		Root:         run.Root,
+		RootID:       run.RootID,
+		Version:      run.Version,
+		Tier:         run.Tier,
+		Started:      run.Started.UTC(),
+		Finished:     run.Finished.UTC(),
+		Status:       report.Status(),
+		Totals:       report.Totals(),
+		Passed:       report.Passed,
+		EvidenceHead: report.EvidenceHead,
+	}
+	// The baseline is only read, so this works for read-only runs too.
+	db, err := openDatabaseReadOnly(databasePath)
+	if err != nil {
+		return err
+	}
+	summary.Files, summary.BaselineHash, err = baselineDigest(db, run.RootID)
+	closeDatabase(db)
+	if err != nil {
+		return fmt.Errorf("hashing the baseline: %v", err)
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	document, err := json.Marshal(signedSummary{
+		Summary:   data,
+		Key:       base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)),
+	})
+	if err != nil {
+		return err
+	}
+	name := summaryName(run)
+	if strings.HasPrefix(options.URL, "s3://") {
+		err = putS3Summary(options, name, document)
+	} else {
+		err = putHTTPSummary(options, name, document)
+	}
+	if err != nil {
+		return fmt.Errorf("pushing the run summary: %v", err)
+	}
+	return nil
+}
+
+// summaryName is where a run's summary is stored under the URL: by host,
+// then in the order the runs started.
+func summaryName(run runInfo) string {
+	host := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r <= ' ' {
+			return '_'
+		}
+		return r
+	}, run.Hostname)
+	return host + "/" + run.Started.UTC().Format("20060102T150405Z") + "-" + run.RunID + ".json"
+}
+
+// baselineDigest returns how many records rootID's baseline holds and the
+// SHA-256 of their paths and hashes, in path order.
+func baselineDigest(db *sql.DB, rootID string) (int64, string, error) {
+	rows, err := db.Query("SELECT filename, hash FROM file_hashes WHERE root_id = ? ORDER BY filename", rootID)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	var files int64
+	for rows.Next() {
+		var filename, hash string
+		err = rows.Scan(&filename, &hash)
+		if err != nil {
+			return 0, "", err
+		}
+		h.Write([]byte(filename + "\x00" + hash + "\x00"))
+		files++
+	}
+	return files, hex.EncodeToString(h.Sum(nil)), rows.Err()
+}
+
+// putS3Summary uploads the summary as an object of the bucket. The upload
+// is conditional, so an object that already exists, locked or not, is
+// never replaced.
+func putS3Summary(options summaryOptions, name string, document []byte) error {
+	parsed, err := url.Parse(options.URL)
+	if err != nil {
+		return err
+	}
+	objectKey := strings.Trim(parsed.Path, "/")
+	if objectKey != "" {
+		objectKey += "/"
+	}
+	objectKey += name
+
+	region := awsRegion()
+	endpoint := "https://" + parsed.Host + ".s3." + region + ".amazonaws.com/" + objectKey
+	if custom := os.Getenv("AWS_ENDPOINT_URL_S3"); custom != "" {
+		// S3-compatible stores are addressed by path.
+		endpoint = strings.TrimSuffix(custom, "/") + "/" + parsed.Host + "/" + objectKey
+		if region == "" {
+			region = "us-east-1"
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(document))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(document)
+	checksum := md5.Sum(document)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(checksum[:]))
+	req.Header.Set("If-None-Match", "*")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if options.Retain > 0 {
+		req.Header.Set("X-Amz-Object-Lock-Mode", "COMPLIANCE")
+		req.Header.Set("X-Amz-Object-Lock-Retain-Until-Date", time.Now().Add(options.Retain).UTC().Format(time.RFC3339))
+	}
+	signAWSRequest(req, document, region, "s3", time.Now())
+	return doAPI(req, nil)
+}
+
+// putHTTPSummary PUTs the summary to the endpoint, asking it not to replace
+// anything already stored under the name.
+func putHTTPSummary(options summaryOptions, name string, document []byte) error {
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(options.URL, "/")+"/"+name, bytes.NewReader(document))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-None-Match", "*")
+	if token := os.Getenv("GOHASH_SUMMARY_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return doAPI(req, nil)
+}
+
+// runVerifySummary checks the signatures of run summaries fetched back from
+// storage and prints what each one records.
+func runVerifySummary(arguments []string) {
+	flags := flag.NewFlagSet("verify-summary", flag.ExitOnError)
+	keyPath := flags.String("key", "", "ed25519 public key from gohash manifest keygen the summaries must be signed with")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify-summary -key public_key summary_file...\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Verifies run summaries pushed with -summary-url, exiting with status 1 if any signature is invalid.\n")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() == 0 || *keyPath == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	key, err := readPublicKey(*keyPath)
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+
+	invalid := 0
+	for _, file := range flags.Args() {
+		summary, err := readSignedSummary(file, key)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			invalid++
+			continue
+		}
+		totals := summary.Totals
+		fmt.Printf("%s: run %s of %s on %s at %s, %s tier: %s, %d changed, %d new, %d missing, %d errors, %d passed; baseline of %d files %s\n",
+			file, summary.RunID, displayPath(summary.RootID), summary.Host, summary.Started.Format(time.RFC3339), summary.Tier, summary.Status,
+			totals.Changed, totals.New, totals.Missing, totals.Errors, summary.Passed, summary.Files, summary.BaselineHash)
+	}
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+// readSignedSummary reads a pushed summary, which must be signed by key.
+func readSignedSummary(file string, key ed25519.PublicKey) (*runSummary, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var document signedSummary
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, fmt.Errorf("not a run summary: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(document.Signature)
+	if err != nil || !ed25519.Verify(key, document.Summary, signature) {
+		return nil, errors.New("invalid signature")
+	}
+	var summary runSummary
+	err = json.Unmarshal(document.Summary, &summary)
+	if err != nil {
+		return nil, fmt.Errorf("not a run summary: %v", err)
+	}
+	return &summary, nil
+}
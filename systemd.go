@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends state to the service manager when running under systemd
+// with Type=notify, and does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+}
+
+// sdWatchdog pings systemd's watchdog at half its timeout until stop is
+// closed, if the unit has WatchdogSec set.
+func sdWatchdog(stop <-chan struct{}) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sdNotify("WATCHDOG=1")
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// sdExtendStop keeps asking systemd for more time to stop until done is
+// closed, so scans in progress can finish instead of being killed at
+// TimeoutStopSec.
+func sdExtendStop(done <-chan struct{}) {
+	const step = 30 * time.Second
+	ticker := time.NewTicker(step / 2)
+	defer ticker.Stop()
+	for {
+		sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", step.Microseconds()))
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func runInstallService(arguments []string) {
+	flags := flag.NewFlagSet("install-service", flag.ExitOnError)
+	name := flags.String("name", "gohash", "name of the systemd unit")
+	user := flags.String("user", "", "user the daemon runs as (default: root)")
+	outputPath := flags.String("output", "", "where to write the unit, or - for stdout (default: /etc/systemd/system/NAME.service)")
+	watchdog := flags.Duration("watchdog", 2*time.Minute, "restart the daemon if it stops responding for this long; 0 disables the watchdog")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s install-service [options] -- daemon_arguments...\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Writes a systemd unit running %s daemon with the given arguments, e.g. -config /etc/gohash.json.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, arguments)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	program, err := os.Executable()
+	if err == nil {
+		program, err = filepath.EvalSymlinks(program)
+	}
+	if err != nil {
+		log.Fatalf("Error finding the gohash binary: %v", err)
+	}
+	// Relative paths in the arguments keep meaning what they mean here.
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Error %v", err)
+	}
+	command := []string{systemdQuote(program), "daemon"}
+	for _, arg := range flags.Args() {
+		command = append(command, systemdQuote(arg))
+	}
+
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "# Generated by gohash install-service\n")
+	fmt.Fprintf(&unit, "[Unit]\nDescription=gohash file integrity daemon\n")
+	fmt.Fprintf(&unit, "Wants=network-online.target\nAfter=network-online.target\n\n")
+	fmt.Fprintf(&unit, "[Service]\nType=notify\nExecStart=%s\n", strings.Join(command, " "))
+	fmt.Fprintf(&unit, "WorkingDirectory=%s\n", strings.ReplaceAll(workingDirectory, "%", "%%"))
+	if *user != "" {
+		fmt.Fprintf(&unit, "User=%s\n", *user)
+	}
+	if *watchdog > 0 {
+		fmt.Fprintf(&unit, "WatchdogSec=%d\n", int(watchdog.Seconds()))
+	}
+	// Only the daemon itself is sent SIGTERM, so a sendmail it is running
+	// can finish delivering the last notifications.
+	fmt.Fprintf(&unit, "KillMode=mixed\nRestart=on-failure\nRestartSec=30\n")
+	fmt.Fprintf(&unit, "Nice=10\nIOSchedulingClass=idle\nNoNewPrivileges=yes\n\n")
+	fmt.Fprintf(&unit, "[Install]\nWantedBy=multi-user.target\n")
+
+	if *outputPath == "-" {
+		fmt.Print(unit.String())
+		return
+	}
+	if *outputPath == "" {
+		*outputPath = filepath.Join("/etc/systemd/system", *name+".service")
+	}
+	err = os.WriteFile(*outputPath, []byte(unit.String()), 0644)
+	if err != nil {
+		log.Fatalf("Error writing the unit file: %v", err)
+	}
+	fmt.Printf("Wrote %s; start it with: systemctl daemon-reload && systemctl enable --now %s\n", *outputPath, *name)
+}
+
+// systemdQuote quotes an argument for a unit's ExecStart line, where % and
+// $ are expanded by systemd.
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// reportData is what email subject and body templates are executed with.
+type reportData struct {
+	// runInfo supplies RunID, Hostname, Root, RootID, Database, Version,
+	// Started, Finished and Duration.
+	runInfo
+	// Status is the default one-line subject, e.g. "Integrity check successful".
+	Status string
+
+	Changed  int
+	New      int
+	Missing  int
+	Errors   int
+	TimedOut int
+	Expected int
+	Passed   int
+	// Corrupted is how many of the Changed files are probably bit rot:
+	// their size and modification time didn't change.
+	Corrupted int
+	// Retyped is how many of the Changed files changed content type.
+	Retyped int
+	// Truncated is how many of the Changed files were emptied or shrank
+	// dramatically.
+	Truncated int
+	// Executables is how many of the New files are executable.
+	Executables int
+	// Elevated is how many of the Changed files gained privileges.
+	Elevated int
+	// Stripped is how many of the Changed files are executables that
+	// lost their Gatekeeper attributes.
+	Stripped int
+	// Encryption is set when many changed files look encrypted, as after
+	// ransomware.
+	Encryption bool
+	// Baselined is the number of files recorded by a scan that created the
+	// root's baseline.
+	Baselined int
+	// Dynamic is the number of changed files under dynamic content rules.
+	Dynamic int
+
+	// EvidenceHead identifies the last evidence log entry of the latest
+	// scan, if it keeps one.
+	EvidenceHead string
+
+	Rollup []directoryCounts
+	// Scans is the number of scans covered; more than one for a daemon's
+	// digest.
+	Scans int
+	// RunIDs identifies each scan covered, oldest first.
+	RunIDs []string
+	// encryptions counts the mass encryption findings, at most one for
+	// each scan.
+	encryptions int
+	reports     []*scanReport
+}
+
+// Findings is the total number of findings of every kind.
+func (d *reportData) Findings() int {
+	return d.Changed + d.New + d.Missing + d.Errors + d.TimedOut + d.Expected + d.encryptions
+}
+
+// Urgent reports whether the findings need attention right away. Probable
+// corruption needs it before backups rotate the good copies away, a new
+// executable or a file that gained privileges may be something planted,
+// and an emptied log may be covering it up.
+func (d *reportData) Urgent() bool {
+	return d.Corrupted > 0 || d.Executables > 0 || d.Elevated > 0 || d.Truncated > 0 || d.Encryption
+}
+
+// Text returns the text report as notifications show it, with at most
+// -max-findings findings listed for each scan. It is read on demand because
+// it can be large; templates that don't use it never load it into memory.
+func (d *reportData) Text() (string, error) {
+	text, err := d.text()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	_, err = io.Copy(&b, text)
+	return b.String(), err
+}
+
+// text returns a reader over the text reports of every scan covered, one
+// after the other.
+func (d *reportData) text() (io.Reader, error) {
+	var texts []io.Reader
+	for i, report := range d.reports {
+		if i > 0 {
+			texts = append(texts, strings.NewReader("\n"))
+		}
+		text, err := report.Excerpt()
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return io.MultiReader(texts...), nil
+}
+
+// newReportData summarizes one or more reports of the same root, oldest
+// first, for a single notification.
+func newReportData(reports []*scanReport) *reportData {
+	run := reports[0].Run
+	run.Finished = reports[len(reports)-1].Run.Finished
+
+	var totals directoryCounts
+	var runIDs []string
+	passed, baselined, dynamic := 0, 0, 0
+	for _, report := range reports {
+		runIDs = append(runIDs, report.Run.RunID)
+		totals.merge(report.Totals())
+		passed += report.Passed
+		baselined += report.Baselined
+		dynamic += report.Dynamic
+	}
+	status := reports[0].Status()
+	if len(reports) > 1 {
+		status = trf("%s (%d scans)", reportStatus(totals), len(reports))
+	}
+	return &reportData{
+		runInfo:      run,
+		Status:       status,
+		Changed:      totals.Changed,
+		New:          totals.New,
+		Missing:      totals.Missing,
+		Errors:       totals.Errors,
+		TimedOut:     totals.TimedOut,
+		Expected:     totals.Expected,
+		Corrupted:    totals.Corrupted,
+		Retyped:      totals.Retyped,
+		Truncated:    totals.Truncated,
+		Executables:  totals.Executables,
+		Elevated:     totals.Elevated,
+		Stripped:     totals.Stripped,
+		Encryption:   totals.Encryption > 0,
+		encryptions:  totals.Encryption,
+		Passed:       passed,
+		Baselined:    baselined,
+		Dynamic:      dynamic,
+		EvidenceHead: reports[len(reports)-1].EvidenceHead,
+		Rollup:       mergeRollups(reports),
+		Scans:        len(reports),
+		RunIDs:       runIDs,
+		reports:      reports,
+	}
+}
+
+// emailTemplates renders notification subjects and bodies. A nil template
+// falls back to the built-in status line and text report.
+type emailTemplates struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// loadEmailTemplates parses the subject template text and the body template
+// file, either of which may be empty.
+func loadEmailTemplates(subjectText, bodyPath string) (*emailTemplates, error) {
+	templates := &emailTemplates{}
+	var err error
+	if subjectText != "" {
+		templates.subject, err = template.New("subject").Parse(subjectText)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the subject template: %w", err)
+		}
+	}
+	if bodyPath != "" {
+		templates.body, err = template.ParseFiles(bodyPath)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the body template: %w", err)
+		}
+	}
+	return templates, nil
+}
+
+func (t *emailTemplates) Subject(data *reportData) (string, error) {
+	if t.subject == nil {
+		return data.Status, nil
+	}
+	var b strings.Builder
+	err := t.subject.Execute(&b, data)
+	// Headers can't span lines.
+	return strings.Join(strings.Fields(b.String()), " "), err
+}
+
+func (t *emailTemplates) Body(data *reportData) (io.Reader, error) {
+	if t.body == nil {
+		return data.text()
+	}
+	var b strings.Builder
+	err := t.body.Execute(&b, data)
+	return strings.NewReader(b.String()), err
+}
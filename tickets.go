@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ticketing systems findings can be filed in. Credentials come from the
+// environment: JIRA_USER and JIRA_API_TOKEN, or SERVICENOW_USER and
+// SERVICENOW_PASSWORD.
+const (
+	TicketJira       = "jira"
+	TicketServiceNow = "servicenow"
+)
+
+// ticketSecrets lists the credentials each ticketing system reads from the
+// environment.
+var ticketSecrets = map[string][]string{
+	TicketJira:       {"JIRA_USER", "JIRA_API_TOKEN"},
+	TicketServiceNow: {"SERVICENOW_USER", "SERVICENOW_PASSWORD"},
+}
+
+// ticketOptions selects where serious findings are filed as tickets: one
+// per directory with findings, which later findings in the directory are
+// added to as comments.
+type ticketOptions struct {
+	System string
+	// URL is the base URL of the Jira site or ServiceNow instance.
+	URL string
+	// Project is the Jira project key, or the ServiceNow assignment group.
+	Project string
+	// IssueType is the Jira issue type.
+	IssueType string
+	// Severity is the lowest severity filed, on the 0-10 scale of CEF.
+	Severity int
+}
+
+func (o *ticketOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.System, "ticket-system", "", "file findings as tickets in jira or servicenow, one per directory with findings, with credentials from JIRA_USER and JIRA_API_TOKEN or SERVICENOW_USER and SERVICENOW_PASSWORD (default: off)")
+	flags.StringVar(&o.URL, "ticket-url", "", "base URL of the Jira site or ServiceNow instance, e.g. https://example.atlassian.net")
+	flags.StringVar(&o.Project, "ticket-project", "", "Jira project key, or ServiceNow assignment group, tickets are filed in")
+	flags.StringVar(&o.IssueType, "ticket-type", "Bug", "Jira issue type of the tickets")
+	flags.IntVar(&o.Severity, "ticket-severity", 8, "only file findings of at least this severity from 0 to 10: 8 is a hash mismatch, 9 a content type change or new executable, 10 silent corruption or mass encryption")
+}
+
+// checkTicketOptions validates the ticketing settings, if tickets are on.
+func checkTicketOptions(options ticketOptions) error {
+	switch options.System {
+	case "":
+		return nil
+	case TicketJira, TicketServiceNow:
+	default:
+		return fmt.Errorf("unknown ticketing system %q", options.System)
+	}
+	parsed, err := url.Parse(options.URL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("-ticket-url must be an https URL, not %q", options.URL)
+	}
+	if options.Project == "" {
+		return fmt.Errorf("-ticket-system %s needs -ticket-project", options.System)
+	}
+	return requireEnv(ticketSecrets[options.System]...)
+}
+
+// ticketFinding is a stored finding to file. It is recognized as already
+// filed by its path and computed hash.
+type ticketFinding struct {
+	Kind     string
+	Path     string
+	Computed string
+	Message  string
+}
+
+// ticketGroup is the findings of one directory not yet filed, and the
+// ticket already open for the directory, if any.
+type ticketGroup struct {
+	Directory string
+	Ticket    string
+	Findings  []ticketFinding
+}
+
+// fileTickets files the open findings of run that are serious enough,
+// creating a ticket for each directory without one and commenting on the
+// tickets of the others. The database is only locked around reading and
+// recording, not while the ticketing system is called.
+func fileTickets(databasePath string, wait time.Duration, run runInfo, options ticketOptions) error {
+	if options.System == "" {
+		return nil
+	}
+	var groups []ticketGroup
+	err := withDatabase(databasePath, wait, func(db *sql.DB) error {
+		var err error
+		groups, err = pendingTickets(db, run, options)
+		return err
+	})
+	if err != nil || len(groups) == 0 {
+		return err
+	}
+
+	var filed []ticketGroup
+	var failures []string
+	for _, group := range groups {
+		summary := fmt.Sprintf("gohash: %d findings in %s on %s", len(group.Findings), group.Directory, run.Hostname)
+		var b strings.Builder
+		fmt.Fprintf(&b, "gohash found this on %s while verifying %s (run %s):\n\n", run.Hostname, displayPath(run.RootID), run.RunID)
+		for _, finding := range group.Findings {
+			b.WriteString(finding.Message + "\n")
+		}
+		if group.Ticket == "" {
+			group.Ticket, err = createTicket(options, summary, b.String())
+		} else {
+			err = updateTicket(options, group.Ticket, b.String())
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", group.Directory, err))
+			continue
+		}
+		filed = append(filed, group)
+	}
+
+	err = nil
+	if len(filed) > 0 {
+		err = withDatabase(databasePath, wait, func(db *sql.DB) error {
+			return recordTickets(db, run.RootID, options.System, filed)
+		})
+	}
+	if err == nil && len(failures) > 0 {
+		err = fmt.Errorf("filing tickets for %s", strings.Join(failures, "; "))
+	}
+	return err
+}
+
+// pendingTickets groups the findings of run waiting to be filed.
+func pendingTickets(db *sql.DB, run runInfo, options ticketOptions) ([]ticketGroup, error) {
+	rows, err := db.Query(`SELECT kind, COALESCE(path, ''), COALESCE(computed_hash, ''), message FROM findings
+		WHERE run_id = ? AND status = ? AND NOT EXISTS (SELECT 1 FROM ticket_findings t
+			WHERE t.system = ? AND t.root_id = findings.root_id AND t.path = COALESCE(findings.path, '') AND t.computed_hash = COALESCE(findings.computed_hash, ''))
+		ORDER BY id`, run.RunID, StatusOpen, options.System)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byDirectory := make(map[string]*ticketGroup)
+	for rows.Next() {
+		var finding ticketFinding
+		err = rows.Scan(&finding.Kind, &finding.Path, &finding.Computed, &finding.Message)
+		if err != nil {
+			return nil, err
+		}
+		if findingRules[finding.Kind].cefSeverity < options.Severity {
+			continue
+		}
+		directory := filepath.Dir(finding.Path)
+		group, ok := byDirectory[directory]
+		if !ok {
+			group = &ticketGroup{Directory: directory}
+			byDirectory[directory] = group
+		}
+		group.Findings = append(group.Findings, finding)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var groups []ticketGroup
+	for _, group := range byDirectory {
+		var ticket sql.NullString
+		err = db.QueryRow("SELECT ticket FROM tickets WHERE system = ? AND root_id = ? AND directory = ?", options.System, run.RootID, group.Directory).Scan(&ticket)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		group.Ticket = ticket.String
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Directory < groups[j].Directory
+	})
+	return groups, nil
+}
+
+// recordTickets remembers the tickets filed and the findings in them.
+func recordTickets(db *sql.DB, rootID, system string, groups []ticketGroup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	for _, group := range groups {
+		_, err = tx.Exec(`INSERT INTO tickets (system, root_id, directory, ticket, opened_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (system, root_id, directory) DO UPDATE SET updated_at = excluded.updated_at`,
+			system, rootID, group.Directory, group.Ticket, now, now)
+		if err != nil {
+			return err
+		}
+		for _, finding := range group.Findings {
+			_, err = tx.Exec("INSERT OR IGNORE INTO ticket_findings (system, root_id, path, computed_hash, ticket) VALUES (?, ?, ?, ?, ?)",
+				system, rootID, finding.Path, finding.Computed, group.Ticket)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// createTicket opens a ticket, returning its key: the issue key in Jira,
+// the record's sys_id in ServiceNow.
+func createTicket(options ticketOptions, summary, description string) (string, error) {
+	base := strings.TrimSuffix(options.URL, "/")
+	var payload any
+	var endpoint string
+	switch options.System {
+	case TicketJira:
+		endpoint = base + "/rest/api/2/issue"
+		payload = map[string]any{"fields": map[string]any{
+			"project":     map[string]string{"key": options.Project},
+			"issuetype":   map[string]string{"name": options.IssueType},
+			"summary":     summary,
+			"description": description,
+		}}
+	default:
+		endpoint = base + "/api/now/table/incident"
+		payload = map[string]string{
+			"short_description": summary,
+			"description":       description,
+			"assignment_group":  options.Project,
+		}
+	}
+	var created struct {
+		Key    string `json:"key"`
+		Result struct {
+			SysID string `json:"sys_id"`
+		} `json:"result"`
+	}
+	err := ticketRequest(options, http.MethodPost, endpoint, payload, &created)
+	if err != nil {
+		return "", err
+	}
+	ticket := created.Key
+	if options.System == TicketServiceNow {
+		ticket = created.Result.SysID
+	}
+	if ticket == "" {
+		return "", fmt.Errorf("%s didn't return the new ticket", options.System)
+	}
+	return ticket, nil
+}
+
+// updateTicket adds comment to an open ticket.
+func updateTicket(options ticketOptions, ticket, comment string) error {
+	base := strings.TrimSuffix(options.URL, "/")
+	if options.System == TicketJira {
+		return ticketRequest(options, http.MethodPost, base+"/rest/api/2/issue/"+url.PathEscape(ticket)+"/comment",
+			map[string]string{"body": comment}, nil)
+	}
+	return ticketRequest(options, http.MethodPatch, base+"/api/now/table/incident/"+url.PathEscape(ticket),
+		map[string]string{"work_notes": comment}, nil)
+}
+
+// ticketRequest sends payload as JSON with the system's credentials and
+// decodes the response into result, if not nil.
+func ticketRequest(options ticketOptions, method, endpoint string, payload, result any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	secrets := ticketSecrets[options.System]
+	req.SetBasicAuth(os.Getenv(secrets[0]), os.Getenv(secrets[1]))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	return doAPI(req, result)
+}
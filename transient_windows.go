@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isTransientError reports whether err is worth retrying: files briefly held
+// open by another process and dropped network connections.
+func isTransientError(err error) bool {
+	for _, errno := range []windows.Errno{
+		windows.ERROR_SHARING_VIOLATION,
+		windows.ERROR_LOCK_VIOLATION,
+		windows.ERROR_NETNAME_DELETED,
+		windows.ERROR_UNEXP_NET_ERR,
+		windows.ERROR_SEM_TIMEOUT,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// walkOptions controls how the files under a root are enumerated.
+type walkOptions struct {
+	Recursive bool
+	Walkers   int
+	// SortBySize enumerates every file before emitting any, largest first,
+	// so the biggest files start hashing early. It requires a stat of every
+	// file up front, which dominates on trees of many small files.
+	SortBySize bool
+	// Streams also emits the alternate data streams of NTFS files and
+	// directories, as file:stream, and the resource forks of macOS files,
+	// as file/..namedfork/rsrc, since they are a classic place to hide
+	// content from a scan of the files alone.
+	Streams bool
+}
+
+// walkError records a directory that couldn't be read, a file or
+// directory whose alternate data streams couldn't be listed, or a
+// filesystem loop the walk didn't follow.
+type walkError struct {
+	RelPath string
+	Err     error
+	Streams bool
+	// Loop, if set, is where the loop at RelPath leads back to: the
+	// directory it is again, as through a bind mount of one of its
+	// ancestors, or the target of a symbolic link that resolves to itself.
+	Loop string
+}
+
+// walkDir is a directory waiting to be read, with the identities of the
+// directories from the root down to it, so arriving at one of them again is
+// recognized as a loop.
+type walkDir struct {
+	relPath string
+	lineage []walkAncestor
+}
+
+type walkAncestor struct {
+	id      fileID
+	relPath string
+}
+
+// subdirectory returns the subdirectory relPath of dir, described by info,
+// or the directory above it that it is again, if it loops back to one.
+// Loops aren't recognized where the system has no file IDs.
+func (dir walkDir) subdirectory(relPath string, info os.FileInfo) (walkDir, string, bool) {
+	id, _, ok := fileIdentity(info)
+	if !ok || dir.lineage == nil {
+		return walkDir{relPath: relPath}, "", false
+	}
+	for _, ancestor := range dir.lineage {
+		if ancestor.id == id {
+			return walkDir{}, ancestor.relPath, true
+		}
+	}
+	// The full slice expression makes each subdirectory copy the lineage
+	// instead of sharing its parent's spare capacity with its siblings.
+	lineage := append(dir.lineage[:len(dir.lineage):len(dir.lineage)], walkAncestor{id, relPath})
+	return walkDir{relPath: relPath, lineage: lineage}, "", false
+}
+
+// dataStream is a named alternate data stream of a file.
+type dataStream struct {
+	Name string
+	Size int64
+}
+
+// dirQueue is the set of directories still to be read, shared by walkers.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []walkDir
+	pending int
+}
+
+func (q *dirQueue) push(dir walkDir) {
+	q.mu.Lock()
+	q.dirs = append(q.dirs, dir)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop blocks until a directory is available, or returns false once every
+// directory has been read.
+func (q *dirQueue) pop() (walkDir, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.dirs) == 0 && q.pending > 0 {
+		q.cond.Wait()
+	}
+	if len(q.dirs) == 0 {
+		return walkDir{}, false
+	}
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	return dir, true
+}
+
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	finished := q.pending == 0
+	q.mu.Unlock()
+	if finished {
+		q.cond.Broadcast()
+	}
+}
+
+// walkRoot sends the root-relative path of every file under rootDirectory to
+// files as it is discovered, reading directories concurrently, and closes
+// files when done. Directories that can't be read are returned, and so are
+// the loops not followed.
+func walkRoot(rootDirectory string, options walkOptions, files chan<- string) []walkError {
+	defer close(files)
+
+	var mu sync.Mutex
+	var failures []walkError
+	var sized []sizedPath
+
+	queue := &dirQueue{}
+	queue.cond = sync.NewCond(&queue.mu)
+	root := walkDir{relPath: "."}
+	if info, err := os.Stat(longPath(rootDirectory)); err == nil {
+		if id, _, ok := fileIdentity(info); ok {
+			root.lineage = []walkAncestor{{id, "."}}
+		}
+	}
+	queue.push(root)
+
+	walkers := options.Walkers
+	if walkers < 1 || !options.Recursive {
+		walkers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < walkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := queue.pop()
+				if !ok {
+					return
+				}
+				entries, err := os.ReadDir(longPath(diskPath(rootDirectory, dir.relPath)))
+				if err != nil {
+					mu.Lock()
+					failures = append(failures, walkError{RelPath: dir.relPath, Err: err})
+					mu.Unlock()
+				}
+				for _, entry := range entries {
+					relPath := path.Join(dir.relPath, entry.Name())
+					if options.Streams {
+						streams, err := alternateStreams(longPath(diskPath(rootDirectory, relPath)))
+						if err != nil {
+							mu.Lock()
+							failures = append(failures, walkError{RelPath: relPath, Err: err, Streams: true})
+							mu.Unlock()
+						}
+						for _, stream := range streams {
+							streamPath := streamPath(relPath, stream.Name)
+							if options.SortBySize {
+								mu.Lock()
+								sized = append(sized, sizedPath{streamPath, stream.Size})
+								mu.Unlock()
+								continue
+							}
+							files <- streamPath
+						}
+					}
+					if entry.IsDir() {
+						if !options.Recursive {
+							continue
+						}
+						info, err := entry.Info()
+						if err != nil {
+							// Gone since the directory was read.
+							continue
+						}
+						subdirectory, loop, looped := dir.subdirectory(relPath, info)
+						if looped {
+							mu.Lock()
+							failures = append(failures, walkError{RelPath: relPath, Loop: loop})
+							mu.Unlock()
+							continue
+						}
+						queue.push(subdirectory)
+						continue
+					}
+					if entry.Type()&os.ModeSymlink != 0 {
+						// A link that resolves to itself can't be hashed,
+						// and is reported as the loop it is instead.
+						if _, err := os.Stat(longPath(diskPath(rootDirectory, relPath))); errors.Is(err, syscall.ELOOP) {
+							target, readErr := os.Readlink(longPath(diskPath(rootDirectory, relPath)))
+							if readErr != nil || target == "" {
+								target = entry.Name()
+							}
+							mu.Lock()
+							failures = append(failures, walkError{RelPath: relPath, Err: err, Loop: target})
+							mu.Unlock()
+							continue
+						}
+					}
+					if options.SortBySize {
+						var size int64
+						if info, err := entry.Info(); err == nil {
+							size = info.Size()
+						}
+						mu.Lock()
+						sized = append(sized, sizedPath{relPath, size})
+						mu.Unlock()
+						continue
+					}
+					files <- relPath
+				}
+				queue.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if options.SortBySize {
+		sort.Slice(sized, func(i, j int) bool {
+			return sized[i].size > sized[j].size
+		})
+		for _, file := range sized {
+			files <- file.relPath
+		}
+	}
+	return failures
+}
+
+type sizedPath struct {
+	relPath string
+	size    int64
+}
+
+// underUnreadable reports whether rel lies in one of the directories the walk
+// failed to read or didn't follow a loop into, is such a loop, or is a
+// stream of a file whose streams it failed to list, in which case its
+// absence proves nothing.
+func underUnreadable(rel string, unreadable []walkError) bool {
+	host, stream := streamHost(rel)
+	for _, failed := range unreadable {
+		if failed.Streams {
+			if stream && host == failed.RelPath {
+				return true
+			}
+			continue
+		}
+		if failed.RelPath == "." || strings.HasPrefix(rel, failed.RelPath+"/") || (failed.Loop != "" && rel == failed.RelPath) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	verdictNew      = "new"
+	verdictMatch    = "match"
+	verdictMismatch = "mismatch"
+	verdictError    = "error"
+	// verdictExpected is a new or changed file whose hash was announced by
+	// a deployment manifest; the baseline is updated to it.
+	verdictExpected = "expected"
+	// verdictDeferred is a stored file left unverified by the scan's
+	// budget; it is only marked seen.
+	verdictDeferred = "deferred"
+	// verdictDynamic is a changed file under a dynamic content rule, whose
+	// new hash is recorded without a finding.
+	verdictDynamic = "dynamic"
+	// verdictSkipped is a new empty or special file left out of the
+	// baseline by policy.
+	verdictSkipped = "skipped"
+	// verdictPending is a new or changed file modified within the grace
+	// period; like a deferred one, it is only marked seen.
+	verdictPending = "pending"
+)
+
+// verdict is the outcome of comparing one hashed file against the baseline.
+type verdict struct {
+	Result     HashResult
+	Kind       string
+	StoredHash string
+	// StoredEntropy is the entropy recorded with StoredHash, if any.
+	StoredEntropy sql.NullFloat64
+	// StoredType is the content type recorded with StoredHash, if any.
+	StoredType string
+	// StoredGatekeeper is the Gatekeeper attributes recorded for the
+	// file, if they were read.
+	StoredGatekeeper sql.NullString
+	// StoredPrivileges is the privileges recorded for the file, if they
+	// were read.
+	StoredPrivileges sql.NullString
+	// StoredSize is the size recorded with StoredHash, if any.
+	StoredSize sql.NullInt64
+	// Untouched reports that the file still has the size and modification
+	// time recorded with StoredHash.
+	Untouched bool
+	// Err explains an error verdict that happened in the database rather
+	// than while hashing.
+	Err error
+}
+
+// baselineWriter owns every database access of a scan's result loop. It
+// looks up and updates results in batches, one transaction per batch, so the
+// hashers never wait on SQLite for each individual file.
+type baselineWriter struct {
+	db     *sql.DB
+	rootID string
+	// baseline, if set, names the saved baseline results are compared
+	// with; it is only read.
+	baseline  string
+	scanStamp int64
+	batchSize int
+	// seen, if not nil, makes the writer read-only: results are compared
+	// with the baseline but nothing is written, and the path of every
+	// result is added to seen instead of stamping its record.
+	seen map[string]bool
+	// expected maps record paths to hashes announced by deployment
+	// manifests.
+	expected map[string]string
+	// dynamic matches the paths whose content is expected to change.
+	dynamic pathRules
+	// actor is who changes to the baseline are attributed to in the audit
+	// log.
+	actor string
+	// grace, if not zero, is how recently a new or changed file may have
+	// been modified for its verdict to be left pending.
+	grace time.Duration
+}
+
+// run consumes results until the channel is closed, sending one verdict per
+// result. A batch is flushed when it is full or when no more results are
+// immediately available.
+func (w *baselineWriter) run(results <-chan HashResult, verdicts chan<- verdict) {
+	defer close(verdicts)
+	for first := range results {
+		batch := []HashResult{first}
+	fill:
+		for len(batch) < w.batchSize {
+			select {
+			case result, ok := <-results:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, result)
+			default:
+				break fill
+			}
+		}
+		for _, v := range w.writeBatch(batch) {
+			verdicts <- v
+		}
+	}
+}
+
+func (w *baselineWriter) writeBatch(batch []HashResult) []verdict {
+	verdicts := make([]verdict, len(batch))
+	fail := func(err error) []verdict {
+		for i, result := range batch {
+			verdicts[i] = verdict{Result: result, Kind: verdictError, Err: err}
+		}
+		return verdicts
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	stored, err := w.lookup(tx, batch)
+	if err != nil {
+		return fail(err)
+	}
+	if w.seen != nil {
+		for i, result := range batch {
+			w.seen[result.RelPath] = true
+			verdicts[i] = w.judge(result, stored)
+		}
+		return verdicts
+	}
+
+	insert, err := tx.Prepare("INSERT INTO file_hashes (root_id, filename, hash, size, mtime, last_verified, last_seen, entropy, content_type, quick_hash, full_verified, gatekeeper, privileges, file_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fail(err)
+	}
+	defer insert.Close()
+	// The content is unchanged, so an entropy, type or quick hash not
+	// taken this time is still the recorded one, and a quick check leaves
+	// the time of the last full hash alone. Gatekeeper attributes and
+	// privileges that were read replace the recorded ones, so a change to
+	// them is reported once.
+	verified, err := tx.Prepare(`UPDATE file_hashes SET size = ?, mtime = ?, last_verified = ?, last_seen = ?, entropy = COALESCE(?, entropy),
+		content_type = COALESCE(?, content_type), quick_hash = COALESCE(?, quick_hash), full_verified = COALESCE(?, full_verified),
+		gatekeeper = COALESCE(?, gatekeeper), privileges = COALESCE(?, privileges), file_id = ? WHERE root_id = ? AND filename = ?`)
+	if err != nil {
+		return fail(err)
+	}
+	defer verified.Close()
+	seen, err := tx.Prepare("UPDATE file_hashes SET last_seen = ? WHERE root_id = ? AND filename = ?")
+	if err != nil {
+		return fail(err)
+	}
+	defer seen.Close()
+	accepted, err := tx.Prepare("UPDATE file_hashes SET hash = ?, size = ?, mtime = ?, last_verified = ?, last_seen = ?, entropy = ?, content_type = ?, quick_hash = ?, full_verified = ?, gatekeeper = ?, privileges = ?, file_id = ? WHERE root_id = ? AND filename = ?")
+	if err != nil {
+		return fail(err)
+	}
+	defer accepted.Close()
+	audit, err := tx.Prepare(auditInsert)
+	if err != nil {
+		return fail(err)
+	}
+	defer audit.Close()
+	logChange := func(action string, result HashResult, oldHash, reason string) error {
+		_, err := audit.Exec(time.Now().Unix(), w.actor, action, w.rootID, dbPath(result.RelPath), nullString(oldHash), result.Hash, reason)
+		return err
+	}
+
+	now := time.Now().Unix()
+	for i, result := range batch {
+		v := w.judge(result, stored)
+		switch v.Kind {
+		case verdictExpected:
+			if v.StoredHash == "" {
+				_, err = insert.Exec(w.rootID, dbPath(result.RelPath), result.Hash, result.Size, result.ModTime, now, w.scanStamp, result.Entropy, nullString(result.MIME), nullString(result.Quick), now, result.Gatekeeper, result.Privileges, result.FileID)
+			} else {
+				_, err = accepted.Exec(result.Hash, result.Size, result.ModTime, now, w.scanStamp, result.Entropy, nullString(result.MIME), nullString(result.Quick), now, result.Gatekeeper, result.Privileges, result.FileID, w.rootID, dbPath(result.RelPath))
+			}
+			if err == nil {
+				err = logChange(AuditExpected, result, v.StoredHash, "announced by a deployment manifest")
+			}
+		case verdictNew:
+			// File is not in the database; insert it.
+			_, err = insert.Exec(w.rootID, dbPath(result.RelPath), result.Hash, result.Size, result.ModTime, now, w.scanStamp, result.Entropy, nullString(result.MIME), nullString(result.Quick), now, result.Gatekeeper, result.Privileges, result.FileID)
+			if err == nil {
+				err = logChange(AuditInsert, result, "", "new file found by a scan")
+			}
+		case verdictDynamic:
+			_, err = accepted.Exec(result.Hash, result.Size, result.ModTime, now, w.scanStamp, result.Entropy, nullString(result.MIME), nullString(result.Quick), now, result.Gatekeeper, result.Privileges, result.FileID, w.rootID, dbPath(result.RelPath))
+			if err == nil {
+				err = logChange(AuditDynamic, result, v.StoredHash, "changed under a dynamic content rule")
+			}
+		case verdictMatch:
+			_, err = verified.Exec(result.Size, result.ModTime, now, w.scanStamp, result.Entropy, nullString(result.MIME), nullString(result.Quick), fullStamp(result, now), result.Gatekeeper, result.Privileges, result.FileID, w.rootID, dbPath(result.RelPath))
+		default:
+			_, err = seen.Exec(w.scanStamp, w.rootID, dbPath(result.RelPath))
+		}
+		if err != nil {
+			return fail(err)
+		}
+		verdicts[i] = v
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fail(err)
+	}
+	return verdicts
+}
+
+// judge compares result with the baseline, allowing for the changes
+// announced by manifests and those expected of dynamic content, and for
+// files that may still be being written. Dynamic content that changed type
+// or was truncated is still a mismatch.
+func (w *baselineWriter) judge(result HashResult, stored map[string]storedFile) verdict {
+	v := compare(result, stored)
+	if want, ok := w.expected[result.RelPath]; ok && result.Hash == want && (v.Kind == verdictNew || v.Kind == verdictMismatch) {
+		v.Kind = verdictExpected
+	} else if v.Kind == verdictMismatch && w.dynamic.match(result.RelPath) && !typeChanged(v.StoredType, result.MIME) && !v.truncated() {
+		v.Kind = verdictDynamic
+	} else if (v.Kind == verdictNew || v.Kind == verdictMismatch) && w.grace > 0 && withinGrace(result.ModTime, w.grace) {
+		v.Kind = verdictPending
+	}
+	return v
+}
+
+// graceSkew is how far in the future a modification time may be and still
+// count as recent, allowing for the clock of a file server being a little
+// ahead of this host's.
+const graceSkew = 5 * time.Second
+
+// withinGrace reports whether a file modified at modTime was modified less
+// than grace ago. A modification time further in the future never is, so
+// setting one can't keep a change pending forever.
+func withinGrace(modTime int64, grace time.Duration) bool {
+	now := time.Now()
+	return modTime > now.Add(-grace).UnixNano() && modTime <= now.Add(graceSkew).UnixNano()
+}
+
+// inFuture reports whether a file modified at modTime was modified later
+// than now, beyond the clock skew allowed for.
+func inFuture(modTime int64) bool {
+	return modTime > time.Now().Add(graceSkew).UnixNano()
+}
+
+// fullStamp is when result was last hashed in full: now, unless a quick
+// check stood in for that.
+func fullStamp(result HashResult, now int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: now, Valid: !result.QuickOnly}
+}
+
+// storedFile is what the baseline records about a file.
+type storedFile struct {
+	Hash    string
+	Size    sql.NullInt64
+	ModTime sql.NullInt64
+	Entropy sql.NullFloat64
+	Type    sql.NullString
+	// Gatekeeper is the recorded Gatekeeper attributes, if they were read.
+	Gatekeeper sql.NullString
+	// Privileges is the recorded privileges, if they were read.
+	Privileges sql.NullString
+}
+
+// listDifference returns the names in the comma-separated list a that
+// aren't in b, if both were recorded.
+func listDifference(a, b sql.NullString) []string {
+	if !a.Valid || !b.Valid {
+		return nil
+	}
+	have := make(map[string]bool)
+	for _, name := range strings.Split(b.String, ",") {
+		have[name] = true
+	}
+	var missing []string
+	for _, name := range strings.Split(a.String, ",") {
+		if name != "" && !have[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// compare judges one result against the stored records of its batch.
+func compare(result HashResult, stored map[string]storedFile) verdict {
+	record, known := stored[result.RelPath]
+	v := verdict{Result: result, StoredHash: record.Hash, StoredEntropy: record.Entropy, StoredType: record.Type.String,
+		StoredGatekeeper: record.Gatekeeper, StoredPrivileges: record.Privileges, StoredSize: record.Size}
+	v.Untouched = record.Size.Valid && record.Size.Int64 == result.Size && record.ModTime.Valid && record.ModTime.Int64 == result.ModTime
+	switch {
+	case result.Err != nil:
+		v.Kind = verdictError
+	case result.Deferred:
+		v.Kind = verdictDeferred
+	case !known && result.Skipped:
+		v.Kind = verdictSkipped
+	case !known:
+		v.Kind = verdictNew
+	case result.Hash != record.Hash:
+		v.Kind = verdictMismatch
+	default:
+		v.Kind = verdictMatch
+	}
+	return v
+}
+
+// truncationRatio is how many times smaller than its recorded size a file
+// must get to be reported as truncated rather than merely changed, and
+// truncationMinimum the smallest recorded size that counts; an emptied file
+// always does.
+const (
+	truncationRatio   = 10
+	truncationMinimum = 1024
+)
+
+// truncated reports whether a file of size was emptied or shrank
+// dramatically from the size recorded with its hash.
+func (v verdict) truncated() bool {
+	stored, size := v.StoredSize.Int64, v.Result.Size
+	if !v.StoredSize.Valid || stored <= 0 || size >= stored {
+		return false
+	}
+	return size == 0 || (stored >= truncationMinimum && size*truncationRatio < stored)
+}
+
+// lookup returns the stored record of every file in batch that has one.
+func (w *baselineWriter) lookup(tx *sql.Tx, batch []HashResult) (map[string]storedFile, error) {
+	args := []any{w.rootID}
+	query := "SELECT filename, hash, size, mtime, entropy, content_type, gatekeeper, privileges FROM file_hashes WHERE root_id = ?"
+	if w.baseline != "" {
+		args = append(args, w.baseline)
+		query = "SELECT filename, hash, size, mtime, NULL, NULL, NULL, NULL FROM baseline_files WHERE root_id = ? AND baseline = ?"
+	}
+	for _, result := range batch {
+		args = append(args, dbPath(result.RelPath))
+	}
+	placeholders := strings.Repeat(", ?", len(batch))[2:]
+	rows, err := tx.Query(query+" AND filename IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]storedFile, len(batch))
+	for rows.Next() {
+		var filename string
+		var record storedFile
+		err = rows.Scan(&filename, &record.Hash, &record.Size, &record.ModTime, &record.Entropy, &record.Type, &record.Gatekeeper, &record.Privileges)
+		if err != nil {
+			return nil, err
+		}
+		stored[filename] = record
+	}
+	return stored, rows.Err()
+}